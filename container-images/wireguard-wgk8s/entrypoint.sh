@@ -1,3 +1,7 @@
 #!/bin/bash
 
-/wgk8s -v 10
+# exec, so that wgk8s receives SIGTERM when the pod is deleted
+if [ -f /etc/wgk8s/config.yaml ]; then
+	exec /wgk8s -v 10 -config /etc/wgk8s/config.yaml
+fi
+exec /wgk8s -v 10
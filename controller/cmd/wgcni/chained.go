@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+const (
+	// modeBridge attaches the pod to the bridge inside the wireguard namespace.
+	modeBridge = "bridge"
+	// modeRouted attaches the pod without a bridge, through a host route on its veth and a link-local gateway.
+	modeRouted = "routed"
+	// modeChained leaves the pod's interface to the plugin before wgcni in the chain, and only routes the pod's
+	// traffic to remote pod CIDRs through the tunnel.
+	modeChained = "chained"
+
+	// defaultRouteTable is the default podNetwork.routeTable of wgk8s, which holds the routes to the remote pod CIDRs.
+	defaultRouteTable = 87
+	// defaultRulePriority makes the rules of the pods take precedence over the main table.
+	defaultRulePriority = 100
+)
+
+// cmdAddChained adds a policy routing rule for each IP address of the pod in the previous result, which looks up
+// the routes to the remote pod CIDRs in the route table of wgk8s. Traffic to other destinations falls through to the
+// main table. The previous result is passed on unchanged.
+func cmdAddChained(args *skel.CmdArgs, netConf *NetConf) error {
+	if netConf.PrevResult == nil {
+		return fmt.Errorf("Chained mode requires a prevResult of the primary CNI plugin")
+	}
+	result, err := current.NewResultFromResult(netConf.PrevResult)
+	if err != nil {
+		return fmt.Errorf("Cannot convert prevResult: %v", err)
+	}
+	ips := podIps(result, args.Netns, args.IfName)
+	if len(ips) == 0 {
+		return fmt.Errorf("prevResult has no IP address of interface %s", args.IfName)
+	}
+
+	var added []net.IP
+	for _, ip := range ips {
+		if err := addRule(ip, netConf.RouteTable, netConf.RulePriority); err != nil {
+			// remove the rules of this attempt, so that a failed ADD does not leave the pod half configured
+			for _, ip := range added {
+				deleteRule(ip, netConf.RouteTable, netConf.RulePriority)
+			}
+			return err
+		}
+		added = append(added, ip)
+	}
+
+	return types.PrintResult(netConf.PrevResult, netConf.CNIVersion)
+}
+
+// cmdDelChained deletes the policy routing rules of the pod. The addresses of the pod are taken from the previous
+// result, or from the pod's interface for CNI versions which do not pass a previous result to DEL.
+func cmdDelChained(args *skel.CmdArgs, netConf *NetConf) error {
+	var ips []net.IP
+	if netConf.PrevResult != nil {
+		result, err := current.NewResultFromResult(netConf.PrevResult)
+		if err != nil {
+			return fmt.Errorf("Cannot convert prevResult: %v", err)
+		}
+		ips = podIps(result, args.Netns, args.IfName)
+	} else if args.Netns != "" {
+		if _, err := os.Stat(args.Netns); err == nil {
+			addresses, err := getAddresses(utils.GetNamespaceNameFromPath(args.Netns), args.IfName)
+			if err != nil {
+				return err
+			}
+			for address := range addresses {
+				if ip, _, err := net.ParseCIDR(address); err == nil && !ip.IsLinkLocalUnicast() {
+					ips = append(ips, ip)
+				}
+			}
+		}
+	}
+
+	for _, ip := range ips {
+		if err := deleteRule(ip, netConf.RouteTable, netConf.RulePriority); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cmdCheckChained returns an error if a policy routing rule of the pod is missing.
+func cmdCheckChained(args *skel.CmdArgs, netConf *NetConf) error {
+	result, err := current.NewResultFromResult(netConf.PrevResult)
+	if err != nil {
+		return fmt.Errorf("Cannot convert prevResult: %v", err)
+	}
+	for _, ip := range podIps(result, args.Netns, args.IfName) {
+		exists, err := hasRule(ip, netConf.RouteTable, netConf.RulePriority)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("Policy routing rule of pod address %s is missing", ip)
+		}
+	}
+	return nil
+}
+
+// podIps returns the IPv4 and IPv6 addresses of result which belong to interface podInterface in netns, or to no
+// interface.
+func podIps(result *current.Result, netns, podInterface string) []net.IP {
+	var ips []net.IP
+	for _, ip := range result.IPs {
+		if ip.Interface != nil {
+			if *ip.Interface < 0 || *ip.Interface >= len(result.Interfaces) {
+				continue
+			}
+			intf := result.Interfaces[*ip.Interface]
+			if intf.Name != podInterface || intf.Sandbox != netns {
+				continue
+			}
+		}
+		ips = append(ips, ip.Address.IP)
+	}
+	return ips
+}
+
+// ruleSelector returns the selector of the rule which routes the traffic of pod address ip with the route table.
+func ruleSelector(ip net.IP, routeTable, rulePriority int) string {
+	return "from " + ip.String() + " lookup " + strconv.Itoa(routeTable) + " priority " + strconv.Itoa(rulePriority)
+}
+
+// ipRule returns the ip rule command of the IP family of pod address ip.
+func ipRule(ip net.IP) string {
+	if ip.To4() == nil {
+		return "ip -6 rule "
+	}
+	return "ip rule "
+}
+
+// hasRule returns true if the rule of pod address ip exists.
+func hasRule(ip net.IP, routeTable, rulePriority int) (bool, error) {
+	out, err := utils.RunCommandWithOutput(ipRule(ip)+"show "+ruleSelector(ip, routeTable, rulePriority), "hasRule")
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) != "", nil
+}
+
+// addRule adds the rule of pod address ip, unless it exists already.
+func addRule(ip net.IP, routeTable, rulePriority int) error {
+	exists, err := hasRule(ip, routeTable, rulePriority)
+	if err != nil || exists {
+		return err
+	}
+	return utils.RunCommand(ipRule(ip)+"add "+ruleSelector(ip, routeTable, rulePriority), "addRule")
+}
+
+// deleteRule deletes the rule of pod address ip, if it exists.
+func deleteRule(ip net.IP, routeTable, rulePriority int) error {
+	exists, err := hasRule(ip, routeTable, rulePriority)
+	if err != nil || !exists {
+		return err
+	}
+	return utils.RunCommand(ipRule(ip)+"del "+ruleSelector(ip, routeTable, rulePriority), "deleteRule")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+func TestChained(t *testing.T) {
+	rule := "from 10.245.3.2 lookup 87 priority 100"
+	rule6 := "from fd00:10:245:3::2 lookup 87 priority 100"
+	recorder := utils.NewCommandRecorder(nil)
+	defer recorder.Install()()
+	ranCommand := func(cmd string) bool {
+		for _, c := range recorder.Commands() {
+			if c == cmd {
+				return true
+			}
+		}
+		return false
+	}
+
+	// the bridge plugin attached the pod and its address of both IP families
+	prevResult := `{
+    "cniVersion": "1.0.0",
+    "interfaces": [ { "name": "cni0" }, { "name": "veth1" }, { "name": "eth0", "sandbox": "/var/run/netns/pod-1" } ],
+    "ips": [
+      { "address": "10.245.3.2/24", "gateway": "10.245.3.1", "interface": 2 },
+      { "address": "fd00:10:245:3::2/64", "interface": 2 }
+    ]
+  }`
+	conf := func(command string, withPrevResult bool) string {
+		c := `{"cniVersion": "1.0.0", "name": "bridge", "type": "wgcni", "mode": "chained"`
+		if withPrevResult {
+			c += `, "prevResult": ` + prevResult
+		}
+		return c + "}"
+	}
+	environ := func(command string) []string {
+		return []string{"CNI_COMMAND=" + command, "CNI_CONTAINERID=" + testContainerId, "CNI_NETNS=" + testNetns,
+			"CNI_IFNAME=eth0", "CNI_PATH=/opt/cni/bin"}
+	}
+
+	// ADD requires the result of the primary plugin
+	if _, err := runWgcni([]byte(conf("ADD", false)), environ("ADD")); err == nil || !strings.Contains(err.Error(), "requires a prevResult") {
+		t.Fatal(fmt.Sprintf("cmdAdd(): Expected an error without prevResult, got %v", err))
+	}
+
+	// ADD adds a rule for each address and passes the result on
+	out, err := runWgcni([]byte(conf("ADD", true)), environ("ADD"))
+	if err != nil {
+		t.Fatal(fmt.Sprintf("cmdAdd(): Expected to return nil error, instead got %s", err))
+	}
+	result := &current.Result{}
+	if err := json.Unmarshal(out, result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Interfaces) != 3 || len(result.IPs) != 2 || result.IPs[0].Address.String() != "10.245.3.2/24" {
+		t.Fatal(fmt.Sprintf("cmdAdd(): Expected the previous result, got %s", out))
+	}
+	if !ranCommand("ip rule add "+rule) || !ranCommand("ip -6 rule add "+rule6) || len(recorder.Commands()) != 4 {
+		t.Fatal(fmt.Sprintf("cmdAdd(): Expected a rule for the IPv4 and the IPv6 address, got %v", recorder.Commands()))
+	}
+	for _, cmd := range recorder.Commands() {
+		if strings.Contains(cmd, "veth") || strings.Contains(cmd, "wgb0") {
+			t.Fatal(fmt.Sprintf("cmdAdd(): Expected no veth or bridge in chained mode, got %s", cmd))
+		}
+	}
+
+	// CHECK fails while the rule is missing
+	if _, err := runWgcni([]byte(conf("CHECK", true)), environ("CHECK")); err == nil {
+		t.Fatal("cmdCheck(): Expected an error for the missing rule")
+	}
+	recorder.SetOutput("ip rule show "+rule, "100:\tfrom 10.245.3.2 lookup 87\n")
+	if _, err := runWgcni([]byte(conf("CHECK", true)), environ("CHECK")); err == nil {
+		t.Fatal("cmdCheck(): Expected an error for the missing IPv6 rule")
+	}
+	recorder.SetOutput("ip -6 rule show "+rule6, "100:\tfrom fd00:10:245:3::2 lookup 87\n")
+	if _, err := runWgcni([]byte(conf("CHECK", true)), environ("CHECK")); err != nil {
+		t.Fatal(fmt.Sprintf("cmdCheck(): Expected to return nil error, instead got %s", err))
+	}
+
+	// ADD does not add an existing rule again, DEL deletes it
+	recorder.Reset()
+	if _, err := runWgcni([]byte(conf("ADD", true)), environ("ADD")); err != nil || ranCommand("ip rule add "+rule) ||
+		ranCommand("ip -6 rule add "+rule6) {
+		t.Fatal(fmt.Sprintf("cmdAdd(): Expected the existing rule to be kept, got %v (%v)", recorder.Commands(), err))
+	}
+	if _, err := runWgcni([]byte(conf("DEL", true)), environ("DEL")); err != nil || !ranCommand("ip rule del "+rule) ||
+		!ranCommand("ip -6 rule del "+rule6) {
+		t.Fatal(fmt.Sprintf("cmdDel(): Expected the rule to be deleted, got %v (%v)", recorder.Commands(), err))
+	}
+
+	// without prevResult, DEL reads the addresses from the pod's interface
+	recorder.Reset()
+	netns := path.Join(t.TempDir(), "pod-2")
+	if err := os.WriteFile(netns, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	recorder.SetOutput("ip netns exec "+netns+" ip -o address show dev eth0", "2: eth0    inet 10.245.3.2/24 scope global eth0\n"+
+		"2: eth0    inet6 fd00:10:245:3::2/64 scope global\n2: eth0    inet6 fe80::2/64 scope link\n")
+	env := append(environ("DEL"), "CNI_NETNS="+netns)
+	if _, err := runWgcni([]byte(conf("DEL", false)), env); err != nil || !ranCommand("ip rule del "+rule) ||
+		!ranCommand("ip -6 rule del "+rule6) || ranCommand("ip -6 rule show from fe80::2 lookup 87 priority 100") {
+		t.Fatal(fmt.Sprintf("cmdDel(): Expected the rule to be deleted, got %v (%v)", recorder.Commands(), err))
+	}
+}
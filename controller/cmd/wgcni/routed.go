@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+// Gateways of the pods in routed mode. The end of the pod's veth in the wireguard namespace answers ARP requests for
+// the IPv4 gateway with proxy ARP, and holds the IPv6 gateway as link-local address.
+const (
+	routedGatewayIpv4 = "169.254.1.1"
+	routedGatewayIpv6 = "fe80::1"
+)
+
+// toRouted turns the addresses of ips into host addresses, /32 or /128, with the gateway of their IP family.
+func toRouted(ips []*current.IPConfig) {
+	for _, ip := range ips {
+		if ip.Address.IP.To4() != nil {
+			ip.Address.Mask = net.CIDRMask(32, 32)
+			ip.Gateway = net.ParseIP(routedGatewayIpv4)
+		} else {
+			ip.Address.Mask = net.CIDRMask(128, 128)
+			ip.Gateway = net.ParseIP(routedGatewayIpv6)
+		}
+	}
+}
+
+// addRoutedIpConfiguration sets up the host addresses of the pod and its routes through the gateways, and routes each
+// address to the pod's veth inside the wireguard namespace, or the default namespace if wireguardNamespace is empty.
+func addRoutedIpConfiguration(podNamespace, podInterface, wireguardNamespace, wireguardInterface string,
+	ips []*current.IPConfig, routes []*types.Route) error {
+	cmds := []string{
+		utils.NetnsExec(wireguardNamespace) + "sysctl -w net.ipv4.conf." + wireguardInterface + ".proxy_arp=1",
+	}
+	for _, ip := range ips {
+		ipv4 := ip.Address.IP.To4() != nil
+		cmds = append(cmds, "ip netns exec "+podNamespace+" ip address add dev "+podInterface+" "+ip.Address.String())
+		if ipv4 {
+			cmds = append(cmds, "ip netns exec "+podNamespace+" ip route add "+routedGatewayIpv4+" dev "+podInterface+" scope link")
+		} else {
+			cmds = append(cmds, utils.NetnsExec(wireguardNamespace)+"ip address add dev "+wireguardInterface+" "+routedGatewayIpv6+"/64")
+		}
+		for _, route := range routes {
+			if (route.Dst.IP.To4() != nil) != ipv4 {
+				continue
+			}
+			cmds = append(cmds, "ip netns exec "+podNamespace+" ip route add "+route.Dst.String()+" via "+ip.Gateway.String()+" dev "+podInterface)
+		}
+		cmds = append(cmds, utils.NetnsExec(wireguardNamespace)+"ip route add "+ip.Address.String()+" dev "+wireguardInterface)
+	}
+	for _, cmd := range cmds {
+		if err := utils.RunCommand(cmd, "addRoutedIpConfiguration"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/invoke"
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+func TestRouted(t *testing.T) {
+	binDir := installPlugins(t)
+	veth := utils.GenerateVethName(testContainerId)
+	recorder := utils.NewCommandRecorder(map[string]string{
+		"ip netns exec wireguard-kubernetes ip link ls dev " + veth: "5: " + veth + "@if2: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500\n    link/ether 02:00:00:00:00:05 brd ff:ff:ff:ff:ff:ff",
+		"ip netns exec pod-1 ip link ls dev eth0":                   "2: eth0@if5: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500\n    link/ether 02:00:00:00:00:02 brd ff:ff:ff:ff:ff:ff",
+		"ip netns exec pod-1 ip -o address show dev eth0": "2: eth0    inet 10.245.3.2/32 scope global eth0\n" +
+			"2: eth0    inet6 fd00:10:245:3::2/128 scope global \n",
+	})
+	defer recorder.Install()()
+
+	conflist, err := libcni.ConfListFromBytes([]byte(fmt.Sprintf(`{
+  "cniVersion": "1.0.0",
+  "name": "wgcni",
+  "plugins": [
+    {
+      "type": "wgcni",
+      "mode": "routed",
+      "ipam": {
+        "type": "host-local",
+        "dataDir": %q,
+        "routes": [ { "dst": "0.0.0.0/0" }, { "dst": "::/0" } ],
+        "ranges": [ [ { "subnet": "10.245.3.0/24" } ], [ { "subnet": "fd00:10:245:3::/64" } ] ]
+      }
+    }
+  ]
+}`, t.TempDir())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cniConfig := libcni.NewCNIConfigWithCacheDir([]string{binDir}, t.TempDir(), &inProcessExec{RawExec: invoke.RawExec{Stderr: os.Stderr}})
+	rt := &libcni.RuntimeConf{ContainerID: testContainerId, NetNS: testNetns, IfName: "eth0"}
+
+	// the pod gets host addresses with the link-local gateways
+	r, err := cniConfig.AddNetworkList(context.TODO(), conflist, rt)
+	if err != nil {
+		t.Fatal(fmt.Sprintf("AddNetworkList(): Expected to return nil error, instead got %s", err))
+	}
+	result, err := current.NewResultFromResult(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.IPs) != 2 || result.IPs[0].Address.String() != "10.245.3.2/32" || result.IPs[0].Gateway.String() != "169.254.1.1" ||
+		result.IPs[1].Address.String() != "fd00:10:245:3::2/128" || result.IPs[1].Gateway.String() != "fe80::1" {
+		t.Fatal(fmt.Sprintf("AddNetworkList(): Unexpected result %+v", result))
+	}
+
+	// there is no bridge, the pod is reached through host routes on its veth
+	expected := []string{
+		"ip netns exec wireguard-kubernetes sysctl -w net.ipv4.conf." + veth + ".proxy_arp=1",
+		"ip netns exec pod-1 ip address add dev eth0 10.245.3.2/32",
+		"ip netns exec pod-1 ip route add 169.254.1.1 dev eth0 scope link",
+		"ip netns exec pod-1 ip route add 0.0.0.0/0 via 169.254.1.1 dev eth0",
+		"ip netns exec wireguard-kubernetes ip route add 10.245.3.2/32 dev " + veth,
+		"ip netns exec pod-1 ip address add dev eth0 fd00:10:245:3::2/128",
+		"ip netns exec wireguard-kubernetes ip address add dev " + veth + " fe80::1/64",
+		"ip netns exec pod-1 ip route add ::/0 via fe80::1 dev eth0",
+		"ip netns exec wireguard-kubernetes ip route add fd00:10:245:3::2/128 dev " + veth,
+	}
+	commands := strings.Join(recorder.Commands(), "\n") + "\n"
+	for _, cmd := range expected {
+		if !strings.Contains(commands, cmd+"\n") {
+			t.Fatal(fmt.Sprintf("AddNetworkList(): Expected command %s, got:\n%s", cmd, commands))
+		}
+	}
+	if strings.Contains(commands, " master ") {
+		t.Fatal(fmt.Sprintf("AddNetworkList(): Expected the veth not to be attached to the bridge, got:\n%s", commands))
+	}
+
+	if err := cniConfig.CheckNetworkList(context.TODO(), conflist, rt); err != nil {
+		t.Fatal(fmt.Sprintf("CheckNetworkList(): Expected to return nil error, instead got %s", err))
+	}
+	if err := cniConfig.DelNetworkList(context.TODO(), conflist, rt); err != nil {
+		t.Fatal(fmt.Sprintf("DelNetworkList(): Expected to return nil error, instead got %s", err))
+	}
+}
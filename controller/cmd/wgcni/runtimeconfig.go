@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+// tbfLatency is the maximum time a packet waits in the token bucket filter which shapes the ingress traffic of a pod.
+const tbfLatency = "25ms"
+
+// RuntimeConfig holds the runtime capabilities which are supported by the plugin. The ips capability is handled by the
+// IPAM plugin, which receives the same network configuration.
+type RuntimeConfig struct {
+	Ips       []string        `json:"ips,omitempty"`
+	Mac       string          `json:"mac,omitempty"`
+	Bandwidth *BandwidthEntry `json:"bandwidth,omitempty"`
+}
+
+// BandwidthEntry is the bandwidth capability. Rates are in bit/s and bursts in bits, 0 for no limit.
+type BandwidthEntry struct {
+	IngressRate  uint64 `json:"ingressRate"`
+	IngressBurst uint64 `json:"ingressBurst"`
+	EgressRate   uint64 `json:"egressRate"`
+	EgressBurst  uint64 `json:"egressBurst"`
+}
+
+// validate returns an error if the runtime configuration cannot be applied.
+func (rc *RuntimeConfig) validate() error {
+	if rc.Mac != "" {
+		if _, err := net.ParseMAC(rc.Mac); err != nil {
+			return fmt.Errorf("Invalid MAC address %s: %v", rc.Mac, err)
+		}
+	}
+	if bw := rc.Bandwidth; bw != nil {
+		if (bw.IngressRate > 0 && bw.IngressBurst < 8) || (bw.EgressRate > 0 && bw.EgressBurst < 8) {
+			return fmt.Errorf("A burst of at least one byte is required for each bandwidth rate")
+		}
+	}
+	return nil
+}
+
+// applyBandwidth limits the bandwidth of a pod on the end of its veth in the wireguard namespace. The traffic to the
+// pod leaves through wireguardInterface and is shaped with a token bucket filter. The traffic from the pod enters
+// through wireguardInterface and is policed, packets which exceed the rate are dropped.
+func applyBandwidth(wireguardNamespace, wireguardInterface string, bw *BandwidthEntry) error {
+	if bw == nil {
+		return nil
+	}
+	var cmds []string
+	if bw.IngressRate > 0 {
+		cmds = append(cmds, fmt.Sprintf("%stc qdisc add dev %s root tbf rate %dbit burst %d latency %s",
+			utils.NetnsExec(wireguardNamespace), wireguardInterface, bw.IngressRate, bw.IngressBurst/8, tbfLatency))
+	}
+	if bw.EgressRate > 0 {
+		cmds = append(cmds,
+			fmt.Sprintf("%stc qdisc add dev %s handle ffff: ingress", utils.NetnsExec(wireguardNamespace), wireguardInterface),
+			fmt.Sprintf("%stc filter add dev %s parent ffff: protocol all u32 match u32 0 0 police rate %dbit burst %d drop",
+				utils.NetnsExec(wireguardNamespace), wireguardInterface, bw.EgressRate, bw.EgressBurst/8),
+		)
+	}
+	for _, cmd := range cmds {
+		if err := utils.RunCommand(cmd, "applyBandwidth"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
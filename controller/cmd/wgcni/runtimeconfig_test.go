@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+func TestLoadNetConfRuntimeConfig(t *testing.T) {
+	tcs := []struct {
+		runtimeConfig string
+		expectedErr   bool
+	}{
+		{runtimeConfig: `{}`},
+		{runtimeConfig: `{"ips": ["10.245.3.100/24"], "mac": "c2:b0:57:49:47:f1"}`},
+		{runtimeConfig: `{"bandwidth": {"ingressRate": 1000000, "ingressBurst": 80000, "egressRate": 0, "egressBurst": 0}}`},
+		{runtimeConfig: `{"mac": "c2:b0:57:49:47"}`, expectedErr: true},
+		{runtimeConfig: `{"bandwidth": {"egressRate": 1000000, "egressBurst": 0}}`, expectedErr: true},
+	}
+	for k, tc := range tcs {
+		data := `{"cniVersion": "0.3.1", "name": "wgcni", "type": "wgcni", "ipam": {"type": "host-local"}, "runtimeConfig": ` + tc.runtimeConfig + `}`
+		_, _, err := loadNetConf([]byte(data))
+		if (err != nil) != tc.expectedErr {
+			t.Fatal(fmt.Sprintf("loadNetConf() - Test %d: Expected error %t, got %v", k, tc.expectedErr, err))
+		}
+	}
+
+	conf, _, _ := loadNetConf([]byte(`{"cniVersion": "0.3.1", "ipam": {"type": "host-local"}, "runtimeConfig": {"mac": "c2:b0:57:49:47:f1"}}`))
+	if conf.RuntimeConfig.Mac != "c2:b0:57:49:47:f1" {
+		t.Fatal(fmt.Sprintf("loadNetConf(): Expected the requested MAC address, got %+v", conf.RuntimeConfig))
+	}
+}
+
+func TestApplyBandwidth(t *testing.T) {
+	var commands []string
+	utils.RunCommand = func(cmd string, methodName string) error {
+		commands = append(commands, cmd)
+		return nil
+	}
+
+	tcs := []struct {
+		bw       *BandwidthEntry
+		expected []string
+	}{
+		{
+			bw:       nil,
+			expected: nil,
+		},
+		{
+			bw: &BandwidthEntry{IngressRate: 1000000, IngressBurst: 80000},
+			expected: []string{
+				"ip netns exec wireguard-kubernetes tc qdisc add dev veth0123456789a root tbf rate 1000000bit burst 10000 latency 25ms",
+			},
+		},
+		{
+			bw: &BandwidthEntry{IngressRate: 1000000, IngressBurst: 80000, EgressRate: 2000000, EgressBurst: 160000},
+			expected: []string{
+				"ip netns exec wireguard-kubernetes tc qdisc add dev veth0123456789a root tbf rate 1000000bit burst 10000 latency 25ms",
+				"ip netns exec wireguard-kubernetes tc qdisc add dev veth0123456789a handle ffff: ingress",
+				"ip netns exec wireguard-kubernetes tc filter add dev veth0123456789a parent ffff: protocol all u32 match u32 0 0 police rate 2000000bit burst 20000 drop",
+			},
+		},
+	}
+	for k, tc := range tcs {
+		commands = nil
+		if err := applyBandwidth("wireguard-kubernetes", "veth0123456789a", tc.bw); err != nil {
+			t.Fatal(fmt.Sprintf("applyBandwidth() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		if fmt.Sprint(commands) != fmt.Sprint(tc.expected) {
+			t.Fatal(fmt.Sprintf("applyBandwidth() - Test %d: Expected commands %v, got %v", k, tc.expected, commands))
+		}
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
 	"github.com/containernetworking/cni/pkg/skel"
@@ -31,12 +33,32 @@ import (
 )
 
 const (
-	wireguardNamespace = "wireguard-kubernetes"
-	wireguardBridge    = "wgb0"
+	defaultWireguardNamespace = "wireguard-kubernetes"
+	wireguardBridge           = "wgb0"
 )
 
 type NetConf struct {
 	types.NetConf
+	// Mode is bridge, routed or chained. In routed mode, the pod is reached through a host route on its veth instead of
+	// the bridge. In chained mode, wgcni runs after another CNI plugin which connects the pod.
+	Mode string `json:"mode,omitempty"`
+	// RouteTable and RulePriority configure the policy routing rules of the pods in chained mode. RouteTable must be
+	// the podNetwork.routeTable of wgk8s.
+	RouteTable   int `json:"routeTable,omitempty"`
+	RulePriority int `json:"rulePriority,omitempty"`
+	// HostNamespace must be set if wgk8s runs with wireguard.hostNamespace, the pod's veth is then moved into the
+	// default namespace instead of the wireguard namespace.
+	HostNamespace bool          `json:"hostNamespace,omitempty"`
+	RuntimeConfig RuntimeConfig `json:"runtimeConfig,omitempty"`
+}
+
+// wireguardNamespace returns the namespace of the end of the pod's veth which is not inside the pod. The empty
+// namespace is the default namespace.
+func (n *NetConf) wireguardNamespace() string {
+	if n.HostNamespace {
+		return ""
+	}
+	return defaultWireguardNamespace
 }
 
 type EnvArgs struct {
@@ -49,10 +71,11 @@ type EnvArgs struct {
 func main() {
 	flag.Parse()
 
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("none"))
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("wgcni"))
 }
 
-// cmdAdd is run when action ADD is provided.
+// cmdAdd is run when action ADD is provided. If wgcni is chained after another plugin, the interfaces and addresses
+// of the previous result are kept, and the interfaces and addresses of wgcni are appended.
 func cmdAdd(args *skel.CmdArgs) error {
 	var success bool = false
 
@@ -61,32 +84,49 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
-
-	// we rely on IPAM
-	if netConf.IPAM.Type == "" {
-		return fmt.Errorf("An IPAM plugin must be specified")
+	if netConf.Mode == modeChained {
+		return cmdAddChained(args, netConf)
 	}
 
 	// determine the veth name inside the wireguard-kubernetes namespace
+	wireguardNamespace := netConf.wireguardNamespace()
 	wireguardInterface := utils.GenerateVethName(args.ContainerID)
 	// determine the pod's namespace and interface name
 	podNamespace := utils.GetNamespaceNameFromPath(args.Netns)
 	podInterface := args.IfName
 
+	// start building the result object
+	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	if netConf.PrevResult != nil {
+		result, err = current.NewResultFromResult(netConf.PrevResult)
+		if err != nil {
+			return fmt.Errorf("Cannot convert prevResult: %v", err)
+		}
+	}
+
 	// create the veth interface that joins the pod's network with bridge wgb0 inside wireguard-kubernetes
-	hostInterface, containerInterface, err := createVeth(podNamespace, podInterface, wireguardNamespace, wireguardInterface, wireguardBridge)
+	// in routed mode, the veth is not attached to the bridge
+	bridge := wireguardBridge
+	if netConf.Mode == modeRouted {
+		bridge = ""
+	}
+	hostInterface, containerInterface, err := createVeth(podNamespace, podInterface, netConf.RuntimeConfig.Mac, wireguardNamespace, wireguardInterface, bridge)
 	if err != nil {
 		return err
 	}
+	result.Interfaces = append(result.Interfaces, hostInterface, containerInterface)
+	containerInterfaceIndex := len(result.Interfaces) - 1
 
-	// start building the result object
-	result := &current.Result{
-		CNIVersion: current.ImplementedSpecVersion,
-		Interfaces: []*current.Interface{
-			hostInterface,
-			containerInterface,
-		},
-	}
+	// release IP and delete the veth in case of failure, deleting one end deletes the pair
+	ipamAdded := false
+	defer func() {
+		if !success {
+			if ipamAdded {
+				ipam.ExecDel(netConf.IPAM.Type, args.StdinData)
+			}
+			utils.RunCommand(utils.NetnsExec(wireguardNamespace)+"ip link del "+wireguardInterface, "cmdAdd")
+		}
+	}()
 
 	// run the IPAM plugin and get back the config to apply
 	// we currently require that an IPAM plugin be configured
@@ -94,13 +134,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
-
-	// release IP in case of failure
-	defer func() {
-		if !success {
-			ipam.ExecDel(netConf.IPAM.Type, args.StdinData)
-		}
-	}()
+	ipamAdded = true
 
 	// Convert whatever the IPAM result was into the current Result type
 	ipamResult, err := current.NewResultFromResult(r)
@@ -108,15 +142,33 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
-	result.IPs = ipamResult.IPs
-	result.Routes = ipamResult.Routes
-
-	if len(result.IPs) == 0 {
+	if len(ipamResult.IPs) == 0 {
 		return errors.New("IPAM plugin returned missing IP config")
 	}
+	for _, ip := range ipamResult.IPs {
+		ip.Interface = current.Int(containerInterfaceIndex)
+	}
+	if netConf.Mode == modeRouted {
+		toRouted(ipamResult.IPs)
+	}
+	result.IPs = append(result.IPs, ipamResult.IPs...)
+	result.Routes = append(result.Routes, ipamResult.Routes...)
+	if len(ipamResult.DNS.Nameservers) > 0 {
+		result.DNS = ipamResult.DNS
+	}
 
 	// now that IPAM returned our IP addresses and routes, apply them
-	err = addIpConfiguration(podNamespace, podInterface, result.IPs, result.Routes)
+	if netConf.Mode == modeRouted {
+		err = addRoutedIpConfiguration(podNamespace, podInterface, wireguardNamespace, wireguardInterface, ipamResult.IPs, ipamResult.Routes)
+	} else {
+		err = addIpConfiguration(podNamespace, podInterface, ipamResult.IPs, ipamResult.Routes)
+	}
+	if err != nil {
+		return err
+	}
+
+	// limit the bandwidth of the pod, if requested by the runtime
+	err = applyBandwidth(wireguardNamespace, wireguardInterface, netConf.RuntimeConfig.Bandwidth)
 	if err != nil {
 		return err
 	}
@@ -126,40 +178,113 @@ func cmdAdd(args *skel.CmdArgs) error {
 	return types.PrintResult(result, netConf.CNIVersion)
 }
 
+// cmdDel is run when action DEL is provided. It succeeds if the pod's interface or namespace are gone already, so that
+// it can be retried. The IP addresses of the pod are released even if the veth cannot be deleted.
 func cmdDel(args *skel.CmdArgs) error {
 	// todo - replace all of this with https://github.com/vishvananda/netlink
 	netConf, _, err := loadNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
-
-	// we rely on IPAM
-	if netConf.IPAM.Type == "" {
-		return fmt.Errorf("An IPAM plugin must be specified")
+	if netConf.Mode == modeChained {
+		return cmdDelChained(args, netConf)
 	}
 
+	wireguardNamespace := netConf.wireguardNamespace()
 	wireguardInterface := utils.GenerateVethName(args.ContainerID)
 	podNamespace := utils.GetNamespaceNameFromPath(args.Netns)
 	podInterface := args.IfName
 
-	err = deleteVeth(podNamespace, podInterface, wireguardNamespace, wireguardInterface)
-	if err != nil {
-		return err
+	var vethErr error
+	if args.Netns != "" {
+		if _, err := os.Stat(args.Netns); err == nil {
+			vethErr = deleteVeth(podNamespace, podInterface, wireguardNamespace, wireguardInterface)
+		}
 	}
 
-	ipam.ExecDel(netConf.IPAM.Type, args.StdinData)
-
-	return types.PrintResult(&current.Result{}, netConf.CNIVersion)
+	err = ipam.ExecDel(netConf.IPAM.Type, args.StdinData)
+	if vethErr != nil {
+		return vethErr
+	}
+	return err
 }
 
+// cmdCheck is run when action CHECK is provided. It verifies that the interfaces and addresses of wgcni in the
+// previous result are still in place.
 func cmdCheck(args *skel.CmdArgs) error {
-	return nil
+	netConf, _, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if netConf.PrevResult == nil {
+		return fmt.Errorf("CHECK requires a prevResult")
+	}
+	if netConf.Mode == modeChained {
+		return cmdCheckChained(args, netConf)
+	}
+	if err := ipam.ExecCheck(netConf.IPAM.Type, args.StdinData); err != nil {
+		return err
+	}
+	result, err := current.NewResultFromResult(netConf.PrevResult)
+	if err != nil {
+		return fmt.Errorf("Cannot convert prevResult: %v", err)
+	}
+
+	wireguardNamespace := netConf.wireguardNamespace()
+	wireguardInterface := utils.GenerateVethName(args.ContainerID)
+	podNamespace := utils.GetNamespaceNameFromPath(args.Netns)
+	podInterface := args.IfName
+	containerInterfaceIndex := -1
+	for i, intf := range result.Interfaces {
+		if intf.Name == podInterface && intf.Sandbox == utils.GetPathFromNamespace(podNamespace) {
+			containerInterfaceIndex = i
+		}
+	}
+	if containerInterfaceIndex < 0 {
+		return fmt.Errorf("prevResult has no interface %s in %s", podInterface, args.Netns)
+	}
+	var ips []*current.IPConfig
+	for _, ip := range result.IPs {
+		if ip.Interface != nil && *ip.Interface == containerInterfaceIndex {
+			ips = append(ips, ip)
+		}
+	}
+	if _, err := utils.GetInterfaceMac(wireguardNamespace, wireguardInterface); err != nil {
+		return fmt.Errorf("Cannot find interface %s of the pod in namespace %s: %v", wireguardInterface, wireguardNamespace, err)
+	}
+	return checkIpConfiguration(podNamespace, podInterface, ips)
 }
 
 func loadNetConf(data []byte) (*NetConf, string, error) {
 	conf := &NetConf{}
 	if err := json.Unmarshal(data, &conf); err != nil {
-		return nil, "", fmt.Errorf("failed to parse")
+		return nil, "", fmt.Errorf("Cannot parse network configuration: %v", err)
+	}
+	if conf.Mode == "" {
+		conf.Mode = modeBridge
+	}
+	if conf.RouteTable == 0 {
+		conf.RouteTable = defaultRouteTable
+	}
+	if conf.RulePriority == 0 {
+		conf.RulePriority = defaultRulePriority
+	}
+	switch conf.Mode {
+	case modeBridge, modeRouted:
+		// we rely on IPAM
+		if conf.IPAM.Type == "" {
+			return nil, "", fmt.Errorf("An IPAM plugin must be specified")
+		}
+	case modeChained:
+	default:
+		return nil, "", fmt.Errorf("Invalid mode %s, must be %s, %s or %s", conf.Mode, modeBridge, modeRouted, modeChained)
+	}
+	if err := conf.RuntimeConfig.validate(); err != nil {
+		return nil, "", err
+	}
+	// the previous result is parsed in the CNI version of the configuration
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, "", fmt.Errorf("Cannot parse prevResult: %v", err)
 	}
 
 	return conf, conf.CNIVersion, nil
@@ -174,16 +299,32 @@ func loadArgs(args *skel.CmdArgs) (*EnvArgs, error) {
 }
 
 // createVeth creates the veth pair for this pod, with one end inside the wireguard-kubernetes namespace, and the
-// other end inside the pod as eth0.
-func createVeth(podNamespace, podInterface, wireguardNamespace, wireguardInterface, wireguardBridge string) (*current.Interface, *current.Interface, error) {
+// other end inside the pod as eth0. The pod's end gets MAC address mac, unless it is empty. The end inside the
+// wireguard-kubernetes namespace is attached to wireguardBridge, unless it is empty. If wireguardNamespace is empty,
+// that end is moved into the default namespace instead.
+func createVeth(podNamespace, podInterface, mac, wireguardNamespace, wireguardInterface, wireguardBridge string) (*current.Interface, *current.Interface, error) {
 	// todo - replace all of this with https://github.com/vishvananda/netlink
 	cmds := []string{
 		"ip netns exec " + podNamespace + " ip link add name " + podInterface + " type veth peer name " + wireguardInterface,
-		"ip netns exec " + podNamespace + " ip link set dev " + podInterface + " up",
-		"ip netns exec " + podNamespace + " ip link set dev " + wireguardInterface + " netns " + wireguardNamespace,
-		"ip netns exec " + wireguardNamespace + " ip link set dev " + wireguardInterface + " master " + wireguardBridge,
-		"ip netns exec " + wireguardNamespace + " ip link set dev " + wireguardInterface + " up",
 	}
+	if mac != "" {
+		cmds = append(cmds, "ip netns exec "+podNamespace+" ip link set dev "+podInterface+" address "+mac)
+	}
+	// the default namespace is the namespace of PID 1
+	targetNamespace := wireguardNamespace
+	hostSandbox := utils.GetPathFromNamespace(wireguardNamespace)
+	if wireguardNamespace == "" {
+		targetNamespace = "1"
+		hostSandbox = ""
+	}
+	cmds = append(cmds,
+		"ip netns exec "+podNamespace+" ip link set dev "+podInterface+" up",
+		"ip netns exec "+podNamespace+" ip link set dev "+wireguardInterface+" netns "+targetNamespace,
+	)
+	if wireguardBridge != "" {
+		cmds = append(cmds, utils.NetnsExec(wireguardNamespace)+"ip link set dev "+wireguardInterface+" master "+wireguardBridge)
+	}
+	cmds = append(cmds, utils.NetnsExec(wireguardNamespace)+"ip link set dev "+wireguardInterface+" up")
 	for _, cmd := range cmds {
 		err := utils.RunCommand(cmd, "cmdAdd")
 		if err != nil {
@@ -198,7 +339,7 @@ func createVeth(podNamespace, podInterface, wireguardNamespace, wireguardInterfa
 	hostInterface := current.Interface{
 		Name:    wireguardInterface,
 		Mac:     wireguardInterfaceMac,
-		Sandbox: utils.GetPathFromNamespace(wireguardNamespace),
+		Sandbox: hostSandbox,
 	}
 	containerInterfaceMac, err := utils.GetInterfaceMac(podNamespace, podInterface)
 	if err != nil {
@@ -212,19 +353,18 @@ func createVeth(podNamespace, podInterface, wireguardNamespace, wireguardInterfa
 	return &hostInterface, &containerInterface, nil
 }
 
-// deleteVeth deletes the given veth pair (only one side must be deleted)
+// deleteVeth deletes the given veth pair (only one side must be deleted), unless the pod's end is gone already, e.g.
+// because a failed ADD deleted it.
 func deleteVeth(podNamespace, podInterface, wireguardNamespace, wireguardInterface string) error {
 	// todo - replace all of this with https://github.com/vishvananda/netlink
-	cmds := []string{
-		"ip netns exec " + podNamespace + " ip link del " + podInterface,
+	out, err := utils.RunCommandWithOutput("ip netns exec "+podNamespace+" ip -o link show dev "+podInterface+" 2>/dev/null || true", "cmdDel")
+	if err != nil {
+		return err
 	}
-	for _, cmd := range cmds {
-		err := utils.RunCommand(cmd, "cmdAdd")
-		if err != nil {
-			return err
-		}
+	if strings.TrimSpace(string(out)) == "" {
+		return nil
 	}
-	return nil
+	return utils.RunCommand("ip netns exec "+podNamespace+" ip link del "+podInterface, "cmdDel")
 }
 
 // addIpConfiguration sets up this interface's IP address and routes for the pod.
@@ -252,3 +392,36 @@ func addIpConfiguration(podNamespace, podInterface string, ips []*current.IPConf
 
 	return nil
 }
+
+// getAddresses returns the addresses of the interface of the pod, in CIDR notation.
+func getAddresses(podNamespace, podInterface string) (map[string]bool, error) {
+	cmd := "ip netns exec " + podNamespace + " ip -o address show dev " + podInterface
+	out, err := utils.RunCommandWithOutput(cmd, "getAddresses")
+	if err != nil {
+		return nil, err
+	}
+	addresses := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "inet" || fields[i] == "inet6" {
+				addresses[fields[i+1]] = true
+			}
+		}
+	}
+	return addresses, nil
+}
+
+// checkIpConfiguration returns an error if the interface of the pod does not have all of the IP addresses.
+func checkIpConfiguration(podNamespace, podInterface string, ips []*current.IPConfig) error {
+	addresses, err := getAddresses(podNamespace, podInterface)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !addresses[ip.Address.String()] {
+			return fmt.Errorf("Interface %s of the pod does not have IP address %s", podInterface, ip.Address.String())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+const (
+	testContainerId = "0123456789abcdef"
+	testNetns       = "/var/run/netns/pod-1"
+)
+
+// chainedPlugins are built by the tests and chained with wgcni.
+var chainedPlugins = map[string]string{
+	"host-local": "github.com/containernetworking/plugins/plugins/ipam/host-local",
+	"portmap":    "github.com/containernetworking/plugins/plugins/meta/portmap",
+}
+
+// inProcessExec runs wgcni in the test process through skel, so that its commands can be mocked. All other plugins
+// are executed as binaries.
+type inProcessExec struct {
+	invoke.RawExec
+	version.PluginDecoder
+}
+
+func (e *inProcessExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	if path.Base(pluginPath) != "wgcni" {
+		return e.RawExec.ExecPlugin(ctx, pluginPath, stdinData, environ)
+	}
+	return runWgcni(stdinData, environ)
+}
+
+// runWgcni runs skel with the CNI environment of environ, stdinData as stdin, and returns the output.
+func runWgcni(stdinData []byte, environ []string) ([]byte, error) {
+	for _, env := range environ {
+		if kv := strings.SplitN(env, "=", 2); len(kv) == 2 && strings.HasPrefix(kv[0], "CNI_") {
+			os.Setenv(kv[0], kv[1])
+			defer os.Unsetenv(kv[0])
+		}
+	}
+	stdin, stdout := os.Stdin, os.Stdout
+	defer func() { os.Stdin, os.Stdout = stdin, stdout }()
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		stdinWriter.Write(stdinData)
+		stdinWriter.Close()
+	}()
+	output := make(chan []byte)
+	go func() {
+		out, _ := io.ReadAll(stdoutReader)
+		output <- out
+	}()
+	os.Stdin, os.Stdout = stdinReader, stdoutWriter
+
+	pluginErr := skel.PluginMainWithError(cmdAdd, cmdCheck, cmdDel, version.All, "")
+	stdoutWriter.Close()
+	out := <-output
+	if pluginErr != nil {
+		return nil, pluginErr
+	}
+	return out, nil
+}
+
+// installPlugins builds the chained plugins into a new directory, which also gets a placeholder of wgcni, and returns
+// the directory.
+func installPlugins(t *testing.T) string {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("Building the chained plugins requires the go tool")
+	}
+	binDir := t.TempDir()
+	for name, pkg := range chainedPlugins {
+		if out, err := exec.Command("go", "build", "-o", path.Join(binDir, name), pkg).CombinedOutput(); err != nil {
+			t.Fatal(fmt.Sprintf("Cannot build %s: %v\n%s", name, err, out))
+		}
+	}
+	if err := os.WriteFile(path.Join(binDir, "wgcni"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return binDir
+}
+
+// mockCommands mocks the commands of wgcni, with a pod interface which holds address.
+func mockCommands(address string) func() {
+	veth := utils.GenerateVethName(testContainerId)
+	return utils.NewCommandRecorder(map[string]string{
+		"ip netns exec wireguard-kubernetes ip link ls dev " + veth: "5: " + veth + "@if2: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500\n    link/ether 02:00:00:00:00:05 brd ff:ff:ff:ff:ff:ff",
+		"ip netns exec pod-1 ip link ls dev eth0":                   "2: eth0@if5: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500\n    link/ether 02:00:00:00:00:02 brd ff:ff:ff:ff:ff:ff",
+		"ip netns exec pod-1 ip -o address show dev eth0":           "2: eth0    inet " + address + " scope global eth0",
+	}).Install()
+}
+
+func TestChain(t *testing.T) {
+	binDir := installPlugins(t)
+	defer mockCommands("10.245.3.2/24")()
+
+	for _, cniVersion := range []string{"0.3.0", "0.3.1", "0.4.0", "1.0.0"} {
+		dataDir := t.TempDir()
+		conflist, err := libcni.ConfListFromBytes([]byte(fmt.Sprintf(`{
+  "cniVersion": %q,
+  "name": "wgcni",
+  "plugins": [
+    {
+      "type": "wgcni",
+      "ipam": {
+        "type": "host-local",
+        "dataDir": %q,
+        "routes": [ { "dst": "0.0.0.0/0" } ],
+        "ranges": [ [ { "subnet": "10.245.3.0/24" } ] ]
+      }
+    },
+    {
+      "type": "portmap",
+      "capabilities": { "portMappings": true }
+    }
+  ]
+}`, cniVersion, dataDir)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cniConfig := libcni.NewCNIConfigWithCacheDir([]string{binDir}, t.TempDir(), &inProcessExec{RawExec: invoke.RawExec{Stderr: os.Stderr}})
+		rt := &libcni.RuntimeConf{ContainerID: testContainerId, NetNS: testNetns, IfName: "eth0"}
+
+		// ADD returns a result in the version of the conflist, which portmap passes through
+		r, err := cniConfig.AddNetworkList(context.TODO(), conflist, rt)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("AddNetworkList() - Version %s: Expected to return nil error, instead got %s", cniVersion, err))
+		}
+		if r.Version() != cniVersion {
+			t.Fatal(fmt.Sprintf("AddNetworkList() - Version %s: Expected a result of the same version, got %s", cniVersion, r.Version()))
+		}
+		result, err := current.NewResultFromResult(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Interfaces) != 2 || result.Interfaces[1].Name != "eth0" || result.Interfaces[1].Sandbox != testNetns ||
+			len(result.IPs) != 1 || result.IPs[0].Address.String() != "10.245.3.2/24" ||
+			result.IPs[0].Interface == nil || *result.IPs[0].Interface != 1 {
+			t.Fatal(fmt.Sprintf("AddNetworkList() - Version %s: Unexpected result %+v", cniVersion, result))
+		}
+
+		// CHECK is not part of the spec before 0.4.0
+		err = cniConfig.CheckNetworkList(context.TODO(), conflist, rt)
+		if (err != nil) != (cniVersion < "0.4.0") {
+			t.Fatal(fmt.Sprintf("CheckNetworkList() - Version %s: Unexpected error %v", cniVersion, err))
+		}
+
+		// DEL releases the address and can be repeated
+		for i := 0; i < 2; i++ {
+			if err := cniConfig.DelNetworkList(context.TODO(), conflist, rt); err != nil {
+				t.Fatal(fmt.Sprintf("DelNetworkList() - Version %s: Expected to return nil error, instead got %s", cniVersion, err))
+			}
+		}
+		if _, err := os.Stat(path.Join(dataDir, "wgcni", "10.245.3.2")); !os.IsNotExist(err) {
+			t.Fatal(fmt.Sprintf("DelNetworkList() - Version %s: Expected the address to be released, got %v", cniVersion, err))
+		}
+	}
+}
+
+func TestCheckMissingAddress(t *testing.T) {
+	binDir := installPlugins(t)
+	defer mockCommands("10.245.3.99/24")()
+
+	conflist, err := libcni.ConfListFromBytes([]byte(fmt.Sprintf(`{
+  "cniVersion": "1.0.0",
+  "name": "wgcni",
+  "plugins": [ { "type": "wgcni", "ipam": { "type": "host-local", "dataDir": %q, "subnet": "10.245.3.0/24" } } ]
+}`, t.TempDir())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cniConfig := libcni.NewCNIConfigWithCacheDir([]string{binDir}, t.TempDir(), &inProcessExec{RawExec: invoke.RawExec{Stderr: os.Stderr}})
+	rt := &libcni.RuntimeConf{ContainerID: testContainerId, NetNS: testNetns, IfName: "eth0"}
+	if _, err := cniConfig.AddNetworkList(context.TODO(), conflist, rt); err != nil {
+		t.Fatal(err)
+	}
+	err = cniConfig.CheckNetworkList(context.TODO(), conflist, rt)
+	if err == nil || !strings.Contains(err.Error(), "does not have IP address 10.245.3.2/24") {
+		t.Fatal(fmt.Sprintf("CheckNetworkList(): Expected an error for the missing address, got %v", err))
+	}
+}
+
+func TestPrevResult(t *testing.T) {
+	binDir := installPlugins(t)
+	defer mockCommands("10.245.3.2/24")()
+	os.Setenv("CNI_PATH", binDir)
+	defer os.Unsetenv("CNI_PATH")
+
+	// wgcni keeps the interfaces and addresses of a plugin before it in the chain
+	prevResult := `{
+    "cniVersion": "0.4.0",
+    "interfaces": [ { "name": "net1", "sandbox": "/var/run/netns/pod-1" } ],
+    "ips": [ { "version": "4", "address": "192.0.2.2/24", "interface": 0 } ]
+  }`
+	conf := fmt.Sprintf(`{
+  "cniVersion": "0.4.0",
+  "name": "wgcni",
+  "type": "wgcni",
+  "ipam": { "type": "host-local", "dataDir": %q, "subnet": "10.245.3.0/24" },
+  "prevResult": %s
+}`, t.TempDir(), prevResult)
+	environ := []string{"CNI_COMMAND=ADD", "CNI_CONTAINERID=" + testContainerId, "CNI_NETNS=" + testNetns, "CNI_IFNAME=eth0",
+		"CNI_PATH=" + binDir}
+	out, err := runWgcni([]byte(conf), environ)
+	if err != nil {
+		t.Fatal(fmt.Sprintf("cmdAdd(): Expected to return nil error, instead got %s", err))
+	}
+	r := &current.Result{}
+	if err := json.Unmarshal(out, r); err != nil {
+		t.Fatal(err)
+	}
+	if r.CNIVersion != "0.4.0" || len(r.Interfaces) != 3 || r.Interfaces[0].Name != "net1" || len(r.IPs) != 2 ||
+		*r.IPs[0].Interface != 0 || *r.IPs[1].Interface != 2 {
+		t.Fatal(fmt.Sprintf("cmdAdd(): Expected the previous result to be kept, got %s", out))
+	}
+
+	// invalid configurations are reported with the cause
+	tcs := []struct {
+		conf     string
+		expected string
+	}{
+		{conf: `{"cniVersion": "0.4.0", "name": "wgcni", "type": "wgcni", "ipam": {"type": "host-local"}, "prevResult": {"ips": "none"}}`, expected: "Cannot parse prevResult"},
+		{conf: `{"cniVersion": "0.4.0", "name": "wgcni", "type": "wgcni", "ipam": "host-local"}`, expected: "Cannot parse network configuration"},
+		{conf: `{"cniVersion": "0.4.0", "name": "wgcni", "type": "wgcni"}`, expected: "An IPAM plugin must be specified"},
+		{conf: `{"cniVersion": "2.0.0", "name": "wgcni", "type": "wgcni", "ipam": {"type": "host-local"}}`, expected: "incompatible CNI versions"},
+	}
+	for k, tc := range tcs {
+		_, err := runWgcni([]byte(tc.conf), environ)
+		var typesErr *types.Error
+		if err != nil {
+			typesErr, _ = err.(*types.Error)
+		}
+		if typesErr == nil || !strings.Contains(typesErr.Error(), tc.expected) {
+			t.Fatal(fmt.Sprintf("cmdAdd() - Test %d: Expected error %q, got %v", k, tc.expected, err))
+		}
+	}
+}
+
+func TestAddFailure(t *testing.T) {
+	binDir := installPlugins(t)
+	veth := utils.GenerateVethName(testContainerId)
+	recorder := utils.NewCommandRecorder(map[string]string{
+		"ip netns exec wireguard-kubernetes ip link ls dev " + veth: "5: " + veth + "@if2: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500\n    link/ether 02:00:00:00:00:05 brd ff:ff:ff:ff:ff:ff",
+		"ip netns exec pod-1 ip link ls dev eth0":                   "2: eth0@if5: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500\n    link/ether 02:00:00:00:00:02 brd ff:ff:ff:ff:ff:ff",
+	})
+	defer recorder.Install()()
+
+	// the veth is deleted again if the IPAM plugin fails
+	conf := `{"cniVersion": "1.0.0", "name": "wgcni", "type": "wgcni", "ipam": {"type": "host-local", "subnet": "invalid"}}`
+	environ := []string{"CNI_COMMAND=ADD", "CNI_CONTAINERID=" + testContainerId, "CNI_NETNS=" + testNetns, "CNI_IFNAME=eth0",
+		"CNI_PATH=" + binDir}
+	if _, err := runWgcni([]byte(conf), environ); err == nil {
+		t.Fatal("cmdAdd(): Expected an error for the invalid IPAM configuration")
+	}
+	commands := recorder.Commands()
+	if cmd := "ip netns exec wireguard-kubernetes ip link del " + veth; commands[len(commands)-1] != cmd {
+		t.Fatal(fmt.Sprintf("cmdAdd(): Expected the veth to be deleted with %s, got %v", cmd, commands))
+	}
+}
+
+func TestDelMissingInterface(t *testing.T) {
+	binDir := installPlugins(t)
+	dataDir := t.TempDir()
+	netns := path.Join(t.TempDir(), "pod-1")
+	if err := os.WriteFile(netns, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	podNamespace := utils.GetNamespaceNameFromPath(netns)
+	veth := utils.GenerateVethName(testContainerId)
+	recorder := utils.NewCommandRecorder(map[string]string{
+		"ip netns exec wireguard-kubernetes ip link ls dev " + veth: "5: " + veth + "@if2: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500\n    link/ether 02:00:00:00:00:05 brd ff:ff:ff:ff:ff:ff",
+		"ip netns exec " + podNamespace + " ip link ls dev eth0":    "2: eth0@if5: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500\n    link/ether 02:00:00:00:00:02 brd ff:ff:ff:ff:ff:ff",
+	})
+	defer recorder.Install()()
+	// the pod's interface is gone, deleting it fails
+	linkShow := "ip netns exec " + podNamespace + " ip -o link show dev eth0 2>/dev/null || true"
+	recorder.SetFailure("ip netns exec " + podNamespace + " ip link del eth0")
+
+	conf := fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "wgcni", "type": "wgcni",
+  "ipam": {"type": "host-local", "dataDir": %q, "subnet": "10.245.3.0/24"}}`, dataDir)
+	environ := func(command string) []string {
+		return []string{"CNI_COMMAND=" + command, "CNI_CONTAINERID=" + testContainerId, "CNI_NETNS=" + netns,
+			"CNI_IFNAME=eth0", "CNI_PATH=" + binDir}
+	}
+	// host-local stores one file per allocated IP address
+	allocated := func() bool {
+		entries, _ := os.ReadDir(path.Join(dataDir, "wgcni"))
+		for _, entry := range entries {
+			if net.ParseIP(entry.Name()) != nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	tcs := []struct {
+		linkOutput    string
+		errorExpected bool
+	}{
+		// DEL succeeds without the interface and releases the IP address
+		{linkOutput: "", errorExpected: false},
+		// the IP address is released even if the interface cannot be deleted
+		{linkOutput: "2: eth0@if5: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500", errorExpected: true},
+	}
+	for k, tc := range tcs {
+		if _, err := runWgcni([]byte(conf), environ("ADD")); err != nil {
+			t.Fatal(fmt.Sprintf("cmdAdd() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		if !allocated() {
+			t.Fatal(fmt.Sprintf("cmdAdd() - Test %d: Expected the IP address to be allocated", k))
+		}
+		recorder.SetOutput(linkShow, tc.linkOutput)
+		if _, err := runWgcni([]byte(conf), environ("DEL")); (err != nil) != tc.errorExpected {
+			t.Fatal(fmt.Sprintf("cmdDel() - Test %d: Expected error to be %t, got %v", k, tc.errorExpected, err))
+		}
+		if allocated() {
+			t.Fatal(fmt.Sprintf("cmdDel() - Test %d: Expected the IP address to be released", k))
+		}
+	}
+}
+
+func TestHostNamespace(t *testing.T) {
+	binDir := installPlugins(t)
+	veth := utils.GenerateVethName(testContainerId)
+	recorder := utils.NewCommandRecorder(map[string]string{
+		"ip link ls dev " + veth:                          "5: " + veth + "@if2: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500\n    link/ether 02:00:00:00:00:05 brd ff:ff:ff:ff:ff:ff",
+		"ip netns exec pod-1 ip link ls dev eth0":         "2: eth0@if5: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500\n    link/ether 02:00:00:00:00:02 brd ff:ff:ff:ff:ff:ff",
+		"ip netns exec pod-1 ip -o address show dev eth0": "2: eth0    inet 10.245.3.2/24 scope global eth0",
+	})
+	defer recorder.Install()()
+
+	conflist, err := libcni.ConfListFromBytes([]byte(fmt.Sprintf(`{
+  "cniVersion": "1.0.0",
+  "name": "wgcni",
+  "plugins": [
+    {
+      "type": "wgcni",
+      "hostNamespace": true,
+      "ipam": {
+        "type": "host-local",
+        "dataDir": %q,
+        "routes": [ { "dst": "0.0.0.0/0" } ],
+        "ranges": [ [ { "subnet": "10.245.3.0/24" } ] ]
+      }
+    }
+  ]
+}`, t.TempDir())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cniConfig := libcni.NewCNIConfigWithCacheDir([]string{binDir}, t.TempDir(), &inProcessExec{RawExec: invoke.RawExec{Stderr: os.Stderr}})
+	rt := &libcni.RuntimeConf{ContainerID: testContainerId, NetNS: testNetns, IfName: "eth0"}
+
+	// the pod's veth is moved into the default namespace and attached to the bridge there
+	r, err := cniConfig.AddNetworkList(context.TODO(), conflist, rt)
+	if err != nil {
+		t.Fatal(fmt.Sprintf("AddNetworkList(): Expected to return nil error, instead got %s", err))
+	}
+	result, err := current.NewResultFromResult(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Interfaces) != 2 || result.Interfaces[0].Name != veth || result.Interfaces[0].Sandbox != "" {
+		t.Fatal(fmt.Sprintf("AddNetworkList(): Unexpected result %+v", result))
+	}
+	expected := []string{
+		"ip netns exec pod-1 ip link set dev " + veth + " netns 1",
+		"ip link set dev " + veth + " master wgb0",
+		"ip link set dev " + veth + " up",
+	}
+	commands := strings.Join(recorder.Commands(), "\n") + "\n"
+	for _, cmd := range expected {
+		if !strings.Contains(commands, cmd+"\n") {
+			t.Fatal(fmt.Sprintf("AddNetworkList(): Expected command %s, got:\n%s", cmd, commands))
+		}
+	}
+	if strings.Contains(commands, "wireguard-kubernetes") {
+		t.Fatal(fmt.Sprintf("AddNetworkList(): Expected no command in the wireguard namespace, got:\n%s", commands))
+	}
+
+	if err := cniConfig.CheckNetworkList(context.TODO(), conflist, rt); err != nil {
+		t.Fatal(fmt.Sprintf("CheckNetworkList(): Expected to return nil error, instead got %s", err))
+	}
+	if err := cniConfig.DelNetworkList(context.TODO(), conflist, rt); err != nil {
+		t.Fatal(fmt.Sprintf("DelNetworkList(): Expected to return nil error, instead got %s", err))
+	}
+}
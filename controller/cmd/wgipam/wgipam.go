@@ -0,0 +1,189 @@
+// wgipam is an IPAM plugin which allocates the IP addresses of pods from the pod CIDRs of the local node. The node is
+// read from the API server on every ADD, so that changes of the pod CIDRs are picked up right away.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/ipam"
+)
+
+// nodeTimeout is the maximum duration of the lookup of the node.
+const nodeTimeout = 10 * time.Second
+
+// IpamConf is the configuration of the plugin, in the ipam section of the network configuration.
+type IpamConf struct {
+	Type string `json:"type"`
+	// NodeName is the name of the local node.
+	NodeName string `json:"nodeName"`
+	// Kubeconfig is used to read the local node.
+	Kubeconfig string `json:"kubeconfig"`
+	// DataDir holds the allocations, in a subdirectory per network.
+	DataDir string         `json:"dataDir"`
+	Routes  []*types.Route `json:"routes"`
+}
+
+// NetConf is the network configuration.
+type NetConf struct {
+	types.NetConf
+	IPAM          IpamConf      `json:"ipam"`
+	RuntimeConfig RuntimeConfig `json:"runtimeConfig,omitempty"`
+}
+
+// RuntimeConfig holds the runtime capabilities which are supported by the plugin.
+type RuntimeConfig struct {
+	// Ips are the static IP addresses which the runtime requested for the container, with or without prefix length.
+	Ips []string `json:"ips,omitempty"`
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("wgipam"))
+}
+
+// cmdAdd allocates one IP address from each pod CIDR of the node. Allocations of containers whose network namespace
+// is gone are released first.
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	subnets, err := podSubnets(conf)
+	if err != nil {
+		return err
+	}
+	requested, err := requestedIps(conf.RuntimeConfig.Ips)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	store.CollectGarbage(netnsExists)
+	ipConfigs, err := store.Allocate(subnets, requested, args.ContainerID, args.IfName, args.Netns)
+	if err != nil {
+		return err
+	}
+	if err := store.Save(); err != nil {
+		return err
+	}
+
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		IPs:        ipConfigs,
+		Routes:     conf.IPAM.Routes,
+	}
+	return types.PrintResult(result, conf.CNIVersion)
+}
+
+// cmdDel releases the IP addresses of the container. Unknown containers are ignored.
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if len(store.Release(args.ContainerID, args.IfName)) == 0 {
+		return nil
+	}
+	return store.Save()
+}
+
+// cmdCheck returns an error if the container has no IP address.
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if len(store.Get(args.ContainerID, args.IfName)) == 0 {
+		return fmt.Errorf("Container %s has no IP address on interface %s", args.ContainerID, args.IfName)
+	}
+	return nil
+}
+
+func loadNetConf(data []byte) (*NetConf, error) {
+	conf := &NetConf{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("Cannot parse network configuration: %v", err)
+	}
+	if conf.IPAM.NodeName == "" || conf.IPAM.DataDir == "" {
+		return nil, fmt.Errorf("The IPAM configuration requires nodeName and dataDir")
+	}
+	return conf, nil
+}
+
+// podSubnets reads the pod CIDRs of the local node from the API server.
+func podSubnets(conf *NetConf) ([]*net.IPNet, error) {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", conf.IPAM.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	restConfig.Timeout = nodeTimeout
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), nodeTimeout)
+	defer cancel()
+	node, err := clientset.CoreV1().Nodes().Get(ctx, conf.IPAM.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot retrieve information about local node: %v", err)
+	}
+	return ipam.PodSubnets(node)
+}
+
+// requestedIps parses the IP addresses of the ips capability.
+func requestedIps(ips []string) ([]net.IP, error) {
+	var requested []net.IP
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			var err error
+			if parsed, _, err = net.ParseCIDR(ip); err != nil {
+				return nil, fmt.Errorf("Invalid requested IP address %s", ip)
+			}
+		}
+		requested = append(requested, parsed)
+	}
+	return requested, nil
+}
+
+// openStore opens the allocations of the network.
+func openStore(conf *NetConf) (*ipam.Store, error) {
+	return ipam.Open(path.Join(conf.IPAM.DataDir, conf.Name))
+}
+
+// netnsExists returns false if the network namespace of an allocation is gone.
+func netnsExists(a ipam.Allocation) bool {
+	if a.Netns == "" {
+		return true
+	}
+	_, err := os.Stat(a.Netns)
+	return !os.IsNotExist(err)
+}
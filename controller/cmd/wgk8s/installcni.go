@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/cni"
+)
+
+// installCni runs the install-cni subcommand with args: it installs the CNI plugins and the conflist of the local
+// node and, with -watch, keeps the conflist up to date.
+func installCni(args []string) {
+	fs := flag.NewFlagSet("install-cni", flag.ExitOnError)
+	klog.InitFlags(fs)
+	kubeconfig := fs.String("kubeconfig", "", "Location of kubeconfig file")
+	hostname := fs.String("hostname", "", "Name of the local node, defaults to the system's hostname")
+	binSourceDir := fs.String("cni-bin-source-dir", "/cni-bin", "Directory of the CNI plugins to install")
+	binDir := fs.String("cni-bin-dir", "/opt/cni/bin", "Directory into which the CNI plugins are installed")
+	confDir := fs.String("cni-conf-dir", "/etc/cni/net.d", "Directory into which the conflist is written")
+	conflistName := fs.String("conflist-name", "05-wireguard-cni.conflist", "File name of the conflist")
+	conflistTemplate := fs.String("conflist-template", "", "Location of the Go template of the conflist, empty for the built-in template")
+	cniVersion := fs.String("cni-version", "1.0.0", "CNI version of the conflist, which all plugins of the conflist must support")
+	networkName := fs.String("network-name", "wgcni", "Name of the network of the conflist")
+	mtu := fs.Int("mtu", 1500, "MTU of the pod interfaces")
+	mode := fs.String("mode", cni.ModeBridge, "Mode of wgcni, "+cni.ModeBridge+" or "+cni.ModeRouted+" (host routes instead of the bridge), must match podNetwork.mode of wgk8s. In "+cni.ModeChained+" mode, wgcni is appended to the conflist of the primary plugin instead")
+	hostNamespace := fs.Bool("host-namespace", false, "Move the pod veths into the host namespace, must be set if wgk8s runs with wireguard.hostNamespace")
+	ipam := fs.String("ipam", cni.IpamHostLocal, "IPAM plugin of the conflist, "+cni.IpamHostLocal+" or "+cni.IpamWgipam+" (reads the pod CIDRs of the node on every ADD)")
+	ipamDataDir := fs.String("ipam-data-dir", "/run/cni-ipam-state", "Directory of the IP address allocations")
+	ipamKubeconfig := fs.String("ipam-kubeconfig", "/etc/cni/net.d/wgk8s.kubeconfig", "Location of the kubeconfig which is written for "+cni.IpamWgipam+", from the service account of the pod, with mode 0600")
+	watch := fs.Bool("watch", false, "Keep running and rewrite the conflist when the pod CIDRs of the node change")
+	resyncInterval := fs.Duration("resync-interval", time.Minute, "Interval in which everything is installed again with -watch")
+	fs.Parse(args)
+	// the service account token in the kubeconfig of wgipam expires and is only refreshed by the resyncs
+	if *ipam == cni.IpamWgipam && !*watch {
+		log.Fatal("-ipam " + cni.IpamWgipam + " requires -watch, which keeps the token of the kubeconfig up to date")
+	}
+
+	nodeName := *hostname
+	if nodeName == "" {
+		var err error
+		if nodeName, err = os.Hostname(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	restConfig, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	installer := &cni.Installer{
+		Clientset:    clientset,
+		NodeName:     nodeName,
+		BinSourceDir: *binSourceDir,
+		BinDir:       *binDir,
+		ConfDir:      *confDir,
+		ConflistName: *conflistName,
+		TemplateFile: *conflistTemplate,
+		Settings: cni.Settings{
+			CniVersion:    *cniVersion,
+			Name:          *networkName,
+			Mtu:           *mtu,
+			Mode:          *mode,
+			HostNamespace: *hostNamespace,
+			Ipam:          *ipam,
+			IpamDataDir:   *ipamDataDir,
+			Kubeconfig:    *ipamKubeconfig,
+		},
+		KubeconfigData: cni.InClusterKubeconfig,
+	}
+	if err := installer.Run(ctx, *watch, *resyncInterval); err != nil {
+		klog.Flush()
+		log.Fatal(err)
+	}
+	klog.Flush()
+}
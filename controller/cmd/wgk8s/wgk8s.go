@@ -1,50 +1,197 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog"
 
+	"github.com/andreaskaris/wireguard-kubernetes/controller/config"
 	"github.com/andreaskaris/wireguard-kubernetes/controller/wgk8s"
 )
 
+// defaults holds the defaults of the configuration, which are the defaults of the flags as well
+var defaults = config.Default()
+
 var kubeconfig = flag.String("kubeconfig", "", "Location of kubeconfig file")
-var wireguardPrivateKey = flag.String("wg-private-key", "/etc/wireguard/private", "Location of the wireguard private key")
-var wireguardPublicKey = flag.String("wg-public-key", "/etc/wireguard/public", "Location of the wireguard public key")
-var wireguardNamespace = flag.String("wg-namespace", "wireguard-kubernetes", "Name of the wireguard-kubernetes namespace")
-var wireguardInterface = flag.String("wg-interface", "wg0", "Name of the interface inside the wireguard-kubernetes namespace")
-var wireguardBridge = flag.String("wg-bridge", "wgb0", "Name of the bridge inside the wireguard-kubernetes namespace")
-var hostname = flag.String("hostname", func() string { s, _ := os.Hostname(); return s }(), "Hostname of this system")
-var internalRoutingCidr = flag.String("internal-routing-cidr", "100.64.0.0/16", "Internal routing network used for the wireguard tunnels")
+var configFile = flag.String("config", "", "Location of the wgk8s configuration file, empty to use the defaults. Flags which are set explicitly override the configuration file")
+var configReloadInterval = flag.Duration("config-reload-interval", 10*time.Second, "Interval in which the configuration file is checked for changes")
+var wireguardPrivateKey = flag.String("wg-private-key", defaults.Wireguard.PrivateKey, "Location of the wireguard private key")
+var wireguardPublicKey = flag.String("wg-public-key", defaults.Wireguard.PublicKey, "Location of the wireguard public key")
+var wireguardNamespace = flag.String("wg-namespace", defaults.Wireguard.Namespace, "Name of the wireguard-kubernetes namespace")
+var wireguardInterface = flag.String("wg-interface", defaults.Wireguard.Interface, "Name of the interface inside the wireguard-kubernetes namespace")
+var wireguardHostNamespace = flag.Bool("wg-host-namespace", defaults.Wireguard.HostNamespace, "Put the wireguard interface and bridge into the host network namespace instead of the wireguard-kubernetes namespace")
+var wireguardBridge = flag.String("wg-bridge", defaults.Wireguard.Bridge, "Name of the bridge inside the wireguard-kubernetes namespace")
+var hostname = flag.String("hostname", "", "Hostname of this system, defaults to the system's hostname")
+var internalRoutingCidr = flag.String("internal-routing-cidr", defaults.InternalRoutingCidr, "Internal routing network used for the wireguard tunnels")
+var endpointAddressType = flag.String("endpoint-address-type", defaults.Peers.EndpointSelection.AddressType, "Preferred node address type for peer endpoints (InternalIP or ExternalIP)")
+var endpointIpFamily = flag.String("endpoint-ip-family", defaults.Peers.EndpointSelection.IpFamily, "Preferred IP family of peer endpoints (ipv4, ipv6 or empty for no preference)")
+var endpointCidrs = flag.String("endpoint-cidrs", "", "Comma separated list of CIDRs that peer endpoints must be part of")
+var remoteClustersNamespace = flag.String("remote-clusters-namespace", defaults.Peers.RemoteClustersNamespace, "Namespace of the Secrets (labeled "+wgk8s.RemoteClusterLabel+") with the kubeconfigs of remote clusters to peer with, empty to disable")
+var topology = flag.String("topology", defaults.Peers.Topology, "Peer topology, "+config.TopologyMesh+", "+config.TopologyHubAndSpoke+" or "+config.TopologyZone+" (hubs and zone gateways are labeled "+wgk8s.GatewayLabel+")")
+var peerSelector = flag.String("peer-selector", defaults.Peers.Selector, "Label selector for the nodes which become peers, empty to select all nodes")
+var teardownPolicy = flag.String("teardown-policy", defaults.Shutdown.TeardownPolicy, "What happens to the data plane when wgk8s stops: "+config.TeardownPolicyRetain+" leaves it running for the next agent, "+config.TeardownPolicyTeardown+" removes peers, routes and the wireguard namespace")
+var reconcileInterval = flag.Duration("reconcile-interval", defaults.Reconcile.Interval.Duration, "Interval in which the data plane is checked for drift and repaired")
+var metricsBindAddress = flag.String("metrics-bind-address", defaults.Metrics.BindAddress, "Address of the /metrics and /readyz endpoint, 0 to disable it")
+var stateDir = flag.String("state-dir", defaults.State.Directory, "Directory of the snapshot of the last applied peers, which are restored when wgk8s starts")
+var clusterCidrs = flag.String("cluster-cidrs", "", "Comma separated cluster CIDRs (at most one per IP family) from which pod CIDRs are allocated to nodes without pod CIDR, empty to disable")
+var podNetworkMode = flag.String("pod-network-mode", defaults.PodNetwork.Mode, "How pods are connected: "+config.PodNetworkModeBridge+" attaches them to the wireguard bridge with wgcni, "+config.PodNetworkModeRouted+" attaches them with wgcni through host routes without bridge, "+config.PodNetworkModeChained+" routes the pods of another CNI plugin, after which wgcni is chained, through the tunnel")
+var encryptHostTraffic = flag.Bool("encrypt-host-traffic", defaults.HostTraffic.Encrypt, "Route the traffic between the InternalIPs of the nodes through the tunnel, all nodes must enable it")
+var serviceCidrs = flag.String("service-cidrs", "", "Comma separated IPv4 service CIDRs whose traffic keeps the pod's IP address, empty to masquerade it")
+var staticPeersConfigMap = flag.String("static-peers-configmap", *defaults.Peers.StaticPeersConfigMap, "Namespace/name of the ConfigMap with static (non-Kubernetes) peers, empty to disable")
+
+// applyFlags overrides the configuration with the flags which were set explicitly on the command line.
+func applyFlags(c *config.WgK8sConfiguration) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "wg-private-key":
+			c.Wireguard.PrivateKey = *wireguardPrivateKey
+		case "wg-public-key":
+			c.Wireguard.PublicKey = *wireguardPublicKey
+		case "wg-namespace":
+			c.Wireguard.Namespace = *wireguardNamespace
+		case "wg-interface":
+			c.Wireguard.Interface = *wireguardInterface
+		case "wg-bridge":
+			c.Wireguard.Bridge = *wireguardBridge
+		case "wg-host-namespace":
+			c.Wireguard.HostNamespace = *wireguardHostNamespace
+		case "encrypt-host-traffic":
+			c.HostTraffic.Encrypt = *encryptHostTraffic
+		case "hostname":
+			c.Hostname = *hostname
+		case "internal-routing-cidr":
+			c.InternalRoutingCidr = *internalRoutingCidr
+		case "endpoint-address-type":
+			c.Peers.EndpointSelection.AddressType = *endpointAddressType
+		case "endpoint-ip-family":
+			c.Peers.EndpointSelection.IpFamily = *endpointIpFamily
+		case "endpoint-cidrs":
+			c.Peers.EndpointSelection.Cidrs = nil
+			if *endpointCidrs != "" {
+				c.Peers.EndpointSelection.Cidrs = strings.Split(*endpointCidrs, ",")
+			}
+		case "remote-clusters-namespace":
+			c.Peers.RemoteClustersNamespace = *remoteClustersNamespace
+		case "topology":
+			c.Peers.Topology = *topology
+		case "peer-selector":
+			c.Peers.Selector = *peerSelector
+		case "static-peers-configmap":
+			staticPeers := *staticPeersConfigMap
+			c.Peers.StaticPeersConfigMap = &staticPeers
+		case "teardown-policy":
+			c.Shutdown.TeardownPolicy = *teardownPolicy
+		case "reconcile-interval":
+			c.Reconcile.Interval.Duration = *reconcileInterval
+		case "metrics-bind-address":
+			c.Metrics.BindAddress = *metricsBindAddress
+		case "state-dir":
+			c.State.Directory = *stateDir
+		case "cluster-cidrs":
+			c.PodCidrAllocation.ClusterCidrs = nil
+			if *clusterCidrs != "" {
+				c.PodCidrAllocation.ClusterCidrs = strings.Split(*clusterCidrs, ",")
+			}
+		case "pod-network-mode":
+			c.PodNetwork.Mode = *podNetworkMode
+		case "service-cidrs":
+			c.Services.ClusterIpCidrs = nil
+			if *serviceCidrs != "" {
+				c.Services.ClusterIpCidrs = strings.Split(*serviceCidrs, ",")
+			}
+		}
+	})
+	config.SetDefaults(c)
+}
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "install-cni" {
+		installCni(os.Args[2:])
+		return
+	}
+
 	klog.InitFlags(nil)
 	defer klog.Flush()
 
 	flag.Parse()
 
+	// SIGTERM and SIGINT stop the controller through its context
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
 	// set up kubernetes client
-	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	restConfig, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
 	if err != nil {
 		log.Fatal(err)
 	}
-	clientset, err := kubernetes.NewForConfig(config)
+	clientset, err := kubernetes.NewForConfig(restConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// read the configuration file, if any, and watch it for changes
+	// without a file, the configuration consists of the flags and the defaults
+	cfg := &config.WgK8sConfiguration{}
+	var configUpdates chan *config.WgK8sConfiguration
+	if *configFile != "" {
+		cfg, err = config.Load(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		configUpdates = make(chan *config.WgK8sConfiguration)
+		go config.Watch(*configFile, *configReloadInterval, applyFlags, ctx.Done(), configUpdates)
+	}
+	applyFlags(cfg)
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
 	// run this
-	wgk8s.Run(clientset,
-		*hostname,
-		*internalRoutingCidr,
-		*wireguardPrivateKey,
-		*wireguardPublicKey,
-		*wireguardNamespace,
-		*wireguardInterface,
-		*wireguardBridge,
-	)
+	controller, err := wgk8s.NewController(wgk8s.Options{
+		Clientset:     clientset,
+		Config:        cfg,
+		ConfigUpdates: configUpdates,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// serve the metrics and the readiness of the controller
+	if cfg.Metrics.BindAddress != "0" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+			if err := controller.Ready(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok"))
+		})
+		go func() {
+			klog.Error("Metrics endpoint stopped: ", http.ListenAndServe(cfg.Metrics.BindAddress, mux))
+		}()
+	}
+	// make sure that the process exits within the shutdown timeout, even if the shutdown hangs
+	go func() {
+		<-ctx.Done()
+		klog.Info("Received signal, shutting down")
+		time.Sleep(cfg.Shutdown.Timeout.Duration)
+		klog.Error("Shutdown did not finish within ", cfg.Shutdown.Timeout.Duration)
+		klog.Flush()
+		os.Exit(1)
+	}()
+	if err := controller.Start(ctx); err != nil {
+		klog.Flush()
+		log.Fatal(err)
+	}
 }
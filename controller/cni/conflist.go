@@ -0,0 +1,173 @@
+// Package cni installs the CNI plugins and renders the CNI configuration of the local node.
+package cni
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"text/template"
+
+	"github.com/containernetworking/cni/libcni"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+// DefaultConflistTemplate is the template of the conflist which chains wgcni with the portmap plugin.
+//
+//go:embed wireguard-cni.conflist.tmpl
+var DefaultConflistTemplate string
+
+// IPAM plugins of the conflist.
+const (
+	// IpamHostLocal allocates from the pod CIDRs of the node at the time the conflist was rendered.
+	IpamHostLocal = "host-local"
+	// IpamWgipam reads the pod CIDRs of the node on every ADD, it needs a kubeconfig.
+	IpamWgipam = "wgipam"
+)
+
+// Modes of wgcni which the conflist can use.
+const (
+	// ModeBridge attaches the pods to the bridge of the wireguard namespace.
+	ModeBridge = "bridge"
+	// ModeRouted attaches the pods through host routes on their veths, without bridge.
+	ModeRouted = "routed"
+	// ModeChained runs wgcni after the primary plugin of the cluster. Its conflist belongs to the primary plugin and
+	// is not rendered.
+	ModeChained = "chained"
+)
+
+// Settings are the settings of the conflist which do not depend on the node.
+type Settings struct {
+	CniVersion string
+	Name       string
+	Mtu        int
+	// Mode is the mode of wgcni, ModeBridge if empty.
+	Mode string
+	// HostNamespace moves the pod's veth into the default namespace, for wgk8s with wireguard.hostNamespace.
+	HostNamespace bool
+	// Ipam is the IPAM plugin, IpamHostLocal if empty.
+	Ipam        string
+	IpamDataDir string
+	// Kubeconfig is the location of the kubeconfig of IpamWgipam.
+	Kubeconfig string
+}
+
+// ConflistData is passed to the conflist template.
+type ConflistData struct {
+	Settings
+	// NodeName is the name of the node.
+	NodeName string
+	// Subnets are the pod CIDRs of the node, the IPv4 CIDR first.
+	Subnets []string
+}
+
+// NewConflistData returns the data of the conflist of node. The node must have at least one pod CIDR.
+func NewConflistData(settings Settings, node *corev1.Node) (*ConflistData, error) {
+	switch settings.Ipam {
+	case "":
+		settings.Ipam = IpamHostLocal
+	case IpamHostLocal, IpamWgipam:
+	default:
+		return nil, fmt.Errorf("Unknown IPAM plugin %s", settings.Ipam)
+	}
+	switch settings.Mode {
+	case "":
+		settings.Mode = ModeBridge
+	case ModeBridge, ModeRouted:
+	case ModeChained:
+		return nil, fmt.Errorf("Mode %s is not rendered, append wgcni to the conflist of the primary plugin", ModeChained)
+	default:
+		return nil, fmt.Errorf("Unknown mode %s", settings.Mode)
+	}
+	podCidrs := utils.GetPodCidrs(node)
+	data := &ConflistData{Settings: settings, NodeName: node.Name}
+	var ipv6 []string
+	for _, cidr := range podCidrs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pod CIDR of node %s: %v", node.Name, err)
+		}
+		if ip.To4() != nil {
+			data.Subnets = append(data.Subnets, cidr)
+		} else {
+			ipv6 = append(ipv6, cidr)
+		}
+	}
+	data.Subnets = append(data.Subnets, ipv6...)
+	if len(data.Subnets) == 0 {
+		return nil, fmt.Errorf("Node %s has no pod CIDR", node.Name)
+	}
+	return data, nil
+}
+
+// RenderConflist renders the conflist template tmpl with data and returns the conflist. The template can use the
+// functions json, which encodes a value as JSON, and defaultRoute, which returns the default route of the IP family
+// of a CIDR. The result must be a valid conflist.
+func RenderConflist(tmpl string, data *ConflistData) ([]byte, error) {
+	t, err := template.New("conflist").Option("missingkey=error").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			out, err := json.Marshal(v)
+			return string(out), err
+		},
+		"defaultRoute": func(cidr string) string {
+			if ip, _, err := net.ParseCIDR(cidr); err == nil && ip.To4() == nil {
+				return "::/0"
+			}
+			return "0.0.0.0/0"
+		},
+	}).Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse conflist template: %v", err)
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return nil, fmt.Errorf("Cannot render conflist template: %v", err)
+	}
+	if _, err := libcni.ConfListFromBytes(b.Bytes()); err != nil {
+		return nil, fmt.Errorf("Rendered conflist is invalid: %v", err)
+	}
+	return b.Bytes(), nil
+}
+
+// WriteConflist atomically writes conflist to file name in confDir, unless the file has the same content already. It
+// returns true if the file was written.
+func WriteConflist(confDir, name string, conflist []byte) (bool, error) {
+	file := path.Join(confDir, name)
+	if current, err := os.ReadFile(file); err == nil && bytes.Equal(current, conflist) {
+		return false, nil
+	}
+	if err := writeFileAtomic(file, conflist, 0644); err != nil {
+		return false, fmt.Errorf("Cannot write conflist: %v", err)
+	}
+	return true, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of file and renames it to file, so that readers
+// never see a partial file.
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(path.Dir(file), "."+path.Base(file)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
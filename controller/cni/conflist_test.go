@@ -0,0 +1,126 @@
+package cni
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/testdata"
+)
+
+var update = flag.Bool("update", false, "Update the golden files in testdata")
+
+var testSettings = Settings{CniVersion: "0.3.1", Name: "wgcni", Mtu: 1500, IpamDataDir: "/run/cni-ipam-state"}
+
+func TestRenderConflist(t *testing.T) {
+	ipv4Only := testdata.WorkerNode0.DeepCopy()
+	ipv4Only.Spec.PodCIDRs = nil
+	// the IPv4 range comes first, independently of the order of the node's pod CIDRs
+	ipv6First := testdata.MasterNode0.DeepCopy()
+	ipv6First.Spec.PodCIDRs = []string{ipv6First.Spec.PodCIDRs[1], ipv6First.Spec.PodCIDRs[0]}
+
+	wgipamSettings := testSettings
+	wgipamSettings.Ipam = IpamWgipam
+	wgipamSettings.Kubeconfig = "/etc/cni/net.d/wgk8s.kubeconfig"
+	routedSettings := testSettings
+	routedSettings.Mode = ModeRouted
+	hostNamespaceSettings := testSettings
+	hostNamespaceSettings.HostNamespace = true
+
+	tcs := []struct {
+		node     *corev1.Node
+		settings Settings
+		golden   string
+	}{
+		{node: ipv4Only, settings: testSettings, golden: "wireguard-cni.conflist"},
+		{node: testdata.MasterNode0, settings: testSettings, golden: "wireguard-cni-dual-stack.conflist"},
+		{node: testdata.MasterNode0, settings: wgipamSettings, golden: "wireguard-cni-wgipam.conflist"},
+		{node: ipv4Only, settings: routedSettings, golden: "wireguard-cni-routed.conflist"},
+		{node: ipv4Only, settings: hostNamespaceSettings, golden: "wireguard-cni-host-namespace.conflist"},
+		{node: ipv6First, settings: testSettings, golden: "wireguard-cni-dual-stack.conflist"},
+	}
+	for k, tc := range tcs {
+		data, err := NewConflistData(tc.settings, tc.node)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("NewConflistData() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		conflist, err := RenderConflist(DefaultConflistTemplate, data)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("RenderConflist() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		golden := path.Join("testdata", tc.golden)
+		if *update && k < 5 {
+			if err := os.WriteFile(golden, conflist, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(conflist, expected) {
+			t.Fatal(fmt.Sprintf("RenderConflist() - Test %d: Expected conflist\n%s\ninstead got\n%s", k, expected, conflist))
+		}
+	}
+
+	// nodes without pod CIDR and invalid templates are refused
+	noPodCidr := testdata.WorkerNode0.DeepCopy()
+	noPodCidr.Spec.PodCIDR, noPodCidr.Spec.PodCIDRs = "", nil
+	if _, err := NewConflistData(testSettings, noPodCidr); err == nil {
+		t.Fatal("NewConflistData(): Expected an error for a node without pod CIDR")
+	}
+	unknownIpam := testSettings
+	unknownIpam.Ipam = "dhcp"
+	if _, err := NewConflistData(unknownIpam, testdata.WorkerNode0); err == nil {
+		t.Fatal("NewConflistData(): Expected an error for an unknown IPAM plugin")
+	}
+	unknownMode := testSettings
+	unknownMode.Mode = "unknown"
+	if _, err := NewConflistData(unknownMode, testdata.WorkerNode0); err == nil {
+		t.Fatal("NewConflistData(): Expected an error for an unknown mode")
+	}
+	chainedMode := testSettings
+	chainedMode.Mode = ModeChained
+	if _, err := NewConflistData(chainedMode, testdata.WorkerNode0); err == nil || !strings.Contains(err.Error(), "append wgcni") {
+		t.Fatal(fmt.Sprintf("NewConflistData(): Expected an error for the chained mode, which cannot be rendered, got %v", err))
+	}
+	data, _ := NewConflistData(testSettings, testdata.WorkerNode0)
+	for k, tmpl := range []string{`{{ .Unknown }}`, `{ "cniVersion": {{ json .CniVersion }} }`, `{{ if }}`} {
+		if _, err := RenderConflist(tmpl, data); err == nil {
+			t.Fatal(fmt.Sprintf("RenderConflist() - Test %d: Expected an error for template %q", k, tmpl))
+		}
+	}
+}
+
+func TestWriteConflist(t *testing.T) {
+	dir := t.TempDir()
+	tcs := []struct {
+		conflist string
+		written  bool
+	}{
+		{conflist: "first", written: true},
+		{conflist: "first", written: false},
+		{conflist: "second", written: true},
+	}
+	for k, tc := range tcs {
+		written, err := WriteConflist(dir, "05-wireguard-cni.conflist", []byte(tc.conflist))
+		if err != nil {
+			t.Fatal(fmt.Sprintf("WriteConflist() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		content, _ := os.ReadFile(path.Join(dir, "05-wireguard-cni.conflist"))
+		if written != tc.written || string(content) != tc.conflist {
+			t.Fatal(fmt.Sprintf("WriteConflist() - Test %d: Expected written %t and content %q, got %t and %q", k, tc.written, tc.conflist, written, content))
+		}
+	}
+	// no temporary files are left behind
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatal(fmt.Sprintf("WriteConflist(): Expected only the conflist in %s, got %v", dir, entries))
+	}
+}
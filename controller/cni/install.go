@@ -0,0 +1,100 @@
+package cni
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"k8s.io/klog"
+)
+
+// InstallBinaries installs all executables of srcDir into dstDir. Binaries which exist already with the same content
+// are left alone, all others are replaced atomically, so that the container runtime never runs a partial binary.
+// It returns the names of the installed binaries.
+func InstallBinaries(srcDir, dstDir string) ([]string, error) {
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read CNI binaries: %v", err)
+	}
+	var installed []string
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return installed, err
+		}
+		if !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+			continue
+		}
+		src, dst := path.Join(srcDir, entry.Name()), path.Join(dstDir, entry.Name())
+		srcDigest, err := fileDigest(src)
+		if err != nil {
+			return installed, err
+		}
+		dstDigest, err := fileDigest(dst)
+		if err == nil && bytes.Equal(srcDigest, dstDigest) {
+			continue
+		}
+		if err == nil {
+			klog.Info("Upgrading CNI binary ", dst, " from ", fmt.Sprintf("%x", dstDigest[:6]), " to ", fmt.Sprintf("%x", srcDigest[:6]))
+		} else {
+			klog.Info("Installing CNI binary ", dst, " ", fmt.Sprintf("%x", srcDigest[:6]))
+		}
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return installed, fmt.Errorf("Cannot read CNI binary: %v", err)
+		}
+		if err := writeFileAtomic(dst, data, 0755); err != nil {
+			return installed, fmt.Errorf("Cannot install CNI binary %s: %v", dst, err)
+		}
+		installed = append(installed, entry.Name())
+	}
+	return installed, nil
+}
+
+// CheckPluginVersions returns an error unless all plugins of conflist support its CNI version. Each plugin is looked
+// up in the directories dirs, in the given order.
+func CheckPluginVersions(ctx context.Context, conflist []byte, dirs ...string) error {
+	confList, err := libcni.ConfListFromBytes(conflist)
+	if err != nil {
+		return err
+	}
+	for _, plugin := range confList.Plugins {
+		pluginPath, err := invoke.FindInPath(plugin.Network.Type, dirs)
+		if err != nil {
+			return fmt.Errorf("Cannot find CNI plugin %s: %v", plugin.Network.Type, err)
+		}
+		info, err := invoke.GetVersionInfo(ctx, pluginPath, nil)
+		if err != nil {
+			return fmt.Errorf("Cannot get version of CNI plugin %s: %v", pluginPath, err)
+		}
+		supported := false
+		for _, v := range info.SupportedVersions() {
+			supported = supported || v == confList.CNIVersion
+		}
+		if !supported {
+			return fmt.Errorf("CNI plugin %s does not support CNI version %s, only %v", pluginPath, confList.CNIVersion,
+				info.SupportedVersions())
+		}
+	}
+	return nil
+}
+
+// fileDigest returns the SHA-256 digest of file.
+func fileDigest(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
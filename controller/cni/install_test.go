@@ -0,0 +1,99 @@
+package cni
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// writePlugin writes a fake CNI plugin to dir, which reports the given supported versions.
+func writePlugin(t *testing.T, dir, name, versions string) {
+	script := "#!/bin/sh\necho '{\"cniVersion\": \"1.0.0\", \"supportedVersions\": [" + versions + "]}'\n"
+	if err := os.WriteFile(path.Join(dir, name), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstallBinaries(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writePlugin(t, srcDir, "wgcni", `"0.3.1"`)
+	writePlugin(t, srcDir, "host-local", `"0.3.1"`)
+	// files which are not executable are not installed
+	if err := os.WriteFile(path.Join(srcDir, "README"), []byte("readme"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		update    func()
+		installed []string
+	}{
+		{
+			update:    func() {},
+			installed: []string{"host-local", "wgcni"},
+		},
+		{
+			// unchanged binaries are not installed again
+			update:    func() {},
+			installed: nil,
+		},
+		{
+			// changed binaries are upgraded, even if they exist already
+			update:    func() { writePlugin(t, srcDir, "wgcni", `"0.3.1", "1.0.0"`) },
+			installed: []string{"wgcni"},
+		},
+	}
+	for k, tc := range tcs {
+		tc.update()
+		installed, err := InstallBinaries(srcDir, dstDir)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("InstallBinaries() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		if !reflect.DeepEqual(installed, tc.installed) {
+			t.Fatal(fmt.Sprintf("InstallBinaries() - Test %d: Expected to install %v, instead installed %v", k, tc.installed, installed))
+		}
+		for _, name := range []string{"wgcni", "host-local"} {
+			src, _ := os.ReadFile(path.Join(srcDir, name))
+			dst, _ := os.ReadFile(path.Join(dstDir, name))
+			info, err := os.Stat(path.Join(dstDir, name))
+			if err != nil || !reflect.DeepEqual(src, dst) || info.Mode().Perm() != 0755 {
+				t.Fatal(fmt.Sprintf("InstallBinaries() - Test %d: Expected %s to be installed with mode 0755", k, name))
+			}
+		}
+	}
+	entries, _ := os.ReadDir(dstDir)
+	if len(entries) != 2 {
+		t.Fatal(fmt.Sprintf("InstallBinaries(): Expected only the binaries in %s, got %v", dstDir, entries))
+	}
+}
+
+func TestCheckPluginVersions(t *testing.T) {
+	conflist := []byte(`{"cniVersion": "0.3.1", "name": "wgcni", "plugins": [{"type": "wgcni"}, {"type": "portmap"}]}`)
+
+	tcs := []struct {
+		wgcni   string
+		portmap string
+		isError bool
+	}{
+		{wgcni: `"0.3.1", "1.0.0"`, portmap: `"0.3.1"`, isError: false},
+		{wgcni: `"1.0.0"`, portmap: `"0.3.1"`, isError: true},
+		{wgcni: `"0.3.1"`, portmap: `"0.4.0"`, isError: true},
+		// a plugin which is missing in all directories
+		{wgcni: `"0.3.1"`, portmap: "", isError: true},
+	}
+	for k, tc := range tcs {
+		srcDir, dstDir := t.TempDir(), t.TempDir()
+		writePlugin(t, srcDir, "wgcni", tc.wgcni)
+		// an outdated wgcni on the node is ignored, as the installed one takes precedence
+		writePlugin(t, dstDir, "wgcni", `"0.1.0"`)
+		if tc.portmap != "" {
+			writePlugin(t, dstDir, "portmap", tc.portmap)
+		}
+		err := CheckPluginVersions(context.TODO(), conflist, srcDir, dstDir)
+		if (err != nil) != tc.isError {
+			t.Fatal(fmt.Sprintf("CheckPluginVersions() - Test %d: Expected error %t, instead got %v", k, tc.isError, err))
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package cni
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/klog"
+)
+
+// Installer installs the CNI plugins and the conflist of the local node.
+type Installer struct {
+	Clientset kubernetes.Interface
+	// NodeName is the name of the local node.
+	NodeName string
+	// BinSourceDir holds the plugins which are installed into BinDir.
+	BinSourceDir string
+	BinDir       string
+	// ConfDir and ConflistName are the location of the conflist.
+	ConfDir      string
+	ConflistName string
+	// TemplateFile is the conflist template, empty for DefaultConflistTemplate. It is read on every install, so that
+	// changes are picked up.
+	TemplateFile string
+	Settings     Settings
+	// KubeconfigData returns the kubeconfig which is written to Settings.Kubeconfig for the wgipam plugin. It is called
+	// on every install, so that rotated credentials are picked up.
+	KubeconfigData func() ([]byte, error)
+}
+
+// Install installs the plugins and the conflist of node. The plugins of the conflist must support its CNI version,
+// otherwise nothing is installed.
+func (i *Installer) Install(ctx context.Context, node *corev1.Node) error {
+	tmpl := DefaultConflistTemplate
+	if i.TemplateFile != "" {
+		t, err := os.ReadFile(i.TemplateFile)
+		if err != nil {
+			return fmt.Errorf("Cannot read conflist template: %v", err)
+		}
+		tmpl = string(t)
+	}
+	data, err := NewConflistData(i.Settings, node)
+	if err != nil {
+		return err
+	}
+	conflist, err := RenderConflist(tmpl, data)
+	if err != nil {
+		return err
+	}
+
+	// the plugins which are installed take precedence over the ones on the node
+	if err := CheckPluginVersions(ctx, conflist, i.BinSourceDir, i.BinDir); err != nil {
+		return err
+	}
+	if _, err := InstallBinaries(i.BinSourceDir, i.BinDir); err != nil {
+		return err
+	}
+	if data.Ipam == IpamWgipam {
+		if err := i.writeKubeconfig(); err != nil {
+			return err
+		}
+	}
+	written, err := WriteConflist(i.ConfDir, i.ConflistName, conflist)
+	if err != nil {
+		return err
+	}
+	if written {
+		klog.Info("Wrote conflist ", i.ConflistName, " for pod CIDRs ", data.Subnets)
+	}
+	return nil
+}
+
+// Run installs the plugins and the conflist of the local node. Unless watchNode is false, it keeps running until ctx
+// is cancelled: the conflist is rewritten whenever the pod CIDRs of the node change, and everything is installed
+// again every resyncInterval, which picks up changes of the template. Only the first install returns an error, later
+// errors are logged and retried.
+func (i *Installer) Run(ctx context.Context, watchNode bool, resyncInterval time.Duration) error {
+	node, err := i.Clientset.CoreV1().Nodes().Get(ctx, i.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("Cannot retrieve information about local node: %v", err)
+	}
+	if err := i.Install(ctx, node); err != nil {
+		return err
+	}
+	if !watchNode {
+		return nil
+	}
+
+	resync := time.NewTicker(resyncInterval)
+	defer resync.Stop()
+	install := func() {
+		if err := i.Install(ctx, node); err != nil {
+			klog.Error("Cannot install CNI: ", err)
+		}
+	}
+	fieldSelector := fields.OneTermEqualSelector("metadata.name", i.NodeName).String()
+	for {
+		watcher, err := i.Clientset.CoreV1().Nodes().Watch(ctx, metav1.ListOptions{
+			FieldSelector:   fieldSelector,
+			ResourceVersion: node.ResourceVersion,
+		})
+		if err != nil {
+			klog.Error("Cannot watch local node: ", err)
+			watcher = watch.NewEmptyWatch()
+		}
+		closed := false
+		for !closed {
+			select {
+			case <-ctx.Done():
+				watcher.Stop()
+				return nil
+			case <-resync.C:
+				install()
+			case event, ok := <-watcher.ResultChan():
+				if !ok || event.Type == watch.Error {
+					closed = true
+					break
+				}
+				if updated, ok := event.Object.(*corev1.Node); ok && updated.Name == i.NodeName && event.Type == watch.Modified {
+					node = updated
+					install()
+				}
+			}
+		}
+		watcher.Stop()
+
+		// the watch was closed, the node may have changed in the meantime
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+		updated, err := i.Clientset.CoreV1().Nodes().Get(ctx, i.NodeName, metav1.GetOptions{})
+		if err != nil {
+			klog.Error("Cannot retrieve information about local node: ", err)
+			continue
+		}
+		node = updated
+		install()
+	}
+}
+
+// writeKubeconfig writes the kubeconfig of the wgipam plugin, unless the file has the same content and mode 0600
+// already. The kubeconfig holds the service account token, which only the owner may read.
+func (i *Installer) writeKubeconfig() error {
+	if i.KubeconfigData == nil || i.Settings.Kubeconfig == "" {
+		return fmt.Errorf("The %s IPAM plugin requires a kubeconfig", IpamWgipam)
+	}
+	kubeconfig, err := i.KubeconfigData()
+	if err != nil {
+		return fmt.Errorf("Cannot create kubeconfig: %v", err)
+	}
+	if current, err := os.ReadFile(i.Settings.Kubeconfig); err == nil && bytes.Equal(current, kubeconfig) {
+		if info, err := os.Stat(i.Settings.Kubeconfig); err == nil && info.Mode().Perm() == 0600 {
+			return nil
+		}
+	}
+	if err := writeFileAtomic(i.Settings.Kubeconfig, kubeconfig, 0600); err != nil {
+		return fmt.Errorf("Cannot write kubeconfig: %v", err)
+	}
+	klog.Info("Wrote kubeconfig ", i.Settings.Kubeconfig)
+	return nil
+}
+
+// InClusterKubeconfig returns a kubeconfig with the API server and the service account credentials of the pod.
+func InClusterKubeconfig() ([]byte, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(restConfig.TLSClientConfig.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.Clusters["local"] = &clientcmdapi.Cluster{Server: restConfig.Host, CertificateAuthorityData: ca}
+	kubeconfig.AuthInfos["wgipam"] = &clientcmdapi.AuthInfo{Token: restConfig.BearerToken}
+	kubeconfig.Contexts["wgipam"] = &clientcmdapi.Context{Cluster: "local", AuthInfo: "wgipam"}
+	kubeconfig.CurrentContext = "wgipam"
+	return clientcmd.Write(*kubeconfig)
+}
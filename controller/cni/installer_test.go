@@ -0,0 +1,139 @@
+package cni
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/testdata"
+)
+
+func TestInstaller(t *testing.T) {
+	srcDir, binDir, confDir := t.TempDir(), t.TempDir(), t.TempDir()
+	writePlugin(t, srcDir, "wgcni", `"0.3.1"`)
+	writePlugin(t, srcDir, "host-local", `"0.3.1"`)
+	writePlugin(t, binDir, "portmap", `"0.3.1"`)
+
+	clientset := fake.NewSimpleClientset(testdata.WorkerNode0.DeepCopy())
+	installer := &Installer{
+		Clientset:    clientset,
+		NodeName:     testdata.WorkerNode0.Name,
+		BinSourceDir: srcDir,
+		BinDir:       binDir,
+		ConfDir:      confDir,
+		ConflistName: "05-wireguard-cni.conflist",
+		Settings:     testSettings,
+	}
+	conflistContains := func(s string) bool {
+		conflist, _ := os.ReadFile(path.Join(confDir, "05-wireguard-cni.conflist"))
+		return strings.Contains(string(conflist), s)
+	}
+
+	// a single install
+	if err := installer.Run(context.TODO(), false, time.Minute); err != nil {
+		t.Fatal(fmt.Sprintf("Run(): Expected to return nil error, instead got %s", err))
+	}
+	if !conflistContains(`"subnet": "10.245.3.0/24"`) {
+		t.Fatal("Run(): Expected the conflist to hold the pod CIDR of the node")
+	}
+	if _, err := os.Stat(path.Join(binDir, "wgcni")); err != nil {
+		t.Fatal(fmt.Sprintf("Run(): Expected wgcni to be installed, got %v", err))
+	}
+
+	// the conflist is rewritten when the pod CIDRs of the node change
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() { errs <- installer.Run(ctx, true, time.Minute) }()
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		node, err := clientset.CoreV1().Nodes().Get(context.TODO(), testdata.WorkerNode0.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		node.Spec.PodCIDRs = []string{"10.245.3.0/24", "fd00:10:245:3::/64"}
+		if _, err := clientset.CoreV1().Nodes().Update(context.TODO(), node, metav1.UpdateOptions{}); err != nil {
+			return false, err
+		}
+		return conflistContains(`"subnet": "fd00:10:245:3::/64"`), nil
+	})
+	if err != nil {
+		t.Fatal("Run(): Expected the conflist to be rewritten with the new pod CIDRs of the node")
+	}
+	cancel()
+	if err := <-errs; err != nil {
+		t.Fatal(fmt.Sprintf("Run(): Expected to return nil error after cancellation, instead got %s", err))
+	}
+
+	// nothing is installed if a plugin does not support the CNI version of the conflist
+	writePlugin(t, binDir, "portmap", `"1.0.0"`)
+	writePlugin(t, srcDir, "wgcni", `"0.3.1", "0.4.0"`)
+	if err := installer.Run(context.TODO(), false, time.Minute); err == nil {
+		t.Fatal("Run(): Expected an error for a plugin which does not support the CNI version")
+	}
+	installed, _ := os.ReadFile(path.Join(binDir, "wgcni"))
+	if strings.Contains(string(installed), "0.4.0") {
+		t.Fatal("Run(): Expected wgcni not to be upgraded when the version check fails")
+	}
+}
+
+func TestInstallerWgipam(t *testing.T) {
+	srcDir, binDir, confDir := t.TempDir(), t.TempDir(), t.TempDir()
+	writePlugin(t, srcDir, "wgcni", `"0.3.1"`)
+	writePlugin(t, srcDir, "wgipam", `"0.3.1"`)
+	writePlugin(t, binDir, "portmap", `"0.3.1"`)
+
+	settings := testSettings
+	settings.Ipam = IpamWgipam
+	settings.Kubeconfig = path.Join(confDir, "wgk8s.kubeconfig")
+	token := "first"
+	installer := &Installer{
+		Clientset:    fake.NewSimpleClientset(testdata.WorkerNode0.DeepCopy()),
+		NodeName:     testdata.WorkerNode0.Name,
+		BinSourceDir: srcDir,
+		BinDir:       binDir,
+		ConfDir:      confDir,
+		ConflistName: "05-wireguard-cni.conflist",
+		Settings:     settings,
+	}
+
+	// the kubeconfig is required
+	if err := installer.Run(context.TODO(), false, time.Minute); err == nil {
+		t.Fatal("Run(): Expected an error without kubeconfig")
+	}
+
+	// the kubeconfig is written and kept up to date
+	installer.KubeconfigData = func() ([]byte, error) { return []byte(token), nil }
+	for _, token = range []string{"first", "second"} {
+		if err := installer.Run(context.TODO(), false, time.Minute); err != nil {
+			t.Fatal(fmt.Sprintf("Run(): Expected to return nil error, instead got %s", err))
+		}
+		kubeconfig, err := os.ReadFile(settings.Kubeconfig)
+		if err != nil || string(kubeconfig) != token {
+			t.Fatal(fmt.Sprintf("Run(): Expected kubeconfig %q, got %q (%v)", token, kubeconfig, err))
+		}
+		if info, err := os.Stat(settings.Kubeconfig); err != nil || info.Mode().Perm() != 0600 {
+			t.Fatal(fmt.Sprintf("Run(): Expected the kubeconfig to be readable by its owner only, got %v", info.Mode()))
+		}
+	}
+	// a kubeconfig with the same content but wider permissions is rewritten
+	if err := os.Chmod(settings.Kubeconfig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := installer.Run(context.TODO(), false, time.Minute); err != nil {
+		t.Fatal(fmt.Sprintf("Run(): Expected to return nil error, instead got %s", err))
+	}
+	if info, err := os.Stat(settings.Kubeconfig); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal(fmt.Sprintf("Run(): Expected the permissions of the kubeconfig to be restored, got %v", info.Mode()))
+	}
+	conflist, _ := os.ReadFile(path.Join(confDir, "05-wireguard-cni.conflist"))
+	if !strings.Contains(string(conflist), `"type": "wgipam"`) {
+		t.Fatal(fmt.Sprintf("Run(): Expected the conflist to use wgipam, got:\n%s", conflist))
+	}
+}
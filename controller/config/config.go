@@ -0,0 +1,528 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+const (
+	// ApiVersion is the current version of the wgk8s configuration file format.
+	ApiVersion = "wgk8s.wireguard.kubernetes.io/v1alpha1"
+	// Kind is the kind of the wgk8s configuration file.
+	Kind = "WgK8sConfiguration"
+
+	// TopologyMesh makes every node peer with every other node.
+	TopologyMesh = "mesh"
+	// TopologyHubAndSpoke makes spoke nodes peer only with the hub nodes. Hubs peer with all nodes and forward the
+	// traffic between spokes.
+	TopologyHubAndSpoke = "hub-and-spoke"
+	// TopologyZone makes nodes of the same zone peer directly. Traffic between zones is forwarded by the zone
+	// gateways.
+	TopologyZone = "zone"
+
+	// TeardownPolicyRetain leaves the data plane running when the agent stops, so that the next agent adopts it.
+	TeardownPolicyRetain = "retain"
+	// TeardownPolicyTeardown removes the peers, the routes and the wireguard namespace when the agent stops, e.g.
+	// when the node is decommissioned.
+	TeardownPolicyTeardown = "teardown"
+
+	// PodNetworkModeBridge attaches the pods to the bridge inside the wireguard namespace with wgcni.
+	PodNetworkModeBridge = "bridge"
+	// PodNetworkModeRouted attaches the pods with wgcni without a bridge. Each pod is reached through a host route
+	// on its veth inside the wireguard namespace.
+	PodNetworkModeRouted = "routed"
+	// PodNetworkModeChained leaves the pod networking to another CNI plugin, after which wgcni is chained. Traffic of
+	// the pods to remote pod CIDRs is sent through the tunnel by policy routing.
+	PodNetworkModeChained = "chained"
+)
+
+// WgK8sConfiguration is the configuration of the wgk8s agent. It is read from a YAML or JSON file, e.g. mounted from
+// a ConfigMap. Only the fields documented as reloadable are applied when the file changes, all other fields require
+// a restart of the agent.
+type WgK8sConfiguration struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Hostname is the name of the local node.
+	Hostname string `json:"hostname,omitempty"`
+	// InternalRoutingCidr is the network of the tunnel interfaces. It must be a /16 network.
+	InternalRoutingCidr string                         `json:"internalRoutingCidr,omitempty"`
+	Wireguard           WireguardConfiguration         `json:"wireguard,omitempty"`
+	Link                LinkConfiguration              `json:"link,omitempty"`
+	Masquerade          MasqueradeConfiguration        `json:"masquerade,omitempty"`
+	Peers               PeersConfiguration             `json:"peers,omitempty"`
+	Shutdown            ShutdownConfiguration          `json:"shutdown,omitempty"`
+	Reconcile           ReconcileConfiguration         `json:"reconcile,omitempty"`
+	Metrics             MetricsConfiguration           `json:"metrics,omitempty"`
+	State               StateConfiguration             `json:"state,omitempty"`
+	PodCidrAllocation   PodCidrAllocationConfiguration `json:"podCidrAllocation,omitempty"`
+	PodNetwork          PodNetworkConfiguration        `json:"podNetwork,omitempty"`
+	HostTraffic         HostTrafficConfiguration       `json:"hostTraffic,omitempty"`
+	Services            ServicesConfiguration          `json:"services,omitempty"`
+}
+
+// WireguardConfiguration configures the wireguard keys, namespace, tunnel and bridge.
+type WireguardConfiguration struct {
+	PrivateKey string `json:"privateKey,omitempty"`
+	PublicKey  string `json:"publicKey,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Interface  string `json:"interface,omitempty"`
+	Bridge     string `json:"bridge,omitempty"`
+	ListenPort int    `json:"listenPort,omitempty"`
+	// Mtu of the tunnel interface. 0 keeps the kernel's default.
+	Mtu int `json:"mtu,omitempty"`
+	// HostNamespace puts the tunnel and the bridge into the default namespace instead of Namespace. There is no link
+	// into a wireguard namespace then, and pod traffic is only masqueraded once, when it leaves the node.
+	HostNamespace bool `json:"hostNamespace,omitempty"`
+}
+
+// LinkConfiguration configures the veth pair which connects the default namespace with the wireguard namespace.
+type LinkConfiguration struct {
+	ToWireguardNsInterface   string `json:"toWireguardNsInterface,omitempty"`
+	ToDefaultNsInterface     string `json:"toDefaultNsInterface,omitempty"`
+	ToWireguardNsInterfaceIp string `json:"toWireguardNsInterfaceIp,omitempty"`
+	ToDefaultNsInterfaceIp   string `json:"toDefaultNsInterfaceIp,omitempty"`
+	PrefixLength             int    `json:"prefixLength,omitempty"`
+	// Uplink is the node's interface towards the machine network. If empty, the interface of the node's
+	// machine network IP is used.
+	Uplink string `json:"uplink,omitempty"`
+}
+
+// MasqueradeConfiguration configures the masquerading of pod traffic which leaves the wireguard namespace.
+type MasqueradeConfiguration struct {
+	Enabled *bool `json:"enabled,omitempty"`
+	// NonMasqueradeCidrs lists destinations which are reached with the pod's IP address. Reloadable.
+	NonMasqueradeCidrs []string `json:"nonMasqueradeCidrs,omitempty"`
+}
+
+// PeersConfiguration configures which peers are configured and how they are reached.
+type PeersConfiguration struct {
+	// Selector is a label selector for the nodes which become peers. Reloadable.
+	Selector                string                         `json:"selector,omitempty"`
+	Topology                string                         `json:"topology,omitempty"`
+	RemoteClustersNamespace string                         `json:"remoteClustersNamespace,omitempty"`
+	EndpointSelection       EndpointSelectionConfiguration `json:"endpointSelection,omitempty"`
+	// StaticPeersConfigMap is the namespace/name of the ConfigMap with the static peers, an empty string disables it.
+	StaticPeersConfigMap *string `json:"staticPeersConfigMap,omitempty"`
+}
+
+// EndpointSelectionConfiguration configures how the endpoint IP of peer nodes is selected.
+type EndpointSelectionConfiguration struct {
+	AddressType string   `json:"addressType,omitempty"`
+	IpFamily    string   `json:"ipFamily,omitempty"`
+	Cidrs       []string `json:"cidrs,omitempty"`
+}
+
+// ShutdownConfiguration configures what happens to the data plane when the agent stops.
+type ShutdownConfiguration struct {
+	// TeardownPolicy is either retain or teardown. Reloadable.
+	TeardownPolicy string `json:"teardownPolicy,omitempty"`
+	// Timeout is the maximum duration of the shutdown. It must be shorter than the terminationGracePeriodSeconds of
+	// the agent's pod.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+}
+
+// ReconcileConfiguration configures the periodic comparison of the actual with the desired data plane.
+type ReconcileConfiguration struct {
+	// Interval between two checks for drift of the data plane. Reloadable.
+	Interval metav1.Duration `json:"interval,omitempty"`
+}
+
+// MetricsConfiguration configures the HTTP endpoint which serves the metrics and the readiness of the agent.
+type MetricsConfiguration struct {
+	// BindAddress is the host:port of the /metrics and /readyz endpoint, 0 to disable it.
+	BindAddress string `json:"bindAddress,omitempty"`
+}
+
+// StateConfiguration configures where the agent keeps its state across restarts.
+type StateConfiguration struct {
+	// Directory holds the snapshot of the last applied peers. It must be persistent across restarts of the agent.
+	Directory string `json:"directory,omitempty"`
+}
+
+// PodCidrAllocationConfiguration configures the allocation of pod CIDRs to nodes which have none, for clusters whose
+// controller-manager does not allocate node CIDRs.
+type PodCidrAllocationConfiguration struct {
+	// ClusterCidrs are the CIDRs from which the pod CIDRs are allocated, at most one per IP family. Allocation is
+	// disabled if empty.
+	ClusterCidrs []string `json:"clusterCidrs,omitempty"`
+	// NodeMaskSizeIpv4 and NodeMaskSizeIpv6 are the prefix lengths of the allocated pod CIDRs.
+	NodeMaskSizeIpv4 int `json:"nodeMaskSizeIpv4,omitempty"`
+	NodeMaskSizeIpv6 int `json:"nodeMaskSizeIpv6,omitempty"`
+	// ConfigMap is the namespace/name of the ConfigMap which records the allocations.
+	ConfigMap string `json:"configMap,omitempty"`
+}
+
+// PodNetworkConfiguration configures how the pods of the node are connected to the tunnel.
+type PodNetworkConfiguration struct {
+	// Mode is bridge, routed or chained.
+	Mode string `json:"mode,omitempty"`
+	// RouteTable is the routing table which holds the routes to the remote pod CIDRs in chained mode. It must match
+	// the routeTable of wgcni.
+	RouteTable int `json:"routeTable,omitempty"`
+}
+
+// HostTrafficConfiguration configures the encryption of the traffic between the nodes themselves, e.g. of kubelet,
+// hostNetwork pods and NodePort backends.
+type HostTrafficConfiguration struct {
+	// Encrypt routes the traffic between the IPv4 InternalIPs of the nodes through the tunnel. All nodes must enable
+	// it, as the peers only accept the node IPs of nodes which do.
+	Encrypt bool `json:"encrypt,omitempty"`
+	// RouteTable holds the routes to the node IPs of the peers, RulePriority is the priority of the rule which makes
+	// all traffic except for the tunnel's own use it.
+	RouteTable   int `json:"routeTable,omitempty"`
+	RulePriority int `json:"rulePriority,omitempty"`
+	// FwMark marks the UDP packets of the tunnel, which must not be routed through the tunnel itself.
+	FwMark int `json:"fwMark,omitempty"`
+}
+
+// ServicesConfiguration configures the traffic of the local pods to Service ClusterIPs, which kube-proxy translates
+// in the default namespace.
+type ServicesConfiguration struct {
+	// ClusterIpCidrs are the IPv4 service CIDRs of the cluster. If set, the traffic of the pods to the ClusterIPs keeps
+	// the pod's IP address. Only used with the wireguard namespace and the bridge or routed pod network.
+	ClusterIpCidrs []string `json:"clusterIpCidrs,omitempty"`
+	// RouteTable sends the replies of the service backends back into the default namespace, RulePriority is the
+	// priority of the rule which makes the replies use it.
+	RouteTable   int `json:"routeTable,omitempty"`
+	RulePriority int `json:"rulePriority,omitempty"`
+	// FwMark marks the connections from the default namespace to the service backends.
+	FwMark int `json:"fwMark,omitempty"`
+}
+
+// Default returns a configuration with all defaults set.
+func Default() *WgK8sConfiguration {
+	c := &WgK8sConfiguration{}
+	SetDefaults(c)
+	return c
+}
+
+// SetDefaults sets all fields of the configuration which are not set to their default values.
+func SetDefaults(c *WgK8sConfiguration) {
+	setString := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	setInt := func(field *int, value int) {
+		if *field == 0 {
+			*field = value
+		}
+	}
+
+	setString(&c.APIVersion, ApiVersion)
+	setString(&c.Kind, Kind)
+	if c.Hostname == "" {
+		c.Hostname, _ = os.Hostname()
+	}
+	setString(&c.InternalRoutingCidr, "100.64.0.0/16")
+
+	setString(&c.Wireguard.PrivateKey, "/etc/wireguard/private")
+	setString(&c.Wireguard.PublicKey, "/etc/wireguard/public")
+	setString(&c.Wireguard.Namespace, "wireguard-kubernetes")
+	setString(&c.Wireguard.Interface, "wg0")
+	setString(&c.Wireguard.Bridge, "wgb0")
+	setInt(&c.Wireguard.ListenPort, 10000)
+
+	setString(&c.Link.ToWireguardNsInterface, "to-wg-ns")
+	setString(&c.Link.ToDefaultNsInterface, "to-default-ns")
+	setString(&c.Link.ToWireguardNsInterfaceIp, "169.254.0.1")
+	setString(&c.Link.ToDefaultNsInterfaceIp, "169.254.0.2")
+	setInt(&c.Link.PrefixLength, 30)
+
+	if c.Masquerade.Enabled == nil {
+		enabled := true
+		c.Masquerade.Enabled = &enabled
+	}
+
+	setString(&c.Peers.Topology, TopologyMesh)
+	if c.Peers.StaticPeersConfigMap == nil {
+		staticPeersConfigMap := "wireguard-kubernetes/static-peers"
+		c.Peers.StaticPeersConfigMap = &staticPeersConfigMap
+	}
+	setString(&c.Peers.EndpointSelection.AddressType, "InternalIP")
+
+	setString(&c.Shutdown.TeardownPolicy, TeardownPolicyRetain)
+	if c.Shutdown.Timeout.Duration == 0 {
+		c.Shutdown.Timeout.Duration = 20 * time.Second
+	}
+
+	if c.Reconcile.Interval.Duration == 0 {
+		c.Reconcile.Interval.Duration = 30 * time.Second
+	}
+	setString(&c.Metrics.BindAddress, ":9742")
+
+	setString(&c.State.Directory, "/var/lib/wireguard-kubernetes")
+
+	setInt(&c.PodCidrAllocation.NodeMaskSizeIpv4, 24)
+	setInt(&c.PodCidrAllocation.NodeMaskSizeIpv6, 64)
+	setString(&c.PodCidrAllocation.ConfigMap, "wireguard-kubernetes/pod-cidr-allocations")
+
+	setString(&c.PodNetwork.Mode, PodNetworkModeBridge)
+	setInt(&c.PodNetwork.RouteTable, 87)
+
+	setInt(&c.HostTraffic.RouteTable, 88)
+	setInt(&c.HostTraffic.RulePriority, 90)
+	setInt(&c.HostTraffic.FwMark, 0x570000)
+
+	setInt(&c.Services.RouteTable, 89)
+	setInt(&c.Services.RulePriority, 95)
+	setInt(&c.Services.FwMark, 0x580000)
+}
+
+// Validate returns an error if the configuration is invalid.
+func (c *WgK8sConfiguration) Validate() error {
+	if c.APIVersion != ApiVersion || c.Kind != Kind {
+		return fmt.Errorf("Unsupported configuration %s/%s, expected %s/%s", c.APIVersion, c.Kind, ApiVersion, Kind)
+	}
+	if c.Hostname == "" {
+		return fmt.Errorf("hostname must not be empty")
+	}
+
+	// todo: at the moment, this is hardcoded to a 16 bit subnet mask
+	// this makes mapping of IP addresses easier (simply map the last 2 octets of the node outer IP
+	// to the internalRouting network)
+	// That means that all nodes currently *must* be part of the same /16 machine network
+	_, internalRoutingNet, err := net.ParseCIDR(c.InternalRoutingCidr)
+	if err != nil {
+		return fmt.Errorf("Cannot parse internalRoutingCidr: %v", err)
+	}
+	if internalRoutingNet.Mask.String() != "ffff0000" {
+		return fmt.Errorf("Invalid internalRoutingCidr mask, must be ffff0000 (16 hex), got: %s", internalRoutingNet.Mask.String())
+	}
+
+	if c.Wireguard.ListenPort < 1 || c.Wireguard.ListenPort > 65535 {
+		return fmt.Errorf("Invalid wireguard.listenPort %d", c.Wireguard.ListenPort)
+	}
+	if c.Wireguard.Mtu < 0 || (c.Wireguard.Mtu > 0 && c.Wireguard.Mtu < 1280) {
+		return fmt.Errorf("Invalid wireguard.mtu %d, must be 0 or at least 1280", c.Wireguard.Mtu)
+	}
+
+	for _, ip := range []string{c.Link.ToWireguardNsInterfaceIp, c.Link.ToDefaultNsInterfaceIp} {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("Invalid link IP %s", ip)
+		}
+	}
+	if c.Link.PrefixLength < 1 || c.Link.PrefixLength > 30 {
+		return fmt.Errorf("Invalid link.prefixLength %d", c.Link.PrefixLength)
+	}
+
+	for _, cidr := range c.Masquerade.NonMasqueradeCidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("Invalid masquerade.nonMasqueradeCidrs entry %s: %v", cidr, err)
+		}
+	}
+
+	if _, err := labels.Parse(c.Peers.Selector); err != nil {
+		return fmt.Errorf("Invalid peers.selector: %v", err)
+	}
+	switch c.Peers.Topology {
+	case TopologyMesh, TopologyHubAndSpoke, TopologyZone:
+	default:
+		return fmt.Errorf("Invalid peers.topology %s, must be %s, %s or %s",
+			c.Peers.Topology, TopologyMesh, TopologyHubAndSpoke, TopologyZone)
+	}
+	if _, err := c.EndpointSelectionPolicy(); err != nil {
+		return err
+	}
+
+	if c.Shutdown.TeardownPolicy != TeardownPolicyRetain && c.Shutdown.TeardownPolicy != TeardownPolicyTeardown {
+		return fmt.Errorf("Invalid shutdown.teardownPolicy %s, must be %s or %s",
+			c.Shutdown.TeardownPolicy, TeardownPolicyRetain, TeardownPolicyTeardown)
+	}
+	if c.Shutdown.Timeout.Duration < 0 {
+		return fmt.Errorf("Invalid shutdown.timeout %s", c.Shutdown.Timeout.Duration)
+	}
+
+	if c.Reconcile.Interval.Duration < time.Second {
+		return fmt.Errorf("Invalid reconcile.interval %s, must be at least 1s", c.Reconcile.Interval.Duration)
+	}
+	if c.Metrics.BindAddress != "0" {
+		if _, _, err := net.SplitHostPort(c.Metrics.BindAddress); err != nil {
+			return fmt.Errorf("Invalid metrics.bindAddress %s: %v", c.Metrics.BindAddress, err)
+		}
+	}
+
+	families := map[bool]bool{}
+	for _, cidr := range c.PodCidrAllocation.ClusterCidrs {
+		_, clusterNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("Invalid podCidrAllocation.clusterCidrs entry %s: %v", cidr, err)
+		}
+		ipv4 := clusterNet.IP.To4() != nil
+		if families[ipv4] {
+			return fmt.Errorf("Invalid podCidrAllocation.clusterCidrs, at most one CIDR per IP family is supported")
+		}
+		families[ipv4] = true
+		ones, _ := clusterNet.Mask.Size()
+		maskSize, maxMaskSize := c.PodCidrAllocation.NodeMaskSizeIpv6, 126
+		if ipv4 {
+			maskSize, maxMaskSize = c.PodCidrAllocation.NodeMaskSizeIpv4, 30
+		}
+		if maskSize < ones || maskSize > maxMaskSize {
+			return fmt.Errorf("Invalid node mask size %d for cluster CIDR %s, must be between %d and %d", maskSize, cidr,
+				ones, maxMaskSize)
+		}
+	}
+	if len(c.PodCidrAllocation.ClusterCidrs) > 0 {
+		if s := strings.Split(c.PodCidrAllocation.ConfigMap, "/"); len(s) != 2 || s[0] == "" || s[1] == "" {
+			return fmt.Errorf("Invalid podCidrAllocation.configMap %s, must be namespace/name", c.PodCidrAllocation.ConfigMap)
+		}
+	}
+
+	switch c.PodNetwork.Mode {
+	case PodNetworkModeBridge, PodNetworkModeRouted, PodNetworkModeChained:
+	default:
+		return fmt.Errorf("Invalid podNetwork.mode %s, must be %s, %s or %s", c.PodNetwork.Mode, PodNetworkModeBridge,
+			PodNetworkModeRouted, PodNetworkModeChained)
+	}
+	if c.Wireguard.HostNamespace && c.PodNetwork.Mode == PodNetworkModeChained {
+		return fmt.Errorf("podNetwork.mode %s requires the wireguard namespace, wireguard.hostNamespace must be false",
+			PodNetworkModeChained)
+	}
+	// the tables 253 to 255 are the kernel's default, main and local tables
+	if !validRouteTable(c.PodNetwork.RouteTable) {
+		return fmt.Errorf("Invalid podNetwork.routeTable %d", c.PodNetwork.RouteTable)
+	}
+
+	if c.HostTraffic.Encrypt {
+		if !validRouteTable(c.HostTraffic.RouteTable) ||
+			(c.PodNetwork.Mode == PodNetworkModeChained && c.HostTraffic.RouteTable == c.PodNetwork.RouteTable) {
+			return fmt.Errorf("Invalid hostTraffic.routeTable %d", c.HostTraffic.RouteTable)
+		}
+		// 0 and 32766 and above are the priorities of the kernel's default rules
+		if c.HostTraffic.RulePriority < 1 || c.HostTraffic.RulePriority >= 32766 {
+			return fmt.Errorf("Invalid hostTraffic.rulePriority %d", c.HostTraffic.RulePriority)
+		}
+		if c.HostTraffic.FwMark < 1 {
+			return fmt.Errorf("Invalid hostTraffic.fwMark %d", c.HostTraffic.FwMark)
+		}
+	}
+
+	for _, cidr := range c.Services.ClusterIpCidrs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil || ip.To4() == nil {
+			return fmt.Errorf("Invalid services.clusterIpCidrs entry %s, must be an IPv4 CIDR", cidr)
+		}
+	}
+	if len(c.Services.ClusterIpCidrs) > 0 {
+		// the wireguard namespace applies table hostTraffic.routeTable to all traffic
+		if !validRouteTable(c.Services.RouteTable) ||
+			(c.HostTraffic.Encrypt && c.Services.RouteTable == c.HostTraffic.RouteTable) {
+			return fmt.Errorf("Invalid services.routeTable %d", c.Services.RouteTable)
+		}
+		if c.Services.RulePriority < 1 || c.Services.RulePriority >= 32766 {
+			return fmt.Errorf("Invalid services.rulePriority %d", c.Services.RulePriority)
+		}
+		if c.Services.FwMark < 1 {
+			return fmt.Errorf("Invalid services.fwMark %d", c.Services.FwMark)
+		}
+	}
+
+	return nil
+}
+
+// validRouteTable returns true if table is a routing table which wgk8s may use.
+func validRouteTable(table int) bool {
+	return table >= 1 && (table < 253 || table > 255)
+}
+
+// EndpointSelectionPolicy returns the peer endpoint selection policy of the configuration.
+func (c *WgK8sConfiguration) EndpointSelectionPolicy() (*utils.EndpointSelectionPolicy, error) {
+	es := c.Peers.EndpointSelection
+	return utils.NewEndpointSelectionPolicy(es.AddressType, es.IpFamily, strings.Join(es.Cidrs, ","))
+}
+
+// PeerSelector returns the label selector for peer nodes. The configuration must be valid.
+func (c *WgK8sConfiguration) PeerSelector() labels.Selector {
+	selector, _ := labels.Parse(c.Peers.Selector)
+	return selector
+}
+
+// Parse parses a configuration in YAML or JSON format, sets defaults and validates it.
+func Parse(data []byte) (*WgK8sConfiguration, error) {
+	c := &WgK8sConfiguration{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("Cannot parse configuration: %v", err)
+	}
+	SetDefaults(c)
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Load reads the configuration from a file.
+func Load(path string) (*WgK8sConfiguration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Reload returns a copy of current with the reloadable fields taken from updated. It also returns true if any of the
+// fields which require a restart differ between the two configurations.
+func Reload(current, updated *WgK8sConfiguration) (*WgK8sConfiguration, bool) {
+	reloaded := *current
+	reloaded.Peers.Selector = updated.Peers.Selector
+	reloaded.Masquerade.NonMasqueradeCidrs = updated.Masquerade.NonMasqueradeCidrs
+	reloaded.Shutdown.TeardownPolicy = updated.Shutdown.TeardownPolicy
+	reloaded.Reconcile.Interval = updated.Reconcile.Interval
+
+	return &reloaded, !reflect.DeepEqual(&reloaded, updated)
+}
+
+// Watch polls the configuration file every interval and sends every valid configuration with changed content to
+// updates, until stop is closed. prepare is applied to each configuration before it is sent, e.g. in order to apply
+// command line overrides. Invalid configurations are logged and ignored.
+func Watch(path string, interval time.Duration, prepare func(*WgK8sConfiguration), stop <-chan struct{},
+	updates chan<- *WgK8sConfiguration) {
+	lastData, _ := os.ReadFile(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			klog.Error("Cannot read configuration file: ", err)
+			continue
+		}
+		// an empty file is most likely being rewritten, it is read again in the next interval
+		if len(bytes.TrimSpace(data)) == 0 || bytes.Equal(data, lastData) {
+			continue
+		}
+		lastData = data
+
+		c, err := Parse(data)
+		if err == nil {
+			prepare(c)
+			err = c.Validate()
+		}
+		if err != nil {
+			klog.Error("Ignoring invalid configuration file ", path, ": ", err)
+			continue
+		}
+		select {
+		case updates <- c:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestParse(t *testing.T) {
+	tcs := []struct {
+		data          string
+		errorExpected bool
+	}{
+		{
+			data: `apiVersion: wgk8s.wireguard.kubernetes.io/v1alpha1
+kind: WgK8sConfiguration
+hostname: worker-0
+wireguard:
+  listenPort: 51820
+  mtu: 1380
+link:
+  uplink: eth1
+masquerade:
+  enabled: false
+  nonMasqueradeCidrs:
+  - 10.0.0.0/8
+peers:
+  selector: wireguard=enabled
+  topology: zone
+  endpointSelection:
+    addressType: ExternalIP
+    cidrs:
+    - 192.0.2.0/24
+shutdown:
+  teardownPolicy: teardown
+  timeout: 10s
+reconcile:
+  interval: 1m
+metrics:
+  bindAddress: 127.0.0.1:9742
+state:
+  directory: /var/lib/wgk8s
+podCidrAllocation:
+  clusterCidrs:
+  - 10.96.0.0/16
+  - fd00:96::/48
+  nodeMaskSizeIpv4: 26
+podNetwork:
+  mode: chained
+`,
+			errorExpected: false,
+		},
+		{
+			// all defaults
+			data:          "hostname: worker-0",
+			errorExpected: false,
+		},
+		{
+			data:          "apiVersion: v1\nhostname: worker-0",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\nunknownField: true",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\ninternalRoutingCidr: 100.64.0.0/24",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\nwireguard:\n  mtu: 1000",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\nmasquerade:\n  nonMasqueradeCidrs:\n  - 10.0.0.0",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\npeers:\n  selector: '!!'",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\npeers:\n  topology: ring",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\npeers:\n  endpointSelection:\n    addressType: Hostname",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\nshutdown:\n  teardownPolicy: delete",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\nreconcile:\n  interval: 10ms",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\nmetrics:\n  bindAddress: \"0\"",
+			errorExpected: false,
+		},
+		{
+			data:          "hostname: worker-0\nmetrics:\n  bindAddress: localhost",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\npodCidrAllocation:\n  clusterCidrs:\n  - 10.96.0.0/16\n  - 10.97.0.0/16",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\npodCidrAllocation:\n  clusterCidrs:\n  - 10.96.0.0/24\n  nodeMaskSizeIpv4: 16",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\npodCidrAllocation:\n  clusterCidrs:\n  - 10.96.0.0\n",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\npodCidrAllocation:\n  clusterCidrs:\n  - 10.96.0.0/16\n  configMap: allocations",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\npodNetwork:\n  mode: routed",
+			errorExpected: false,
+		},
+		{
+			data:          "hostname: worker-0\npodNetwork:\n  mode: overlay",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\npodNetwork:\n  routeTable: 254",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\nwireguard:\n  hostNamespace: true\npodNetwork:\n  mode: routed",
+			errorExpected: false,
+		},
+		{
+			data:          "hostname: worker-0\nwireguard:\n  hostNamespace: true\npodNetwork:\n  mode: chained",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\nhostTraffic:\n  encrypt: true\n  fwMark: 0x570000",
+			errorExpected: false,
+		},
+		{
+			data:          "hostname: worker-0\nhostTraffic:\n  encrypt: true\n  routeTable: 87\npodNetwork:\n  mode: chained",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\nhostTraffic:\n  encrypt: true\n  rulePriority: 32766",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\nservices:\n  clusterIpCidrs:\n  - 10.96.0.0/16",
+			errorExpected: false,
+		},
+		{
+			data:          "hostname: worker-0\nservices:\n  clusterIpCidrs:\n  - fd00:10:96::/112",
+			errorExpected: true,
+		},
+		{
+			data:          "hostname: worker-0\nhostTraffic:\n  encrypt: true\nservices:\n  clusterIpCidrs:\n  - 10.96.0.0/16\n  routeTable: 88",
+			errorExpected: true,
+		},
+	}
+	for k, tc := range tcs {
+		_, err := Parse([]byte(tc.data))
+		if tc.errorExpected != (err != nil) {
+			t.Fatal(fmt.Sprintf("Parse() - Test %d: Expected to see error: %t. Instead, got: %v", k, tc.errorExpected, err))
+		}
+	}
+
+	c, err := Parse([]byte(tcs[0].data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Wireguard.ListenPort != 51820 || c.Wireguard.Interface != "wg0" || *c.Masquerade.Enabled ||
+		c.Link.ToDefaultNsInterfaceIp != "169.254.0.2" || c.Peers.Topology != TopologyZone ||
+		c.Shutdown.TeardownPolicy != TeardownPolicyTeardown || c.Shutdown.Timeout.Duration != 10*time.Second ||
+		c.Reconcile.Interval.Duration != time.Minute || c.Metrics.BindAddress != "127.0.0.1:9742" ||
+		c.State.Directory != "/var/lib/wgk8s" || c.PodCidrAllocation.NodeMaskSizeIpv4 != 26 ||
+		c.PodCidrAllocation.NodeMaskSizeIpv6 != 64 || len(c.PodCidrAllocation.ClusterCidrs) != 2 ||
+		c.PodNetwork.Mode != PodNetworkModeChained || c.PodNetwork.RouteTable != 87 {
+		t.Fatal(fmt.Sprintf("Parse(): Configuration does not match the file and defaults, got %+v", *c))
+	}
+	if !c.PeerSelector().Matches(labels.Set{"wireguard": "enabled"}) || c.PeerSelector().Matches(labels.Set{}) {
+		t.Fatal(fmt.Sprintf("PeerSelector(): Selector %s does not match the expected labels", c.PeerSelector()))
+	}
+}
+
+func TestStaticPeersConfigMapDefault(t *testing.T) {
+	tcs := []struct {
+		data     string
+		expected string
+	}{
+		// the same default applies with and without a configuration file
+		{data: "", expected: "wireguard-kubernetes/static-peers"},
+		{data: "hostname: worker-0", expected: "wireguard-kubernetes/static-peers"},
+		{data: "hostname: worker-0\npeers:\n  staticPeersConfigMap: \"\"", expected: ""},
+		{data: "hostname: worker-0\npeers:\n  staticPeersConfigMap: kube-system/peers", expected: "kube-system/peers"},
+	}
+	for k, tc := range tcs {
+		c := Default()
+		if tc.data != "" {
+			var err error
+			if c, err = Parse([]byte(tc.data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if *c.Peers.StaticPeersConfigMap != tc.expected {
+			t.Fatal(fmt.Sprintf("Parse() - Test %d: Expected static peers ConfigMap '%s', got '%s'", k, tc.expected, *c.Peers.StaticPeersConfigMap))
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	current := Default()
+	current.Hostname = "worker-0"
+
+	updated := Default()
+	updated.Hostname = "worker-0"
+	updated.Peers.Selector = "wireguard=enabled"
+	updated.Masquerade.NonMasqueradeCidrs = []string{"10.0.0.0/8"}
+	updated.Shutdown.TeardownPolicy = TeardownPolicyTeardown
+	updated.Reconcile.Interval.Duration = time.Minute
+	reloaded, restartRequired := Reload(current, updated)
+	if restartRequired {
+		t.Fatal("Reload(): Expected no restart for changes of reloadable fields")
+	}
+	if reloaded.Peers.Selector != "wireguard=enabled" || len(reloaded.Masquerade.NonMasqueradeCidrs) != 1 ||
+		reloaded.Shutdown.TeardownPolicy != TeardownPolicyTeardown || reloaded.Reconcile.Interval.Duration != time.Minute {
+		t.Fatal(fmt.Sprintf("Reload(): Expected reloadable fields to be updated, got %+v", *reloaded))
+	}
+	if current.Peers.Selector != "" {
+		t.Fatal("Reload(): Expected current configuration to be unmodified")
+	}
+
+	updated.Wireguard.ListenPort = 51820
+	reloaded, restartRequired = Reload(current, updated)
+	if !restartRequired || reloaded.Wireguard.ListenPort != 10000 {
+		t.Fatal(fmt.Sprintf("Reload(): Expected restart to be required and listen port to be kept, got %t and %d",
+			restartRequired, reloaded.Wireguard.ListenPort))
+	}
+}
+
+func TestWatch(t *testing.T) {
+	configFile := path.Join(t.TempDir(), "config.yaml")
+	// replace the file atomically, like the kubelet does for ConfigMap volumes
+	writeConfig := func(data string) error {
+		if err := os.WriteFile(configFile+".tmp", []byte(data), 0644); err != nil {
+			return err
+		}
+		return os.Rename(configFile+".tmp", configFile)
+	}
+	if err := writeConfig("hostname: worker-0"); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	updates := make(chan *WgK8sConfiguration)
+	prepare := func(c *WgK8sConfiguration) { c.Wireguard.Bridge = "br0" }
+	go Watch(configFile, 10*time.Millisecond, prepare, stop, updates)
+
+	// invalid configurations are ignored
+	if err := writeConfig("hostname: worker-0\npeers:\n  topology: ring"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := writeConfig("hostname: worker-0\npeers:\n  selector: wireguard=enabled"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case c := <-updates:
+		if c.Peers.Selector != "wireguard=enabled" || c.Wireguard.Bridge != "br0" {
+			t.Fatal(fmt.Sprintf("Watch(): Expected updated and prepared configuration, got %+v", *c))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch(): Timed out waiting for configuration update")
+	}
+}
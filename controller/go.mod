@@ -8,6 +8,7 @@ require (
 	github.com/containernetworking/cni v1.0.1
 	github.com/containernetworking/plugins v1.0.1
 	github.com/imdario/mergo v0.3.12 // indirect
+	github.com/prometheus/client_golang v1.9.0
 	golang.org/x/sys v0.0.0-20210817190340-bfb29a6856f2 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	k8s.io/api v0.22.3
@@ -15,4 +16,5 @@ require (
 	k8s.io/client-go v0.22.3
 	k8s.io/klog v1.0.0
 	k8s.io/utils v0.0.0-20210930125809-cb0fa318a74b // indirect
+	sigs.k8s.io/yaml v1.2.0
 )
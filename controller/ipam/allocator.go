@@ -0,0 +1,185 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+// Allocate allocates one IP address of each subnet to the interface ifName of container containerId. The first
+// address of each subnet is the gateway of the pods and is never allocated, nor are the network and broadcast
+// addresses. If the interface holds an address of a subnet already, e.g. because ADD is retried, it is returned
+// instead of a new one. requested are the addresses which the runtime requested for the container, at most one per
+// subnet; each of them must be part of one of the subnets and must not be allocated to another interface. After an
+// error, the store may be partially modified and must not be saved.
+func (s *Store) Allocate(subnets []*net.IPNet, requested []net.IP, containerId, ifName, netns string) ([]*current.IPConfig, error) {
+	owned := s.Get(containerId, ifName)
+	for _, r := range requested {
+		found := false
+		for _, subnet := range subnets {
+			found = found || subnet.Contains(r)
+		}
+		if !found {
+			return nil, fmt.Errorf("Requested IP address %s is not part of the pod CIDRs %v", r, subnets)
+		}
+	}
+
+	var ipConfigs []*current.IPConfig
+	for _, subnet := range subnets {
+		gateway, err := Gateway(subnet)
+		if err != nil {
+			return nil, err
+		}
+		var ip net.IP
+		for _, o := range owned {
+			if subnet.Contains(o) {
+				ip = o
+			}
+		}
+		for _, r := range requested {
+			if !subnet.Contains(r) {
+				continue
+			}
+			if ip != nil && !ip.Equal(r) {
+				return nil, fmt.Errorf("Cannot allocate requested IP address %s, the interface has IP address %s", r, ip)
+			}
+			if err := s.checkRequested(subnet, r, containerId, ifName); err != nil {
+				return nil, err
+			}
+			ip = r
+			s.state.Allocations[ip.String()] = Allocation{ContainerId: containerId, IfName: ifName, Netns: netns}
+		}
+		if ip == nil {
+			if ip, err = s.next(subnet); err != nil {
+				return nil, err
+			}
+			s.state.Allocations[ip.String()] = Allocation{ContainerId: containerId, IfName: ifName, Netns: netns}
+			s.state.Last[subnet.String()] = ip.String()
+		}
+		ipConfigs = append(ipConfigs, &current.IPConfig{
+			Address: net.IPNet{IP: ip, Mask: subnet.Mask},
+			Gateway: gateway,
+		})
+	}
+	return ipConfigs, nil
+}
+
+// checkRequested returns an error if the requested IP address r of subnet cannot be allocated to the interface
+// ifName of container containerId.
+func (s *Store) checkRequested(subnet *net.IPNet, r net.IP, containerId, ifName string) error {
+	gateway, err := Gateway(subnet)
+	if err != nil {
+		return err
+	}
+	ones, bits := subnet.Mask.Size()
+	broadcast := intToIp(new(big.Int).Add(ipToInt(subnet.IP), new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)), big.NewInt(1))), len(subnet.IP))
+	if r.Equal(subnet.IP) || r.Equal(gateway) || r.Equal(broadcast) {
+		return fmt.Errorf("Requested IP address %s is reserved in subnet %s", r, subnet)
+	}
+	if a, allocated := s.state.Allocations[r.String()]; allocated && (a.ContainerId != containerId || a.IfName != ifName) {
+		return fmt.Errorf("Requested IP address %s is allocated to container %s already", r, a.ContainerId)
+	}
+	return nil
+}
+
+// Get returns the IP addresses which are allocated to the interface ifName of container containerId, sorted.
+func (s *Store) Get(containerId, ifName string) []net.IP {
+	var ips []net.IP
+	for ip, a := range s.state.Allocations {
+		if a.ContainerId == containerId && a.IfName == ifName {
+			ips = append(ips, net.ParseIP(ip))
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i].String() < ips[j].String() })
+	return ips
+}
+
+// Release releases all IP addresses of the interface ifName of container containerId and returns them.
+func (s *Store) Release(containerId, ifName string) []net.IP {
+	ips := s.Get(containerId, ifName)
+	for _, ip := range ips {
+		delete(s.state.Allocations, ip.String())
+	}
+	return ips
+}
+
+// CollectGarbage releases the allocations of all containers for which exists returns false, and returns the released
+// IP addresses.
+func (s *Store) CollectGarbage(exists func(Allocation) bool) []string {
+	var released []string
+	for ip, a := range s.state.Allocations {
+		if !exists(a) {
+			delete(s.state.Allocations, ip)
+			released = append(released, ip)
+		}
+	}
+	sort.Strings(released)
+	return released
+}
+
+// Gateway returns the gateway of the pods in subnet, which is the address of the wireguard bridge.
+func Gateway(subnet *net.IPNet) (net.IP, error) {
+	gateway, _, err := utils.GetFirstNetworkAddress(subnet.String())
+	if err != nil {
+		return nil, err
+	}
+	return net.ParseIP(gateway), nil
+}
+
+// next returns the next free IP address of subnet, starting after the last allocated one.
+func (s *Store) next(subnet *net.IPNet) (net.IP, error) {
+	ones, bits := subnet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("Subnet %s is too small", subnet)
+	}
+	// the network address and the gateway come first, the broadcast address last
+	network := ipToInt(subnet.IP)
+	first := new(big.Int).Add(network, big.NewInt(2))
+	last := new(big.Int).Sub(new(big.Int).Add(network, new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))), big.NewInt(2))
+	if first.Cmp(last) > 0 {
+		return nil, fmt.Errorf("Subnet %s has no addresses for pods", subnet)
+	}
+
+	start := first
+	if lastIp := net.ParseIP(s.state.Last[subnet.String()]); lastIp != nil && subnet.Contains(lastIp) {
+		start = new(big.Int).Add(ipToInt(lastIp), big.NewInt(1))
+	}
+	if start.Cmp(first) < 0 || start.Cmp(last) > 0 {
+		start = first
+	}
+	candidate := new(big.Int).Set(start)
+	for {
+		ip := intToIp(candidate, len(subnet.IP))
+		if _, allocated := s.state.Allocations[ip.String()]; !allocated {
+			return ip, nil
+		}
+		candidate.Add(candidate, big.NewInt(1))
+		if candidate.Cmp(last) > 0 {
+			candidate.Set(first)
+		}
+		if candidate.Cmp(start) == 0 {
+			return nil, fmt.Errorf("No free IP address in subnet %s", subnet)
+		}
+	}
+}
+
+// ipToInt converts an IP address to an integer. IPv4 addresses are converted from their 4 byte representation.
+func ipToInt(ip net.IP) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return new(big.Int).SetBytes(ip)
+}
+
+// intToIp converts an integer to an IP address of length bytes.
+func intToIp(i *big.Int, length int) net.IP {
+	b := i.Bytes()
+	ip := make(net.IP, length)
+	copy(ip[length-len(b):], b)
+	return ip
+}
@@ -0,0 +1,207 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func mustParseCidr(cidr string) *net.IPNet {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return subnet
+}
+
+func TestAllocate(t *testing.T) {
+	ipv4 := mustParseCidr("10.245.3.0/24")
+	ipv6 := mustParseCidr("fd00:10:245:3::/64")
+
+	tcs := []struct {
+		subnets     []*net.IPNet
+		containers  []string
+		expected    [][]string
+		expectedErr bool
+	}{
+		{
+			// the network address and the gateway are skipped
+			subnets:    []*net.IPNet{ipv4},
+			containers: []string{"c1", "c2"},
+			expected:   [][]string{{"10.245.3.2/24"}, {"10.245.3.3/24"}},
+		},
+		{
+			// dual-stack
+			subnets:    []*net.IPNet{ipv4, ipv6},
+			containers: []string{"c1"},
+			expected:   [][]string{{"10.245.3.2/24", "fd00:10:245:3::2/64"}},
+		},
+		{
+			// a repeated ADD returns the same address
+			subnets:    []*net.IPNet{ipv4},
+			containers: []string{"c1", "c1"},
+			expected:   [][]string{{"10.245.3.2/24"}, {"10.245.3.2/24"}},
+		},
+		{
+			// the broadcast address is skipped, the subnet is exhausted after one address
+			subnets:     []*net.IPNet{mustParseCidr("10.245.3.0/30")},
+			containers:  []string{"c1", "c2"},
+			expected:    [][]string{{"10.245.3.2/30"}},
+			expectedErr: true,
+		},
+		{
+			subnets:     []*net.IPNet{mustParseCidr("10.245.3.0/31")},
+			containers:  []string{"c1"},
+			expectedErr: true,
+		},
+	}
+
+	for k, tc := range tcs {
+		s, err := Open(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var err2 error
+		for i, c := range tc.containers {
+			ipConfigs, err := s.Allocate(tc.subnets, nil, c, "eth0", "")
+			if err != nil {
+				err2 = err
+				break
+			}
+			var addresses []string
+			for j, ipConfig := range ipConfigs {
+				addresses = append(addresses, ipConfig.Address.String())
+				gateway, _ := Gateway(tc.subnets[j])
+				if !ipConfig.Gateway.Equal(gateway) {
+					t.Fatal(fmt.Sprintf("Allocate() - Test %d: Expected gateway %s, got %s", k, gateway, ipConfig.Gateway))
+				}
+			}
+			if fmt.Sprint(addresses) != fmt.Sprint(tc.expected[i]) {
+				t.Fatal(fmt.Sprintf("Allocate() - Test %d: Expected %v for %s, got %v", k, tc.expected[i], c, addresses))
+			}
+		}
+		if (err2 != nil) != tc.expectedErr {
+			t.Fatal(fmt.Sprintf("Allocate() - Test %d: Expected error %t, got %v", k, tc.expectedErr, err2))
+		}
+		s.Close()
+	}
+}
+
+func TestRelease(t *testing.T) {
+	subnet := mustParseCidr("10.245.3.0/29")
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, c := range []string{"c1", "c2", "c3"} {
+		if _, err := s.Allocate([]*net.IPNet{subnet}, nil, c, "eth0", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	released := s.Release("c1", "eth0")
+	if fmt.Sprint(released) != "[10.245.3.2]" {
+		t.Fatal(fmt.Sprintf("Release(): Expected to release 10.245.3.2, got %v", released))
+	}
+	if released := s.Release("c1", "eth0"); len(released) != 0 {
+		t.Fatal(fmt.Sprintf("Release(): Expected a repeated release to be a no-op, got %v", released))
+	}
+	// released addresses are reused only after the end of the subnet was reached
+	var addresses []string
+	for _, c := range []string{"c4", "c5", "c6"} {
+		ipConfigs, err := s.Allocate([]*net.IPNet{subnet}, nil, c, "eth0", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses = append(addresses, ipConfigs[0].Address.IP.String())
+	}
+	if fmt.Sprint(addresses) != "[10.245.3.5 10.245.3.6 10.245.3.2]" {
+		t.Fatal(fmt.Sprintf("Allocate(): Expected round-robin allocation, got %v", addresses))
+	}
+	if _, err := s.Allocate([]*net.IPNet{subnet}, nil, "c7", "eth0", ""); err == nil {
+		t.Fatal("Allocate(): Expected an error for an exhausted subnet")
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	subnet := mustParseCidr("10.245.3.0/24")
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, c := range []string{"c1", "c2", "c3"} {
+		if _, err := s.Allocate([]*net.IPNet{subnet}, nil, c, "eth0", "/var/run/netns/"+c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	released := s.CollectGarbage(func(a Allocation) bool {
+		return a.Netns != "/var/run/netns/c2"
+	})
+	if fmt.Sprint(released) != "[10.245.3.3]" {
+		t.Fatal(fmt.Sprintf("CollectGarbage(): Expected to release 10.245.3.3, got %v", released))
+	}
+	if len(s.Get("c2", "eth0")) != 0 || len(s.Get("c1", "eth0")) != 1 || len(s.Get("c3", "eth0")) != 1 {
+		t.Fatal("CollectGarbage(): Expected to release the allocations of c2 only")
+	}
+}
+
+func TestAllocateRequested(t *testing.T) {
+	ipv4 := mustParseCidr("10.245.3.0/24")
+	ipv6 := mustParseCidr("fd00:10:245:3::/64")
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Allocate([]*net.IPNet{ipv4}, nil, "c1", "eth0", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		containerId string
+		requested   []string
+		expected    string
+		expectedErr bool
+	}{
+		// the requested address of one family, a free one of the other
+		{containerId: "c2", requested: []string{"10.245.3.100"}, expected: "[10.245.3.100/24 fd00:10:245:3::2/64]"},
+		// a repeated ADD
+		{containerId: "c2", requested: []string{"10.245.3.100"}, expected: "[10.245.3.100/24 fd00:10:245:3::2/64]"},
+		{containerId: "c3", requested: []string{"10.245.3.101", "fd00:10:245:3::101"}, expected: "[10.245.3.101/24 fd00:10:245:3::101/64]"},
+		// allocated to another container
+		{containerId: "c4", requested: []string{"10.245.3.2"}, expectedErr: true},
+		// the interface has another address already
+		{containerId: "c2", requested: []string{"10.245.3.102"}, expectedErr: true},
+		// reserved addresses
+		{containerId: "c4", requested: []string{"10.245.3.1"}, expectedErr: true},
+		{containerId: "c4", requested: []string{"10.245.3.255"}, expectedErr: true},
+		{containerId: "c4", requested: []string{"fd00:10:245:3::"}, expectedErr: true},
+		// not part of the pod CIDRs
+		{containerId: "c4", requested: []string{"10.245.4.2"}, expectedErr: true},
+		// two addresses of the same subnet
+		{containerId: "c4", requested: []string{"10.245.3.103", "10.245.3.104"}, expectedErr: true},
+	}
+	for k, tc := range tcs {
+		var requested []net.IP
+		for _, r := range tc.requested {
+			requested = append(requested, net.ParseIP(r))
+		}
+		ipConfigs, err := s.Allocate([]*net.IPNet{ipv4, ipv6}, requested, tc.containerId, "eth0", "")
+		if (err != nil) != tc.expectedErr {
+			t.Fatal(fmt.Sprintf("Allocate() - Test %d: Expected error %t, got %v", k, tc.expectedErr, err))
+		}
+		if err != nil {
+			continue
+		}
+		var addresses []string
+		for _, ipConfig := range ipConfigs {
+			addresses = append(addresses, ipConfig.Address.String())
+		}
+		if fmt.Sprint(addresses) != tc.expected {
+			t.Fatal(fmt.Sprintf("Allocate() - Test %d: Expected %s, got %v", k, tc.expected, addresses))
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+// PodSubnets returns the pod CIDRs of node, the IPv4 CIDR first.
+func PodSubnets(node *corev1.Node) ([]*net.IPNet, error) {
+	podCidrs := utils.GetPodCidrs(node)
+	var ipv4, ipv6 []*net.IPNet
+	for _, cidr := range podCidrs {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pod CIDR of node %s: %v", node.Name, err)
+		}
+		if subnet.IP.To4() != nil {
+			ipv4 = append(ipv4, subnet)
+		} else {
+			ipv6 = append(ipv6, subnet)
+		}
+	}
+	if len(ipv4)+len(ipv6) == 0 {
+		return nil, fmt.Errorf("Node %s has no pod CIDR", node.Name)
+	}
+	return append(ipv4, ipv6...), nil
+}
@@ -0,0 +1,45 @@
+package ipam
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodSubnets(t *testing.T) {
+	tcs := []struct {
+		spec        corev1.NodeSpec
+		expected    string
+		expectedErr bool
+	}{
+		{
+			spec:     corev1.NodeSpec{PodCIDR: "10.245.3.0/24"},
+			expected: "[10.245.3.0/24]",
+		},
+		{
+			// IPv4 first
+			spec:     corev1.NodeSpec{PodCIDR: "fd00:10:245:3::/64", PodCIDRs: []string{"fd00:10:245:3::/64", "10.245.3.0/24"}},
+			expected: "[10.245.3.0/24 fd00:10:245:3::/64]",
+		},
+		{
+			spec:        corev1.NodeSpec{},
+			expectedErr: true,
+		},
+		{
+			spec:        corev1.NodeSpec{PodCIDRs: []string{"10.245.3.0"}},
+			expectedErr: true,
+		},
+	}
+	for k, tc := range tcs {
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker-1"}, Spec: tc.spec}
+		subnets, err := PodSubnets(node)
+		if (err != nil) != tc.expectedErr {
+			t.Fatal(fmt.Sprintf("PodSubnets() - Test %d: Expected error %t, got %v", k, tc.expectedErr, err))
+		}
+		if err == nil && fmt.Sprint(subnets) != tc.expected {
+			t.Fatal(fmt.Sprintf("PodSubnets() - Test %d: Expected %s, got %v", k, tc.expected, subnets))
+		}
+	}
+}
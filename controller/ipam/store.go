@@ -0,0 +1,108 @@
+// Package ipam allocates the IP addresses of pods from the pod CIDRs of the local node. The allocations are persisted
+// in a directory on the node, which is shared by all concurrent invocations of the IPAM plugin.
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// Allocation is an IP address which is allocated to an interface of a container.
+type Allocation struct {
+	ContainerId string `json:"containerId"`
+	IfName      string `json:"ifName"`
+	// Netns is the path of the network namespace of the container. The allocation is released once it is gone.
+	Netns string `json:"netns,omitempty"`
+}
+
+// state is the file format of the allocations.
+type state struct {
+	// Allocations are the allocations by IP address.
+	Allocations map[string]Allocation `json:"allocations"`
+	// Last is the last allocated IP address by subnet. The next allocation starts after it, so that released addresses
+	// are not reused right away.
+	Last map[string]string `json:"last"`
+}
+
+// Store holds the allocations of a network. Only one Store of a directory is open at any time, Open blocks until the
+// store is closed by its current owner.
+type Store struct {
+	dir   string
+	lock  *os.File
+	state state
+}
+
+// Open opens and locks the store in dir. The directory is created if it does not exist.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Cannot create IPAM directory: %v", err)
+	}
+	lock, err := os.OpenFile(path.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open IPAM lock: %v", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("Cannot lock IPAM directory: %v", err)
+	}
+
+	s := &Store{dir: dir, lock: lock}
+	data, err := os.ReadFile(s.file())
+	if err != nil && !os.IsNotExist(err) {
+		s.Close()
+		return nil, fmt.Errorf("Cannot read IP allocations: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("Cannot decode IP allocations: %v", err)
+		}
+	}
+	if s.state.Allocations == nil {
+		s.state.Allocations = map[string]Allocation{}
+	}
+	if s.state.Last == nil {
+		s.state.Last = map[string]string{}
+	}
+	return s, nil
+}
+
+// Save atomically writes the allocations.
+func (s *Store) Save() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Cannot encode IP allocations: %v", err)
+	}
+	tmp, err := os.CreateTemp(s.dir, "allocations.json.tmp-")
+	if err != nil {
+		return fmt.Errorf("Cannot write IP allocations: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.file())
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot write IP allocations: %v", err)
+	}
+	return nil
+}
+
+// Close unlocks the store. Changes which were not saved are lost.
+func (s *Store) Close() error {
+	return s.lock.Close()
+}
+
+// file returns the path of the allocations.
+func (s *Store) file() string {
+	return path.Join(s.dir, "allocations.json")
+}
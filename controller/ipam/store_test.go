@@ -0,0 +1,86 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestStorePersistence(t *testing.T) {
+	dir := path.Join(t.TempDir(), "wgcni")
+	subnet := mustParseCidr("10.245.3.0/24")
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Allocate([]*net.IPNet{subnet}, nil, "c1", "eth0", "/var/run/netns/c1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	// changes which are not saved are lost
+	if _, err := s.Allocate([]*net.IPNet{subnet}, nil, "c2", "eth0", ""); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if info, err := os.Stat(path.Join(dir, "allocations.json")); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal(fmt.Sprintf("Save(): Expected the allocations to be readable by their owner only, got %v", err))
+	}
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if ips := s.Get("c1", "eth0"); fmt.Sprint(ips) != "[10.245.3.2]" {
+		t.Fatal(fmt.Sprintf("Open(): Expected the saved allocation of c1, got %v", ips))
+	}
+	if ips := s.Get("c2", "eth0"); len(ips) != 0 {
+		t.Fatal(fmt.Sprintf("Open(): Expected no allocation of c2, got %v", ips))
+	}
+	// the next allocation continues after the last saved one
+	ipConfigs, err := s.Allocate([]*net.IPNet{subnet}, nil, "c3", "eth0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := ipConfigs[0].Address.IP.String(); ip != "10.245.3.3" {
+		t.Fatal(fmt.Sprintf("Allocate(): Expected 10.245.3.3, got %s", ip))
+	}
+}
+
+func TestStoreLock(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened := make(chan *Store)
+	go func() {
+		s2, err := Open(dir)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- s2
+	}()
+	select {
+	case <-opened:
+		t.Fatal("Open(): Expected to block while the store is open")
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.Close()
+	select {
+	case s2 := <-opened:
+		if s2 != nil {
+			s2.Close()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Open(): Expected to return once the store is closed")
+	}
+}
@@ -0,0 +1,78 @@
+package simulation
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// namePrefix starts the names of all namespaces and interfaces of a simulated node, followed by the node's index,
+// e.g. sim0 is the host namespace of the first node and sim0-eth0 its uplink.
+const namePrefix = "sim"
+
+// nodeNameRegexp matches the names of the namespaces and interfaces of a simulated node other than its host namespace.
+var nodeNameRegexp = regexp.MustCompile(`\b` + namePrefix + `(\d+)-`)
+
+// hostNamespace returns the name of the network namespace which acts as the default namespace of node i.
+func hostNamespace(i int) string {
+	return fmt.Sprintf("%s%d", namePrefix, i)
+}
+
+// namespaceExecutor runs the commands of the agents of all simulated nodes. The agents run their commands through
+// utils.RunCommand and utils.RunCommandWithOutput, which are shared by all agents of the process. The executor finds
+// the node of a command by the names of its namespaces and interfaces, which all start with the node's prefix, and
+// runs the command in the node's host namespace.
+type namespaceExecutor struct {
+	nodes                int
+	runCommand           func(cmd string, methodName string) error
+	runCommandWithOutput func(cmd string, methodName string) ([]byte, error)
+}
+
+// commands returns the commands which run cmd in the right host namespaces. Commands which name an interface or
+// namespace of a node run in the node's host namespace. `ip link ls` without a name runs in the host namespaces of all
+// nodes; as the names of the interfaces are unique, each agent finds its own interfaces in the combined output. All
+// other commands, e.g. `ip netns`, run unchanged, as network namespaces have global names.
+func (e *namespaceExecutor) commands(cmd string) []string {
+	if m := nodeNameRegexp.FindStringSubmatch(cmd); m != nil {
+		return []string{inNamespace(namePrefix+m[1], cmd)}
+	}
+	if strings.HasPrefix(cmd, "ip link ls") {
+		cmds := make([]string, 0, e.nodes)
+		for i := 0; i < e.nodes; i++ {
+			cmds = append(cmds, inNamespace(hostNamespace(i), cmd))
+		}
+		return cmds
+	}
+	return []string{cmd}
+}
+
+// RunCommand replaces utils.RunCommand.
+func (e *namespaceExecutor) RunCommand(cmd string, methodName string) error {
+	for _, c := range e.commands(cmd) {
+		if err := e.runCommand(c, methodName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunCommandWithOutput replaces utils.RunCommandWithOutput. If a command runs in several namespaces, the outputs are
+// concatenated.
+func (e *namespaceExecutor) RunCommandWithOutput(cmd string, methodName string) ([]byte, error) {
+	var out bytes.Buffer
+	for _, c := range e.commands(cmd) {
+		o, err := e.runCommandWithOutput(c, methodName)
+		if err != nil {
+			return []byte{}, err
+		}
+		out.Write(o)
+	}
+	return out.Bytes(), nil
+}
+
+// inNamespace returns a command which runs the shell command cmd in namespace. The whole command, including pipes
+// and `||`, runs in the namespace.
+func inNamespace(namespace, cmd string) string {
+	return "ip netns exec " + namespace + " bash -c '" + strings.ReplaceAll(cmd, "'", `'\''`) + "'"
+}
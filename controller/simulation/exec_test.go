@@ -0,0 +1,78 @@
+package simulation
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestNamespaceExecutor(t *testing.T) {
+	var commands []string
+	e := &namespaceExecutor{
+		nodes: 2,
+		runCommand: func(cmd string, methodName string) error {
+			commands = append(commands, cmd)
+			return nil
+		},
+		runCommandWithOutput: func(cmd string, methodName string) ([]byte, error) {
+			commands = append(commands, cmd)
+			return []byte(cmd + "\n"), nil
+		},
+	}
+
+	tcs := []struct {
+		cmd      string
+		expected []string
+	}{
+		{
+			cmd:      "ip netns",
+			expected: []string{"ip netns"},
+		},
+		{
+			cmd:      "ip route ls dev sim1-towg proto 87",
+			expected: []string{"ip netns exec sim1 bash -c 'ip route ls dev sim1-towg proto 87'"},
+		},
+		{
+			cmd:      "ip netns exec sim0-wg ip -o a",
+			expected: []string{"ip netns exec sim0 bash -c 'ip netns exec sim0-wg ip -o a'"},
+		},
+		{
+			cmd: "iptables -t nat -C POSTROUTING -o sim0-eth0 -j MASQUERADE 2>/dev/null || iptables -t nat -I POSTROUTING -o sim0-eth0 -j MASQUERADE",
+			expected: []string{"ip netns exec sim0 bash -c 'iptables -t nat -C POSTROUTING -o sim0-eth0 -j MASQUERADE 2>/dev/null || " +
+				"iptables -t nat -I POSTROUTING -o sim0-eth0 -j MASQUERADE'"},
+		},
+		{
+			cmd:      "echo 'sim0-eth0'",
+			expected: []string{`ip netns exec sim0 bash -c 'echo '\''sim0-eth0'\'''`},
+		},
+		{
+			cmd:      "ip link ls",
+			expected: []string{"ip netns exec sim0 bash -c 'ip link ls'", "ip netns exec sim1 bash -c 'ip link ls'"},
+		},
+	}
+	for k, tc := range tcs {
+		commands = nil
+		out, err := e.RunCommandWithOutput(tc.cmd, "TestNamespaceExecutor")
+		if err != nil {
+			t.Fatal(fmt.Sprintf("RunCommandWithOutput() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		if !reflect.DeepEqual(commands, tc.expected) {
+			t.Fatal(fmt.Sprintf("RunCommandWithOutput() - Test %d: Expected commands %q, instead got %q", k, tc.expected, commands))
+		}
+		expectedOut := ""
+		for _, cmd := range tc.expected {
+			expectedOut += cmd + "\n"
+		}
+		if string(out) != expectedOut {
+			t.Fatal(fmt.Sprintf("RunCommandWithOutput() - Test %d: Expected output %q, instead got %q", k, expectedOut, out))
+		}
+
+		commands = nil
+		if err := e.RunCommand(tc.cmd, "TestNamespaceExecutor"); err != nil {
+			t.Fatal(fmt.Sprintf("RunCommand() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		if !reflect.DeepEqual(commands, tc.expected) {
+			t.Fatal(fmt.Sprintf("RunCommand() - Test %d: Expected commands %q, instead got %q", k, tc.expected, commands))
+		}
+	}
+}
@@ -0,0 +1,335 @@
+// Package simulation runs a cluster of simulated nodes on a single Linux machine. Every node gets its own network
+// namespace which acts as the node's default namespace, an uplink to a shared underlay bridge, its own wireguard
+// keys and its own wgk8s agent. All agents run in the calling process and share a fake clientset. A pod namespace is
+// attached to the bridge of every node, so that tests can check the encrypted pod-to-pod connectivity without kind.
+// The simulation must run as root and changes the network namespaces of the machine.
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/config"
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+	"github.com/andreaskaris/wireguard-kubernetes/controller/wgk8s"
+	"github.com/andreaskaris/wireguard-kubernetes/controller/wireguard"
+)
+
+const (
+	// underlayNamespace holds the bridge which connects the uplinks of all nodes.
+	underlayNamespace = namePrefix + "-underlay"
+	underlayBridge    = "underlay"
+	// MaxNodes is the maximum number of nodes of a simulated cluster.
+	MaxNodes = 200
+)
+
+// Node is a simulated node.
+type Node struct {
+	Name string
+	// HostNamespace acts as the node's default namespace.
+	HostNamespace string
+	// WireguardNamespace and WireguardInterface are the wireguard namespace and tunnel of the node's agent.
+	WireguardNamespace string
+	WireguardInterface string
+	// PodNamespace is a pod which is attached to the node's bridge once the agent synced.
+	PodNamespace string
+	OuterIp      string
+	PodCidr      string
+	PodIp        string
+	// Config is the configuration of the node's agent.
+	Config *config.WgK8sConfiguration
+
+	controller *wgk8s.Controller
+	cancel     context.CancelFunc
+	errs       chan error
+}
+
+// Cluster is a simulated cluster.
+type Cluster struct {
+	Clientset *fake.Clientset
+	Nodes     []*Node
+
+	runCommand           func(cmd string, methodName string) error
+	runCommandWithOutput func(cmd string, methodName string) ([]byte, error)
+	runtimeDir           string
+}
+
+// Available returns an error if the simulation cannot run on this machine. It needs root, the commands ip, wg,
+// iptables and ping, and wireguard support of the kernel.
+func Available() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("The simulation must run as root")
+	}
+	for _, cmd := range []string{"bash", "ip", "wg", "iptables", "ping"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			return fmt.Errorf("The simulation requires command %s: %v", cmd, err)
+		}
+	}
+	probe := namePrefix + "-probe"
+	cmd := "ip netns add " + probe + " && ip netns exec " + probe + " ip link add wg-probe type wireguard; rc=$?; " +
+		"ip netns del " + probe + "; exit $rc"
+	if err := exec.Command("bash", "-c", cmd).Run(); err != nil {
+		return fmt.Errorf("The kernel does not support wireguard interfaces: %v", err)
+	}
+	return nil
+}
+
+// NewCluster creates the namespaces, the underlay, the keys and the node objects of a cluster with n nodes, and the
+// agents of all nodes. The files of the agents are kept in dir. Leftovers of a previous simulation are removed first.
+// From now on, all commands of utils.RunCommand and utils.RunCommandWithOutput run in the namespace of the node they
+// belong to, until Stop is called.
+func NewCluster(n int, dir string) (*Cluster, error) {
+	if n < 1 || n > MaxNodes {
+		return nil, fmt.Errorf("Invalid number of nodes %d, must be between 1 and %d", n, MaxNodes)
+	}
+	c := &Cluster{
+		Clientset:            fake.NewSimpleClientset(),
+		runCommand:           utils.RunCommand,
+		runCommandWithOutput: utils.RunCommandWithOutput,
+		runtimeDir:           wireguard.RuntimeDir,
+	}
+	for i := 0; i < n; i++ {
+		c.Nodes = append(c.Nodes, newNode(i, dir))
+	}
+	c.deleteNamespaces()
+
+	err := c.run(
+		"ip netns add "+underlayNamespace,
+		"ip netns exec "+underlayNamespace+" ip link add "+underlayBridge+" type bridge",
+		"ip netns exec "+underlayNamespace+" ip link set dev "+underlayBridge+" up",
+	)
+	if err != nil {
+		return nil, c.abort(err)
+	}
+	for i, node := range c.Nodes {
+		if err := c.createNode(i, node); err != nil {
+			return nil, c.abort(err)
+		}
+	}
+
+	// the agents only run commands through the executor from now on
+	executor := &namespaceExecutor{
+		nodes:                n,
+		runCommand:           c.runCommand,
+		runCommandWithOutput: c.runCommandWithOutput,
+	}
+	utils.RunCommand, utils.RunCommandWithOutput = executor.RunCommand, executor.RunCommandWithOutput
+	wireguard.RuntimeDir = path.Join(dir, "run")
+
+	for _, node := range c.Nodes {
+		controller, err := wgk8s.NewController(wgk8s.Options{Clientset: c.Clientset, Config: node.Config})
+		if err != nil {
+			return nil, c.abort(err)
+		}
+		node.controller = controller
+	}
+	return c, nil
+}
+
+// newNode returns node i with its names, addresses and configuration.
+func newNode(i int, dir string) *Node {
+	host := hostNamespace(i)
+	node := &Node{
+		Name:               fmt.Sprintf("sim-node-%d", i),
+		HostNamespace:      host,
+		WireguardNamespace: host + "-wg",
+		WireguardInterface: host + "-wg0",
+		PodNamespace:       host + "-pod",
+		OuterIp:            fmt.Sprintf("172.31.0.%d", i+1),
+		PodCidr:            fmt.Sprintf("10.250.%d.0/24", i),
+		PodIp:              fmt.Sprintf("10.250.%d.2", i),
+	}
+
+	nodeDir := path.Join(dir, node.Name)
+	cfg := config.Default()
+	cfg.Hostname = node.Name
+	cfg.Wireguard.PrivateKey = path.Join(nodeDir, "private")
+	cfg.Wireguard.PublicKey = path.Join(nodeDir, "public")
+	cfg.Wireguard.Namespace = node.WireguardNamespace
+	cfg.Wireguard.Interface = node.WireguardInterface
+	cfg.Wireguard.Bridge = host + "-br"
+	cfg.Link.ToWireguardNsInterface = host + "-towg"
+	cfg.Link.ToDefaultNsInterface = host + "-todef"
+	cfg.Link.Uplink = host + "-eth0"
+	*cfg.Peers.StaticPeersConfigMap = ""
+	cfg.State.Directory = path.Join(nodeDir, "state")
+	node.Config = cfg
+	return node
+}
+
+// createNode creates the host namespace, the uplink and the keys of node i and adds its node object.
+func (c *Cluster) createNode(i int, node *Node) error {
+	uplink, peer := node.Config.Link.Uplink, fmt.Sprintf("%s-ul", node.HostNamespace)
+	err := c.run(
+		"ip netns add "+node.HostNamespace,
+		"ip netns exec "+node.HostNamespace+" ip link set dev lo up",
+		"ip link add "+uplink+" type veth peer name "+peer,
+		"ip link set dev "+uplink+" netns "+node.HostNamespace,
+		"ip link set dev "+peer+" netns "+underlayNamespace,
+		"ip netns exec "+underlayNamespace+" ip link set dev "+peer+" master "+underlayBridge+" up",
+		"ip netns exec "+node.HostNamespace+" ip address add dev "+uplink+" "+node.OuterIp+"/24",
+		"ip netns exec "+node.HostNamespace+" ip link set dev "+uplink+" up",
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(node.Config.Wireguard.PrivateKey), 0700); err != nil {
+		return err
+	}
+	privateKey, err := c.runCommandWithOutput("wg genkey", "createNode")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(node.Config.Wireguard.PrivateKey, privateKey, 0600); err != nil {
+		return err
+	}
+	publicKey, err := c.runCommandWithOutput("wg pubkey < "+node.Config.Wireguard.PrivateKey, "createNode")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(node.Config.Wireguard.PublicKey, publicKey, 0600); err != nil {
+		return err
+	}
+
+	_, err = c.Clientset.CoreV1().Nodes().Create(context.TODO(), &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   node.Name,
+			Labels: map[string]string{"kubernetes.io/hostname": node.Name},
+		},
+		Spec: corev1.NodeSpec{
+			PodCIDR:  node.PodCidr,
+			PodCIDRs: []string{node.PodCidr},
+		},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: node.OuterIp}},
+		},
+	}, metav1.CreateOptions{})
+	return err
+}
+
+// Start starts the agents of all nodes and waits until all of them synced. Then it attaches the pod of every node to
+// the node's bridge. The agents run until Stop is called.
+func (c *Cluster) Start(ctx context.Context) error {
+	for _, node := range c.Nodes {
+		agentCtx, cancel := context.WithCancel(context.Background())
+		node.cancel, node.errs = cancel, make(chan error, 1)
+		go func(node *Node) { node.errs <- node.controller.Start(agentCtx) }(node)
+	}
+	for _, node := range c.Nodes {
+		syncCtx, cancel := context.WithCancel(ctx)
+		go func(node *Node) {
+			// stop waiting if the agent fails
+			select {
+			case err := <-node.errs:
+				node.errs <- err
+				cancel()
+			case <-syncCtx.Done():
+			}
+		}(node)
+		synced := node.controller.WaitForSync(syncCtx)
+		cancel()
+		if !synced {
+			return fmt.Errorf("Agent of node %s did not sync: %v", node.Name, node.controller.Ready())
+		}
+	}
+
+	for _, node := range c.Nodes {
+		if err := c.createPod(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createPod attaches the pod namespace of node to the node's bridge, like the CNI plugin does. It also enables
+// forwarding in the wireguard namespace, as new namespaces do not inherit it from the machine in all cases.
+func (c *Cluster) createPod(node *Node) error {
+	bridgeIp, _, err := utils.GetFirstNetworkAddress(node.PodCidr)
+	if err != nil {
+		return err
+	}
+	hostVeth, podVeth := node.PodNamespace+"0", node.PodNamespace+"1"
+	return c.run(
+		"ip netns exec "+node.WireguardNamespace+" bash -c 'echo 1 > /proc/sys/net/ipv4/ip_forward'",
+		"ip netns add "+node.PodNamespace,
+		"ip link add "+hostVeth+" type veth peer name "+podVeth,
+		"ip link set dev "+hostVeth+" netns "+node.WireguardNamespace,
+		"ip netns exec "+node.WireguardNamespace+" ip link set dev "+hostVeth+" master "+node.Config.Wireguard.Bridge+" up",
+		"ip link set dev "+podVeth+" netns "+node.PodNamespace,
+		"ip netns exec "+node.PodNamespace+" ip link set dev lo up",
+		"ip netns exec "+node.PodNamespace+" ip link set dev "+podVeth+" name eth0",
+		"ip netns exec "+node.PodNamespace+" ip address add dev eth0 "+node.PodIp+"/24",
+		"ip netns exec "+node.PodNamespace+" ip link set dev eth0 up",
+		"ip netns exec "+node.PodNamespace+" ip route add default via "+bridgeIp,
+	)
+}
+
+// Exec runs the shell command cmd in namespace and returns its output.
+func (c *Cluster) Exec(namespace, cmd string) ([]byte, error) {
+	return c.runCommandWithOutput(inNamespace(namespace, cmd), "Exec")
+}
+
+// Ping sends pings from the pod of node from to the pod of node to until one is answered or timeout expires.
+func (c *Cluster) Ping(from, to *Node, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := c.Exec(from.PodNamespace, "ping -c 1 -W 1 "+to.PodIp)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+	}
+}
+
+// Stop stops all agents and removes all namespaces of the cluster. The commands run on the machine again.
+func (c *Cluster) Stop() {
+	for _, node := range c.Nodes {
+		if node.cancel == nil {
+			continue
+		}
+		node.cancel()
+		if err := <-node.errs; err != nil {
+			klog.Error("Agent of node ", node.Name, " failed: ", err)
+		}
+	}
+	utils.RunCommand, utils.RunCommandWithOutput = c.runCommand, c.runCommandWithOutput
+	wireguard.RuntimeDir = c.runtimeDir
+	c.deleteNamespaces()
+}
+
+// abort removes the namespaces which were created so far and returns err.
+func (c *Cluster) abort(err error) error {
+	c.Stop()
+	return err
+}
+
+// deleteNamespaces deletes the namespaces of all nodes and the underlay, if they exist.
+func (c *Cluster) deleteNamespaces() {
+	var namespaces []string
+	for _, node := range c.Nodes {
+		namespaces = append(namespaces, node.PodNamespace, node.WireguardNamespace, node.HostNamespace)
+	}
+	namespaces = append(namespaces, underlayNamespace)
+	for _, namespace := range namespaces {
+		c.runCommand("ip netns del "+namespace+" 2>/dev/null || true", "deleteNamespaces")
+	}
+}
+
+// run runs all commands on the machine and stops at the first error.
+func (c *Cluster) run(cmds ...string) error {
+	for _, cmd := range cmds {
+		if err := c.runCommand(cmd, "simulation"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// TestSimulatedCluster runs the agents of a cluster with three simulated nodes and checks the encrypted connectivity
+// between their pods. It is skipped unless it runs as root on a machine with wireguard support.
+func TestSimulatedCluster(t *testing.T) {
+	if err := Available(); err != nil {
+		t.Skip(fmt.Sprintf("Skipping the simulation: %v", err))
+	}
+
+	cluster, err := NewCluster(3, t.TempDir())
+	if err != nil {
+		t.Fatal(fmt.Sprintf("NewCluster(): Expected to return nil error, instead got %s", err))
+	}
+	defer cluster.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := cluster.Start(ctx); err != nil {
+		t.Fatal(fmt.Sprintf("Start(): Expected to return nil error, instead got %s", err))
+	}
+
+	// all pods reach each other through the tunnels
+	for _, from := range cluster.Nodes {
+		for _, to := range cluster.Nodes {
+			if from == to {
+				continue
+			}
+			if err := cluster.Ping(from, to, 10*time.Second); err != nil {
+				t.Fatal(fmt.Sprintf("Ping(): Expected pod of %s to reach pod of %s, instead got %s", from.Name, to.Name, err))
+			}
+		}
+	}
+
+	// the traffic went through the tunnels: every node completed a handshake with every peer
+	for _, node := range cluster.Nodes {
+		out, err := cluster.Exec(node.WireguardNamespace, "wg show "+node.WireguardInterface+" latest-handshakes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		if len(lines) != len(cluster.Nodes)-1 {
+			t.Fatal(fmt.Sprintf("Node %s: Expected %d peers, got %q", node.Name, len(cluster.Nodes)-1, out))
+		}
+		for _, line := range lines {
+			if fields := strings.Fields(line); len(fields) != 2 || fields[1] == "0" {
+				t.Fatal(fmt.Sprintf("Node %s: Expected a handshake with every peer, got %q", node.Name, out))
+			}
+		}
+	}
+
+	// deleted nodes are removed from the peers of all other nodes
+	deleted := cluster.Nodes[len(cluster.Nodes)-1]
+	if err := cluster.Clientset.CoreV1().Nodes().Delete(context.TODO(), deleted.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	node := cluster.Nodes[0]
+	err = wait.PollImmediate(100*time.Millisecond, 10*time.Second, func() (bool, error) {
+		out, err := cluster.Exec(node.WireguardNamespace, "wg show "+node.WireguardInterface+" peers")
+		return err == nil && len(strings.Fields(string(out))) == len(cluster.Nodes)-2, nil
+	})
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Node %s: Expected the peer of deleted node %s to be removed", node.Name, deleted.Name))
+	}
+	if err := cluster.Ping(node, deleted, time.Second); err == nil {
+		t.Fatal(fmt.Sprintf("Ping(): Expected pod of %s not to reach pod of deleted node %s", node.Name, deleted.Name))
+	}
+}
@@ -1,6 +1,9 @@
 package testdata
 
 import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
 	"os/exec"
 	"strings"
 
@@ -257,3 +260,43 @@ var WorkerNodeLocal = &corev1.Node{
 		},
 	},
 }
+
+// GenerateWorkerNodes returns n worker nodes with unique names, public keys, machine network IPs (in 172.19.0.0/16)
+// and PodCIDRs (in 10.128.0.0/9), e.g. for benchmarks. n must not exceed 32767.
+func GenerateWorkerNodes(n int) []*corev1.Node {
+	nodes := make([]*corev1.Node, 0, n)
+	for i := 1; i <= n; i++ {
+		name := fmt.Sprintf("worker-gen-%d", i)
+		key := make([]byte, 32)
+		binary.BigEndian.PutUint32(key, uint32(i))
+		nodes = append(nodes, &corev1.Node{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: "v1",
+				Kind:       "Node",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					"node-role.kubernetes.io/worker": "",
+					"kubernetes.io/hostname":         name,
+				},
+				Annotations: map[string]string{
+					"wireguard.kubernetes.io/publickey": base64.StdEncoding.EncodeToString(key),
+				},
+			},
+			Spec: corev1.NodeSpec{
+				PodCIDR:  fmt.Sprintf("10.%d.%d.0/24", 128+i/256, i%256),
+				PodCIDRs: []string{fmt.Sprintf("10.%d.%d.0/24", 128+i/256, i%256)},
+			},
+			Status: corev1.NodeStatus{
+				Addresses: []corev1.NodeAddress{
+					{
+						Type:    corev1.NodeInternalIP,
+						Address: fmt.Sprintf("172.19.%d.%d", i/256, i%256),
+					},
+				},
+			},
+		})
+	}
+	return nodes
+}
@@ -0,0 +1,10 @@
+//go:build tools
+// +build tools
+
+// Package tools records the dependency on the CNI plugins which the tests of wgcni build and chain with it.
+package tools
+
+import (
+	_ "github.com/containernetworking/plugins/plugins/ipam/host-local"
+	_ "github.com/containernetworking/plugins/plugins/meta/portmap"
+)
@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+)
+
+// CommandRecorder is an executor which records commands instead of running them. Install replaces RunCommand and
+// RunCommandWithOutput with it. It is used by tests and benchmarks to count and inspect the data plane operations.
+type CommandRecorder struct {
+	mutex    sync.Mutex
+	commands []string
+	outputs  map[string]string
+	failures map[string]bool
+}
+
+// NewCommandRecorder returns a recorder which returns the output in outputs for the commands which equal the
+// respective key, and an empty output for all other commands.
+func NewCommandRecorder(outputs map[string]string) *CommandRecorder {
+	if outputs == nil {
+		outputs = map[string]string{}
+	}
+	return &CommandRecorder{outputs: outputs, failures: map[string]bool{}}
+}
+
+// Install replaces RunCommand and RunCommandWithOutput with the recorder. The returned function restores them.
+func (r *CommandRecorder) Install() func() {
+	runCommand, runCommandWithOutput := RunCommand, RunCommandWithOutput
+	RunCommand = func(cmd string, methodName string) error {
+		_, err := r.record(cmd, methodName)
+		return err
+	}
+	RunCommandWithOutput = func(cmd string, methodName string) ([]byte, error) {
+		out, err := r.record(cmd, methodName)
+		if err != nil {
+			return []byte{}, err
+		}
+		return []byte(out), nil
+	}
+	return func() { RunCommand, RunCommandWithOutput = runCommand, runCommandWithOutput }
+}
+
+// SetOutput sets the output of cmd.
+func (r *CommandRecorder) SetOutput(cmd, output string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.outputs[cmd] = output
+}
+
+// SetFailure makes cmd fail, as the command would fail on the host.
+func (r *CommandRecorder) SetFailure(cmd string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.failures[cmd] = true
+}
+
+// Commands returns the recorded commands in the order in which they were run.
+func (r *CommandRecorder) Commands() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.commands...)
+}
+
+// Count returns the number of recorded commands.
+func (r *CommandRecorder) Count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.commands)
+}
+
+// Reset forgets all recorded commands.
+func (r *CommandRecorder) Reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.commands = nil
+}
+
+func (r *CommandRecorder) record(cmd, methodName string) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.commands = append(r.commands, cmd)
+	if r.failures[cmd] {
+		return "", fmt.Errorf("Error in %s: exit status 1 (%s)", methodName, cmd)
+	}
+	return r.outputs[cmd], nil
+}
@@ -61,6 +61,111 @@ func GetNodeMachineNetworkIp(node *corev1.Node) (net.IP, error) {
 	return nil, fmt.Errorf("Could not determine machine network IP for node %v", *node)
 }
 
+// EndpointAnnotation is the node annotation which explicitly overrides the wireguard endpoint IP of a node.
+const EndpointAnnotation = "wireguard.kubernetes.io/endpoint"
+
+// EndpointSelectionPolicy describes how the wireguard endpoint IP of a peer node is selected from the node's
+// addresses.
+type EndpointSelectionPolicy struct {
+	// AddressTypes lists the node address types in order of preference.
+	AddressTypes []corev1.NodeAddressType
+	// IpFamily prefers "ipv4" or "ipv6" addresses, addresses of the other family are only selected if the node has
+	// none of the preferred family. An empty string has no preference.
+	IpFamily string
+	// Cidrs restricts the selection to addresses inside one of these networks. An empty list allows all addresses.
+	Cidrs []*net.IPNet
+}
+
+// NewEndpointSelectionPolicy parses the preferred address type (InternalIP or ExternalIP), the IP family
+// (ipv4, ipv6 or empty) and a comma separated list of CIDRs into an EndpointSelectionPolicy.
+// The address type which is not preferred is used as a fallback.
+func NewEndpointSelectionPolicy(preferredAddressType, ipFamily, cidrs string) (*EndpointSelectionPolicy, error) {
+	policy := &EndpointSelectionPolicy{}
+
+	switch corev1.NodeAddressType(preferredAddressType) {
+	case corev1.NodeInternalIP:
+		policy.AddressTypes = []corev1.NodeAddressType{corev1.NodeInternalIP, corev1.NodeExternalIP}
+	case corev1.NodeExternalIP:
+		policy.AddressTypes = []corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeInternalIP}
+	default:
+		return nil, fmt.Errorf("Invalid address type %s, must be %s or %s",
+			preferredAddressType, corev1.NodeInternalIP, corev1.NodeExternalIP)
+	}
+
+	switch ipFamily {
+	case "", "ipv4", "ipv6":
+		policy.IpFamily = ipFamily
+	default:
+		return nil, fmt.Errorf("Invalid IP family %s, must be ipv4, ipv6 or empty", ipFamily)
+	}
+
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid endpoint CIDR %s: %v", cidr, err)
+		}
+		policy.Cidrs = append(policy.Cidrs, ipnet)
+	}
+
+	return policy, nil
+}
+
+// matches returns true if ip is of the IP family ipFamily, if set, and satisfies the CIDR restrictions of the policy.
+func (policy *EndpointSelectionPolicy) matches(ip net.IP, ipFamily string) bool {
+	if ipFamily == "ipv4" && ip.To4() == nil {
+		return false
+	}
+	if ipFamily == "ipv6" && ip.To4() != nil {
+		return false
+	}
+	if len(policy.Cidrs) == 0 {
+		return true
+	}
+	for _, cidr := range policy.Cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetNodeEndpointIp returns the IP address that peers use to reach the node's wireguard tunnel endpoint.
+// The annotation `wireguard.kubernetes.io/endpoint` takes precedence over the node's addresses. Otherwise, the
+// first node address which matches the policy is returned, with address types checked in order of preference. Addresses
+// of the preferred IP family are returned before the addresses of the other family.
+func GetNodeEndpointIp(node *corev1.Node, policy *EndpointSelectionPolicy) (net.IP, error) {
+	if endpoint, ok := node.GetAnnotations()[EndpointAnnotation]; ok {
+		ip := net.ParseIP(endpoint)
+		if ip == nil {
+			return nil, fmt.Errorf("Cannot parse annotation %s=%s of node %s", EndpointAnnotation, endpoint, node.Name)
+		}
+		return ip, nil
+	}
+
+	ipFamilies := []string{policy.IpFamily}
+	if policy.IpFamily != "" {
+		ipFamilies = append(ipFamilies, "")
+	}
+	for _, ipFamily := range ipFamilies {
+		for _, addressType := range policy.AddressTypes {
+			for _, a := range node.Status.Addresses {
+				if a.Type != addressType {
+					continue
+				}
+				ip := net.ParseIP(a.Address)
+				if ip != nil && policy.matches(ip, ipFamily) {
+					return ip, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("Could not determine endpoint IP for node %s", node.Name)
+}
+
 // GetInnterToOuterIp returns the tunnel inner IP address for this node, based on its outer (machine network) IP address.
 // TODO: overly simplistic, only works with a /16 machine network at the moment and only IPv4
 // This also won't work with remote nodes with overlapping IP addresses
@@ -91,38 +196,82 @@ func RandomIpInSubnet(cidr string) (net.IP, error) {
 	), nil
 }*/
 
+// PodCidrsAnnotation is the node annotation with the comma separated pod CIDRs which wgk8s allocated to a node whose
+// Spec.PodCIDRs is not set.
+const PodCidrsAnnotation = "wireguard.kubernetes.io/pod-cidrs"
+
+// GetPodCidrs returns the pod CIDRs of a given node: Spec.PodCIDRs, Spec.PodCIDR or, if neither is set, the CIDRs of
+// PodCidrsAnnotation.
+func GetPodCidrs(node *corev1.Node) []string {
+	if len(node.Spec.PodCIDRs) > 0 {
+		return node.Spec.PodCIDRs
+	}
+	if node.Spec.PodCIDR != "" {
+		return []string{node.Spec.PodCIDR}
+	}
+	if cidrs := node.GetAnnotations()[PodCidrsAnnotation]; cidrs != "" {
+		return strings.Split(cidrs, ",")
+	}
+	return nil
+}
+
 // GetPodCidr returns the IPv4 and/or IPv6 Cidr of a given node.
 func GetPodCidr(node *corev1.Node) (map[string]string, error) {
 	ips := map[string]string{
 		"ipv4": "",
 		"ipv6": "",
 	}
-	if len(node.Spec.PodCIDRs) > 0 {
-		for _, cidr := range node.Spec.PodCIDRs {
-			ip, _, err := net.ParseCIDR(cidr)
-			if err != nil {
-				return nil, err
-			}
-			if ip.To4() != nil {
-				ips["ipv4"] = cidr
-			} else {
-				ips["ipv6"] = cidr
-			}
-		}
-	} else {
-		ip, _, err := net.ParseCIDR(node.Spec.PodCIDR)
+	podCidrs := GetPodCidrs(node)
+	if len(podCidrs) == 0 {
+		return nil, fmt.Errorf("Node %s has no pod CIDR", node.Name)
+	}
+	for _, cidr := range podCidrs {
+		ip, _, err := net.ParseCIDR(cidr)
 		if err != nil {
 			return nil, err
 		}
 		if ip.To4() != nil {
-			ips["ipv4"] = node.Spec.PodCIDR
+			ips["ipv4"] = cidr
 		} else {
-			ips["ipv6"] = node.Spec.PodCIDR
+			ips["ipv6"] = cidr
 		}
 	}
 	return ips, nil
 }
 
+// NormalizeCidr returns the canonical network notation of a CIDR. Addresses without prefix length, as printed by
+// `ip route` for host routes, are treated as /32 (IPv4) or /128 (IPv6). Unparsable input is returned as is.
+func NormalizeCidr(cidr string) string {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return cidr
+		}
+		if ip.To4() != nil {
+			return ip.String() + "/32"
+		}
+		return ip.String() + "/128"
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return cidr
+	}
+	return ipnet.String()
+}
+
+// CidrsOverlap returns true if the two networks share at least one address. Unparsable networks never overlap.
+func CidrsOverlap(a, b string) bool {
+	_, aNet, err := net.ParseCIDR(NormalizeCidr(a))
+	if err != nil {
+		return false
+	}
+	_, bNet, err := net.ParseCIDR(NormalizeCidr(b))
+	if err != nil {
+		return false
+	}
+	return aNet.Contains(bNet.IP) || bNet.Contains(aNet.IP)
+}
+
 // GetFirstNetworkAddress returns the local network's first address.
 func GetFirstNetworkAddress(cidr string) (string, string, error) {
 	s := strings.Split(cidr, "/")
@@ -157,9 +306,18 @@ func GetPathFromNamespace(namespace string) string {
 	return "/var/run/netns/" + namespace
 }
 
+// NetnsExec returns the prefix which runs a command inside the given namespace. The empty namespace is the default
+// namespace, in which commands run without prefix.
+func NetnsExec(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+	return "ip netns exec " + namespace + " "
+}
+
 // GetInterfaceMac returns an interface's MAC address.
 func GetInterfaceMac(namespace, interfaceName string) (string, error) {
-	cmd := "ip netns exec " + namespace + " ip link ls dev " + interfaceName
+	cmd := NetnsExec(namespace) + "ip link ls dev " + interfaceName
 	out, err := RunCommandWithOutput(cmd, "GetInterfaceMac")
 	if err != nil {
 		return "", err
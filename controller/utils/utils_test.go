@@ -6,6 +6,8 @@ import (
 	"os"
 	"testing"
 
+	corev1 "k8s.io/api/core/v1"
+
 	"github.com/andreaskaris/wireguard-kubernetes/controller/testdata"
 )
 
@@ -40,6 +42,74 @@ func TestGetNodeMachineNetworkIp(t *testing.T) {
 	}
 }
 
+func TestNewEndpointSelectionPolicy(t *testing.T) {
+	tcs := []struct {
+		addressType   string
+		ipFamily      string
+		cidrs         string
+		errorExpected bool
+	}{
+		{addressType: "InternalIP", ipFamily: "", cidrs: "", errorExpected: false},
+		{addressType: "ExternalIP", ipFamily: "ipv6", cidrs: "2000::/64, 10.0.0.0/8", errorExpected: false},
+		{addressType: "Hostname", ipFamily: "", cidrs: "", errorExpected: true},
+		{addressType: "InternalIP", ipFamily: "ipv5", cidrs: "", errorExpected: true},
+		{addressType: "InternalIP", ipFamily: "", cidrs: "10.0.0.0/33", errorExpected: true},
+	}
+	for k, tc := range tcs {
+		_, err := NewEndpointSelectionPolicy(tc.addressType, tc.ipFamily, tc.cidrs)
+		if tc.errorExpected != (err != nil) {
+			t.Fatal(fmt.Sprintf("NewEndpointSelectionPolicy(%s, %s, %s) - Test %d: Expected to see error: %t. Instead, got: %s",
+				tc.addressType, tc.ipFamily, tc.cidrs, k, tc.errorExpected, err))
+		}
+	}
+}
+
+func TestGetNodeEndpointIp(t *testing.T) {
+	hybridNode := testdata.MasterNode0.DeepCopy()
+	hybridNode.Status.Addresses = []corev1.NodeAddress{
+		{Type: corev1.NodeInternalIP, Address: "172.18.0.100"},
+		{Type: corev1.NodeInternalIP, Address: "fd00::100"},
+		{Type: corev1.NodeExternalIP, Address: "203.0.113.10"},
+	}
+	annotatedNode := hybridNode.DeepCopy()
+	annotatedNode.Annotations[EndpointAnnotation] = "198.51.100.1"
+
+	tcs := []struct {
+		node          *corev1.Node
+		addressType   string
+		ipFamily      string
+		cidrs         string
+		expected      string
+		errorExpected bool
+	}{
+		{node: hybridNode, addressType: "InternalIP", expected: "172.18.0.100"},
+		{node: hybridNode, addressType: "ExternalIP", expected: "203.0.113.10"},
+		{node: hybridNode, addressType: "InternalIP", ipFamily: "ipv6", expected: "fd00::100"},
+		{node: hybridNode, addressType: "ExternalIP", cidrs: "172.18.0.0/16", expected: "172.18.0.100"},
+		{node: testdata.MasterNode0, addressType: "ExternalIP", expected: "172.18.0.100"},
+		// single-stack nodes fall back to the other IP family
+		{node: testdata.MasterNode0, addressType: "InternalIP", ipFamily: "ipv6", expected: "172.18.0.100"},
+		{node: hybridNode, addressType: "ExternalIP", ipFamily: "ipv6", expected: "fd00::100"},
+		{node: testdata.MasterNode0, addressType: "InternalIP", cidrs: "10.0.0.0/8", errorExpected: true},
+		{node: annotatedNode, addressType: "InternalIP", cidrs: "10.0.0.0/8", expected: "198.51.100.1"},
+	}
+	for k, tc := range tcs {
+		policy, err := NewEndpointSelectionPolicy(tc.addressType, tc.ipFamily, tc.cidrs)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("TestGetNodeEndpointIp().Test%d: Could not create policy, got error %s", k, err))
+		}
+		ip, err := GetNodeEndpointIp(tc.node, policy)
+		if tc.errorExpected != (err != nil) {
+			t.Fatal(fmt.Sprintf("GetNodeEndpointIp(%s) - Test %d: Expected to see error: %t. Instead, got: %s",
+				tc.node.Name, k, tc.errorExpected, err))
+		}
+		if !tc.errorExpected && ip.String() != tc.expected {
+			t.Fatal(fmt.Sprintf("GetNodeEndpointIp(%s) - Test %d: Expected to get %s, instead got %s",
+				tc.node.Name, k, tc.expected, ip.String()))
+		}
+	}
+}
+
 func TestGetInnerToOuterIp(t *testing.T) {
 	tcs := []struct {
 		outerIp            string
@@ -76,6 +146,64 @@ func TestGetPodCidr(t *testing.T) {
 	if podCidr["ipv6"] != "2000::3/64" {
 		t.Fatal(fmt.Sprintf("GetPodCidr(testdata.MasterNode0)[ipv6]: Expected to get 2000::3/64, instead got %s", podCidr["ipv6"]))
 	}
+
+	// the allocated pod CIDRs are used if the node has none
+	allocated := testdata.WorkerNode0.DeepCopy()
+	allocated.Spec.PodCIDR, allocated.Spec.PodCIDRs = "", nil
+	allocated.Annotations[PodCidrsAnnotation] = "10.96.0.0/24,fd00:96::/64"
+	podCidr, err = GetPodCidr(allocated)
+	if err != nil || podCidr["ipv4"] != "10.96.0.0/24" || podCidr["ipv6"] != "fd00:96::/64" {
+		t.Fatal(fmt.Sprintf("GetPodCidr(allocated): Expected to get the annotated pod CIDRs, instead got %v, %v", podCidr, err))
+	}
+	// the node's own pod CIDRs take precedence
+	allocated.Spec.PodCIDR = "10.245.3.0/24"
+	if podCidrs := GetPodCidrs(allocated); len(podCidrs) != 1 || podCidrs[0] != "10.245.3.0/24" {
+		t.Fatal(fmt.Sprintf("GetPodCidrs(allocated): Expected to get 10.245.3.0/24, instead got %v", podCidrs))
+	}
+	allocated.Spec.PodCIDR = ""
+	delete(allocated.Annotations, PodCidrsAnnotation)
+	if _, err := GetPodCidr(allocated); err == nil {
+		t.Fatal("GetPodCidr(allocated): Expected an error for a node without pod CIDR")
+	}
+}
+
+func TestNormalizeCidr(t *testing.T) {
+	tcs := []struct {
+		in  string
+		out string
+	}{
+		{in: "192.0.2.10", out: "192.0.2.10/32"},
+		{in: "2001:db8::1", out: "2001:db8::1/128"},
+		{in: "192.168.10.5/24", out: "192.168.10.0/24"},
+		{in: "default", out: "default"},
+	}
+	for _, tc := range tcs {
+		out := NormalizeCidr(tc.in)
+		if out != tc.out {
+			t.Fatal(fmt.Sprintf("NormalizeCidr(%s): Expected %s, got %s", tc.in, tc.out, out))
+		}
+	}
+}
+
+func TestCidrsOverlap(t *testing.T) {
+	tcs := []struct {
+		a        string
+		b        string
+		expected bool
+	}{
+		{a: "10.245.0.0/16", b: "10.245.3.0/24", expected: true},
+		{a: "10.245.3.0/24", b: "10.245.0.0/16", expected: true},
+		{a: "10.245.3.0/24", b: "10.245.4.0/24", expected: false},
+		{a: "10.245.3.10", b: "10.245.3.0/24", expected: true},
+		{a: "2000::/64", b: "10.245.3.0/24", expected: false},
+		{a: "", b: "10.245.3.0/24", expected: false},
+	}
+	for _, tc := range tcs {
+		out := CidrsOverlap(tc.a, tc.b)
+		if out != tc.expected {
+			t.Fatal(fmt.Sprintf("CidrsOverlap(%s, %s): Expected %t, got %t", tc.a, tc.b, tc.expected, out))
+		}
+	}
 }
 
 func TestGetFirstNetworkAddress(t *testing.T) {
@@ -218,3 +346,38 @@ func TestGetInterfaceToIp(t *testing.T) {
 		t.Fatal(fmt.Sprintf("GetInterfaceToIp(%s): Expected to get interface name %s, instead got %s", ipAddress, expectedInterface, intf))
 	}
 }
+
+func TestCommandRecorder(t *testing.T) {
+	r := NewCommandRecorder(map[string]string{
+		"ip netns":                            "default\n",
+		"ip netns exec wireguard ip route ls": "exec\n",
+	})
+	restore := r.Install()
+	defer restore()
+
+	tcs := []struct {
+		cmd    string
+		output string
+	}{
+		{cmd: "ip netns", output: "default\n"},
+		{cmd: "ip netns exec wireguard ip route ls", output: "exec\n"},
+		{cmd: "ip netns exec wireguard ip link ls", output: ""},
+		{cmd: "iptables -t nat -S", output: ""},
+	}
+	for k, tc := range tcs {
+		out, err := RunCommandWithOutput(tc.cmd, "TestCommandRecorder")
+		if err != nil || string(out) != tc.output {
+			t.Fatal(fmt.Sprintf("CommandRecorder - Test %d: Expected output %q, got %q and error %v", k, tc.output, out, err))
+		}
+	}
+	if err := RunCommand("ip link ls", "TestCommandRecorder"); err != nil {
+		t.Fatal(err)
+	}
+	if r.Count() != 5 || r.Commands()[4] != "ip link ls" {
+		t.Fatal(fmt.Sprintf("CommandRecorder: Expected 5 recorded commands, got %v", r.Commands()))
+	}
+	r.Reset()
+	if r.Count() != 0 {
+		t.Fatal(fmt.Sprintf("CommandRecorder: Expected no commands after Reset(), got %v", r.Commands()))
+	}
+}
@@ -0,0 +1,158 @@
+package wgk8s
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/config"
+	"github.com/andreaskaris/wireguard-kubernetes/controller/testdata"
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+	"github.com/andreaskaris/wireguard-kubernetes/controller/wireguard"
+)
+
+// benchmarkSizes are the numbers of nodes of the benchmarks.
+var benchmarkSizes = []int{100, 1000, 5000}
+
+// newBenchmarkController returns a controller for a fake cluster with the local node and n generated nodes. All
+// commands are recorded by the returned recorder. The controller is not started.
+func newBenchmarkController(b *testing.B, n int) (*Controller, []*corev1.Node, *utils.CommandRecorder) {
+	wireguard.RuntimeDir = b.TempDir()
+	recorder := utils.NewCommandRecorder(map[string]string{"ip netns": "wireguard-kubernetes\n"})
+	b.Cleanup(recorder.Install())
+
+	keyDir := b.TempDir()
+	if err := os.WriteFile(path.Join(keyDir, "private"), []byte("private"), 0600); err != nil {
+		b.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(keyDir, "public"), []byte("public\n"), 0600); err != nil {
+		b.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Hostname = "worker-local"
+	cfg.Wireguard.PrivateKey = path.Join(keyDir, "private")
+	cfg.Wireguard.PublicKey = path.Join(keyDir, "public")
+	cfg.Link.Uplink = "eth0"
+	*cfg.Peers.StaticPeersConfigMap = ""
+	cfg.State.Directory = b.TempDir()
+
+	nodes := testdata.GenerateWorkerNodes(n)
+	objects := []runtime.Object{testdata.WorkerNodeLocal.DeepCopy()}
+	for _, node := range nodes {
+		objects = append(objects, node)
+	}
+	controller, err := NewController(Options{Clientset: fake.NewSimpleClientset(objects...), Config: cfg})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return controller, nodes, recorder
+}
+
+// resyncEvent returns the resync event of the nodes resource for nodes.
+func resyncEvent(nodes []*corev1.Node) resourceEvent {
+	objects := make([]runtime.Object, 0, len(nodes))
+	for _, node := range nodes {
+		objects = append(objects, node)
+	}
+	return resourceEvent{resource: nodesResource, resync: true, objects: objects}
+}
+
+// BenchmarkControllerInitialSync measures the start of the controller until the initial sync is done: the setup of
+// the data plane, the list and watch of all nodes and the full sync of all peers and routes.
+func BenchmarkControllerInitialSync(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("nodes=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			commands := 0
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				controller, _, recorder := newBenchmarkController(b, n)
+				ctx, cancel := context.WithCancel(context.Background())
+				errs := make(chan error)
+				b.StartTimer()
+
+				go func() { errs <- controller.Start(ctx) }()
+				if !controller.WaitForSync(ctx) {
+					b.Fatal("Controller did not sync")
+				}
+
+				b.StopTimer()
+				commands += recorder.Count()
+				cancel()
+				if err := <-errs; err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(commands)/float64(b.N), "commands/op")
+		})
+	}
+}
+
+// BenchmarkControllerNodeEvent measures a single node event of the watch loop after the initial sync: a node changes
+// its IP address, the peer list is updated and the change is applied to the tunnel.
+func BenchmarkControllerNodeEvent(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("nodes=%d", n), func(b *testing.B) {
+			controller, nodes, recorder := newBenchmarkController(b, n)
+			if _, err := controller.handleNodes(resyncEvent(nodes)); err != nil {
+				b.Fatal(err)
+			}
+			if err := controller.applyPeerList(); err != nil {
+				b.Fatal(err)
+			}
+			recorder.Reset()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				node := nodes[i%n].DeepCopy()
+				node.Status.Addresses[0].Address = fmt.Sprintf("172.20.%d.%d", i/256%256, i%256)
+				if _, err := controller.handleNodes(resourceEvent{resource: nodesResource, eventType: watch.Modified, object: node}); err != nil {
+					b.Fatal(err)
+				}
+				if err := controller.applyPeerList(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(recorder.Count())/float64(b.N), "commands/op")
+		})
+	}
+}
+
+// BenchmarkControllerResync measures a resync of the watch loop, e.g. after the watch of the nodes was closed: all
+// nodes are listed again, but none of them changed.
+func BenchmarkControllerResync(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("nodes=%d", n), func(b *testing.B) {
+			controller, nodes, recorder := newBenchmarkController(b, n)
+			event := resyncEvent(nodes)
+			if _, err := controller.handleNodes(event); err != nil {
+				b.Fatal(err)
+			}
+			if err := controller.applyPeerList(); err != nil {
+				b.Fatal(err)
+			}
+			recorder.Reset()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := controller.handleNodes(event); err != nil {
+					b.Fatal(err)
+				}
+				if err := controller.applyPeerList(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(recorder.Count())/float64(b.N), "commands/op")
+		})
+	}
+}
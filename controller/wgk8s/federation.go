@@ -0,0 +1,253 @@
+package wgk8s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+	"github.com/andreaskaris/wireguard-kubernetes/controller/wireguard"
+)
+
+const (
+	// RemoteClusterLabel marks Secrets which hold the kubeconfig of a remote cluster. The name of the Secret is
+	// used as the name of the remote cluster.
+	RemoteClusterLabel = "wireguard.kubernetes.io/remote-cluster"
+	// RemoteClusterKubeconfigKey is the key of the kubeconfig inside a remote cluster Secret.
+	RemoteClusterKubeconfigKey = "kubeconfig"
+
+	remoteClusterRetryInterval = 10 * time.Second
+)
+
+// remoteClusterEvent reports a change of the nodes of a remote cluster. A resync event holds the full list of
+// nodes of the remote cluster and replaces all peers of that cluster.
+type remoteClusterEvent struct {
+	cluster    string
+	generation int
+	eventType  watch.EventType
+	node       *corev1.Node
+	resync     bool
+	nodes      []corev1.Node
+}
+
+// remoteCluster keeps track of the goroutine which watches the nodes of a remote cluster. Events of a previous
+// generation (e.g. from before the Secret was updated) are discarded.
+type remoteCluster struct {
+	generation      int
+	resourceVersion string
+	cancel          context.CancelFunc
+}
+
+// remoteClusterGeneration is incremented whenever the watch of a remote cluster is (re)started.
+var remoteClusterGeneration int
+
+// remoteClusterSource returns the peer source of all peers of a remote cluster.
+func remoteClusterSource(cluster string) string {
+	return "cluster/" + cluster
+}
+
+// newRemoteClientset creates a clientset for a remote cluster from the contents of its kubeconfig.
+var newRemoteClientset = func(kubeconfig []byte) (kubernetes.Interface, error) {
+	config, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// startRemoteCluster starts watching the remote cluster of the given Secret until ctx is cancelled. A previous watch
+// for the same cluster is stopped.
+func startRemoteCluster(ctx context.Context, remoteClusters map[string]*remoteCluster, secret *corev1.Secret,
+	events chan<- remoteClusterEvent) error {
+	kubeconfig, ok := secret.Data[RemoteClusterKubeconfigKey]
+	if !ok {
+		return fmt.Errorf("Secret %s/%s has no key %s", secret.Namespace, secret.Name, RemoteClusterKubeconfigKey)
+	}
+	clientset, err := newRemoteClientset(kubeconfig)
+	if err != nil {
+		return fmt.Errorf("Cannot create client for remote cluster %s: %v", secret.Name, err)
+	}
+
+	if rc, ok := remoteClusters[secret.Name]; ok {
+		rc.cancel()
+	}
+	remoteClusterGeneration++
+	ctx, cancel := context.WithCancel(ctx)
+	remoteClusters[secret.Name] = &remoteCluster{
+		generation:      remoteClusterGeneration,
+		resourceVersion: secret.ResourceVersion,
+		cancel:          cancel,
+	}
+	go watchRemoteCluster(ctx, secret.Name, remoteClusterGeneration, clientset, events)
+	return nil
+}
+
+// stopRemoteCluster stops watching a remote cluster and removes all of its peers from the peer list.
+func stopRemoteCluster(remoteClusters map[string]*remoteCluster, cluster string, pl *wireguard.PeerList) error {
+	if rc, ok := remoteClusters[cluster]; ok {
+		rc.cancel()
+		delete(remoteClusters, cluster)
+	}
+	for _, p := range pl.ListBySource(remoteClusterSource(cluster)) {
+		if err := pl.Delete(p.PeerHostname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchRemoteCluster lists and watches the nodes of a remote cluster and sends the changes to events until ctx is
+// cancelled. Whenever the watch is closed by the remote API server, it is re-established with a full resync.
+func watchRemoteCluster(ctx context.Context, cluster string, generation int, clientset kubernetes.Interface,
+	events chan<- remoteClusterEvent) {
+	send := func(event remoteClusterEvent) bool {
+		event.cluster = cluster
+		event.generation = generation
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	retry := func() bool {
+		select {
+		case <-time.After(remoteClusterRetryInterval):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			klog.Error("Cannot list nodes of remote cluster ", cluster, ": ", err)
+			if !retry() {
+				return
+			}
+			continue
+		}
+		if !send(remoteClusterEvent{resync: true, nodes: nodes.Items}) {
+			return
+		}
+
+		watcher, err := clientset.CoreV1().Nodes().Watch(ctx, metav1.ListOptions{ResourceVersion: nodes.ResourceVersion})
+		if err != nil {
+			klog.Error("Cannot watch nodes of remote cluster ", cluster, ": ", err)
+			if !retry() {
+				return
+			}
+			continue
+		}
+		for event := range watcher.ResultChan() {
+			node, ok := event.Object.(*corev1.Node)
+			if !ok {
+				continue
+			}
+			if !send(remoteClusterEvent{eventType: event.Type, node: node}) {
+				watcher.Stop()
+				return
+			}
+		}
+		klog.V(5).Info("Watch of remote cluster ", cluster, " was closed, resyncing")
+	}
+}
+
+// handleRemoteClusterEvent applies a remote cluster event to the peer list. Events of stopped or replaced watches
+// are ignored.
+func handleRemoteClusterEvent(remoteClusters map[string]*remoteCluster, event remoteClusterEvent,
+	pl *wireguard.PeerList, endpointPolicy *utils.EndpointSelectionPolicy, listenPort int, localPodCidr string) error {
+	if rc, ok := remoteClusters[event.cluster]; !ok || rc.generation != event.generation {
+		return nil
+	}
+
+	if event.resync {
+		for _, p := range pl.ListBySource(remoteClusterSource(event.cluster)) {
+			if err := pl.Delete(p.PeerHostname); err != nil {
+				return err
+			}
+		}
+		for i := range event.nodes {
+			if err := updateRemotePeer(pl, event.cluster, &event.nodes[i], endpointPolicy, listenPort, localPodCidr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch event.eventType {
+	case watch.Added, watch.Modified:
+		return updateRemotePeer(pl, event.cluster, event.node, endpointPolicy, listenPort, localPodCidr)
+	case watch.Deleted:
+		return pl.Delete(remotePeerHostname(event.cluster, event.node.Name))
+	}
+	return nil
+}
+
+// remotePeerHostname returns the name of the peer of a node of a remote cluster.
+func remotePeerHostname(cluster, nodeName string) string {
+	return cluster + "/" + nodeName
+}
+
+// updateRemotePeer converts a node of a remote cluster into a peer and adds it to the peer list. Peers of remote
+// clusters do not get a tunnel inner IP, as the internal routing networks of the clusters may overlap.
+// Remote nodes are expected to listen on the same wireguard port listenPort as the local nodes.
+// A peer whose pod subnet overlaps the local pod subnet or the subnets of any other peer is refused and removed.
+func updateRemotePeer(pl *wireguard.PeerList, cluster string, node *corev1.Node,
+	endpointPolicy *utils.EndpointSelectionPolicy, listenPort int, localPodCidr string) error {
+	peerHostname := remotePeerHostname(cluster, node.Name)
+	peer, err := nodeToPeer(node, nil, endpointPolicy, listenPort)
+	if err != nil {
+		klog.V(1).Info("Skipping node of remote cluster ", cluster, ": ", err)
+		return pl.Delete(peerHostname)
+	}
+	peer.PeerHostname = peerHostname
+	peer.PeerSource = remoteClusterSource(cluster)
+
+	if err := checkPeerOverlap(pl, peer, localPodCidr); err != nil {
+		klog.Error("Refusing to install peer ", peerHostname, ": ", err)
+		return pl.Delete(peerHostname)
+	}
+	return pl.UpdateOrAdd(peer)
+}
+
+// checkPeerOverlap returns an error if any subnet of peer overlaps the local pod subnet or a subnet of any other
+// peer in the peer list.
+func checkPeerOverlap(pl *wireguard.PeerList, peer *wireguard.Peer, localPodCidr string) error {
+	for _, subnet := range peer.Subnets() {
+		if utils.CidrsOverlap(subnet, localPodCidr) {
+			return fmt.Errorf("Subnet %s overlaps local pod subnet %s", subnet, localPodCidr)
+		}
+		for _, other := range *pl {
+			if other.PeerHostname == peer.PeerHostname {
+				continue
+			}
+			for _, otherSubnet := range other.Subnets() {
+				if utils.CidrsOverlap(subnet, otherSubnet) {
+					return fmt.Errorf("Subnet %s overlaps subnet %s of peer %s", subnet, otherSubnet, other.PeerHostname)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// peersOverlap returns true if any subnet of peer a overlaps a subnet of peer b.
+func peersOverlap(a, b *wireguard.Peer) bool {
+	for _, subnet := range a.Subnets() {
+		for _, otherSubnet := range b.Subnets() {
+			if utils.CidrsOverlap(subnet, otherSubnet) {
+				return true
+			}
+		}
+	}
+	return false
+}
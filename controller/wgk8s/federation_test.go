@@ -0,0 +1,133 @@
+package wgk8s
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/testdata"
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+	"github.com/andreaskaris/wireguard-kubernetes/controller/wireguard"
+)
+
+func TestHandleRemoteClusterEvent(t *testing.T) {
+	endpointPolicy, err := utils.NewEndpointSelectionPolicy("InternalIP", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlappingNode := testdata.WorkerNode2.DeepCopy()
+	overlappingNode.Name = "worker-overlap"
+	overlappingNode.Spec.PodCIDRs = []string{"10.245.6.0/25"}
+
+	remoteClusters := map[string]*remoteCluster{
+		"cluster-b": &remoteCluster{generation: 2, cancel: func() {}},
+	}
+	pl := wireguard.NewPeerList()
+	pl.UpdateOrAdd(&wireguard.Peer{PeerHostname: "master-0", PeerPodSubnet: "10.245.0.0/24"})
+
+	tcs := []struct {
+		event    remoteClusterEvent
+		expected []string
+	}{
+		{
+			// events of older generations are ignored
+			event: remoteClusterEvent{cluster: "cluster-b", generation: 1, resync: true,
+				nodes: []corev1.Node{*testdata.WorkerNode0}},
+			expected: []string{"master-0"},
+		},
+		{
+			// master-1 of the remote cluster overlaps the local master-0 peer, worker-overlap overlaps the local pod cidr
+			event: remoteClusterEvent{cluster: "cluster-b", generation: 2, resync: true,
+				nodes: []corev1.Node{*testdata.WorkerNode0, *testdata.WorkerNode1, *overlappingNode, *testdata.MasterNode0}},
+			expected: []string{"master-0", "cluster-b/worker-0", "cluster-b/worker-1"},
+		},
+		{
+			event:    remoteClusterEvent{cluster: "cluster-b", generation: 2, eventType: watch.Deleted, node: testdata.WorkerNode1},
+			expected: []string{"master-0", "cluster-b/worker-0"},
+		},
+		{
+			event:    remoteClusterEvent{cluster: "cluster-b", generation: 2, resync: true, nodes: []corev1.Node{*testdata.WorkerNode2}},
+			expected: []string{"master-0", "cluster-b/worker-2"},
+		},
+	}
+
+	for k, tc := range tcs {
+		err := handleRemoteClusterEvent(remoteClusters, tc.event, pl, endpointPolicy, 10000, "10.245.6.0/24")
+		if err != nil {
+			t.Fatal(fmt.Sprintf("handleRemoteClusterEvent() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		if len(*pl) != len(tc.expected) {
+			t.Fatal(fmt.Sprintf("handleRemoteClusterEvent() - Test %d: Expected peers %v, got %v", k, tc.expected, *pl))
+		}
+		for _, hostname := range tc.expected {
+			if _, err := pl.Get(hostname); err != nil {
+				t.Fatal(fmt.Sprintf("handleRemoteClusterEvent() - Test %d: Expected peers %v, got %v", k, tc.expected, *pl))
+			}
+		}
+	}
+
+	peer, _ := pl.Get("cluster-b/worker-2")
+	if peer.PeerInnerIp != nil || peer.PeerSource != "cluster/cluster-b" {
+		t.Fatal(fmt.Sprintf("handleRemoteClusterEvent(): Expected remote peer without inner IP and with source cluster/cluster-b, got %v", *peer))
+	}
+
+	err = stopRemoteCluster(remoteClusters, "cluster-b", pl)
+	if err != nil {
+		t.Fatal(fmt.Sprintf("stopRemoteCluster(): Expected to return nil error, instead got %s", err))
+	}
+	if len(*pl) != 1 || len(remoteClusters) != 0 {
+		t.Fatal(fmt.Sprintf("stopRemoteCluster(): Expected only peer master-0 and no remote clusters, got %v and %v", *pl, remoteClusters))
+	}
+}
+
+func TestWatchRemoteCluster(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testdata.WorkerNode0)
+	newRemoteClientset = func(kubeconfig []byte) (kubernetes.Interface, error) {
+		return clientset, nil
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-b", Namespace: "wireguard-kubernetes"},
+		Data:       map[string][]byte{RemoteClusterKubeconfigKey: []byte("kubeconfig")},
+	}
+
+	remoteClusters := map[string]*remoteCluster{}
+	events := make(chan remoteClusterEvent)
+	if err := startRemoteCluster(context.Background(), remoteClusters, secret, events); err != nil {
+		t.Fatal(fmt.Sprintf("startRemoteCluster(): Expected to return nil error, instead got %s", err))
+	}
+	defer remoteClusters["cluster-b"].cancel()
+
+	receive := func() remoteClusterEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("watchRemoteCluster(): Timed out waiting for event")
+		}
+		return remoteClusterEvent{}
+	}
+
+	event := receive()
+	if !event.resync || len(event.nodes) != 1 || event.nodes[0].Name != "worker-0" {
+		t.Fatal(fmt.Sprintf("watchRemoteCluster(): Expected resync event with node worker-0, got %v", event))
+	}
+
+	_, err := clientset.CoreV1().Nodes().Create(context.TODO(), testdata.WorkerNode1, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event = receive()
+	if event.eventType != watch.Added || event.node.Name != "worker-1" || event.cluster != "cluster-b" {
+		t.Fatal(fmt.Sprintf("watchRemoteCluster(): Expected added event for node worker-1, got %v", event))
+	}
+	if event.generation != remoteClusters["cluster-b"].generation {
+		t.Fatal(fmt.Sprintf("watchRemoteCluster(): Expected generation %d, got %d", remoteClusters["cluster-b"].generation, event.generation))
+	}
+}
@@ -0,0 +1,101 @@
+package wgk8s
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// listWatchRetryInterval is the time to wait before a failed list or watch is retried.
+var listWatchRetryInterval = 10 * time.Second
+
+// resourceEvent reports a change of a watched resource. A resync event holds the full list of objects and replaces
+// all objects which were reported before.
+type resourceEvent struct {
+	resource  string
+	eventType watch.EventType
+	object    runtime.Object
+	resync    bool
+	objects   []runtime.Object
+}
+
+// listWatch lists and watches a resource and sends the changes to events until ctx is cancelled. The watch is
+// established before the resync event is sent, so no change after the resync is missed. Whenever the watch is closed,
+// it is re-established with a full resync.
+func listWatch(ctx context.Context, resource string, lw *cache.ListWatch, events chan<- resourceEvent) {
+	send := func(event resourceEvent) bool {
+		event.resource = resource
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	retry := func() bool {
+		select {
+		case <-time.After(listWatchRetryInterval):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		list, err := lw.List(metav1.ListOptions{})
+		if err != nil {
+			klog.Error("Cannot list ", resource, ": ", err)
+			if !retry() {
+				return
+			}
+			continue
+		}
+		objects, err := meta.ExtractList(list)
+		if err != nil {
+			klog.Error("Cannot extract list of ", resource, ": ", err)
+			if !retry() {
+				return
+			}
+			continue
+		}
+		listMeta, err := meta.ListAccessor(list)
+		if err != nil {
+			klog.Error("Cannot read list metadata of ", resource, ": ", err)
+			if !retry() {
+				return
+			}
+			continue
+		}
+
+		watcher, err := lw.Watch(metav1.ListOptions{ResourceVersion: listMeta.GetResourceVersion()})
+		if err != nil {
+			klog.Error("Cannot watch ", resource, ": ", err)
+			if !retry() {
+				return
+			}
+			continue
+		}
+		if !send(resourceEvent{resync: true, objects: objects}) {
+			watcher.Stop()
+			return
+		}
+		for event := range watcher.ResultChan() {
+			if event.Type == watch.Error {
+				klog.V(5).Info("Watch of ", resource, " returned an error: ", event.Object)
+				break
+			}
+			if !send(resourceEvent{eventType: event.Type, object: event.Object}) {
+				watcher.Stop()
+				return
+			}
+		}
+		watcher.Stop()
+		klog.V(5).Info("Watch of ", resource, " was closed, resyncing")
+	}
+}
@@ -0,0 +1,29 @@
+package wgk8s
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Results of a reconciliation of the data plane.
+const (
+	reconcileResultInSync   = "in_sync"
+	reconcileResultRepaired = "repaired"
+	reconcileResultError    = "error"
+)
+
+var (
+	// driftsTotal counts the differences between the desired and the actual data plane, by component.
+	driftsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wgk8s_data_plane_drifts_total",
+		Help: "Number of detected differences between the desired and the actual data plane, by component.",
+	}, []string{"component"})
+	// reconcilesTotal counts the reconciliations of the data plane, by result.
+	reconcilesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wgk8s_data_plane_reconciles_total",
+		Help: "Number of reconciliations of the data plane, by result (in_sync, repaired or error).",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(driftsTotal, reconcilesTotal)
+}
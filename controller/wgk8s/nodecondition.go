@@ -0,0 +1,62 @@
+package wgk8s
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// NodeConditionType is the type of the node condition which reports the state of the node's wireguard data plane.
+	NodeConditionType corev1.NodeConditionType = "WireguardReady"
+
+	// NodeConditionReasonSynced means that the agent configured all peers of the node.
+	NodeConditionReasonSynced = "PeersSynced"
+	// NodeConditionReasonAgentStopped means that the agent stopped and left the data plane running. The peers are not
+	// updated until the next agent starts.
+	NodeConditionReasonAgentStopped = "AgentStopped"
+	// NodeConditionReasonTornDown means that the agent stopped and removed the data plane.
+	NodeConditionReasonTornDown = "DataPlaneRemoved"
+)
+
+// setNodeCondition sets the wireguard condition of the node. The transition time is only updated if the status
+// changes.
+func setNodeCondition(ctx context.Context, clientset kubernetes.Interface, nodeName string,
+	status corev1.ConditionStatus, reason, message string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		now := metav1.Now()
+		condition := corev1.NodeCondition{
+			Type:               NodeConditionType,
+			Status:             status,
+			LastHeartbeatTime:  now,
+			LastTransitionTime: now,
+			Reason:             reason,
+			Message:            message,
+		}
+		found := false
+		for i, c := range node.Status.Conditions {
+			if c.Type != NodeConditionType {
+				continue
+			}
+			if c.Status == status {
+				condition.LastTransitionTime = c.LastTransitionTime
+			}
+			node.Status.Conditions[i] = condition
+			found = true
+		}
+		if !found {
+			node.Status.Conditions = append(node.Status.Conditions, condition)
+		}
+
+		_, err = clientset.CoreV1().Nodes().UpdateStatus(ctx, node, metav1.UpdateOptions{})
+		return err
+	})
+}
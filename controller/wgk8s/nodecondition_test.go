@@ -0,0 +1,46 @@
+package wgk8s
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/testdata"
+)
+
+func TestSetNodeCondition(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testdata.WorkerNode0.DeepCopy())
+
+	tcs := []struct {
+		status corev1.ConditionStatus
+		reason string
+	}{
+		{status: corev1.ConditionTrue, reason: NodeConditionReasonSynced},
+		{status: corev1.ConditionTrue, reason: NodeConditionReasonSynced},
+		{status: corev1.ConditionFalse, reason: NodeConditionReasonAgentStopped},
+	}
+	for k, tc := range tcs {
+		err := setNodeCondition(context.TODO(), clientset, "worker-0", tc.status, tc.reason, "")
+		if err != nil {
+			t.Fatal(fmt.Sprintf("setNodeCondition() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		node, err := clientset.CoreV1().Nodes().Get(context.TODO(), "worker-0", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var conditions []corev1.NodeCondition
+		for _, c := range node.Status.Conditions {
+			if c.Type == NodeConditionType {
+				conditions = append(conditions, c)
+			}
+		}
+		if len(conditions) != 1 || conditions[0].Status != tc.status || conditions[0].Reason != tc.reason {
+			t.Fatal(fmt.Sprintf("setNodeCondition() - Test %d: Expected one condition with status %s and reason %s, got %v",
+				k, tc.status, tc.reason, conditions))
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package wgk8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/config"
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+// podCidrAllocationBackoff is the backoff between conflicting updates of the allocations ConfigMap. All agents start
+// at the same time when the DaemonSet is rolled out, so more retries than retry.DefaultRetry are allowed.
+var podCidrAllocationBackoff = wait.Backoff{
+	Steps:    20,
+	Duration: 10 * time.Millisecond,
+	Factor:   1.5,
+	Jitter:   1,
+	Cap:      2 * time.Second,
+}
+
+// allocatePodCidrs allocates pod CIDRs from the cluster CIDRs of cfg to node nodeName, unless the node has pod CIDRs
+// in its spec. The allocations of all nodes are recorded in a ConfigMap, one key per node, which is updated with
+// optimistic concurrency: agents which allocate at the same time conflict, and the losers retry with the updated
+// allocations, so that no CIDR is allocated twice. The allocated CIDRs are then set in the annotation
+// utils.PodCidrsAnnotation of the node.
+func allocatePodCidrs(ctx context.Context, clientset kubernetes.Interface, nodeName string,
+	cfg config.PodCidrAllocationConfiguration) error {
+	node, err := clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("Cannot retrieve information about local node: %v", err)
+	}
+	if len(node.Spec.PodCIDRs) > 0 || node.Spec.PodCIDR != "" {
+		return nil
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(cfg.ConfigMap)
+	if err != nil {
+		return fmt.Errorf("Cannot parse pod CIDR allocations ConfigMap name: %v", err)
+	}
+
+	var podCidrs string
+	isConflict := func(err error) bool { return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) }
+	err = retry.OnError(podCidrAllocationBackoff, isConflict, func() error {
+		configMaps := clientset.CoreV1().ConfigMaps(namespace)
+		cm, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm, err = configMaps.Create(ctx, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}},
+				metav1.CreateOptions{})
+		}
+		if err != nil {
+			return err
+		}
+		nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+
+		allocations, err := allocate(cfg, nodeName, cm.Data, nodes.Items)
+		if err != nil {
+			return err
+		}
+		podCidrs = allocations[nodeName]
+		if podCidrs == cm.Data[nodeName] && len(allocations) == len(cm.Data) {
+			return nil
+		}
+		cm.Data = allocations
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot allocate pod CIDRs: %v", err)
+	}
+
+	if node.Annotations[utils.PodCidrsAnnotation] == podCidrs {
+		return nil
+	}
+	klog.Info("Allocated pod CIDRs ", podCidrs, " to node ", nodeName)
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{utils.PodCidrsAnnotation: podCidrs},
+		},
+	})
+	if _, err := clientset.CoreV1().Nodes().Patch(ctx, nodeName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("Cannot add pod CIDRs annotation to node: %v", err)
+	}
+	return nil
+}
+
+// allocate returns the pod CIDR allocations of all nodes, by node name, after allocating pod CIDRs to node nodeName.
+// allocations are the current allocations. The allocations of nodes which no longer exist are released. A node keeps
+// its current allocation, or else its annotated pod CIDRs if they are still free. Pod CIDRs which are in use by any
+// other node, e.g. in its spec, are never allocated.
+func allocate(cfg config.PodCidrAllocationConfiguration, nodeName string, allocations map[string]string,
+	nodes []corev1.Node) (map[string]string, error) {
+	updated := map[string]string{}
+	var used []*net.IPNet
+	var annotated []string
+	for _, node := range nodes {
+		if node.Name == nodeName {
+			annotated = utils.GetPodCidrs(&node)
+			continue
+		}
+		podCidrs := utils.GetPodCidrs(&node)
+		if cidrs, ok := allocations[node.Name]; ok {
+			updated[node.Name] = cidrs
+			podCidrs = append(podCidrs, strings.Split(cidrs, ",")...)
+		}
+		for _, cidr := range podCidrs {
+			if _, subnet, err := net.ParseCIDR(cidr); err == nil {
+				used = append(used, subnet)
+			}
+		}
+	}
+	if cidrs, ok := allocations[nodeName]; ok {
+		updated[nodeName] = cidrs
+		return updated, nil
+	}
+
+	var podCidrs []string
+	for _, clusterCidr := range cfg.ClusterCidrs {
+		_, clusterNet, err := net.ParseCIDR(clusterCidr)
+		if err != nil {
+			return nil, err
+		}
+		maskSize := cfg.NodeMaskSizeIpv6
+		if clusterNet.IP.To4() != nil {
+			maskSize = cfg.NodeMaskSizeIpv4
+		}
+		podCidr := reusablePodCidr(clusterNet, maskSize, annotated, used)
+		if podCidr == nil {
+			if podCidr, err = freePodCidr(clusterNet, maskSize, used); err != nil {
+				return nil, err
+			}
+		}
+		podCidrs = append(podCidrs, podCidr.String())
+	}
+	updated[nodeName] = strings.Join(podCidrs, ",")
+	return updated, nil
+}
+
+// reusablePodCidr returns the CIDR of annotated which is a free subnet of clusterNet with mask size maskSize, if any.
+func reusablePodCidr(clusterNet *net.IPNet, maskSize int, annotated []string, used []*net.IPNet) *net.IPNet {
+	for _, cidr := range annotated {
+		ip, subnet, err := net.ParseCIDR(cidr)
+		if err != nil || !ip.Equal(subnet.IP) || !clusterNet.Contains(ip) {
+			continue
+		}
+		if ones, _ := subnet.Mask.Size(); ones == maskSize && !overlapsAny(subnet, used) {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// freePodCidr returns the first subnet of clusterNet with mask size maskSize which does not overlap with used.
+func freePodCidr(clusterNet *net.IPNet, maskSize int, used []*net.IPNet) (*net.IPNet, error) {
+	ones, bits := clusterNet.Mask.Size()
+	ip := clusterNet.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	base := new(big.Int).SetBytes(ip)
+	step := new(big.Int).Lsh(big.NewInt(1), uint(bits-maskSize))
+	count := new(big.Int).Lsh(big.NewInt(1), uint(maskSize-ones))
+	for i := big.NewInt(0); i.Cmp(count) < 0; i.Add(i, big.NewInt(1)) {
+		b := new(big.Int).Add(base, new(big.Int).Mul(i, step)).Bytes()
+		candidate := &net.IPNet{IP: make(net.IP, len(ip)), Mask: net.CIDRMask(maskSize, bits)}
+		copy(candidate.IP[len(ip)-len(b):], b)
+		if !overlapsAny(candidate, used) {
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("No free /%d pod CIDR in cluster CIDR %s", maskSize, clusterNet)
+}
+
+// overlapsAny returns true if subnet overlaps with any of the subnets of used.
+func overlapsAny(subnet *net.IPNet, used []*net.IPNet) bool {
+	for _, u := range used {
+		if u.Contains(subnet.IP) || subnet.Contains(u.IP) {
+			return true
+		}
+	}
+	return false
+}
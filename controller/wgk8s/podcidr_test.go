@@ -0,0 +1,204 @@
+package wgk8s
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/config"
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+// testPodCidrAllocation is the dual-stack pod CIDR allocation configuration of the tests.
+var testPodCidrAllocation = config.PodCidrAllocationConfiguration{
+	ClusterCidrs:     []string{"10.96.0.0/22", "fd00:96::/48"},
+	NodeMaskSizeIpv4: 24,
+	NodeMaskSizeIpv6: 64,
+	ConfigMap:        "wireguard-kubernetes/pod-cidr-allocations",
+}
+
+// nodeWithoutPodCidr returns a node without pod CIDRs in its spec, optionally annotated with podCidrs.
+func nodeWithoutPodCidr(name, podCidrs string) *corev1.Node {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{}}}
+	if podCidrs != "" {
+		node.Annotations[utils.PodCidrsAnnotation] = podCidrs
+	}
+	return node
+}
+
+func TestAllocate(t *testing.T) {
+	nodeWithSpec := nodeWithoutPodCidr("worker-spec", "")
+	nodeWithSpec.Spec.PodCIDR = "10.96.0.0/24"
+
+	tcs := []struct {
+		nodes       []corev1.Node
+		allocations map[string]string
+		expected    map[string]string
+		expectedErr bool
+	}{
+		{
+			// pod CIDRs in the spec of other nodes are not allocated
+			nodes:    []corev1.Node{*nodeWithoutPodCidr("worker-0", ""), *nodeWithSpec},
+			expected: map[string]string{"worker-0": "10.96.1.0/24,fd00:96::/64"},
+		},
+		{
+			// allocations of deleted nodes are released
+			nodes:       []corev1.Node{*nodeWithoutPodCidr("worker-0", ""), *nodeWithoutPodCidr("worker-1", "")},
+			allocations: map[string]string{"worker-1": "10.96.0.0/24,fd00:96::/64", "worker-2": "10.96.1.0/24"},
+			expected:    map[string]string{"worker-0": "10.96.1.0/24,fd00:96:0:1::/64", "worker-1": "10.96.0.0/24,fd00:96::/64"},
+		},
+		{
+			// the current allocation is kept
+			nodes:       []corev1.Node{*nodeWithoutPodCidr("worker-0", "10.96.2.0/24")},
+			allocations: map[string]string{"worker-0": "10.96.3.0/24,fd00:96:0:3::/64"},
+			expected:    map[string]string{"worker-0": "10.96.3.0/24,fd00:96:0:3::/64"},
+		},
+		{
+			// annotated pod CIDRs are reused if they are free, e.g. after the ConfigMap was deleted
+			nodes:    []corev1.Node{*nodeWithoutPodCidr("worker-0", "10.96.2.0/24,fd00:96:0:2::/64")},
+			expected: map[string]string{"worker-0": "10.96.2.0/24,fd00:96:0:2::/64"},
+		},
+		{
+			// but not if another node uses them
+			nodes: []corev1.Node{
+				*nodeWithoutPodCidr("worker-0", "10.96.2.0/24,fd00:96:0:2::/64"),
+				*nodeWithoutPodCidr("worker-1", "10.96.2.0/24"),
+			},
+			allocations: map[string]string{"worker-1": "10.96.2.0/24"},
+			expected:    map[string]string{"worker-0": "10.96.0.0/24,fd00:96:0:2::/64", "worker-1": "10.96.2.0/24"},
+		},
+		{
+			// the cluster CIDR is exhausted
+			nodes: []corev1.Node{
+				*nodeWithoutPodCidr("worker-0", ""),
+				*nodeWithoutPodCidr("worker-1", ""),
+				*nodeWithoutPodCidr("worker-2", ""),
+			},
+			allocations: map[string]string{"worker-1": "10.96.0.0/23", "worker-2": "10.96.2.0/23"},
+			expectedErr: true,
+		},
+	}
+
+	for k, tc := range tcs {
+		allocations, err := allocate(testPodCidrAllocation, "worker-0", tc.allocations, tc.nodes)
+		if (err != nil) != tc.expectedErr {
+			t.Fatal(fmt.Sprintf("allocate() - Test %d: Expected error %t, got %v", k, tc.expectedErr, err))
+		}
+		if err == nil && fmt.Sprint(allocations) != fmt.Sprint(tc.expected) {
+			t.Fatal(fmt.Sprintf("allocate() - Test %d: Expected %v, got %v", k, tc.expected, allocations))
+		}
+	}
+}
+
+// enforceResourceVersions makes the fake clientset reject updates of ConfigMaps with an outdated resource version,
+// like the API server does.
+func enforceResourceVersions(clientset *fake.Clientset) {
+	var mutex sync.Mutex
+	gvr := corev1.SchemeGroupVersion.WithResource("configmaps")
+	clientset.PrependReactor("*", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch action.GetVerb() {
+		case "create":
+			cm := action.(k8stesting.CreateAction).GetObject().(*corev1.ConfigMap).DeepCopy()
+			cm.ResourceVersion = "1"
+			return true, cm, clientset.Tracker().Create(gvr, cm, cm.Namespace)
+		case "update":
+			cm := action.(k8stesting.UpdateAction).GetObject().(*corev1.ConfigMap).DeepCopy()
+			current, err := clientset.Tracker().Get(gvr, cm.Namespace, cm.Name)
+			if err != nil {
+				return true, nil, err
+			}
+			if current.(*corev1.ConfigMap).ResourceVersion != cm.ResourceVersion {
+				return true, nil, apierrors.NewConflict(gvr.GroupResource(), cm.Name, fmt.Errorf("outdated resource version"))
+			}
+			version, _ := strconv.Atoi(cm.ResourceVersion)
+			cm.ResourceVersion = strconv.Itoa(version + 1)
+			return true, cm, clientset.Tracker().Update(gvr, cm, cm.Namespace)
+		case "get":
+			obj, err := clientset.Tracker().Get(gvr, action.GetNamespace(), action.(k8stesting.GetAction).GetName())
+			return true, obj, err
+		}
+		return false, nil, nil
+	})
+}
+
+func TestAllocatePodCidrs(t *testing.T) {
+	// agents of all nodes allocate at the same time
+	var nodes []runtime.Object
+	for i := 0; i < 10; i++ {
+		nodes = append(nodes, nodeWithoutPodCidr(fmt.Sprintf("worker-%d", i), ""))
+	}
+	clientset := fake.NewSimpleClientset(nodes...)
+	enforceResourceVersions(clientset)
+	// make the agents interleave between reading and updating the allocations
+	clientset.PrependReactor("list", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		time.Sleep(5 * time.Millisecond)
+		return false, nil, nil
+	})
+	cfg := testPodCidrAllocation
+	cfg.ClusterCidrs = []string{"10.96.0.0/16"}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(nodes))
+	for i := range nodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- allocatePodCidrs(context.TODO(), clientset, fmt.Sprintf("worker-%d", i), cfg)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(fmt.Sprintf("allocatePodCidrs(): Expected to return nil error, instead got %s", err))
+		}
+	}
+
+	allocated := map[string]string{}
+	for i := range nodes {
+		node, err := clientset.CoreV1().Nodes().Get(context.TODO(), fmt.Sprintf("worker-%d", i), metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		podCidr, err := utils.GetPodCidr(node)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("allocatePodCidrs(): Expected node %s to be annotated, got %v", node.Name, err))
+		}
+		if other, ok := allocated[podCidr["ipv4"]]; ok {
+			t.Fatal(fmt.Sprintf("allocatePodCidrs(): Expected unique pod CIDRs, got %s for %s and %s", podCidr["ipv4"], other, node.Name))
+		}
+		allocated[podCidr["ipv4"]] = node.Name
+	}
+	cm, err := clientset.CoreV1().ConfigMaps("wireguard-kubernetes").Get(context.TODO(), "pod-cidr-allocations", metav1.GetOptions{})
+	if err != nil || len(cm.Data) != len(nodes) {
+		t.Fatal(fmt.Sprintf("allocatePodCidrs(): Expected the ConfigMap to record %d allocations, got %v (%v)", len(nodes), cm, err))
+	}
+
+	// a restarted agent keeps its pod CIDR, nodes with pod CIDRs in their spec are left alone
+	version := cm.ResourceVersion
+	if err := allocatePodCidrs(context.TODO(), clientset, "worker-0", cfg); err != nil {
+		t.Fatal(err)
+	}
+	node := nodeWithoutPodCidr("worker-spec", "")
+	node.Spec.PodCIDR = "10.245.0.0/24"
+	clientset.CoreV1().Nodes().Create(context.TODO(), node, metav1.CreateOptions{})
+	if err := allocatePodCidrs(context.TODO(), clientset, "worker-spec", cfg); err != nil {
+		t.Fatal(err)
+	}
+	cm, _ = clientset.CoreV1().ConfigMaps("wireguard-kubernetes").Get(context.TODO(), "pod-cidr-allocations", metav1.GetOptions{})
+	if cm.ResourceVersion != version {
+		t.Fatal(fmt.Sprintf("allocatePodCidrs(): Expected the allocations to be unchanged, got %v", cm.Data))
+	}
+}
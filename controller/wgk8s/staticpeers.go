@@ -0,0 +1,110 @@
+package wgk8s
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/wireguard"
+)
+
+// StaticPeerSpec is the configuration of a wireguard peer which is not a Kubernetes node, e.g. a bare-metal host,
+// a VM subnet or a site router. Each key of the static peers ConfigMap holds one StaticPeerSpec in YAML or JSON
+// format, and the key is used as the name of the peer:
+//
+//	database: |
+//	  publicKey: bDOPiAaYvtq1y+7+u75t1QYhogY4cuLo02jPhjNM+FA=
+//	  endpoint: 192.0.2.10:51820
+//	  allowedIps:
+//	  - 192.0.2.10/32
+type StaticPeerSpec struct {
+	PublicKey  string   `json:"publicKey"`
+	Endpoint   string   `json:"endpoint"`
+	AllowedIps []string `json:"allowedIps"`
+}
+
+// ParseStaticPeers converts the contents of the static peers ConfigMap into a list of peers. If any of the entries
+// is invalid, an error is returned and none of the peers should be applied.
+func ParseStaticPeers(cm *corev1.ConfigMap) ([]*wireguard.Peer, error) {
+	var names []string
+	for name := range cm.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var peers []*wireguard.Peer
+	for _, name := range names {
+		spec := StaticPeerSpec{}
+		if err := yaml.UnmarshalStrict([]byte(cm.Data[name]), &spec); err != nil {
+			return nil, fmt.Errorf("Cannot parse static peer %s: %v", name, err)
+		}
+		peer, err := spec.toPeer(name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid static peer %s: %v", name, err)
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// toPeer validates the spec and converts it into a peer with the given name.
+func (spec *StaticPeerSpec) toPeer(name string) (*wireguard.Peer, error) {
+	key, err := base64.StdEncoding.DecodeString(spec.PublicKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Invalid public key %s", spec.PublicKey)
+	}
+
+	host, port, err := net.SplitHostPort(spec.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid endpoint %s: %v", spec.Endpoint, err)
+	}
+	outerIp := net.ParseIP(host)
+	if outerIp == nil {
+		return nil, fmt.Errorf("Invalid endpoint IP %s", host)
+	}
+	outerPort, err := strconv.Atoi(port)
+	if err != nil || outerPort < 1 || outerPort > 65535 {
+		return nil, fmt.Errorf("Invalid endpoint port %s", port)
+	}
+
+	if len(spec.AllowedIps) == 0 {
+		return nil, fmt.Errorf("At least one entry in allowedIps is required")
+	}
+	var subnets []string
+	for _, allowedIp := range spec.AllowedIps {
+		_, ipnet, err := net.ParseCIDR(allowedIp)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid allowed IP %s: %v", allowedIp, err)
+		}
+		subnets = append(subnets, ipnet.String())
+	}
+
+	return &wireguard.Peer{
+		PeerHostname:      wireguard.PeerSourceStatic + "/" + name,
+		PeerOuterIp:       outerIp,
+		PeerOuterPort:     outerPort,
+		PeerPublicKey:     spec.PublicKey,
+		PeerRoutedSubnets: subnets,
+		PeerSource:        wireguard.PeerSourceStatic,
+	}, nil
+}
+
+// updateStaticPeers replaces all static peers inside the peer list with the given peers.
+func updateStaticPeers(pl *wireguard.PeerList, peers []*wireguard.Peer) error {
+	for _, p := range pl.ListBySource(wireguard.PeerSourceStatic) {
+		if err := pl.Delete(p.PeerHostname); err != nil {
+			return err
+		}
+	}
+	for _, p := range peers {
+		if err := pl.UpdateOrAdd(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package wgk8s
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/wireguard"
+)
+
+func TestParseStaticPeers(t *testing.T) {
+	tcs := []struct {
+		data          map[string]string
+		expected      map[string]string
+		errorExpected bool
+	}{
+		{
+			data: map[string]string{
+				"database": `publicKey: bDOPiAaYvtq1y+7+u75t1QYhogY4cuLo02jPhjNM+FA=
+endpoint: 192.0.2.10:51820
+allowedIps:
+- 192.0.2.10/32
+`,
+				"site": `{"publicKey": "jQyD90Rm1xTj5YkYTrgUTc2AVgHqUbwFpvVUSCUV/Ao=", "endpoint": "[2001:db8::1]:51820", "allowedIps": ["192.168.10.5/24", "192.168.20.0/24"]}`,
+			},
+			expected: map[string]string{
+				"static/database": "192.0.2.10:51820 [192.0.2.10/32]",
+				"static/site":     "2001:db8::1:51820 [192.168.10.0/24 192.168.20.0/24]",
+			},
+			errorExpected: false,
+		},
+		{
+			data: map[string]string{
+				"database": `publicKey: invalid
+endpoint: 192.0.2.10:51820
+allowedIps:
+- 192.0.2.10/32
+`,
+			},
+			errorExpected: true,
+		},
+		{
+			data: map[string]string{
+				"database": `publicKey: bDOPiAaYvtq1y+7+u75t1QYhogY4cuLo02jPhjNM+FA=
+endpoint: 192.0.2.10
+allowedIps:
+- 192.0.2.10/32
+`,
+			},
+			errorExpected: true,
+		},
+		{
+			data: map[string]string{
+				"database": `publicKey: bDOPiAaYvtq1y+7+u75t1QYhogY4cuLo02jPhjNM+FA=
+endpoint: 192.0.2.10:51820
+`,
+			},
+			errorExpected: true,
+		},
+		{
+			data: map[string]string{
+				"database": `publicKey: bDOPiAaYvtq1y+7+u75t1QYhogY4cuLo02jPhjNM+FA=
+endpoint: 192.0.2.10:51820
+allowedIp:
+- 192.0.2.10/32
+`,
+			},
+			errorExpected: true,
+		},
+	}
+
+	for k, tc := range tcs {
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "static-peers", Namespace: "wireguard-kubernetes"},
+			Data:       tc.data,
+		}
+		peers, err := ParseStaticPeers(cm)
+		if tc.errorExpected != (err != nil) {
+			t.Fatal(fmt.Sprintf("ParseStaticPeers() - Test %d: Expected to see error: %t. Instead, got: %s", k, tc.errorExpected, err))
+		}
+		if len(peers) != len(tc.expected) {
+			t.Fatal(fmt.Sprintf("ParseStaticPeers() - Test %d: Expected %d peers, got %v", k, len(tc.expected), peers))
+		}
+		for _, p := range peers {
+			got := fmt.Sprintf("%s:%d %v", p.PeerOuterIp, p.PeerOuterPort, p.PeerRoutedSubnets)
+			if tc.expected[p.PeerHostname] != got {
+				t.Fatal(fmt.Sprintf("ParseStaticPeers() - Test %d: Expected peer %s to be '%s', got '%s'",
+					k, p.PeerHostname, tc.expected[p.PeerHostname], got))
+			}
+			if p.PeerSource != wireguard.PeerSourceStatic {
+				t.Fatal(fmt.Sprintf("ParseStaticPeers() - Test %d: Expected peer %s to have source %s, got %s",
+					k, p.PeerHostname, wireguard.PeerSourceStatic, p.PeerSource))
+			}
+		}
+	}
+}
+
+func TestUpdateStaticPeers(t *testing.T) {
+	pl := wireguard.NewPeerList()
+	pl.UpdateOrAdd(&wireguard.Peer{PeerHostname: "worker-0"})
+	pl.UpdateOrAdd(&wireguard.Peer{PeerHostname: "static/old", PeerSource: wireguard.PeerSourceStatic})
+
+	err := updateStaticPeers(pl, []*wireguard.Peer{
+		{PeerHostname: "static/new", PeerSource: wireguard.PeerSourceStatic},
+	})
+	if err != nil {
+		t.Fatal(fmt.Sprintf("updateStaticPeers(): Expected to return nil error, instead got %s", err))
+	}
+	for _, hostname := range []string{"worker-0", "static/new"} {
+		if _, err := pl.Get(hostname); err != nil {
+			t.Fatal(fmt.Sprintf("updateStaticPeers(): Expected peer %s to be in the peer list, got error %s", hostname, err))
+		}
+	}
+	if _, err := pl.Get("static/old"); err == nil {
+		t.Fatal("updateStaticPeers(): Expected peer static/old to be removed from the peer list")
+	}
+}
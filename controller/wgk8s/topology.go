@@ -0,0 +1,139 @@
+package wgk8s
+
+import (
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/config"
+	"github.com/andreaskaris/wireguard-kubernetes/controller/wireguard"
+)
+
+// GatewayLabel marks nodes which act as hubs for the hub-and-spoke topology, or as zone gateways for the zone
+// topology.
+const GatewayLabel = "wireguard.kubernetes.io/gateway"
+
+// isGateway returns true if the node is labeled as a hub or zone gateway.
+func isGateway(node *corev1.Node) bool {
+	_, ok := node.GetLabels()[GatewayLabel]
+	return ok
+}
+
+// getZone returns the topology zone of the node, or an empty string if the node has no zone label.
+func getZone(node *corev1.Node) string {
+	return node.GetLabels()[corev1.LabelTopologyZone]
+}
+
+// applyTopology returns the peers which the local node configures on its tunnel. With the mesh topology, these are
+// all peers. Static peers and peers of remote clusters are always configured, regardless of the topology.
+func applyTopology(pl *wireguard.PeerList, topology string, localIsGateway bool, localZone string) *wireguard.PeerList {
+	if topology == config.TopologyMesh || (topology == config.TopologyHubAndSpoke && localIsGateway) {
+		return pl
+	}
+
+	effective := wireguard.NewPeerList()
+	var nodes []*wireguard.Peer
+	for _, p := range *pl {
+		if p.PeerSource != wireguard.PeerSourceNode {
+			effective.UpdateOrAdd(p)
+			continue
+		}
+		nodes = append(nodes, p)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].PeerHostname < nodes[j].PeerHostname })
+
+	if topology == config.TopologyHubAndSpoke {
+		applyHubAndSpokeTopology(effective, nodes)
+	} else {
+		applyZoneTopology(effective, nodes, localIsGateway, localZone)
+	}
+	return effective
+}
+
+// applyHubAndSpokeTopology adds the peers of a spoke node to effective. Spokes only peer with the hubs: the first hub
+// becomes the primary hub and relays the traffic to all other spokes.
+func applyHubAndSpokeTopology(effective *wireguard.PeerList, nodes []*wireguard.Peer) {
+	hubs, spokes := splitGateways(nodes)
+	if len(hubs) == 0 {
+		klog.V(1).Info("No gateway nodes with label ", GatewayLabel, " found, spoke node cannot reach other nodes")
+		return
+	}
+	effective.UpdateOrAdd(relayPeer(hubs[0], spokes))
+	for _, hub := range hubs[1:] {
+		effective.UpdateOrAdd(hub)
+	}
+}
+
+// applyZoneTopology adds the peers of a node of the zone topology to effective. Nodes of the same zone peer directly.
+// Traffic to another zone is relayed by that zone's primary gateway (its first gateway). Nodes which are not
+// gateways relay all traffic to other zones through the primary gateway of their own zone. Zones without gateways
+// fall back to direct peering: their nodes peer with all nodes directly, and all nodes peer with them directly, so
+// that both ends of each tunnel configure each other.
+func applyZoneTopology(effective *wireguard.PeerList, nodes []*wireguard.Peer, localIsGateway bool, localZone string) {
+	var zones []string
+	zoneNodes := map[string][]*wireguard.Peer{}
+	for _, p := range nodes {
+		if _, ok := zoneNodes[p.PeerZone]; !ok {
+			zones = append(zones, p.PeerZone)
+		}
+		zoneNodes[p.PeerZone] = append(zoneNodes[p.PeerZone], p)
+	}
+	sort.Strings(zones)
+
+	localGateways, _ := splitGateways(zoneNodes[localZone])
+	if !localIsGateway && len(localGateways) == 0 {
+		for _, p := range nodes {
+			effective.UpdateOrAdd(p)
+		}
+		return
+	}
+	viaLocalGateway := !localIsGateway
+
+	var relayed []*wireguard.Peer
+	for _, zone := range zones {
+		gateways, others := splitGateways(zoneNodes[zone])
+		switch {
+		case zone == localZone || len(gateways) == 0:
+			for _, p := range zoneNodes[zone] {
+				effective.UpdateOrAdd(p)
+			}
+		case viaLocalGateway:
+			relayed = append(relayed, zoneNodes[zone]...)
+		default:
+			effective.UpdateOrAdd(relayPeer(gateways[0], others))
+			for _, gateway := range gateways[1:] {
+				effective.UpdateOrAdd(gateway)
+			}
+		}
+	}
+	if viaLocalGateway && len(relayed) > 0 {
+		effective.UpdateOrAdd(relayPeer(localGateways[0], relayed))
+	}
+}
+
+// splitGateways splits a list of peers into gateways and all other peers.
+func splitGateways(peers []*wireguard.Peer) ([]*wireguard.Peer, []*wireguard.Peer) {
+	var gateways, others []*wireguard.Peer
+	for _, p := range peers {
+		if p.PeerGateway {
+			gateways = append(gateways, p)
+		} else {
+			others = append(others, p)
+		}
+	}
+	return gateways, others
+}
+
+// relayPeer returns a copy of gateway whose allowed-ips are extended by the subnets and node IPs of the relayed
+// peers. The original peer is not modified.
+func relayPeer(gateway *wireguard.Peer, relayed []*wireguard.Peer) *wireguard.Peer {
+	p := *gateway
+	p.PeerRoutedSubnets = append([]string{}, gateway.PeerRoutedSubnets...)
+	p.PeerNodeIps = append([]string(nil), gateway.PeerNodeIps...)
+	for _, r := range relayed {
+		p.PeerRoutedSubnets = append(p.PeerRoutedSubnets, r.Subnets()...)
+		p.PeerNodeIps = append(p.PeerNodeIps, r.PeerNodeIps...)
+	}
+	return &p
+}
@@ -0,0 +1,200 @@
+package wgk8s
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/config"
+	"github.com/andreaskaris/wireguard-kubernetes/controller/testdata"
+	"github.com/andreaskaris/wireguard-kubernetes/controller/wireguard"
+)
+
+func TestIsGateway(t *testing.T) {
+	node := testdata.WorkerNode0.DeepCopy()
+	if isGateway(node) {
+		t.Fatal("isGateway(worker-0): Expected to be false, not true")
+	}
+	node.Labels[GatewayLabel] = ""
+	if !isGateway(node) {
+		t.Fatal("isGateway(worker-0): Expected to be true, not false")
+	}
+}
+
+func TestGetZone(t *testing.T) {
+	node := testdata.WorkerNode0.DeepCopy()
+	if getZone(node) != "" {
+		t.Fatal(fmt.Sprintf("getZone(worker-0): Expected empty zone, got %s", getZone(node)))
+	}
+	node.Labels["topology.kubernetes.io/zone"] = "zone-a"
+	if getZone(node) != "zone-a" {
+		t.Fatal(fmt.Sprintf("getZone(worker-0): Expected zone-a, got %s", getZone(node)))
+	}
+}
+
+func TestApplyTopology(t *testing.T) {
+	pl := wireguard.NewPeerList()
+	pl.UpdateOrAdd(&wireguard.Peer{PeerHostname: "hub-b", PeerInnerIp: net.ParseIP("100.64.0.2"), PeerPodSubnet: "10.245.2.0/24", PeerGateway: true})
+	pl.UpdateOrAdd(&wireguard.Peer{PeerHostname: "hub-a", PeerInnerIp: net.ParseIP("100.64.0.1"), PeerPodSubnet: "10.245.1.0/24", PeerGateway: true})
+	pl.UpdateOrAdd(&wireguard.Peer{PeerHostname: "spoke-1", PeerInnerIp: net.ParseIP("100.64.0.11"), PeerPodSubnet: "10.245.11.0/24", PeerNodeIps: []string{"172.18.0.11/32"}})
+	pl.UpdateOrAdd(&wireguard.Peer{PeerHostname: "spoke-2", PeerInnerIp: net.ParseIP("100.64.0.12"), PeerPodSubnet: "10.245.12.0/24"})
+	pl.UpdateOrAdd(&wireguard.Peer{PeerHostname: "static/db", PeerRoutedSubnets: []string{"192.0.2.10/32"}, PeerSource: wireguard.PeerSourceStatic})
+
+	tcs := []struct {
+		topology       string
+		localIsGateway bool
+		expected       map[string]string
+	}{
+		{
+			topology: config.TopologyMesh,
+			expected: map[string]string{
+				"hub-a":     "[100.64.0.1 10.245.1.0/24]",
+				"hub-b":     "[100.64.0.2 10.245.2.0/24]",
+				"spoke-1":   "[100.64.0.11 10.245.11.0/24 172.18.0.11/32]",
+				"spoke-2":   "[100.64.0.12 10.245.12.0/24]",
+				"static/db": "[192.0.2.10/32]",
+			},
+		},
+		{
+			topology:       config.TopologyHubAndSpoke,
+			localIsGateway: true,
+			expected: map[string]string{
+				"hub-a":     "[100.64.0.1 10.245.1.0/24]",
+				"hub-b":     "[100.64.0.2 10.245.2.0/24]",
+				"spoke-1":   "[100.64.0.11 10.245.11.0/24 172.18.0.11/32]",
+				"spoke-2":   "[100.64.0.12 10.245.12.0/24]",
+				"static/db": "[192.0.2.10/32]",
+			},
+		},
+		{
+			topology:       config.TopologyHubAndSpoke,
+			localIsGateway: false,
+			expected: map[string]string{
+				"hub-a":     "[100.64.0.1 10.245.1.0/24 10.245.11.0/24 10.245.12.0/24 172.18.0.11/32]",
+				"hub-b":     "[100.64.0.2 10.245.2.0/24]",
+				"static/db": "[192.0.2.10/32]",
+			},
+		},
+	}
+
+	for k, tc := range tcs {
+		effective := applyTopology(pl, tc.topology, tc.localIsGateway, "")
+		if len(*effective) != len(tc.expected) {
+			t.Fatal(fmt.Sprintf("applyTopology(%s, %t) - Test %d: Expected peers %v, got %v", tc.topology, tc.localIsGateway, k, tc.expected, *effective))
+		}
+		for hostname, allowedIps := range tc.expected {
+			p, err := effective.Get(hostname)
+			if err != nil {
+				t.Fatal(fmt.Sprintf("applyTopology(%s, %t) - Test %d: Expected peer %s, got error %s", tc.topology, tc.localIsGateway, k, hostname, err))
+			}
+			if fmt.Sprint(p.AllowedIps()) != allowedIps {
+				t.Fatal(fmt.Sprintf("applyTopology(%s, %t) - Test %d: Expected allowed-ips %s for peer %s, got %v", tc.topology, tc.localIsGateway, k, allowedIps, hostname, p.AllowedIps()))
+			}
+		}
+	}
+
+	// the peer list itself must not be modified
+	hubA, _ := pl.Get("hub-a")
+	if len(hubA.PeerRoutedSubnets) != 0 {
+		t.Fatal(fmt.Sprintf("applyTopology(): Expected the peer list to be unmodified, got routed subnets %v for hub-a", hubA.PeerRoutedSubnets))
+	}
+}
+
+func TestApplyZoneTopology(t *testing.T) {
+	pl := wireguard.NewPeerList()
+	pl.UpdateOrAdd(&wireguard.Peer{PeerHostname: "a-1", PeerPodSubnet: "10.245.1.0/24", PeerZone: "a"})
+	pl.UpdateOrAdd(&wireguard.Peer{PeerHostname: "a-gw", PeerPodSubnet: "10.245.2.0/24", PeerZone: "a", PeerGateway: true})
+	pl.UpdateOrAdd(&wireguard.Peer{PeerHostname: "b-1", PeerPodSubnet: "10.245.3.0/24", PeerZone: "b"})
+	pl.UpdateOrAdd(&wireguard.Peer{PeerHostname: "b-gw", PeerPodSubnet: "10.245.4.0/24", PeerZone: "b", PeerGateway: true})
+	pl.UpdateOrAdd(&wireguard.Peer{PeerHostname: "c-1", PeerPodSubnet: "10.245.5.0/24", PeerZone: "c"})
+
+	tcs := []struct {
+		localIsGateway bool
+		localZone      string
+		expected       map[string]string
+	}{
+		{
+			// nodes relay all traffic to other zones with gateways through their own zone gateway
+			localIsGateway: false,
+			localZone:      "a",
+			expected: map[string]string{
+				"a-1":  "[10.245.1.0/24]",
+				"a-gw": "[10.245.2.0/24 10.245.3.0/24 10.245.4.0/24]",
+				"c-1":  "[10.245.5.0/24]",
+			},
+		},
+		{
+			// zone gateways peer with the gateways of other zones
+			localIsGateway: true,
+			localZone:      "a",
+			expected: map[string]string{
+				"a-1":  "[10.245.1.0/24]",
+				"a-gw": "[10.245.2.0/24]",
+				"b-gw": "[10.245.4.0/24 10.245.3.0/24]",
+				"c-1":  "[10.245.5.0/24]",
+			},
+		},
+		{
+			// zone d has no gateway, so its nodes peer with all nodes directly
+			localIsGateway: false,
+			localZone:      "d",
+			expected: map[string]string{
+				"a-1":  "[10.245.1.0/24]",
+				"a-gw": "[10.245.2.0/24]",
+				"b-1":  "[10.245.3.0/24]",
+				"b-gw": "[10.245.4.0/24]",
+				"c-1":  "[10.245.5.0/24]",
+			},
+		},
+	}
+
+	for k, tc := range tcs {
+		effective := applyTopology(pl, config.TopologyZone, tc.localIsGateway, tc.localZone)
+		if len(*effective) != len(tc.expected) {
+			t.Fatal(fmt.Sprintf("applyTopology(%s, %t, %s) - Test %d: Expected peers %v, got %v", config.TopologyZone, tc.localIsGateway, tc.localZone, k, tc.expected, *effective))
+		}
+		for hostname, allowedIps := range tc.expected {
+			p, err := effective.Get(hostname)
+			if err != nil {
+				t.Fatal(fmt.Sprintf("applyTopology(%s, %t, %s) - Test %d: Expected peer %s, got error %s", config.TopologyZone, tc.localIsGateway, tc.localZone, k, hostname, err))
+			}
+			if fmt.Sprint(p.AllowedIps()) != allowedIps {
+				t.Fatal(fmt.Sprintf("applyTopology(%s, %t, %s) - Test %d: Expected allowed-ips %s for peer %s, got %v", config.TopologyZone, tc.localIsGateway, tc.localZone, k, allowedIps, hostname, p.AllowedIps()))
+			}
+		}
+	}
+}
+
+func TestTopologyIsSymmetric(t *testing.T) {
+	nodes := []*wireguard.Peer{
+		{PeerHostname: "a-1", PeerPodSubnet: "10.245.1.0/24", PeerZone: "a"},
+		{PeerHostname: "a-2", PeerPodSubnet: "10.245.6.0/24", PeerZone: "a"},
+		{PeerHostname: "a-gw", PeerPodSubnet: "10.245.2.0/24", PeerZone: "a", PeerGateway: true},
+		{PeerHostname: "b-1", PeerPodSubnet: "10.245.3.0/24", PeerZone: "b"},
+		{PeerHostname: "b-gw", PeerPodSubnet: "10.245.4.0/24", PeerZone: "b", PeerGateway: true},
+		{PeerHostname: "b-gw2", PeerPodSubnet: "10.245.7.0/24", PeerZone: "b", PeerGateway: true},
+		{PeerHostname: "c-1", PeerPodSubnet: "10.245.5.0/24", PeerZone: "c"},
+		{PeerHostname: "c-2", PeerPodSubnet: "10.245.8.0/24", PeerZone: "c"},
+	}
+
+	for _, topology := range []string{config.TopologyMesh, config.TopologyHubAndSpoke, config.TopologyZone} {
+		// the effective peers of each node, computed from the peer list of all other nodes
+		effective := map[string]*wireguard.PeerList{}
+		for _, local := range nodes {
+			pl := wireguard.NewPeerList()
+			for _, p := range nodes {
+				if p != local {
+					pl.UpdateOrAdd(p)
+				}
+			}
+			effective[local.PeerHostname] = applyTopology(pl, topology, local.PeerGateway, local.PeerZone)
+		}
+		for x, peers := range effective {
+			for y := range *peers {
+				if _, err := effective[y].Get(x); err != nil {
+					t.Fatal(fmt.Sprintf("applyTopology(%s): Node %s peers with %s, but %s does not peer with %s", topology, x, y, y, x))
+				}
+			}
+		}
+	}
+}
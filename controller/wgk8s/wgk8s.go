@@ -2,172 +2,927 @@ package wgk8s
 
 import (
 	"context"
-	"log"
+	"fmt"
 	"net"
 	"os"
+	"path"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog"
 
+	"github.com/andreaskaris/wireguard-kubernetes/controller/config"
 	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
 	"github.com/andreaskaris/wireguard-kubernetes/controller/wireguard"
 )
 
-// Run is responsible for running the wgk8s application. This application sets up the wireguard keys,
-// the wireguard namespace and tunnel connections, as well as the wireguard bridge interface.
+const (
+	nodesResource       = "nodes"
+	staticPeersResource = "static peers ConfigMap"
+	secretsResource     = "remote cluster Secrets"
+)
+
+// Options configures a Controller.
+type Options struct {
+	// Clientset is the client of the local cluster.
+	Clientset kubernetes.Interface
+	// Config is the configuration of the agent.
+	Config *config.WgK8sConfiguration
+	// ConfigUpdates optionally receives updated configurations. They are applied as far as possible without a
+	// restart, see config.Reload.
+	ConfigUpdates <-chan *config.WgK8sConfiguration
+}
+
+// Controller sets up the wireguard keys, the wireguard namespace and tunnel connections, as well as the wireguard
+// bridge interface of the local node, and keeps the tunnel's peers in sync with the nodes of the cluster, the static
+// peers and the nodes of remote clusters.
 // The CNI plugin will use this infrastructure and plug in the veth endpoints into the wireguard bridge.
-func Run(clientset kubernetes.Interface, localHostname, internalRoutingCidr, wireguardPrivateKey, wireguardPublicKey,
-	wireguardNamespace, wireguardInterface, wireguardBridge string) {
+type Controller struct {
+	clientset     kubernetes.Interface
+	cfg           *config.WgK8sConfiguration
+	configUpdates <-chan *config.WgK8sConfiguration
 
+	// namespace is the wireguard namespace, empty if the tunnel lives in the host namespace
+	namespace          string
+	link               wireguard.NamespaceLink
+	internalRoutingNet *net.IPNet
+	endpointPolicy     *utils.EndpointSelectionPolicy
+	peerSelector       labels.Selector
+
+	// the following fields are only accessed by the goroutine which runs Start
+	peerList       *wireguard.PeerList
+	appliedPeers   *wireguard.PeerList
+	restoredPeers  map[string]*wireguard.Peer
+	nodes          map[string]*corev1.Node
+	localPodCidr   string
+	localNodeIp    net.IP
+	dataPlane      *wireguard.DataPlane
+	localIsGateway bool
+	localZone      string
+	remoteClusters map[string]*remoteCluster
+
+	synced chan struct{}
+	mutex  sync.Mutex
+	// started is true once Start was called, stopErr is set when Start returned
+	started bool
+	stopErr error
+}
+
+// NewController validates the options and returns a new Controller.
+func NewController(opts Options) (*Controller, error) {
+	if opts.Clientset == nil {
+		return nil, fmt.Errorf("A clientset is required")
+	}
+	if opts.Config == nil {
+		return nil, fmt.Errorf("A configuration is required")
+	}
+	if err := opts.Config.Validate(); err != nil {
+		return nil, err
+	}
+	cfg := opts.Config
+
+	endpointPolicy, _ := cfg.EndpointSelectionPolicy()
 	// convert internal routing cidr to network
 	// the internal routing cidr is the subnet that is assigned to the tunnel interfaces
-	_, internalRoutingNet, err := net.ParseCIDR(internalRoutingCidr)
-	if err != nil {
-		log.Fatal("Cannot parse internal routing cidr: ", err)
+	_, internalRoutingNet, _ := net.ParseCIDR(cfg.InternalRoutingCidr)
+
+	link := wireguard.NamespaceLink{
+		ToWireguardNsInterface:   cfg.Link.ToWireguardNsInterface,
+		ToDefaultNsInterface:     cfg.Link.ToDefaultNsInterface,
+		ToWireguardNsInterfaceIp: cfg.Link.ToWireguardNsInterfaceIp,
+		ToDefaultNsInterfaceIp:   cfg.Link.ToDefaultNsInterfaceIp,
+		PrefixLength:             cfg.Link.PrefixLength,
+	}
+	// in chained mode, the routes to the remote pod CIDRs are only used by the pods for which wgcni added a rule
+	if cfg.PodNetwork.Mode == config.PodNetworkModeChained {
+		link.RouteTable = cfg.PodNetwork.RouteTable
+	}
+	// in the host namespace, there is neither a wireguard namespace nor a link into it
+	namespace := cfg.Wireguard.Namespace
+	if cfg.Wireguard.HostNamespace {
+		namespace = ""
+		link = wireguard.NamespaceLink{}
+	}
+
+	return &Controller{
+		clientset:          opts.Clientset,
+		cfg:                cfg,
+		configUpdates:      opts.ConfigUpdates,
+		namespace:          namespace,
+		link:               link,
+		internalRoutingNet: internalRoutingNet,
+		endpointPolicy:     endpointPolicy,
+		peerSelector:       cfg.PeerSelector(),
+		peerList:           wireguard.NewPeerList(),
+		nodes:              map[string]*corev1.Node{},
+		remoteClusters:     map[string]*remoteCluster{},
+		synced:             make(chan struct{}),
+	}, nil
+}
+
+// HasSynced returns true once the controller applied the initial state of all watched resources to the tunnel.
+func (c *Controller) HasSynced() bool {
+	select {
+	case <-c.synced:
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitForSync blocks until the controller applied the initial state of all watched resources to the tunnel. It
+// returns false if ctx is cancelled before.
+func (c *Controller) WaitForSync(ctx context.Context) bool {
+	select {
+	case <-c.synced:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Ready returns nil if the controller is running and has synced, otherwise it returns the reason why it is not ready.
+// It can be used as a readiness check.
+func (c *Controller) Ready() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch {
+	case c.stopErr != nil:
+		return fmt.Errorf("Controller stopped: %v", c.stopErr)
+	case !c.started:
+		return fmt.Errorf("Controller not started")
+	case !c.HasSynced():
+		return fmt.Errorf("Controller has not synced yet")
 	}
+	return nil
+}
+
+// Start sets up the local node and keeps the tunnel's peers in sync until ctx is cancelled. It returns nil when it
+// was stopped through ctx, otherwise it returns the error which stopped it. Before it returns, the node condition is
+// set to false, and the data plane is removed if the teardown policy says so. Start must only be called once.
+func (c *Controller) Start(ctx context.Context) error {
+	c.mutex.Lock()
+	if c.started {
+		c.mutex.Unlock()
+		return fmt.Errorf("Controller was already started")
+	}
+	c.started = true
+	c.mutex.Unlock()
 
-	// todo: at the moment, this is hardcoded to a 16 bit subnet mask
-	// this makes mapping of IP addresses easier (simply map the last 2 octets of the node outer IP
-	// to the internalRouting network)
-	// That means that all nodes currently *must* be part of the same /16 machine network
-	if internalRoutingNet.Mask.String() != "ffff0000" {
-		log.Fatalf("Invalid mask, must be ffff0000 (16 hex), got: %s", internalRoutingNet.Mask.String())
+	err := c.run(ctx)
+	if ctx.Err() != nil {
+		err = nil
 	}
+	c.shutdown(err == nil)
+
+	c.mutex.Lock()
+	c.stopErr = err
+	if c.stopErr == nil {
+		c.stopErr = fmt.Errorf("context cancelled")
+	}
+	c.mutex.Unlock()
+	return err
+}
+
+// setup creates the wireguard keys, the wireguard namespace, the bridge and the tunnel of the local node.
+func (c *Controller) setup(ctx context.Context) error {
+	cfg := c.cfg
 
 	// key management
 	// create wireguard keys if they do not exist, yet
-	if err := wireguard.EnsureWireguardKeys(wireguardPrivateKey, wireguardPublicKey); err != nil {
-		log.Fatal(err)
+	if err := wireguard.EnsureWireguardKeys(cfg.Wireguard.PrivateKey, cfg.Wireguard.PublicKey); err != nil {
+		return err
 	}
 	// read the public key
-	pubKey, err := os.ReadFile(wireguardPublicKey)
+	pubKey, err := os.ReadFile(cfg.Wireguard.PublicKey)
 	localPublicKey := strings.TrimSuffix(string(pubKey), "\n")
 	if localPublicKey == "" {
-		log.Fatal("Cannot read pubkey:", err)
+		return fmt.Errorf("Cannot read pubkey: %v", err)
 	}
 
 	// annotate the node which belongs to this process with the public key
-	klog.V(5).Info("Updating label of node: ", localHostname, " with public key: ", string(localPublicKey))
-	if err := wireguard.AddPublicKeyLabel(clientset, localHostname, string(localPublicKey)); err != nil {
-		log.Fatal("Cannot add public key annotation to node:", err)
+	klog.V(5).Info("Updating label of node: ", cfg.Hostname, " with public key: ", localPublicKey)
+	if err := wireguard.AddPublicKeyLabel(c.clientset, cfg.Hostname, localPublicKey); err != nil {
+		return fmt.Errorf("Cannot add public key annotation to node: %v", err)
+	}
+
+	// allocate pod CIDRs if the cluster does not allocate node CIDRs
+	if len(cfg.PodCidrAllocation.ClusterCidrs) > 0 {
+		if err := allocatePodCidrs(ctx, c.clientset, cfg.Hostname, cfg.PodCidrAllocation); err != nil {
+			return err
+		}
 	}
 
 	// get information about local host
-	localNode, err := clientset.CoreV1().Nodes().Get(context.TODO(), localHostname, metav1.GetOptions{})
+	localNode, err := c.clientset.CoreV1().Nodes().Get(ctx, cfg.Hostname, metav1.GetOptions{})
 	if err != nil {
-		log.Fatal("Cannot retrieve information about local node: ", err)
+		return fmt.Errorf("Cannot retrieve information about local node: %v", err)
 	}
 	localOuterIp, err := utils.GetNodeMachineNetworkIp(localNode)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	// retried the tunnel inner IP address of this node (currently 10.64.x.y where x.y are the last 2 octets from this node's node local IP)
-	localInnerIp := utils.GetInnerToOuterIp(localOuterIp, *internalRoutingNet)
+	localInnerIp := utils.GetInnerToOuterIp(localOuterIp, *c.internalRoutingNet)
 
-	nodeDefaultInterface, err := utils.GetInterfaceToIp(localOuterIp)
+	nodeDefaultInterface := cfg.Link.Uplink
+	if nodeDefaultInterface == "" {
+		nodeDefaultInterface, err = utils.GetInterfaceToIp(localOuterIp)
+		if err != nil {
+			return err
+		}
+	}
+	localPodCidrs, err := utils.GetPodCidr(localNode)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	c.localPodCidr = localPodCidrs["ipv4"]
+	if cfg.HostTraffic.Encrypt {
+		if localOuterIp.To4() == nil {
+			return fmt.Errorf("Cannot encrypt host traffic, the InternalIP %s of the local node is not an IPv4 address",
+				localOuterIp)
+		}
+		c.localNodeIp = localOuterIp
+	}
+
+	// set up the local wireguard tunnel namespace, the wgb0 bridge and the wg0 tunnel
+	// the same desired state is used later on to detect and repair drift
+	dataPlane := &wireguard.DataPlane{
+		Namespace:          c.namespace,
+		Interface:          cfg.Wireguard.Interface,
+		Link:               c.link,
+		Uplink:             nodeDefaultInterface,
+		Masquerade:         *cfg.Masquerade.Enabled,
+		NonMasqueradeCidrs: c.nonMasqueradeCidrs(cfg.Masquerade.NonMasqueradeCidrs),
+		ListenPort:         cfg.Wireguard.ListenPort,
+		InnerIp:            localInnerIp,
+		PrivateKey:         cfg.Wireguard.PrivateKey,
+		Mtu:                cfg.Wireguard.Mtu,
 	}
-	// set up the local wireguard tunnel namespace
-	if err := wireguard.EnsureNamespace(wireguardNamespace, nodeDefaultInterface); err != nil {
-		log.Fatal(err)
+	// in chained mode, the pods are attached by another CNI plugin and reached through the default namespace
+	switch cfg.PodNetwork.Mode {
+	case config.PodNetworkModeBridge:
+		// set brw0's IP address to the first IP address in the node's PodCIDR
+		bridgeIp, bridgeIpNetmask, err := utils.GetFirstNetworkAddress(c.localPodCidr)
+		if err != nil {
+			return err
+		}
+		dataPlane.Bridge = cfg.Wireguard.Bridge
+		dataPlane.BridgeIp = bridgeIp
+		dataPlane.BridgeIpNetmask = bridgeIpNetmask
+		dataPlane.LocalPodCidr = c.localPodCidr
+	case config.PodNetworkModeRouted:
+		dataPlane.Routed = true
+		dataPlane.LocalPodCidr = c.localPodCidr
+	}
+	if cfg.HostTraffic.Encrypt {
+		dataPlane.HostRouting = &wireguard.HostRouting{
+			RouteTable:   cfg.HostTraffic.RouteTable,
+			RulePriority: cfg.HostTraffic.RulePriority,
+			FwMark:       cfg.HostTraffic.FwMark,
+			LocalNodeIp:  c.localNodeIp,
+		}
+	}
+	if c.routesServices() {
+		dataPlane.ServiceRouting = &wireguard.ServiceRouting{
+			ClusterIpCidrs: cfg.Services.ClusterIpCidrs,
+			RouteTable:     cfg.Services.RouteTable,
+			RulePriority:   cfg.Services.RulePriority,
+			FwMark:         cfg.Services.FwMark,
+		}
+	}
+	// an existing tunnel keeps the peers of the snapshot or of the previous agent
+	if err := dataPlane.Ensure(false); err != nil {
+		return err
 	}
 
-	// set brw0's IP address to the first IP address in the node's PodCIDR
-	localPodCidrs, _ := utils.GetPodCidr(localNode)
-	bridgeIp, bridgeIpNetmask, err := utils.GetFirstNetworkAddress(localPodCidrs["ipv4"])
-	if err != nil {
-		log.Fatal(err)
-	}
-	// Create the wgb0 bridge
-	if err := wireguard.EnsureBridge(wireguardNamespace, wireguardBridge, bridgeIp, bridgeIpNetmask); err != nil {
-		log.Fatal(err)
-	}
-	// Create the wg0 tunnel
-	err = wireguard.InitWireguardTunnel(
-		wireguardNamespace,
-		wireguardInterface,
-		10000,
-		localInnerIp,
-		wireguardPrivateKey)
-	if err != nil {
-		log.Fatal(err)
+	c.dataPlane = dataPlane
+	c.localIsGateway = isGateway(localNode)
+	c.localZone = getZone(localNode)
+	return nil
+}
+
+// run sets up the local node, starts watching all resources and processes their events until ctx is cancelled or
+// an error occurs.
+func (c *Controller) run(ctx context.Context) error {
+	// the snapshot does not depend on the API server, which may be unreachable while the agent restarts
+	c.restoreSnapshot()
+	if err := c.setup(ctx); err != nil {
+		return err
+	}
+
+	// all watches and remote clusters are stopped when run returns
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer func() {
+		for _, rc := range c.remoteClusters {
+			rc.cancel()
+		}
+	}()
+
+	// the peers are only applied once the initial state of all resources is known, so that no peers are pruned
+	// before they were listed
+	pendingSyncs := map[string]bool{}
+	resourceEvents := make(chan resourceEvent)
+	watchResource := func(resource string, lw *cache.ListWatch) {
+		pendingSyncs[resource] = true
+		go listWatch(ctx, resource, lw, resourceEvents)
 	}
 
 	// monitor nodes
-	// Create a list of peers of this node.
-	peerList := wireguard.NewPeerList()
-	nodesWatcher, _ := clientset.CoreV1().Nodes().Watch(context.TODO(), metav1.ListOptions{})
+	watchResource(nodesResource, &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return c.clientset.CoreV1().Nodes().List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return c.clientset.CoreV1().Nodes().Watch(ctx, options)
+		},
+	})
+
+	// monitor the static peers ConfigMap, if configured
+	if *c.cfg.Peers.StaticPeersConfigMap != "" {
+		staticPeersNamespace, staticPeersName, err := cache.SplitMetaNamespaceKey(*c.cfg.Peers.StaticPeersConfigMap)
+		if err != nil {
+			return fmt.Errorf("Cannot parse static peers ConfigMap name: %v", err)
+		}
+		fieldSelector := fields.OneTermEqualSelector("metadata.name", staticPeersName).String()
+		watchResource(staticPeersResource, &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.FieldSelector = fieldSelector
+				return c.clientset.CoreV1().ConfigMaps(staticPeersNamespace).List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.FieldSelector = fieldSelector
+				return c.clientset.CoreV1().ConfigMaps(staticPeersNamespace).Watch(ctx, options)
+			},
+		})
+	}
+
+	// monitor the Secrets with the kubeconfigs of remote clusters, if configured
+	// the nodes of each remote cluster are watched in a separate goroutine which reports to remoteClusterEvents
+	remoteClusterEvents := make(chan remoteClusterEvent)
+	if c.cfg.Peers.RemoteClustersNamespace != "" {
+		namespace := c.cfg.Peers.RemoteClustersNamespace
+		watchResource(secretsResource, &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = RemoteClusterLabel
+				return c.clientset.CoreV1().Secrets(namespace).List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = RemoteClusterLabel
+				return c.clientset.CoreV1().Secrets(namespace).Watch(ctx, options)
+			},
+		})
+	}
+
+	// the data plane is checked for drift periodically once the initial sync is done
+	reconcileInterval := c.cfg.Reconcile.Interval.Duration
+	reconcileTicker := time.NewTicker(reconcileInterval)
+	defer reconcileTicker.Stop()
+
 	for {
+		changed := false
+		var err error
 		select {
-		case event := <-nodesWatcher.ResultChan():
-			// every time a node is added, deleted or modified
-			if event.Type == watch.Added || event.Type == watch.Deleted || event.Type == watch.Modified {
-				// extract node from event
-				node := event.Object.(*corev1.Node)
-
-				// extract node name
-				peerHostname := node.Name
-
-				// skip this node event if the event is for the local node
-				if localHostname == peerHostname {
-					continue
+		case <-ctx.Done():
+			return nil
+		case <-reconcileTicker.C:
+			if c.HasSynced() {
+				c.reconcile()
+			}
+			continue
+		case updated := <-c.configUpdates:
+			changed, err = c.reloadConfig(updated)
+			if c.cfg.Reconcile.Interval.Duration != reconcileInterval {
+				reconcileInterval = c.cfg.Reconcile.Interval.Duration
+				reconcileTicker.Reset(reconcileInterval)
+			}
+		case event := <-resourceEvents:
+			switch event.resource {
+			case nodesResource:
+				changed, err = c.handleNodes(event)
+			case staticPeersResource:
+				changed, err = c.handleStaticPeers(event)
+			case secretsResource:
+				changed, err = c.handleRemoteClusterSecrets(ctx, event, remoteClusterEvents)
+			}
+			if event.resync && pendingSyncs[event.resource] {
+				delete(pendingSyncs, event.resource)
+				// the initial sync replaces the restored peers, and sets and prunes all peers and routes
+				if len(pendingSyncs) == 0 {
+					err = c.dropRestoredPeers()
+					c.appliedPeers = nil
+					changed = true
 				}
+			}
+		case event := <-remoteClusterEvents:
+			err = handleRemoteClusterEvent(c.remoteClusters, event, c.peerList, c.endpointPolicy, c.cfg.Wireguard.ListenPort, c.localPodCidr)
+			changed = true
+		}
+		if err != nil {
+			return err
+		}
 
-				// extract node IPv4 Cidr
-				podCidrs, _ := utils.GetPodCidr(node)
-				peerPodSubnet := podCidrs["ipv4"]
+		if !changed || len(pendingSyncs) > 0 {
+			continue
+		}
+		if err := c.applyPeerList(); err != nil {
+			return err
+		}
+		if !c.HasSynced() {
+			klog.V(1).Info("Initial sync done, configured ", len(*c.peerList), " peers")
+			close(c.synced)
+			err := setNodeCondition(ctx, c.clientset, c.cfg.Hostname, corev1.ConditionTrue, NodeConditionReasonSynced,
+				"wgk8s configured all peers")
+			if err != nil {
+				klog.Error("Cannot set node condition: ", err)
+			}
+		}
+	}
+}
 
-				// extract public key node annotation
-				nodeAnnotations := node.GetAnnotations()
-				peerPublicKey, ok := nodeAnnotations["wireguard.kubernetes.io/publickey"]
-				if !ok {
-					klog.V(5).Info("Could not get annotation for node, skipping: ", peerHostname)
-					continue
-				}
+// shutdown sets the node condition to false when the controller stops. If the controller was stopped through its
+// context and the teardown policy is set to teardown, the data plane is removed first. Otherwise, it is left running
+// so that the next agent can adopt it. shutdown returns after the configured shutdown timeout at the latest.
+func (c *Controller) shutdown(stopped bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Shutdown.Timeout.Duration)
+	defer cancel()
 
-				// get the peer's IP address
-				peerOuterIp, err := utils.GetNodeMachineNetworkIp(node)
-				if err != nil {
-					klog.V(1).Info(err.Error())
-					continue
-				}
+	reason, message := NodeConditionReasonAgentStopped, "wgk8s stopped, the data plane is not updated"
+	// the data plane can only be removed if it was set up
+	if stopped && c.cfg.Shutdown.TeardownPolicy == config.TeardownPolicyTeardown && c.dataPlane != nil {
+		klog.Info("Tearing down the data plane")
+		if err := c.dataPlane.Teardown(); err != nil {
+			klog.Error("Cannot tear down the data plane: ", err)
+			message = fmt.Sprintf("wgk8s stopped, tearing down the data plane failed: %v", err)
+		} else {
+			reason, message = NodeConditionReasonTornDown, "wgk8s stopped and removed the data plane"
+			// the removed peers must not be restored by the next start
+			if err := os.Remove(c.snapshotFile()); err != nil && !os.IsNotExist(err) {
+				klog.Error("Cannot remove peer snapshot: ", err)
+			}
+		}
+	}
 
-				// if this is an add or modify, update the peer list
-				if event.Type == watch.Added || event.Type == watch.Modified {
-					klog.V(5).Info("Peer node added or updated: ", peerHostname)
-					peerInnerIp := utils.GetInnerToOuterIp(peerOuterIp, *internalRoutingNet)
-					err = peerList.UpdateOrAdd(&wireguard.Peer{
-						PeerHostname:  peerHostname,
-						PeerOuterIp:   peerOuterIp,
-						PeerInnerIp:   peerInnerIp,
-						PeerPublicKey: peerPublicKey,
-						PeerOuterPort: 10000,
-						PeerPodSubnet: peerPodSubnet,
-					})
-					// if this is a delete, delete the peer from the peer list
-				} else {
-					klog.V(5).Info("Peer node deleted: ", peerHostname)
-					err = peerList.Delete(peerHostname)
-				}
-				if err != nil {
-					log.Fatal(err)
-				}
+	if err := setNodeCondition(ctx, c.clientset, c.cfg.Hostname, corev1.ConditionFalse, reason, message); err != nil {
+		klog.Error("Cannot set node condition: ", err)
+	}
+}
+
+// applyPeerList writes out the changes in the peer list to the node's wg0 port.
+// With the hub-and-spoke and zone topologies, only a subset of the peer list is configured.
+// Only the difference to the last applied peer list is applied. The first time, and whenever applying the difference
+// fails, all peers and routes are set and pruned.
+func (c *Controller) applyPeerList() error {
+	peers := applyTopology(c.peerList, c.cfg.Peers.Topology, c.localIsGateway, c.localZone)
+	if c.appliedPeers != nil {
+		diff := peers.Diff(c.appliedPeers)
+		if diff.Empty() {
+			return nil
+		}
+		klog.V(5).Info("Applying peer list changes: ", diff)
+		err := wireguard.ApplyPeerListDiff(c.namespace, c.cfg.Wireguard.Interface, c.link, peers, diff)
+		if err == nil {
+			err = c.dataPlane.SyncHostRoutes(peers)
+		}
+		if err == nil {
+			c.appliedPeers = peers.Copy()
+			c.saveSnapshot()
+			return nil
+		}
+		klog.Warning("Cannot apply peer list changes, resyncing all peers: ", err)
+	}
+
+	err := wireguard.UpdateWireguardTunnelPeers(
+		c.namespace,
+		c.cfg.Wireguard.Interface,
+		c.link,
+		peers,
+		c.dataPlane.LocalPodCidr)
+	if err == nil {
+		err = c.dataPlane.SyncHostRoutes(peers)
+	}
+	if err != nil {
+		c.appliedPeers = nil
+		return err
+	}
+	c.appliedPeers = peers.Copy()
+	c.saveSnapshot()
+	return nil
+}
+
+// snapshotFile returns the path of the snapshot of the last applied peers.
+func (c *Controller) snapshotFile() string {
+	return path.Join(c.cfg.State.Directory, "peers.json")
+}
+
+// saveSnapshot writes the last applied peers to the snapshot. Failures are logged, as the snapshot only speeds up the
+// next start.
+func (c *Controller) saveSnapshot() {
+	if err := wireguard.SaveSnapshot(c.snapshotFile(), c.appliedPeers); err != nil {
+		klog.Warning("Cannot save peer snapshot: ", err)
+	}
+}
+
+// restoreSnapshot configures the peers and routes of the last snapshot before any request to the API server, so that
+// the node reaches its peers right after a restart, even if the API server is unreachable. The snapshot seeds the peer
+// list and the applied peers. Nothing is pruned: peers and routes which are no longer wanted are only removed by the
+// initial sync, which replaces the snapshot.
+func (c *Controller) restoreSnapshot() {
+	peers, err := wireguard.LoadSnapshot(c.snapshotFile())
+	if err != nil {
+		klog.Warning("Cannot restore peer snapshot, waiting for the initial sync: ", err)
+		return
+	}
+	if peers == nil || len(*peers) == 0 {
+		return
+	}
+	err = wireguard.ApplyPeerListDiff(c.namespace, c.cfg.Wireguard.Interface, c.link, peers,
+		peers.Diff(wireguard.NewPeerList()))
+	if err != nil {
+		klog.Warning("Cannot restore peer snapshot, waiting for the initial sync: ", err)
+		return
+	}
+	c.restoredPeers = map[string]*wireguard.Peer{}
+	for _, p := range *peers {
+		if err := c.peerList.UpdateOrAdd(p); err != nil {
+			klog.Warning("Cannot restore peer snapshot, waiting for the initial sync: ", err)
+			return
+		}
+		c.restoredPeers[p.PeerHostname] = p
+	}
+	c.appliedPeers = peers.Copy()
+	klog.Info("Restored ", len(*peers), " peers from snapshot ", c.snapshotFile())
+}
+
+// dropRestoredPeers removes the peers of the snapshot which were not replaced by the initial sync of all resources,
+// e.g. the peers of nodes which were deleted while the agent was down.
+func (c *Controller) dropRestoredPeers() error {
+	for hostname, restored := range c.restoredPeers {
+		if p, err := c.peerList.Get(hostname); err == nil && p == restored {
+			if err := c.peerList.Delete(hostname); err != nil {
+				return err
+			}
+		}
+	}
+	c.restoredPeers = nil
+	return nil
+}
+
+// reconcile compares the actual data plane with the desired state and repairs all drift, e.g. routes, peers or NAT
+// rules which were removed by an administrator or another tool. Each drift is logged and counted. Failures are logged
+// and retried in the next interval.
+func (c *Controller) reconcile() {
+	peers := applyTopology(c.peerList, c.cfg.Peers.Topology, c.localIsGateway, c.localZone)
+	drifts, err := c.dataPlane.DetectDrift(peers)
+	if err != nil {
+		klog.Error("Cannot detect drift of the data plane: ", err)
+		reconcilesTotal.WithLabelValues(reconcileResultError).Inc()
+		return
+	}
+	if len(drifts) == 0 {
+		klog.V(5).Info("Data plane is in sync")
+		reconcilesTotal.WithLabelValues(reconcileResultInSync).Inc()
+		return
+	}
+
+	// peers and routes are repaired by resyncing the peer list, everything else has to be recreated first
+	ensure, recreateTunnel := false, false
+	for _, drift := range drifts {
+		klog.Warning("Data plane drift detected: ", drift)
+		driftsTotal.WithLabelValues(drift.Component).Inc()
+		switch drift.Component {
+		case wireguard.DriftNamespace, wireguard.DriftTunnel:
+			ensure, recreateTunnel = true, true
+		case wireguard.DriftLink, wireguard.DriftBridge, wireguard.DriftNat, wireguard.DriftRule, wireguard.DriftService:
+			ensure = true
+		}
+	}
+	if ensure {
+		if err := c.dataPlane.Ensure(recreateTunnel); err != nil {
+			klog.Error("Cannot repair the data plane: ", err)
+			reconcilesTotal.WithLabelValues(reconcileResultError).Inc()
+			return
+		}
+	}
+	c.appliedPeers = nil
+	if err := c.applyPeerList(); err != nil {
+		klog.Error("Cannot repair the peers of the data plane: ", err)
+		reconcilesTotal.WithLabelValues(reconcileResultError).Inc()
+		return
+	}
+	klog.Info("Repaired ", len(drifts), " differences of the data plane")
+	reconcilesTotal.WithLabelValues(reconcileResultRepaired).Inc()
+}
+
+// reloadConfig applies the reloadable fields of an updated configuration. It returns true if the peer list changed.
+func (c *Controller) reloadConfig(updated *config.WgK8sConfiguration) (bool, error) {
+	reloaded, restartRequired := config.Reload(c.cfg, updated)
+	if restartRequired {
+		klog.Warning("Configuration changed, some of the changes only take effect after a restart")
+	}
+	if !reflect.DeepEqual(reloaded.Masquerade.NonMasqueradeCidrs, c.cfg.Masquerade.NonMasqueradeCidrs) {
+		klog.V(5).Info("Non-masquerade CIDRs updated: ", reloaded.Masquerade.NonMasqueradeCidrs)
+		cidrs := c.nonMasqueradeCidrs(reloaded.Masquerade.NonMasqueradeCidrs)
+		if err := c.dataPlane.SetNonMasqueradeCidrs(cidrs); err != nil {
+			return false, err
+		}
+	}
+	changed := false
+	if reloaded.Peers.Selector != c.cfg.Peers.Selector {
+		klog.V(5).Info("Peer selector updated: ", reloaded.Peers.Selector)
+		c.peerSelector = reloaded.PeerSelector()
+		for _, node := range c.nodes {
+			nodeChanged, err := c.updateNode(watch.Modified, node)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || nodeChanged
+		}
+	}
+	c.cfg = reloaded
+	return changed, nil
+}
+
+// nonMasqueradeCidrs returns the destinations which are not masqueraded when they leave the wireguard namespace. In
+// chained mode, traffic from remote pods leaves the wireguard namespace towards the local pods, which must see the
+// remote pod's IP address, so the local pod CIDR is never masqueraded. The same holds for the local node IP when the
+// host traffic is encrypted. Traffic to the service CIDRs keeps the pod's IP address when it reaches kube-proxy.
+func (c *Controller) nonMasqueradeCidrs(cidrs []string) []string {
+	result := append([]string{}, cidrs...)
+	if c.cfg.PodNetwork.Mode == config.PodNetworkModeChained && c.localPodCidr != "" {
+		result = append(result, c.localPodCidr)
+	}
+	if c.routesServices() {
+		result = append(result, c.cfg.Services.ClusterIpCidrs...)
+	}
+	if c.localNodeIp != nil {
+		result = append(result, c.localNodeIp.String()+"/32")
+	}
+	return result
+}
+
+// routesServices returns true if the traffic of the pods to the service CIDRs is routed into the default namespace
+// without masquerading. Without the wireguard namespace or in chained mode, the pods' traffic reaches kube-proxy
+// without being masqueraded anyway.
+func (c *Controller) routesServices() bool {
+	return len(c.cfg.Services.ClusterIpCidrs) > 0 && c.namespace != "" &&
+		c.cfg.PodNetwork.Mode != config.PodNetworkModeChained
+}
+
+// handleNodes applies a node event to the peer list. It returns true if the peer list or the topology changed.
+func (c *Controller) handleNodes(event resourceEvent) (bool, error) {
+	if !event.resync {
+		node, ok := event.object.(*corev1.Node)
+		if !ok {
+			return false, nil
+		}
+		return c.updateNode(event.eventType, node)
+	}
+
+	// a resync replaces all nodes, nodes which are not part of it were deleted in the meantime
+	listed := map[string]bool{}
+	changed := false
+	for _, object := range event.objects {
+		node, ok := object.(*corev1.Node)
+		if !ok {
+			continue
+		}
+		listed[node.Name] = true
+		nodeChanged, err := c.updateNode(watch.Modified, node)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || nodeChanged
+	}
+	for name, node := range c.nodes {
+		if listed[name] {
+			continue
+		}
+		nodeChanged, err := c.updateNode(watch.Deleted, node)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || nodeChanged
+	}
+	return changed, nil
+}
+
+// updateNode updates the peer list for an event of a single node and returns true if the peer list or the topology
+// changed.
+func (c *Controller) updateNode(eventType watch.EventType, node *corev1.Node) (bool, error) {
+	if eventType != watch.Added && eventType != watch.Modified && eventType != watch.Deleted {
+		return false, nil
+	}
+
+	// skip this node event if the event is for the local node
+	// changes of the local node's gateway or zone label change the topology
+	if c.cfg.Hostname == node.Name {
+		if eventType != watch.Deleted && (isGateway(node) != c.localIsGateway || getZone(node) != c.localZone) {
+			c.localIsGateway = isGateway(node)
+			c.localZone = getZone(node)
+			klog.V(5).Info("Local node changed gateway role or zone, gateway: ", c.localIsGateway, ", zone: ", c.localZone)
+			return true, nil
+		}
+		return false, nil
+	}
 
-				// write out the changes in the peer list to the node's wg0 port
-				err = wireguard.UpdateWireguardTunnelPeers(
-					wireguardNamespace,
-					wireguardInterface,
-					peerList,
-					localPodCidrs["ipv4"])
-				if err != nil {
-					log.Fatal(err)
+	// the last known state of all nodes is needed to re-evaluate the peers when the peer selector changes
+	if eventType == watch.Deleted {
+		delete(c.nodes, node.Name)
+	} else {
+		c.nodes[node.Name] = node
+	}
+
+	// nodes which do not match the peer selector are never peers, even if they have a public key
+	if eventType != watch.Deleted && !c.peerSelector.Matches(labels.Set(node.GetLabels())) {
+		if _, err := c.peerList.Get(node.Name); err != nil {
+			return false, nil
+		}
+		klog.V(5).Info("Peer node no longer matches peer selector: ", node.Name)
+		eventType = watch.Deleted
+	}
+
+	// if this is an add or modify, update the peer list
+	if eventType == watch.Added || eventType == watch.Modified {
+		peer, err := nodeToPeer(node, c.internalRoutingNet, c.endpointPolicy, c.cfg.Wireguard.ListenPort)
+		if err != nil {
+			klog.V(1).Info(err.Error())
+			return false, nil
+		}
+		if c.cfg.HostTraffic.Encrypt {
+			peer.PeerNodeIps = nodeIps(node)
+		}
+		// peers restored from the snapshot may be stale until the initial sync, they yield to the nodes
+		for hostname, restored := range c.restoredPeers {
+			if p, err := c.peerList.Get(hostname); err == nil && p == restored && hostname != node.Name &&
+				peersOverlap(restored, peer) {
+				klog.V(5).Info("Dropping restored peer which overlaps node ", node.Name, ": ", hostname)
+				if err := c.peerList.Delete(hostname); err != nil {
+					return false, err
 				}
 			}
 		}
+		if err := checkPeerOverlap(c.peerList, peer, c.localPodCidr); err != nil {
+			klog.Error("Refusing to install peer ", node.Name, ": ", err)
+			if _, err := c.peerList.Get(node.Name); err != nil {
+				return false, nil
+			}
+			return true, c.peerList.Delete(node.Name)
+		}
+		klog.V(5).Info("Peer node added or updated: ", node.Name)
+		return true, c.peerList.UpdateOrAdd(peer)
+	}
+	// if this is a delete, delete the peer from the peer list
+	if _, err := c.peerList.Get(node.Name); err != nil {
+		return false, nil
+	}
+	klog.V(5).Info("Peer node deleted: ", node.Name)
+	return true, c.peerList.Delete(node.Name)
+}
+
+// handleStaticPeers applies an event of the static peers ConfigMap to the peer list. It returns true if the peer
+// list changed. Invalid ConfigMaps are logged and ignored.
+func (c *Controller) handleStaticPeers(event resourceEvent) (bool, error) {
+	var cm *corev1.ConfigMap
+	if event.resync {
+		if len(event.objects) > 0 {
+			cm, _ = event.objects[0].(*corev1.ConfigMap)
+		}
+	} else {
+		if event.eventType != watch.Added && event.eventType != watch.Deleted && event.eventType != watch.Modified {
+			return false, nil
+		}
+		if event.eventType != watch.Deleted {
+			cm, _ = event.object.(*corev1.ConfigMap)
+		}
+	}
+
+	var staticPeers []*wireguard.Peer
+	if cm != nil {
+		var err error
+		staticPeers, err = ParseStaticPeers(cm)
+		if err != nil {
+			klog.Error("Ignoring update of static peers: ", err)
+			return false, nil
+		}
+	}
+	klog.V(5).Info("Static peers updated: ", staticPeers)
+	return true, updateStaticPeers(c.peerList, staticPeers)
+}
+
+// handleRemoteClusterSecrets starts, restarts and stops the watches of remote clusters for an event of the remote
+// cluster Secrets. It returns true if the peer list changed.
+func (c *Controller) handleRemoteClusterSecrets(ctx context.Context, event resourceEvent,
+	remoteClusterEvents chan<- remoteClusterEvent) (bool, error) {
+	if !event.resync {
+		secret, ok := event.object.(*corev1.Secret)
+		if !ok {
+			return false, nil
+		}
+		switch event.eventType {
+		case watch.Added, watch.Modified:
+			klog.V(5).Info("Remote cluster added or updated: ", secret.Name)
+			if err := startRemoteCluster(ctx, c.remoteClusters, secret, remoteClusterEvents); err != nil {
+				klog.Error(err)
+			}
+		case watch.Deleted:
+			klog.V(5).Info("Remote cluster deleted: ", secret.Name)
+			return true, stopRemoteCluster(c.remoteClusters, secret.Name, c.peerList)
+		}
+		return false, nil
+	}
+
+	// a resync replaces all remote clusters, unchanged remote clusters keep running
+	listed := map[string]bool{}
+	for _, object := range event.objects {
+		secret, ok := object.(*corev1.Secret)
+		if !ok {
+			continue
+		}
+		listed[secret.Name] = true
+		if rc, ok := c.remoteClusters[secret.Name]; ok && rc.resourceVersion == secret.ResourceVersion {
+			continue
+		}
+		klog.V(5).Info("Remote cluster added or updated: ", secret.Name)
+		if err := startRemoteCluster(ctx, c.remoteClusters, secret, remoteClusterEvents); err != nil {
+			klog.Error(err)
+		}
+	}
+	changed := false
+	for cluster := range c.remoteClusters {
+		if listed[cluster] {
+			continue
+		}
+		klog.V(5).Info("Remote cluster deleted: ", cluster)
+		if err := stopRemoteCluster(c.remoteClusters, cluster, c.peerList); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// nodeIps returns the IPv4 InternalIPs of node as /32 CIDRs.
+func nodeIps(node *corev1.Node) []string {
+	var ips []string
+	for _, a := range node.Status.Addresses {
+		if a.Type != corev1.NodeInternalIP {
+			continue
+		}
+		if ip := net.ParseIP(a.Address); ip != nil && ip.To4() != nil {
+			ips = append(ips, ip.String()+"/32")
+		}
+	}
+	return ips
+}
+
+// nodeToPeer converts a node into a wireguard peer. It returns an error if the node cannot be a peer, e.g. because
+// it was not annotated with its public key, yet. If internalRoutingNet is nil, the peer does not get a tunnel inner IP.
+// All nodes listen on the same wireguard port listenPort.
+func nodeToPeer(node *corev1.Node, internalRoutingNet *net.IPNet, endpointPolicy *utils.EndpointSelectionPolicy, listenPort int) (*wireguard.Peer, error) {
+	// extract node IPv4 Cidr
+	podCidrs, _ := utils.GetPodCidr(node)
+
+	// extract public key node annotation
+	peerPublicKey, ok := node.GetAnnotations()["wireguard.kubernetes.io/publickey"]
+	if !ok {
+		return nil, fmt.Errorf("Could not get annotation for node, skipping: %s", node.Name)
+	}
+
+	// get the peer's machine network IP address, the tunnel inner IP is derived from it
+	peerMachineIp, err := utils.GetNodeMachineNetworkIp(node)
+	if err != nil {
+		return nil, err
+	}
+
+	// get the IP address under which the peer's tunnel endpoint can be reached
+	peerOuterIp, err := utils.GetNodeEndpointIp(node, endpointPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	peer := &wireguard.Peer{
+		PeerHostname:  node.Name,
+		PeerOuterIp:   peerOuterIp,
+		PeerPublicKey: peerPublicKey,
+		PeerOuterPort: listenPort,
+		PeerPodSubnet: podCidrs["ipv4"],
+		PeerGateway:   isGateway(node),
+		PeerZone:      getZone(node),
+	}
+	if internalRoutingNet != nil {
+		peer.PeerInnerIp = utils.GetInnerToOuterIp(peerMachineIp, *internalRoutingNet)
 	}
+	return peer, nil
 }
@@ -5,14 +5,26 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
+	"os"
+	"path"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 	"k8s.io/klog"
 
+	"github.com/andreaskaris/wireguard-kubernetes/controller/config"
 	"github.com/andreaskaris/wireguard-kubernetes/controller/testdata"
 	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
 	"github.com/andreaskaris/wireguard-kubernetes/controller/wireguard"
@@ -36,39 +48,39 @@ func TestRun(t *testing.T) {
 	// Delete the namespace in order to have a clean slate before testing.
 	wireguard.DeleteNamespace("wireguard-kubernetes")
 
-	// run the application in a go routine
-	go Run(clientset,
-		"worker-local",
-		"100.64.0.0/16",
-		"/etc/wireguard/private",
-		"/etc/wireguard/public",
-		"wireguard-kubernetes",
-		"wg0",
-		"wgb0",
-	)
-
-	// sleep for 5 seconds (that should be enough to bring up everything)
-	time.Sleep(5 * time.Second)
-
 	// now, add 3 worker nodes
-	_, err = clientset.CoreV1().Nodes().Create(context.TODO(), testdata.WorkerNode0, metav1.CreateOptions{})
-	if err != nil {
-		fmt.Print(err.Error())
+	for _, node := range []*corev1.Node{testdata.WorkerNode0, testdata.WorkerNode1, testdata.WorkerNode2} {
+		_, err = clientset.CoreV1().Nodes().Create(context.TODO(), node, metav1.CreateOptions{})
+		if err != nil {
+			fmt.Print(err.Error())
+		}
 	}
-	time.Sleep(5 * time.Second)
-	_, err = clientset.CoreV1().Nodes().Create(context.TODO(), testdata.WorkerNode1, metav1.CreateOptions{})
+
+	cfg := config.Default()
+	cfg.Hostname = "worker-local"
+	cfg.State.Directory = t.TempDir()
+	controller, err := NewController(Options{Clientset: clientset, Config: cfg})
 	if err != nil {
-		fmt.Print(err.Error())
+		t.Fatal(err)
 	}
-	time.Sleep(5 * time.Second)
-	_, err = clientset.CoreV1().Nodes().Create(context.TODO(), testdata.WorkerNode2, metav1.CreateOptions{})
-	if err != nil {
-		fmt.Print(err.Error())
+
+	// run the application in a go routine and wait until the tunnel is in sync with the nodes
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	syncCtx, syncCancel := context.WithTimeout(ctx, 30*time.Second)
+	defer syncCancel()
+	go func() {
+		// stop waiting for the sync as soon as the controller fails
+		if err := controller.Start(ctx); err != nil {
+			syncCancel()
+		}
+	}()
+	if !controller.WaitForSync(syncCtx) {
+		t.Fatal(fmt.Sprintf("TestRun(): Controller did not sync, readiness: %v", controller.Ready()))
 	}
-	time.Sleep(5 * time.Second)
 
 	tests := map[string]func(string) error{
-		"ip netns exec wireguard-kubernetes ip route ls dev wg0 | grep -v 'proto kernel'": func(out string) error {
+		"ip netns exec wireguard-kubernetes ip route ls dev wg0 proto " + wireguard.RouteProtocol: func(out string) error {
 			lines := map[string]struct{}{
 				"10.245.3.0/24 via 100.64.0.103": struct{}{},
 				"10.245.4.0/24 via 100.64.0.104": struct{}{},
@@ -185,3 +197,450 @@ func TestRun(t *testing.T) {
 		}
 	}
 }
+
+func TestController(t *testing.T) {
+	tcs := []struct {
+		teardownPolicy string
+		reason         string
+		tornDown       bool
+	}{
+		{teardownPolicy: config.TeardownPolicyRetain, reason: NodeConditionReasonAgentStopped, tornDown: false},
+		{teardownPolicy: config.TeardownPolicyTeardown, reason: NodeConditionReasonTornDown, tornDown: true},
+	}
+	for k, tc := range tcs {
+		testController(t, k, tc.teardownPolicy, tc.reason, tc.tornDown)
+	}
+}
+
+// testController runs a controller with mocked commands, adds a node after the initial sync and stops the controller.
+func testController(t *testing.T, k int, teardownPolicy, reason string, tornDown bool) {
+	// mock all commands and record them, the wireguard namespace exists already
+	var mutex sync.Mutex
+	var commands []string
+	record := func(cmd string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		commands = append(commands, cmd)
+	}
+	ranCommand := func(prefix string) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, cmd := range commands {
+			if strings.HasPrefix(cmd, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	// the peers are configured through the generated wireguard configuration
+	wireguard.RuntimeDir = t.TempDir()
+	syncedPeer := func(publicKey string) bool {
+		config, _ := os.ReadFile(path.Join(wireguard.RuntimeDir, "wireguard-kubernetes-wg0.conf"))
+		return strings.Contains(string(config), "PublicKey = "+publicKey+"\n")
+	}
+	runCommand, runCommandWithOutput := utils.RunCommand, utils.RunCommandWithOutput
+	defer func() { utils.RunCommand, utils.RunCommandWithOutput = runCommand, runCommandWithOutput }()
+	utils.RunCommand = func(cmd string, methodName string) error {
+		record(cmd)
+		return nil
+	}
+	utils.RunCommandWithOutput = func(cmd string, methodName string) ([]byte, error) {
+		record(cmd)
+		if cmd == "ip netns" {
+			return []byte("wireguard-kubernetes\n"), nil
+		}
+		return []byte{}, nil
+	}
+
+	keyDir := t.TempDir()
+	if err := os.WriteFile(path.Join(keyDir, "private"), []byte("private"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(keyDir, "public"), []byte("public\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Hostname = "worker-local"
+	cfg.Wireguard.PrivateKey = path.Join(keyDir, "private")
+	cfg.Wireguard.PublicKey = path.Join(keyDir, "public")
+	cfg.Link.Uplink = "eth0"
+	cfg.Shutdown.TeardownPolicy = teardownPolicy
+	cfg.State.Directory = t.TempDir()
+
+	// the snapshot of the last run holds a node which was deleted while the agent was down
+	stalePeers := wireguard.NewPeerList()
+	stalePeers.UpdateOrAdd(&wireguard.Peer{
+		PeerHostname:  "worker-deleted",
+		PeerInnerIp:   net.ParseIP("100.64.0.99"),
+		PeerOuterIp:   net.ParseIP("172.18.0.99"),
+		PeerOuterPort: 10000,
+		PeerPublicKey: "deleted",
+		PeerPodSubnet: "10.245.99.0/24",
+	})
+	snapshotFile := path.Join(cfg.State.Directory, "peers.json")
+	if err := wireguard.SaveSnapshot(snapshotFile, stalePeers); err != nil {
+		t.Fatal(err)
+	}
+
+	clientset := fake.NewSimpleClientset(testdata.WorkerNodeLocal.DeepCopy(), testdata.WorkerNode0)
+	controller, err := NewController(Options{Clientset: clientset, Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if controller.Ready() == nil {
+		t.Fatal(fmt.Sprintf("Ready() - Test %d: Expected an error before the controller was started", k))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() { errs <- controller.Start(ctx) }()
+
+	syncCtx, syncCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer syncCancel()
+	if !controller.WaitForSync(syncCtx) {
+		t.Fatal(fmt.Sprintf("WaitForSync() - Test %d: Controller did not sync, readiness: %v", k, controller.Ready()))
+	}
+	if err := controller.Ready(); err != nil {
+		t.Fatal(fmt.Sprintf("Ready() - Test %d: Expected nil error after sync, instead got %s", k, err))
+	}
+	if !ranCommand("ip netns exec wireguard-kubernetes wg syncconf wg0 ") || !syncedPeer(testdata.WorkerNode0.Annotations["wireguard.kubernetes.io/publickey"]) {
+		t.Fatal(fmt.Sprintf("Start() - Test %d: Expected the peer of worker-0 to be configured during the initial sync", k))
+	}
+	// the snapshot is restored before the initial sync, which removes the stale peer and replaces the snapshot
+	if !ranCommand("ip route replace 10.245.99.0/24 via 169.254.0.2 dev to-wg-ns proto " + wireguard.RouteProtocol) {
+		t.Fatal(fmt.Sprintf("Start() - Test %d: Expected the routes of the snapshot to be restored", k))
+	}
+	if syncedPeer("deleted") {
+		t.Fatal(fmt.Sprintf("Start() - Test %d: Expected the stale peer of the snapshot to be removed by the initial sync", k))
+	}
+	snapshot, err := wireguard.LoadSnapshot(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snapshot.Get("worker-deleted"); err == nil {
+		t.Fatal(fmt.Sprintf("Start() - Test %d: Expected the snapshot to be replaced after the initial sync, got %v", k, *snapshot))
+	}
+	if _, err := snapshot.Get(testdata.WorkerNode0.Name); err != nil {
+		t.Fatal(fmt.Sprintf("Start() - Test %d: Expected worker-0 in the snapshot, got %v", k, *snapshot))
+	}
+
+	// nodes which are added after the sync are configured, too
+	_, err = clientset.CoreV1().Nodes().Create(context.TODO(), testdata.WorkerNode1, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return syncedPeer(testdata.WorkerNode1.Annotations["wireguard.kubernetes.io/publickey"]), nil
+	})
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Start() - Test %d: Expected the peer of worker-1 to be configured", k))
+	}
+	// only the initial sync prunes the routes, later changes are applied incrementally
+	mutex.Lock()
+	prunes := 0
+	for _, cmd := range commands {
+		if cmd == "ip route ls dev to-wg-ns proto "+wireguard.RouteProtocol {
+			prunes++
+		}
+	}
+	mutex.Unlock()
+	if prunes != 1 {
+		t.Fatal(fmt.Sprintf("Start() - Test %d: Expected routes to be pruned once, got %d prunes", k, prunes))
+	}
+
+	cancel()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Start() - Test %d: Expected to return nil error after cancellation, instead got %s", k, err))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(fmt.Sprintf("Start() - Test %d: Did not return after cancellation", k))
+	}
+	if controller.Ready() == nil {
+		t.Fatal(fmt.Sprintf("Ready() - Test %d: Expected an error after the controller stopped", k))
+	}
+	if ranCommand("ip netns del wireguard-kubernetes") != tornDown {
+		t.Fatal(fmt.Sprintf("Start() - Test %d: Expected data plane removal to be %t with teardown policy %s", k, tornDown, teardownPolicy))
+	}
+	if _, err := os.Stat(snapshotFile); os.IsNotExist(err) != tornDown {
+		t.Fatal(fmt.Sprintf("Start() - Test %d: Expected snapshot removal to be %t with teardown policy %s", k, tornDown, teardownPolicy))
+	}
+	node, err := clientset.CoreV1().Nodes().Get(context.TODO(), "worker-local", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, c := range node.Status.Conditions {
+		found = found || (c.Type == NodeConditionType && c.Status == corev1.ConditionFalse && c.Reason == reason)
+	}
+	if !found {
+		t.Fatal(fmt.Sprintf("Start() - Test %d: Expected node condition false with reason %s, got %v", k, reason, node.Status.Conditions))
+	}
+	if err := controller.Start(context.Background()); err == nil {
+		t.Fatal(fmt.Sprintf("Start() - Test %d: Expected an error when starting the controller twice", k))
+	}
+}
+
+func TestRestoreSnapshotWithoutApiServer(t *testing.T) {
+	wireguard.RuntimeDir = t.TempDir()
+	recorder := utils.NewCommandRecorder(nil)
+	defer recorder.Install()()
+
+	keyDir := t.TempDir()
+	if err := os.WriteFile(path.Join(keyDir, "private"), []byte("private"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(keyDir, "public"), []byte("public\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Hostname = "worker-local"
+	cfg.Wireguard.PrivateKey = path.Join(keyDir, "private")
+	cfg.Wireguard.PublicKey = path.Join(keyDir, "public")
+	cfg.State.Directory = t.TempDir()
+	peers := wireguard.NewPeerList()
+	peers.UpdateOrAdd(&wireguard.Peer{
+		PeerHostname:  "worker-0",
+		PeerInnerIp:   net.ParseIP("100.64.0.3"),
+		PeerOuterIp:   net.ParseIP("172.18.0.3"),
+		PeerOuterPort: 10000,
+		PeerPublicKey: "worker-0",
+		PeerPodSubnet: "10.245.3.0/24",
+	})
+	if err := wireguard.SaveSnapshot(path.Join(cfg.State.Directory, "peers.json"), peers); err != nil {
+		t.Fatal(err)
+	}
+
+	// the API server is unreachable
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("connection refused")
+	})
+	controller, err := NewController(Options{Clientset: clientset, Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.Start(context.Background()); err == nil {
+		t.Fatal("Start(): Expected an error without API server, got nil")
+	}
+
+	config, _ := os.ReadFile(path.Join(wireguard.RuntimeDir, "wireguard-kubernetes-wg0.conf"))
+	if !strings.Contains(string(config), "PublicKey = worker-0\n") {
+		t.Fatal(fmt.Sprintf("Start(): Expected the peer of the snapshot to be configured, got configuration %s", config))
+	}
+	routed := false
+	for _, cmd := range recorder.Commands() {
+		routed = routed || cmd == "ip route replace 10.245.3.0/24 via 169.254.0.2 dev to-wg-ns proto "+wireguard.RouteProtocol
+	}
+	if !routed {
+		t.Fatal(fmt.Sprintf("Start(): Expected the routes of the snapshot to be configured, got %v", recorder.Commands()))
+	}
+	if _, err := controller.peerList.Get("worker-0"); err != nil || controller.appliedPeers == nil {
+		t.Fatal(fmt.Sprintf("Start(): Expected the peer list and the applied peers to be seeded, got %v and %v",
+			controller.peerList, controller.appliedPeers))
+	}
+}
+
+func TestUpdateNodeOverlap(t *testing.T) {
+	cfg := config.Default()
+	cfg.Hostname = "worker-local"
+	controller, err := NewController(Options{Clientset: fake.NewSimpleClientset(), Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller.localPodCidr = "10.245.6.0/24"
+	// the snapshot holds a node which was deleted while the agent was down, its pod CIDR was handed to worker-1
+	stalePeer := &wireguard.Peer{PeerHostname: "worker-deleted", PeerPodSubnet: "10.245.4.0/24"}
+	controller.peerList.UpdateOrAdd(stalePeer)
+	controller.restoredPeers = map[string]*wireguard.Peer{stalePeer.PeerHostname: stalePeer}
+
+	overlappingNode := testdata.WorkerNode2.DeepCopy()
+	overlappingNode.Name = "worker-overlap"
+	overlappingNode.Spec.PodCIDR = "10.245.3.0/25"
+	overlappingNode.Spec.PodCIDRs = []string{"10.245.3.0/25"}
+	localOverlappingNode := overlappingNode.DeepCopy()
+	localOverlappingNode.Spec.PodCIDR = "10.245.6.0/25"
+	localOverlappingNode.Spec.PodCIDRs = []string{"10.245.6.0/25"}
+	modifiedNode := testdata.WorkerNode0.DeepCopy()
+	modifiedNode.Spec.PodCIDR = "10.245.6.128/25"
+	modifiedNode.Spec.PodCIDRs = []string{"10.245.6.128/25"}
+
+	tcs := []struct {
+		node     *corev1.Node
+		changed  bool
+		expected []string
+	}{
+		{node: testdata.WorkerNode0, changed: true, expected: []string{"worker-deleted", "worker-0"}},
+		// the restored peer yields to the node
+		{node: testdata.WorkerNode1, changed: true, expected: []string{"worker-0", "worker-1"}},
+		// worker-overlap overlaps worker-0, then the local pod CIDR
+		{node: overlappingNode, changed: false, expected: []string{"worker-0", "worker-1"}},
+		{node: localOverlappingNode, changed: false, expected: []string{"worker-0", "worker-1"}},
+		// the existing peer is removed when its node starts to overlap the local pod CIDR
+		{node: modifiedNode, changed: true, expected: []string{"worker-1"}},
+	}
+	for k, tc := range tcs {
+		changed, err := controller.updateNode(watch.Added, tc.node)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("updateNode() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		if changed != tc.changed || len(*controller.peerList) != len(tc.expected) {
+			t.Fatal(fmt.Sprintf("updateNode() - Test %d: Expected change %t and peers %v, got %t and %v", k, tc.changed,
+				tc.expected, changed, *controller.peerList))
+		}
+		for _, hostname := range tc.expected {
+			if _, err := controller.peerList.Get(hostname); err != nil {
+				t.Fatal(fmt.Sprintf("updateNode() - Test %d: Expected peers %v, got %v", k, tc.expected, *controller.peerList))
+			}
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	wireguard.RuntimeDir = t.TempDir()
+	var commands []string
+	var netnsOutput string
+	var netnsErr error
+	runCommand, runCommandWithOutput := utils.RunCommand, utils.RunCommandWithOutput
+	defer func() { utils.RunCommand, utils.RunCommandWithOutput = runCommand, runCommandWithOutput }()
+	utils.RunCommand = func(cmd string, methodName string) error {
+		commands = append(commands, cmd)
+		return nil
+	}
+	utils.RunCommandWithOutput = func(cmd string, methodName string) ([]byte, error) {
+		commands = append(commands, cmd)
+		if cmd == "ip netns" {
+			return []byte(netnsOutput), netnsErr
+		}
+		return []byte{}, nil
+	}
+
+	cfg := config.Default()
+	cfg.Hostname = "worker-local"
+	cfg.State.Directory = t.TempDir()
+	controller, err := NewController(Options{Clientset: fake.NewSimpleClientset(), Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller.dataPlane = &wireguard.DataPlane{
+		Namespace:  cfg.Wireguard.Namespace,
+		Interface:  cfg.Wireguard.Interface,
+		Bridge:     cfg.Wireguard.Bridge,
+		Link:       wireguard.DefaultNamespaceLink,
+		Uplink:     "eth0",
+		Masquerade: true,
+		ListenPort: cfg.Wireguard.ListenPort,
+	}
+
+	tcs := []struct {
+		netnsOutput    string
+		netnsErr       error
+		result         string
+		driftComponent string
+		repairCommand  string
+	}{
+		{
+			// the wireguard namespace was deleted
+			netnsOutput:    "",
+			result:         reconcileResultRepaired,
+			driftComponent: wireguard.DriftNamespace,
+			repairCommand:  "ip link add name to-wg-ns type veth peer name to-default-ns",
+		},
+		{
+			netnsErr: fmt.Errorf("ip: command not found"),
+			result:   reconcileResultError,
+		},
+	}
+	for k, tc := range tcs {
+		commands = nil
+		netnsOutput, netnsErr = tc.netnsOutput, tc.netnsErr
+		results := testutil.ToFloat64(reconcilesTotal.WithLabelValues(tc.result))
+		var drifts float64
+		if tc.driftComponent != "" {
+			drifts = testutil.ToFloat64(driftsTotal.WithLabelValues(tc.driftComponent))
+		}
+
+		controller.reconcile()
+
+		if testutil.ToFloat64(reconcilesTotal.WithLabelValues(tc.result)) != results+1 {
+			t.Fatal(fmt.Sprintf("reconcile() - Test %d: Expected a reconciliation with result %s to be counted", k, tc.result))
+		}
+		if tc.driftComponent != "" && testutil.ToFloat64(driftsTotal.WithLabelValues(tc.driftComponent)) != drifts+1 {
+			t.Fatal(fmt.Sprintf("reconcile() - Test %d: Expected a drift of %s to be counted", k, tc.driftComponent))
+		}
+		if tc.repairCommand == "" {
+			continue
+		}
+		found := false
+		for _, cmd := range commands {
+			found = found || cmd == tc.repairCommand
+		}
+		if !found {
+			t.Fatal(fmt.Sprintf("reconcile() - Test %d: Expected repair command %s, got %v", k, tc.repairCommand, commands))
+		}
+	}
+}
+
+func TestNonMasqueradeCidrs(t *testing.T) {
+	tcs := []struct {
+		mode         string
+		localNodeIp  net.IP
+		serviceCidrs []string
+		expected     []string
+	}{
+		{mode: config.PodNetworkModeBridge, expected: []string{"10.0.0.0/8"}},
+		// traffic from remote pods to the local pods keeps the remote pod's IP address
+		{mode: config.PodNetworkModeChained, expected: []string{"10.0.0.0/8", "10.245.1.0/24"}},
+		// traffic from remote nodes to the local node keeps the remote node's IP address
+		{mode: config.PodNetworkModeBridge, localNodeIp: net.ParseIP("172.18.0.2"), expected: []string{"10.0.0.0/8", "172.18.0.2/32"}},
+		// traffic to the service CIDRs keeps the pod's IP address when it reaches kube-proxy
+		{mode: config.PodNetworkModeRouted, serviceCidrs: []string{"10.96.0.0/16"}, expected: []string{"10.0.0.0/8", "10.96.0.0/16"}},
+		// in chained mode, the pods reach kube-proxy directly
+		{mode: config.PodNetworkModeChained, serviceCidrs: []string{"10.96.0.0/16"}, expected: []string{"10.0.0.0/8", "10.245.1.0/24"}},
+	}
+	for k, tc := range tcs {
+		cfg := config.Default()
+		cfg.Hostname = "worker-local"
+		cfg.PodNetwork.Mode = tc.mode
+		cfg.Services.ClusterIpCidrs = tc.serviceCidrs
+		controller, err := NewController(Options{Clientset: fake.NewSimpleClientset(), Config: cfg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		controller.localPodCidr = "10.245.1.0/24"
+		controller.localNodeIp = tc.localNodeIp
+		cidrs := []string{"10.0.0.0/8"}
+		if actual := controller.nonMasqueradeCidrs(cidrs); !reflect.DeepEqual(actual, tc.expected) || len(cidrs) != 1 {
+			t.Fatal(fmt.Sprintf("nonMasqueradeCidrs() - Test %d: Expected %v, got %v", k, tc.expected, actual))
+		}
+		if (controller.link.RouteTable != 0) != (tc.mode == config.PodNetworkModeChained) {
+			t.Fatal(fmt.Sprintf("NewController() - Test %d: Unexpected route table %d in mode %s", k, controller.link.RouteTable, tc.mode))
+		}
+	}
+}
+
+func TestNewControllerHostNamespace(t *testing.T) {
+	tcs := []struct {
+		hostNamespace bool
+		namespace     string
+		link          wireguard.NamespaceLink
+	}{
+		{hostNamespace: false, namespace: "wireguard-kubernetes", link: wireguard.DefaultNamespaceLink},
+		// without the wireguard namespace, there is no link into it
+		{hostNamespace: true, namespace: "", link: wireguard.NamespaceLink{}},
+	}
+	for k, tc := range tcs {
+		cfg := config.Default()
+		cfg.Hostname = "worker-local"
+		cfg.Wireguard.HostNamespace = tc.hostNamespace
+		controller, err := NewController(Options{Clientset: fake.NewSimpleClientset(), Config: cfg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if controller.namespace != tc.namespace || controller.link != tc.link {
+			t.Fatal(fmt.Sprintf("NewController() - Test %d: Expected namespace '%s' and link %v, got '%s' and %v", k,
+				tc.namespace, tc.link, controller.namespace, controller.link))
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package wireguard
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+// benchmarkSizes are the numbers of peers of the benchmarks.
+var benchmarkSizes = []int{100, 1000, 5000}
+
+// generatePeerList returns a peer list with n node peers.
+func generatePeerList(n int) *PeerList {
+	pl := NewPeerList()
+	for i := 1; i <= n; i++ {
+		key := make([]byte, 32)
+		binary.BigEndian.PutUint32(key, uint32(i))
+		pl.UpdateOrAdd(&Peer{
+			PeerHostname:  fmt.Sprintf("worker-gen-%d", i),
+			PeerInnerIp:   net.IPv4(100, 64, byte(i/256), byte(i%256)),
+			PeerOuterIp:   net.IPv4(172, 19, byte(i/256), byte(i%256)),
+			PeerOuterPort: 10000,
+			PeerPublicKey: base64.StdEncoding.EncodeToString(key),
+			PeerPodSubnet: fmt.Sprintf("10.%d.%d.0/24", 128+i/256, i%256),
+		})
+	}
+	return pl
+}
+
+// newBenchmarkRecorder returns a recorder whose route listings return the routes of pl, i.e. a data plane which is
+// in sync with pl.
+func newBenchmarkRecorder(pl *PeerList) *utils.CommandRecorder {
+	var tunnelRoutes, namespaceRoutes strings.Builder
+	for _, p := range *pl {
+		fmt.Fprintf(&tunnelRoutes, "%s via %s\n", p.PeerPodSubnet, p.PeerInnerIp)
+		fmt.Fprintf(&namespaceRoutes, "%s via 169.254.0.2\n", p.PeerPodSubnet)
+	}
+	return utils.NewCommandRecorder(map[string]string{
+		"ip netns exec wireguard ip route ls dev wg0 proto " + RouteProtocol: tunnelRoutes.String(),
+		"ip route ls dev to-wg-ns proto " + RouteProtocol:                    namespaceRoutes.String(),
+	})
+}
+
+// BenchmarkUpdateWireguardTunnelPeers measures a full resync of all peers and routes.
+func BenchmarkUpdateWireguardTunnelPeers(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("peers=%d", n), func(b *testing.B) {
+			RuntimeDir = b.TempDir()
+			pl := generatePeerList(n)
+			recorder := newBenchmarkRecorder(pl)
+			defer recorder.Install()()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := UpdateWireguardTunnelPeers("wireguard", "wg0", DefaultNamespaceLink, pl, "10.127.0.0/24"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(recorder.Count())/float64(b.N), "commands/op")
+		})
+	}
+}
+
+// BenchmarkApplyPeerListDiff measures a single node event: the diff is computed and applied for one peer whose
+// endpoint changed.
+func BenchmarkApplyPeerListDiff(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("peers=%d", n), func(b *testing.B) {
+			RuntimeDir = b.TempDir()
+			applied := generatePeerList(n)
+			recorder := newBenchmarkRecorder(applied)
+			defer recorder.Install()()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pl := applied.Copy()
+				moved := *(*pl)["worker-gen-1"]
+				moved.PeerOuterIp = net.IPv4(172, 20, byte(i/256), byte(i%256))
+				pl.UpdateOrAdd(&moved)
+				if err := ApplyPeerListDiff("wireguard", "wg0", DefaultNamespaceLink, pl, pl.Diff(applied)); err != nil {
+					b.Fatal(err)
+				}
+				applied = pl
+			}
+			b.ReportMetric(float64(recorder.Count())/float64(b.N), "commands/op")
+		})
+	}
+}
+
+// BenchmarkRenderConfig measures the rendering of the wireguard configuration.
+func BenchmarkRenderConfig(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("peers=%d", n), func(b *testing.B) {
+			pl := generatePeerList(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				RenderConfig(InterfaceConfig{}, pl)
+			}
+		})
+	}
+}
@@ -0,0 +1,455 @@
+package wireguard
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+// Components of the data plane in which drift can be detected.
+const (
+	DriftNamespace = "namespace"
+	DriftLink      = "link"
+	DriftBridge    = "bridge"
+	DriftTunnel    = "tunnel"
+	DriftPeer      = "peer"
+	DriftRoute     = "route"
+	DriftNat       = "nat"
+	DriftRule      = "rule"
+	DriftService   = "service"
+)
+
+// Drift is a difference between the desired and the actual state of a component of the data plane.
+type Drift struct {
+	Component   string
+	Description string
+}
+
+func (d Drift) String() string {
+	return d.Component + ": " + d.Description
+}
+
+// DataPlane describes the desired state of the local data plane, except for the peers of the tunnel. Without Bridge,
+// e.g. when wgcni is chained after another CNI plugin, no bridge is created. If Routed is set, the pods are reached
+// through the host routes of wgcni on their veths instead of a bridge, and the addresses of LocalPodCidr without a
+// pod are unreachable inside the wireguard namespace. Without Namespace, the tunnel and the bridge live in the default
+// namespace, and Link must be the zero NamespaceLink. If HostRouting is set, the traffic between the nodes is sent
+// through the tunnel as well. If ServiceRouting is set, the traffic of the pods to Service ClusterIPs keeps the pod's
+// IP address.
+type DataPlane struct {
+	Namespace          string
+	Interface          string
+	Bridge             string
+	BridgeIp           string
+	BridgeIpNetmask    string
+	Link               NamespaceLink
+	Uplink             string
+	Masquerade         bool
+	NonMasqueradeCidrs []string
+	ListenPort         int
+	InnerIp            net.IP
+	PrivateKey         string
+	Mtu                int
+	LocalPodCidr       string
+	Routed             bool
+	HostRouting        *HostRouting
+	ServiceRouting     *ServiceRouting
+}
+
+// Ensure creates all parts of the data plane which are missing and restores the NAT rules. Existing parts are left
+// untouched, except for the tunnel which is recreated if recreateTunnel is true. Otherwise, an existing tunnel keeps
+// its peers.
+func (dp *DataPlane) Ensure(recreateTunnel bool) error {
+	if dp.Namespace != "" {
+		if err := EnsureNamespace(dp.Namespace, dp.Uplink, dp.Link, dp.Masquerade); err != nil {
+			return err
+		}
+	}
+	if dp.Masquerade {
+		if err := dp.ensureMasqueradeRules(); err != nil {
+			return err
+		}
+	}
+	if err := SetNonMasqueradeCidrs(dp.Namespace, dp.masqueradeInterface(), dp.NonMasqueradeCidrs); err != nil {
+		return err
+	}
+	if dp.Bridge != "" {
+		if err := EnsureBridge(dp.Namespace, dp.Bridge, dp.BridgeIp, dp.BridgeIpNetmask); err != nil {
+			return err
+		}
+	}
+	if dp.Routed && dp.LocalPodCidr != "" {
+		if err := EnsureUnreachableRoute(dp.Namespace, dp.LocalPodCidr); err != nil {
+			return err
+		}
+	}
+	if dp.ServiceRouting != nil {
+		if err := dp.ensureServiceRouting(); err != nil {
+			return err
+		}
+	}
+	if recreateTunnel {
+		if err := InitWireguardTunnel(dp.Namespace, dp.Interface, dp.ListenPort, dp.InnerIp, dp.PrivateKey, dp.Mtu); err != nil {
+			return err
+		}
+	} else if err := EnsureWireguardTunnel(dp.Namespace, dp.Interface, dp.ListenPort, dp.InnerIp, dp.PrivateKey, dp.Mtu); err != nil {
+		return err
+	}
+	if dp.HostRouting != nil {
+		return dp.ensureHostRouting()
+	}
+	return nil
+}
+
+// masqueradeRules returns the iptables rules, without the command, which masquerade the traffic which leaves the
+// wireguard namespace. The first two rules live inside the wireguard namespace, the last one in the default namespace.
+// Without the wireguard namespace, only the traffic of the local pods which leaves the node is masqueraded.
+func (dp *DataPlane) masqueradeRules() []string {
+	if dp.Namespace == "" {
+		if dp.LocalPodCidr == "" {
+			return nil
+		}
+		return []string{"iptables -t nat %s POSTROUTING -o " + dp.Uplink + " --src " + dp.LocalPodCidr + " -j MASQUERADE"}
+	}
+	return []string{
+		utils.NetnsExec(dp.Namespace) + "iptables -t nat %s POSTROUTING -o " + dp.Link.ToDefaultNsInterface + " -j MASQUERADE",
+		utils.NetnsExec(dp.Namespace) + "iptables -t nat %s POSTROUTING --src " + dp.Link.ToWireguardNsInterfaceIp + " -j MASQUERADE",
+		"iptables -t nat %s POSTROUTING -o " + dp.Uplink + " --src " + dp.Link.ToDefaultNsInterfaceIp + " -j MASQUERADE",
+	}
+}
+
+// masqueradeInterface returns the interface through which masqueraded traffic leaves the wireguard namespace, or the
+// node if there is no wireguard namespace.
+func (dp *DataPlane) masqueradeInterface() string {
+	if dp.Namespace == "" {
+		return dp.Uplink
+	}
+	return dp.Link.ToDefaultNsInterface
+}
+
+// SetNonMasqueradeCidrs replaces the destinations which are not masqueraded.
+func (dp *DataPlane) SetNonMasqueradeCidrs(cidrs []string) error {
+	if err := SetNonMasqueradeCidrs(dp.Namespace, dp.masqueradeInterface(), cidrs); err != nil {
+		return err
+	}
+	dp.NonMasqueradeCidrs = cidrs
+	return nil
+}
+
+// ensureMasqueradeRules inserts the masquerade rules which are missing.
+func (dp *DataPlane) ensureMasqueradeRules() error {
+	for _, rule := range dp.masqueradeRules() {
+		cmd := fmt.Sprintf(rule, "-C") + " 2>/dev/null || " + fmt.Sprintf(rule, "-I")
+		if err := utils.RunCommand(cmd, "ensureMasqueradeRules"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Teardown removes the data plane. With the wireguard namespace, this is TeardownNamespace. Without it, the tunnel,
+// the bridge, the unreachable route and the NAT rules are removed from the default namespace. Parts which do not
+// exist are skipped.
+func (dp *DataPlane) Teardown() error {
+	if dp.HostRouting != nil {
+		if err := dp.teardownHostRouting(); err != nil {
+			return err
+		}
+	}
+	if dp.ServiceRouting != nil {
+		if err := dp.teardownServiceRouting(); err != nil {
+			return err
+		}
+	}
+	if dp.Namespace != "" {
+		return TeardownNamespace(dp.Namespace, dp.Interface, dp.Uplink, dp.Link, dp.Masquerade)
+	}
+
+	// deleting the tunnel and the bridge removes their routes as well
+	cmds := []string{"ip link del " + dp.Interface + " 2>/dev/null || true"}
+	if dp.Bridge != "" {
+		cmds = append(cmds, "ip link del "+dp.Bridge+" 2>/dev/null || true")
+	}
+	if dp.Routed && dp.LocalPodCidr != "" {
+		cmds = append(cmds, "ip route del unreachable "+dp.LocalPodCidr+" proto "+RouteProtocol+" 2>/dev/null || true")
+	}
+	if dp.Masquerade {
+		for _, rule := range dp.masqueradeRules() {
+			cmds = append(cmds, fmt.Sprintf(rule, "-D")+" 2>/dev/null || true")
+		}
+	}
+	prefix := "iptables -t nat "
+	cmds = append(cmds,
+		prefix+"-D POSTROUTING -o "+dp.Uplink+" -j "+nonMasqueradeChain+" 2>/dev/null || true",
+		prefix+"-F "+nonMasqueradeChain+" 2>/dev/null || true",
+		prefix+"-X "+nonMasqueradeChain+" 2>/dev/null || true",
+	)
+	for _, cmd := range cmds {
+		if err := utils.RunCommand(cmd, "Teardown"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DetectDrift compares the actual state of the data plane with dp and with the peers in pl. It returns all
+// differences, but does not repair them.
+func (dp *DataPlane) DetectDrift(pl *PeerList) ([]Drift, error) {
+	var drifts []Drift
+	var out []byte
+	var err error
+
+	if dp.Namespace != "" {
+		out, err = utils.RunCommandWithOutput("ip netns", "DetectDrift")
+		if err != nil {
+			return nil, err
+		}
+		if !containsField(out, 0, dp.Namespace) {
+			return []Drift{{DriftNamespace, "namespace " + dp.Namespace + " is missing"}}, nil
+		}
+
+		out, err = utils.RunCommandWithOutput("ip link ls", "DetectDrift")
+		if err != nil {
+			return nil, err
+		}
+		if !regexp.MustCompile(`(?m)^\d+: ` + regexp.QuoteMeta(dp.Link.ToWireguardNsInterface) + `@`).Match(out) {
+			drifts = append(drifts, Drift{DriftLink, "interface " + dp.Link.ToWireguardNsInterface + " is missing"})
+		}
+	}
+
+	if dp.Bridge != "" {
+		out, err = utils.RunCommandWithOutput(utils.NetnsExec(dp.Namespace)+"ip link ls type bridge", "DetectDrift")
+		if err != nil {
+			return nil, err
+		}
+		if !containsField(out, 1, dp.Bridge+":") {
+			drifts = append(drifts, Drift{DriftBridge, "bridge " + dp.Bridge + " is missing"})
+		}
+	}
+
+	// in routed mode, the unreachable route of the pod CIDR takes the place of the bridge's connected route
+	if dp.Routed && dp.LocalPodCidr != "" {
+		out, err = utils.RunCommandWithOutput(utils.NetnsExec(dp.Namespace)+"ip route ls type unreachable proto "+RouteProtocol, "DetectDrift")
+		if err != nil {
+			return nil, err
+		}
+		if !containsField(out, 1, utils.NormalizeCidr(dp.LocalPodCidr)) {
+			drifts = append(drifts, Drift{DriftBridge, "unreachable route to " + dp.LocalPodCidr + " is missing"})
+		}
+	}
+
+	tunnelExists, err := isWireguardTunnel(dp.Namespace, dp.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if tunnelExists {
+		tunnelDrifts, err := dp.detectTunnelDrift(pl)
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, tunnelDrifts...)
+	} else {
+		drifts = append(drifts, Drift{DriftTunnel, "tunnel " + dp.Interface + " is missing"})
+	}
+
+	// the routes of the default namespace lead to the subnets of all peers and to the pod subnet of the local node
+	if !dp.Link.none() {
+		desiredRoutes := []string{}
+		if dp.LocalPodCidr != "" {
+			desiredRoutes = append(desiredRoutes, dp.LocalPodCidr)
+		}
+		for _, p := range *pl {
+			desiredRoutes = append(desiredRoutes, p.Subnets()...)
+		}
+		routeDrifts, err := detectRouteDrift("ip route ls dev "+dp.Link.ToWireguardNsInterface+" proto "+RouteProtocol+dp.Link.routeTable(),
+			desiredRoutes)
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, routeDrifts...)
+	}
+
+	if dp.HostRouting != nil {
+		hostRoutingDrifts, err := dp.detectHostRoutingDrift(pl)
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, hostRoutingDrifts...)
+	}
+
+	if dp.ServiceRouting != nil {
+		serviceRoutingDrifts, err := dp.detectServiceRoutingDrift()
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, serviceRoutingDrifts...)
+	}
+
+	natDrifts, err := dp.detectNatDrift()
+	if err != nil {
+		return nil, err
+	}
+	return append(drifts, natDrifts...), nil
+}
+
+// detectTunnelDrift compares the listen port, the peers and the routes of the tunnel with the desired state.
+func (dp *DataPlane) detectTunnelDrift(pl *PeerList) ([]Drift, error) {
+	var drifts []Drift
+
+	// wg show dump prints the interface in the first line and then one line per peer:
+	// public-key preshared-key endpoint allowed-ips latest-handshake transfer-rx transfer-tx persistent-keepalive
+	cmd := utils.NetnsExec(dp.Namespace) + "wg show " + dp.Interface + " dump"
+	out, err := utils.RunCommandWithOutput(cmd, "detectTunnelDrift")
+	if err != nil {
+		return nil, err
+	}
+	actualPeers := map[string][]string{}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for i := 0; s.Scan(); i++ {
+		fields := strings.Fields(s.Text())
+		if i == 0 {
+			if len(fields) > 2 && fields[2] != strconv.Itoa(dp.ListenPort) {
+				drifts = append(drifts, Drift{DriftTunnel, fmt.Sprintf("tunnel listens on port %s instead of %d", fields[2], dp.ListenPort)})
+			}
+			// the firewall mark is only managed with HostRouting
+			if dp.HostRouting != nil && len(fields) > 3 && fields[3] != fmt.Sprintf("0x%x", dp.HostRouting.FwMark) {
+				drifts = append(drifts, Drift{DriftRule, fmt.Sprintf("tunnel has firewall mark %s instead of 0x%x", fields[3], dp.HostRouting.FwMark)})
+			}
+			continue
+		}
+		if len(fields) > 3 {
+			actualPeers[fields[0]] = fields
+		}
+	}
+
+	var desiredSubnets []string
+	for _, p := range *pl {
+		desiredSubnets = append(desiredSubnets, p.Subnets()...)
+
+		actual, ok := actualPeers[p.PeerPublicKey]
+		if !ok {
+			drifts = append(drifts, Drift{DriftPeer, "peer " + p.PeerHostname + " is missing"})
+			continue
+		}
+		delete(actualPeers, p.PeerPublicKey)
+		endpoint := net.JoinHostPort(p.PeerOuterIp.String(), strconv.Itoa(p.PeerOuterPort))
+		if actual[2] != endpoint {
+			drifts = append(drifts, Drift{DriftPeer, fmt.Sprintf("peer %s has endpoint %s instead of %s", p.PeerHostname, actual[2], endpoint)})
+		}
+		if allowedIps := normalizeCidrList(strings.Split(actual[3], ",")); allowedIps != normalizeCidrList(p.AllowedIps()) {
+			drifts = append(drifts, Drift{DriftPeer, fmt.Sprintf("peer %s has allowed-ips %s instead of %s",
+				p.PeerHostname, allowedIps, normalizeCidrList(p.AllowedIps()))})
+		}
+	}
+	for publicKey := range actualPeers {
+		drifts = append(drifts, Drift{DriftPeer, "unexpected peer " + publicKey})
+	}
+
+	routeDrifts, err := detectRouteDrift(utils.NetnsExec(dp.Namespace)+"ip route ls dev "+dp.Interface+" proto "+RouteProtocol, desiredSubnets)
+	if err != nil {
+		return nil, err
+	}
+	return append(drifts, routeDrifts...), nil
+}
+
+// detectRouteDrift compares the routes which are printed by cmd with the desired destinations. cmd should only list
+// the routes which are owned by wgk8s, kernel routes are ignored anyway.
+func detectRouteDrift(cmd string, desired []string) ([]Drift, error) {
+	out, err := utils.RunCommandWithOutput(cmd, "detectRouteDrift")
+	if err != nil {
+		return nil, err
+	}
+	actual := map[string]bool{}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.Contains(s.Text(), "proto kernel") {
+			continue
+		}
+		actual[utils.NormalizeCidr(fields[0])] = true
+	}
+
+	var drifts []Drift
+	for _, destination := range desired {
+		destination = utils.NormalizeCidr(destination)
+		if !actual[destination] {
+			drifts = append(drifts, Drift{DriftRoute, "route to " + destination + " is missing (" + cmd + ")"})
+		}
+		delete(actual, destination)
+	}
+	var unexpected []string
+	for destination := range actual {
+		unexpected = append(unexpected, destination)
+	}
+	sort.Strings(unexpected)
+	for _, destination := range unexpected {
+		drifts = append(drifts, Drift{DriftRoute, "unexpected route to " + destination + " (" + cmd + ")"})
+	}
+	return drifts, nil
+}
+
+// detectNatDrift checks the masquerade rules and the non-masquerade exceptions.
+func (dp *DataPlane) detectNatDrift() ([]Drift, error) {
+	var drifts []Drift
+	if dp.Masquerade {
+		for _, rule := range dp.masqueradeRules() {
+			if err := utils.RunCommand(fmt.Sprintf(rule, "-C"), "detectNatDrift"); err != nil {
+				drifts = append(drifts, Drift{DriftNat, "rule is missing: " + fmt.Sprintf(rule, "-A")})
+			}
+		}
+	}
+
+	prefix := utils.NetnsExec(dp.Namespace) + "iptables -t nat "
+	if err := utils.RunCommand(prefix+"-C POSTROUTING -o "+dp.masqueradeInterface()+" -j "+nonMasqueradeChain, "detectNatDrift"); err != nil {
+		drifts = append(drifts, Drift{DriftNat, "jump to chain " + nonMasqueradeChain + " is missing"})
+	}
+	out, err := utils.RunCommandWithOutput(prefix+"-S "+nonMasqueradeChain, "detectNatDrift")
+	if err != nil {
+		return append(drifts, Drift{DriftNat, "chain " + nonMasqueradeChain + " is missing"}), nil
+	}
+	var actual []string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		// -A WGK8S-NON-MASQUERADE -d 10.0.0.0/8 -j ACCEPT
+		fields := strings.Fields(s.Text())
+		if len(fields) > 3 && fields[0] == "-A" && fields[2] == "-d" {
+			actual = append(actual, fields[3])
+		}
+	}
+	if normalizeCidrList(actual) != normalizeCidrList(dp.NonMasqueradeCidrs) {
+		drifts = append(drifts, Drift{DriftNat, fmt.Sprintf("chain %s exempts %s instead of %s",
+			nonMasqueradeChain, normalizeCidrList(actual), normalizeCidrList(dp.NonMasqueradeCidrs))})
+	}
+	return drifts, nil
+}
+
+// containsField returns true if any line of out has the given value in field number index.
+func containsField(out []byte, index int, value string) bool {
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > index && fields[index] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeCidrList returns a sorted, comma separated list of the normalized CIDRs, for comparison.
+func normalizeCidrList(cidrs []string) string {
+	var normalized []string
+	for _, cidr := range cidrs {
+		if cidr = strings.TrimSpace(cidr); cidr != "" && cidr != "(none)" {
+			normalized = append(normalized, utils.NormalizeCidr(cidr))
+		}
+	}
+	sort.Strings(normalized)
+	return strings.Join(normalized, ",")
+}
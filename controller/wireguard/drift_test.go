@@ -0,0 +1,314 @@
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+func TestDetectDrift(t *testing.T) {
+	dp := &DataPlane{
+		Namespace:          "wireguard",
+		Interface:          "wg0",
+		Bridge:             "wgb0",
+		Link:               DefaultNamespaceLink,
+		Uplink:             "eth0",
+		Masquerade:         true,
+		NonMasqueradeCidrs: []string{"10.0.0.0/8"},
+		ListenPort:         10000,
+		LocalPodCidr:       "10.245.1.0/24",
+	}
+	pl := NewPeerList()
+	pl.UpdateOrAdd(&Peer{
+		PeerHostname:  "worker-1",
+		PeerInnerIp:   net.ParseIP("100.64.0.3"),
+		PeerOuterIp:   net.ParseIP("172.18.0.3"),
+		PeerOuterPort: 10000,
+		PeerPublicKey: "qP+1Sstf6Y0MYBeUtJjWthBMfx8uG1hmK4mz9hOQjGI=",
+		PeerPodSubnet: "10.245.3.0/24",
+	})
+
+	// the commands and outputs of a data plane without drift
+	inSync := map[string]string{
+		"ip netns": "wireguard (id: 0)\n",
+		"ip link ls": `1: lo: <LOOPBACK,UP,LOWER_UP> mtu 65536 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000
+    link/loopback 00:00:00:00:00:00 brd 00:00:00:00:00:00
+7: to-wg-ns@if6: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP mode DEFAULT group default qlen 1000
+    link/ether 5a:3c:19:0b:6e:51 brd ff:ff:ff:ff:ff:ff link-netns wireguard
+`,
+		"ip netns exec wireguard ip link ls type bridge": `3: wgb0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP mode DEFAULT group default qlen 1000
+    link/ether 2e:7d:80:c5:4f:12 brd ff:ff:ff:ff:ff:ff
+`,
+		"ip netns exec wireguard ip -o a": "4: wg0    inet 100.64.0.2/16 scope global wg0\\       valid_lft forever preferred_lft forever\n",
+		"ip netns exec wireguard wg show wg0 dump": "cJ0fXvzfq1IdcoXoAsYMRqnD6bNmRsS0HNbSmMfCoG0=\tFzD7xm0pUlSLPHSeF8bU/aNSaaBqr2oNLMAOTRx4Ezk=\t10000\toff\n" +
+			"qP+1Sstf6Y0MYBeUtJjWthBMfx8uG1hmK4mz9hOQjGI=\t(none)\t172.18.0.3:10000\t100.64.0.3/32,10.245.3.0/24\t0\t0\t0\toff\n",
+		"ip netns exec wireguard ip route ls dev wg0 proto 87": `10.245.3.0/24 via 100.64.0.3
+100.64.0.0/16 proto kernel scope link src 100.64.0.2
+`,
+		"ip route ls dev to-wg-ns proto 87": `10.245.1.0/24 via 169.254.0.2
+10.245.3.0/24 via 169.254.0.2
+169.254.0.0/30 proto kernel scope link src 169.254.0.1
+`,
+		"ip netns exec wireguard iptables -t nat -S WGK8S-NON-MASQUERADE": "-N WGK8S-NON-MASQUERADE\n-A WGK8S-NON-MASQUERADE -d 10.0.0.0/8 -j ACCEPT\n",
+	}
+	rules := []string{
+		"ip netns exec wireguard iptables -t nat -C POSTROUTING -o to-default-ns -j MASQUERADE",
+		"ip netns exec wireguard iptables -t nat -C POSTROUTING --src 169.254.0.1 -j MASQUERADE",
+		"iptables -t nat -C POSTROUTING -o eth0 --src 169.254.0.2 -j MASQUERADE",
+		"ip netns exec wireguard iptables -t nat -C POSTROUTING -o to-default-ns -j WGK8S-NON-MASQUERADE",
+	}
+
+	var commandOutputs map[string]string
+	var existingRules map[string]bool
+	// mock command
+	utils.RunCommandWithOutput = func(cmd string, methodName string) ([]byte, error) {
+		out, ok := commandOutputs[cmd]
+		if !ok {
+			return []byte{}, fmt.Errorf("Unknown command '%s' in method '%s'", cmd, methodName)
+		}
+		return []byte(out), nil
+	}
+	utils.RunCommand = func(cmd string, methodName string) error {
+		if !existingRules[cmd] {
+			return fmt.Errorf("iptables: Bad rule (does a matching rule exist in that chain?)")
+		}
+		return nil
+	}
+
+	tcs := []struct {
+		commandOutputs map[string]string
+		missingRules   []string
+		expected       []string
+	}{
+		{
+			// no drift
+			commandOutputs: map[string]string{},
+			expected:       nil,
+		},
+		{
+			commandOutputs: map[string]string{
+				"ip netns": "test (id: 1)\n",
+			},
+			expected: []string{DriftNamespace},
+		},
+		{
+			// the tunnel is gone, together with its routes
+			commandOutputs: map[string]string{
+				"ip link ls": "1: lo: <LOOPBACK,UP,LOWER_UP> mtu 65536 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\n",
+				"ip netns exec wireguard ip link ls type bridge": "",
+				"ip netns exec wireguard ip -o a":                "",
+			},
+			expected: []string{DriftLink, DriftBridge, DriftTunnel},
+		},
+		{
+			commandOutputs: map[string]string{
+				"ip netns exec wireguard wg show wg0 dump": "cJ0fXvzfq1IdcoXoAsYMRqnD6bNmRsS0HNbSmMfCoG0=\tFzD7xm0pUlSLPHSeF8bU/aNSaaBqr2oNLMAOTRx4Ezk=\t51820\toff\n" +
+					"qP+1Sstf6Y0MYBeUtJjWthBMfx8uG1hmK4mz9hOQjGI=\t(none)\t172.18.0.4:10000\t100.64.0.3/32\t0\t0\t0\toff\n" +
+					"bJpOINHuLj/VXDqhiwL1aiiNpSc3dfoKe5bMAV0mAX8=\t(none)\t172.18.0.5:10000\t100.64.0.5/32\t0\t0\t0\toff\n",
+			},
+			expected: []string{DriftTunnel, DriftPeer, DriftPeer, DriftPeer},
+		},
+		{
+			commandOutputs: map[string]string{
+				"ip netns exec wireguard ip route ls dev wg0 proto 87": "10.245.5.0/24 via 100.64.0.5\n",
+				"ip route ls dev to-wg-ns proto 87":                    "10.245.1.0/24 via 169.254.0.2\n10.245.3.0/24 via 169.254.0.2\n",
+			},
+			expected: []string{DriftRoute, DriftRoute},
+		},
+		{
+			commandOutputs: map[string]string{
+				"ip netns exec wireguard iptables -t nat -S WGK8S-NON-MASQUERADE": "-N WGK8S-NON-MASQUERADE\n",
+			},
+			missingRules: []string{"iptables -t nat -C POSTROUTING -o eth0 --src 169.254.0.2 -j MASQUERADE"},
+			expected:     []string{DriftNat, DriftNat},
+		},
+	}
+
+	for k, tc := range tcs {
+		commandOutputs = map[string]string{}
+		for cmd, out := range inSync {
+			commandOutputs[cmd] = out
+		}
+		for cmd, out := range tc.commandOutputs {
+			commandOutputs[cmd] = out
+		}
+		existingRules = map[string]bool{}
+		for _, rule := range rules {
+			existingRules[rule] = true
+		}
+		for _, rule := range tc.missingRules {
+			delete(existingRules, rule)
+		}
+
+		drifts, err := dp.DetectDrift(pl)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("DetectDrift() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		var components []string
+		for _, d := range drifts {
+			components = append(components, d.Component)
+		}
+		if !reflect.DeepEqual(components, tc.expected) {
+			t.Fatal(fmt.Sprintf("DetectDrift() - Test %d: Expected drift in %v, instead got %v", k, tc.expected, drifts))
+		}
+	}
+}
+
+func TestDetectDriftWithoutBridge(t *testing.T) {
+	pl := NewPeerList()
+	pl.UpdateOrAdd(&Peer{
+		PeerHostname:  "worker-1",
+		PeerInnerIp:   net.ParseIP("100.64.0.3"),
+		PeerOuterIp:   net.ParseIP("172.18.0.3"),
+		PeerOuterPort: 10000,
+		PeerPublicKey: "qP+1Sstf6Y0MYBeUtJjWthBMfx8uG1hmK4mz9hOQjGI=",
+		PeerPodSubnet: "10.245.3.0/24",
+	})
+	inSync := map[string]string{
+		"ip netns":                        "wireguard (id: 0)\n",
+		"ip link ls":                      "7: to-wg-ns@if6: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP mode DEFAULT group default qlen 1000\n",
+		"ip netns exec wireguard ip -o a": "4: wg0    inet 100.64.0.2/16 scope global wg0\\       valid_lft forever preferred_lft forever\n",
+		"ip netns exec wireguard wg show wg0 dump": "cJ0fXvzfq1IdcoXoAsYMRqnD6bNmRsS0HNbSmMfCoG0=\tFzD7xm0pUlSLPHSeF8bU/aNSaaBqr2oNLMAOTRx4Ezk=\t10000\toff\n" +
+			"qP+1Sstf6Y0MYBeUtJjWthBMfx8uG1hmK4mz9hOQjGI=\t(none)\t172.18.0.3:10000\t100.64.0.3/32,10.245.3.0/24\t0\t0\t0\toff\n",
+		"ip netns exec wireguard ip route ls dev wg0 proto 87":            "10.245.3.0/24 via 100.64.0.3\n",
+		"ip netns exec wireguard iptables -t nat -S WGK8S-NON-MASQUERADE": "-N WGK8S-NON-MASQUERADE\n",
+		// chained mode, the routes into the wireguard namespace live in their own table
+		"ip route ls dev to-wg-ns proto 87 table 87": "10.245.3.0/24 via 169.254.0.2\n",
+		// routed mode, the local pod CIDR is routed into the wireguard namespace and unreachable there
+		"ip route ls dev to-wg-ns proto 87":                             "10.245.1.0/24 via 169.254.0.2\n10.245.3.0/24 via 169.254.0.2\n",
+		"ip netns exec wireguard ip route ls type unreachable proto 87": "unreachable 10.245.1.0/24\n",
+		// host namespace mode, the tunnel and the bridge live in the default namespace
+		"ip link ls type bridge": "5: wgb0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP mode DEFAULT group default qlen 1000\n",
+		"ip -o a":                "4: wg0    inet 100.64.0.2/16 scope global wg0\\       valid_lft forever preferred_lft forever\n",
+		"wg show wg0 dump": "cJ0fXvzfq1IdcoXoAsYMRqnD6bNmRsS0HNbSmMfCoG0=\tFzD7xm0pUlSLPHSeF8bU/aNSaaBqr2oNLMAOTRx4Ezk=\t10000\toff\n" +
+			"qP+1Sstf6Y0MYBeUtJjWthBMfx8uG1hmK4mz9hOQjGI=\t(none)\t172.18.0.3:10000\t100.64.0.3/32,10.245.3.0/24\t0\t0\t0\toff\n",
+		"ip route ls dev wg0 proto 87":            "10.245.3.0/24 via 100.64.0.3\n",
+		"iptables -t nat -S WGK8S-NON-MASQUERADE": "-N WGK8S-NON-MASQUERADE\n",
+	}
+	var commandOutputs map[string]string
+	utils.RunCommandWithOutput = func(cmd string, methodName string) ([]byte, error) {
+		out, ok := commandOutputs[cmd]
+		if !ok {
+			return []byte{}, fmt.Errorf("Unknown command '%s' in method '%s'", cmd, methodName)
+		}
+		return []byte(out), nil
+	}
+	utils.RunCommand = func(cmd string, methodName string) error {
+		return nil
+	}
+
+	chainedLink := DefaultNamespaceLink
+	chainedLink.RouteTable = 87
+	tcs := []struct {
+		dp             *DataPlane
+		commandOutputs map[string]string
+		expected       []string
+	}{
+		{
+			dp: &DataPlane{Namespace: "wireguard", Interface: "wg0", Link: chainedLink, Uplink: "eth0", ListenPort: 10000},
+		},
+		{
+			dp: &DataPlane{Namespace: "wireguard", Interface: "wg0", Link: DefaultNamespaceLink, Uplink: "eth0",
+				ListenPort: 10000, LocalPodCidr: "10.245.1.0/24", Routed: true},
+		},
+		{
+			dp: &DataPlane{Namespace: "wireguard", Interface: "wg0", Link: DefaultNamespaceLink, Uplink: "eth0",
+				ListenPort: 10000, LocalPodCidr: "10.245.1.0/24", Routed: true},
+			commandOutputs: map[string]string{"ip netns exec wireguard ip route ls type unreachable proto 87": ""},
+			expected:       []string{DriftBridge},
+		},
+		{
+			dp: &DataPlane{Interface: "wg0", Bridge: "wgb0", Uplink: "eth0", ListenPort: 10000,
+				LocalPodCidr: "10.245.1.0/24"},
+		},
+		{
+			dp: &DataPlane{Interface: "wg0", Bridge: "wgb0", Uplink: "eth0", ListenPort: 10000,
+				LocalPodCidr: "10.245.1.0/24"},
+			commandOutputs: map[string]string{"ip -o a": "", "ip route ls dev wg0 proto 87": ""},
+			expected:       []string{DriftTunnel},
+		},
+	}
+	for k, tc := range tcs {
+		commandOutputs = map[string]string{}
+		for cmd, out := range inSync {
+			commandOutputs[cmd] = out
+		}
+		for cmd, out := range tc.commandOutputs {
+			commandOutputs[cmd] = out
+		}
+		drifts, err := tc.dp.DetectDrift(pl)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("DetectDrift() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		var components []string
+		for _, d := range drifts {
+			components = append(components, d.Component)
+		}
+		if !reflect.DeepEqual(components, tc.expected) {
+			t.Fatal(fmt.Sprintf("DetectDrift() - Test %d: Expected drift in %v, instead got %v", k, tc.expected, drifts))
+		}
+	}
+}
+
+func TestEnsureMasqueradeRules(t *testing.T) {
+	var commands []string
+	utils.RunCommand = func(cmd string, methodName string) error {
+		commands = append(commands, cmd)
+		return nil
+	}
+
+	tcs := []struct {
+		dp       *DataPlane
+		expected []string
+	}{
+		{
+			dp: &DataPlane{Namespace: "wireguard", Link: DefaultNamespaceLink, Uplink: "eth0", LocalPodCidr: "10.245.1.0/24"},
+			expected: []string{
+				"ip netns exec wireguard iptables -t nat -C POSTROUTING -o to-default-ns -j MASQUERADE 2>/dev/null || ip netns exec wireguard iptables -t nat -I POSTROUTING -o to-default-ns -j MASQUERADE",
+				"ip netns exec wireguard iptables -t nat -C POSTROUTING --src 169.254.0.1 -j MASQUERADE 2>/dev/null || ip netns exec wireguard iptables -t nat -I POSTROUTING --src 169.254.0.1 -j MASQUERADE",
+				"iptables -t nat -C POSTROUTING -o eth0 --src 169.254.0.2 -j MASQUERADE 2>/dev/null || iptables -t nat -I POSTROUTING -o eth0 --src 169.254.0.2 -j MASQUERADE",
+			},
+		},
+		{
+			// in the host namespace, only the pod traffic which leaves the node is masqueraded
+			dp: &DataPlane{Uplink: "eth0", LocalPodCidr: "10.245.1.0/24"},
+			expected: []string{
+				"iptables -t nat -C POSTROUTING -o eth0 --src 10.245.1.0/24 -j MASQUERADE 2>/dev/null || iptables -t nat -I POSTROUTING -o eth0 --src 10.245.1.0/24 -j MASQUERADE",
+			},
+		},
+	}
+	for k, tc := range tcs {
+		commands = nil
+		err := tc.dp.ensureMasqueradeRules()
+		if err != nil {
+			t.Fatal(fmt.Sprintf("ensureMasqueradeRules() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		if !reflect.DeepEqual(commands, tc.expected) {
+			t.Fatal(fmt.Sprintf("ensureMasqueradeRules() - Test %d: Expected commands %v, got %v", k, tc.expected, commands))
+		}
+	}
+}
+
+func TestTeardownHostNamespace(t *testing.T) {
+	recorder := utils.NewCommandRecorder(nil)
+	defer recorder.Install()()
+
+	dp := &DataPlane{Interface: "wg0", Bridge: "wgb0", Uplink: "eth0", Masquerade: true, LocalPodCidr: "10.245.1.0/24"}
+	if err := dp.Teardown(); err != nil {
+		t.Fatal(fmt.Sprintf("Teardown(): Expected to return nil error, instead got %s", err))
+	}
+	expected := []string{
+		"ip link del wg0 2>/dev/null || true",
+		"ip link del wgb0 2>/dev/null || true",
+		"iptables -t nat -D POSTROUTING -o eth0 --src 10.245.1.0/24 -j MASQUERADE 2>/dev/null || true",
+		"iptables -t nat -D POSTROUTING -o eth0 -j WGK8S-NON-MASQUERADE 2>/dev/null || true",
+		"iptables -t nat -F WGK8S-NON-MASQUERADE 2>/dev/null || true",
+		"iptables -t nat -X WGK8S-NON-MASQUERADE 2>/dev/null || true",
+	}
+	if commands := recorder.Commands(); !reflect.DeepEqual(commands, expected) {
+		t.Fatal(fmt.Sprintf("Teardown(): Expected commands %v, got %v", expected, commands))
+	}
+}
@@ -0,0 +1,228 @@
+package wireguard
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+// HostRouting routes the traffic between the nodes through the tunnel, in addition to the pod traffic. The node IPs
+// of the peers are routed into the tunnel in table RouteTable of the default namespace, which the rule
+// `not fwmark FwMark lookup RouteTable` applies to all traffic except for the tunnel's own UDP packets: the tunnel
+// marks them with FwMark, so they keep following the main table to the peers' endpoints, which are usually the same
+// node IPs. The routes prefer LocalNodeIp as source address, so the peers see the same address as without the
+// tunnel. With a wireguard namespace, the routes lead through the link into the wireguard namespace, where the rule
+// `lookup RouteTable` routes the node IPs onto the tunnel.
+type HostRouting struct {
+	RouteTable   int
+	RulePriority int
+	FwMark       int
+	LocalNodeIp  net.IP
+}
+
+// hostRoute is a route of table RouteTable to the node IP of a peer.
+type hostRoute struct {
+	via string
+	cmd string
+}
+
+// hostRouteTable holds the desired routes of table RouteTable in one namespace, by destination.
+type hostRouteTable struct {
+	prefix  string
+	desired map[string]hostRoute
+}
+
+// hostRules returns the rules, without the action, which make the namespaces use table RouteTable.
+func (dp *DataPlane) hostRules() []string {
+	hr := dp.HostRouting
+	rules := []string{fmt.Sprintf("ip rule %%s not fwmark 0x%x lookup %d priority %d", hr.FwMark, hr.RouteTable, hr.RulePriority)}
+	if dp.Namespace != "" {
+		rules = append(rules, utils.NetnsExec(dp.Namespace)+fmt.Sprintf("ip rule %%s lookup %d priority %d", hr.RouteTable, hr.RulePriority))
+	}
+	return rules
+}
+
+// hostMarkRule returns the iptables rule, without the command, which marks the UDP packets to the tunnel's listen
+// port. Together with src_valid_mark, this keeps the reverse path filter from checking their source, the peer's node
+// IP, against table RouteTable.
+func (dp *DataPlane) hostMarkRule() string {
+	return fmt.Sprintf("iptables -t mangle %%s PREROUTING -p udp --dport %d -j MARK --set-mark 0x%x", dp.ListenPort, dp.HostRouting.FwMark)
+}
+
+// hasIpRule returns true if the ip rule exists.
+func hasIpRule(rule string) (bool, error) {
+	out, err := utils.RunCommandWithOutput(fmt.Sprintf(rule, "show"), "hasIpRule")
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) != "", nil
+}
+
+// ensureHostRouting sets the firewall mark of the tunnel and adds the rules which are missing.
+func (dp *DataPlane) ensureHostRouting() error {
+	cmds := []string{
+		utils.NetnsExec(dp.Namespace) + fmt.Sprintf("wg set %s fwmark 0x%x", dp.Interface, dp.HostRouting.FwMark),
+		"sysctl -w net.ipv4.conf.all.src_valid_mark=1",
+		fmt.Sprintf(dp.hostMarkRule(), "-C") + " 2>/dev/null || " + fmt.Sprintf(dp.hostMarkRule(), "-I"),
+	}
+	for _, rule := range dp.hostRules() {
+		exists, err := hasIpRule(rule)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			cmds = append(cmds, fmt.Sprintf(rule, "add"))
+		}
+	}
+	for _, cmd := range cmds {
+		if err := utils.RunCommand(cmd, "ensureHostRouting"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostRouteTables returns the desired routes of table RouteTable to the node IPs of the peers in pl, first for the
+// default namespace and then for the wireguard namespace, if there is one.
+func (dp *DataPlane) hostRouteTables(pl *PeerList) []hostRouteTable {
+	table := " proto " + RouteProtocol + " table " + strconv.Itoa(dp.HostRouting.RouteTable)
+	src := " src " + dp.HostRouting.LocalNodeIp.String()
+	defaultNs := hostRouteTable{desired: map[string]hostRoute{}}
+	wireguardNs := hostRouteTable{prefix: utils.NetnsExec(dp.Namespace), desired: map[string]hostRoute{}}
+	for _, p := range *pl {
+		innerIp := ""
+		if p.PeerInnerIp != nil {
+			innerIp = p.PeerInnerIp.String()
+		}
+		for _, nodeIp := range p.PeerNodeIps {
+			destination := utils.NormalizeCidr(nodeIp)
+			if dp.Namespace == "" {
+				defaultNs.desired[destination] = hostRoute{innerIp,
+					"ip route replace " + nodeIp + viaArgument(innerIp) + " dev " + dp.Interface + src + table}
+				continue
+			}
+			defaultNs.desired[destination] = hostRoute{dp.Link.ToDefaultNsInterfaceIp,
+				"ip route replace " + nodeIp + viaArgument(dp.Link.ToDefaultNsInterfaceIp) + " dev " + dp.Link.ToWireguardNsInterface + src + table}
+			wireguardNs.desired[destination] = hostRoute{innerIp,
+				wireguardNs.prefix + "ip route replace " + nodeIp + viaArgument(innerIp) + " dev " + dp.Interface + table}
+		}
+	}
+	if dp.Namespace == "" {
+		return []hostRouteTable{defaultNs}
+	}
+	return []hostRouteTable{defaultNs, wireguardNs}
+}
+
+// viaArgument returns the via argument of a route through gateway, if there is one.
+func viaArgument(gateway string) string {
+	if gateway == "" {
+		return ""
+	}
+	return " via " + gateway
+}
+
+// listHostRoutesCommand returns the command which lists the routes of table RouteTable which are owned by wgk8s.
+func (dp *DataPlane) listHostRoutesCommand(t hostRouteTable) string {
+	return t.prefix + "ip route ls proto " + RouteProtocol + " table " + strconv.Itoa(dp.HostRouting.RouteTable)
+}
+
+// SyncHostRoutes sets the routes of table RouteTable to the node IPs of the peers in pl, and removes the routes to
+// node IPs which are not part of pl. It does nothing without HostRouting.
+func (dp *DataPlane) SyncHostRoutes(pl *PeerList) error {
+	if dp.HostRouting == nil {
+		return nil
+	}
+	for _, t := range dp.hostRouteTables(pl) {
+		out, err := utils.RunCommandWithOutput(dp.listHostRoutesCommand(t), "SyncHostRoutes")
+		if err != nil {
+			return err
+		}
+		// 172.18.0.3 via 169.254.0.2 dev to-wg-ns src 172.18.0.2
+		actual := map[string]string{}
+		s := bufio.NewScanner(bytes.NewReader(out))
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) == 0 {
+				continue
+			}
+			via := ""
+			for i := 1; i+1 < len(fields); i++ {
+				if fields[i] == "via" {
+					via = fields[i+1]
+				}
+			}
+			actual[utils.NormalizeCidr(fields[0])] = via
+		}
+
+		var cmds []string
+		for destination, route := range t.desired {
+			if via, ok := actual[destination]; !ok || via != route.via {
+				cmds = append(cmds, route.cmd)
+			}
+		}
+		for destination := range actual {
+			if _, ok := t.desired[destination]; !ok {
+				cmds = append(cmds, t.prefix+"ip route delete "+destination+" proto "+RouteProtocol+" table "+
+					strconv.Itoa(dp.HostRouting.RouteTable))
+			}
+		}
+		sort.Strings(cmds)
+		for _, cmd := range cmds {
+			if err := utils.RunCommand(cmd, "SyncHostRoutes"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// detectHostRoutingDrift checks the rules and the routes of table RouteTable.
+func (dp *DataPlane) detectHostRoutingDrift(pl *PeerList) ([]Drift, error) {
+	var drifts []Drift
+	for _, rule := range dp.hostRules() {
+		exists, err := hasIpRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			drifts = append(drifts, Drift{DriftRule, "rule is missing: " + fmt.Sprintf(rule, "add")})
+		}
+	}
+	if err := utils.RunCommand(fmt.Sprintf(dp.hostMarkRule(), "-C"), "detectHostRoutingDrift"); err != nil {
+		drifts = append(drifts, Drift{DriftRule, "rule is missing: " + fmt.Sprintf(dp.hostMarkRule(), "-A")})
+	}
+	for _, t := range dp.hostRouteTables(pl) {
+		var desired []string
+		for destination := range t.desired {
+			desired = append(desired, destination)
+		}
+		sort.Strings(desired)
+		routeDrifts, err := detectRouteDrift(dp.listHostRoutesCommand(t), desired)
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, routeDrifts...)
+	}
+	return drifts, nil
+}
+
+// teardownHostRouting removes the rules of the default namespace. The routes and the rule of the wireguard namespace
+// are removed together with the tunnel, the link and the namespace.
+func (dp *DataPlane) teardownHostRouting() error {
+	cmds := []string{
+		fmt.Sprintf(dp.hostRules()[0], "del") + " 2>/dev/null || true",
+		fmt.Sprintf(dp.hostMarkRule(), "-D") + " 2>/dev/null || true",
+	}
+	for _, cmd := range cmds {
+		if err := utils.RunCommand(cmd, "teardownHostRouting"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+func TestSyncHostRoutes(t *testing.T) {
+	pl := NewPeerList()
+	pl.UpdateOrAdd(&Peer{PeerHostname: "worker-1", PeerInnerIp: net.ParseIP("100.64.0.3"), PeerPodSubnet: "10.245.3.0/24",
+		PeerNodeIps: []string{"172.18.0.3/32"}})
+	pl.UpdateOrAdd(&Peer{PeerHostname: "worker-2", PeerInnerIp: net.ParseIP("100.64.0.4"), PeerPodSubnet: "10.245.4.0/24",
+		PeerNodeIps: []string{"172.18.0.4/32"}})
+	hostRouting := &HostRouting{RouteTable: 88, RulePriority: 90, FwMark: 0x570000, LocalNodeIp: net.ParseIP("172.18.0.2")}
+
+	tcs := []struct {
+		dataPlane *DataPlane
+		outputs   map[string]string
+		expected  []string
+	}{
+		{
+			// routes of the default namespace lead into the wireguard namespace, which routes them onto the tunnel
+			dataPlane: &DataPlane{Namespace: "wireguard-kubernetes", Interface: "wg0", Link: DefaultNamespaceLink, HostRouting: hostRouting},
+			outputs: map[string]string{
+				"ip route ls proto 87 table 88": "172.18.0.3 via 169.254.0.2 dev to-wg-ns src 172.18.0.2\n" +
+					"172.18.0.9 via 169.254.0.2 dev to-wg-ns src 172.18.0.2\n",
+				"ip netns exec wireguard-kubernetes ip route ls proto 87 table 88": "172.18.0.3 via 100.64.0.3 dev wg0\n" +
+					"172.18.0.4 via 100.64.0.5 dev wg0\n",
+			},
+			expected: []string{
+				"ip route ls proto 87 table 88",
+				"ip route delete 172.18.0.9/32 proto 87 table 88",
+				"ip route replace 172.18.0.4/32 via 169.254.0.2 dev to-wg-ns src 172.18.0.2 proto 87 table 88",
+				"ip netns exec wireguard-kubernetes ip route ls proto 87 table 88",
+				"ip netns exec wireguard-kubernetes ip route replace 172.18.0.4/32 via 100.64.0.4 dev wg0 proto 87 table 88",
+			},
+		},
+		{
+			// without the wireguard namespace, the routes of the default namespace lead onto the tunnel
+			dataPlane: &DataPlane{Interface: "wg0", HostRouting: hostRouting},
+			outputs: map[string]string{
+				"ip route ls proto 87 table 88": "172.18.0.3 via 100.64.0.3 dev wg0 src 172.18.0.2\n",
+			},
+			expected: []string{
+				"ip route ls proto 87 table 88",
+				"ip route replace 172.18.0.4/32 via 100.64.0.4 dev wg0 src 172.18.0.2 proto 87 table 88",
+			},
+		},
+		{
+			// without HostRouting, there is nothing to do
+			dataPlane: &DataPlane{Namespace: "wireguard-kubernetes", Interface: "wg0", Link: DefaultNamespaceLink},
+		},
+	}
+	for k, tc := range tcs {
+		recorder := utils.NewCommandRecorder(tc.outputs)
+		restore := recorder.Install()
+		err := tc.dataPlane.SyncHostRoutes(pl)
+		restore()
+		if err != nil {
+			t.Fatal(fmt.Sprintf("SyncHostRoutes() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		if commands := recorder.Commands(); !reflect.DeepEqual(commands, tc.expected) {
+			t.Fatal(fmt.Sprintf("SyncHostRoutes() - Test %d: Expected commands %v, got %v", k, tc.expected, commands))
+		}
+	}
+}
+
+func TestDetectHostRoutingDrift(t *testing.T) {
+	pl := NewPeerList()
+	pl.UpdateOrAdd(&Peer{PeerHostname: "worker-1", PeerInnerIp: net.ParseIP("100.64.0.3"), PeerPodSubnet: "10.245.3.0/24",
+		PeerNodeIps: []string{"172.18.0.3/32"}})
+	dp := &DataPlane{Interface: "wg0", ListenPort: 51820,
+		HostRouting: &HostRouting{RouteTable: 88, RulePriority: 90, FwMark: 0x570000, LocalNodeIp: net.ParseIP("172.18.0.2")}}
+
+	tcs := []struct {
+		outputs  map[string]string
+		expected []string
+	}{
+		{
+			outputs: map[string]string{
+				"ip rule show not fwmark 0x570000 lookup 88 priority 90": "90:	not from all fwmark 0x570000 lookup 88\n",
+				"ip route ls proto 87 table 88":                          "172.18.0.3 via 100.64.0.3 dev wg0 src 172.18.0.2\n",
+			},
+		},
+		{
+			outputs: map[string]string{
+				"ip route ls proto 87 table 88": "172.18.0.9 via 100.64.0.9 dev wg0 src 172.18.0.2\n",
+			},
+			expected: []string{DriftRule, DriftRoute, DriftRoute},
+		},
+	}
+	for k, tc := range tcs {
+		recorder := utils.NewCommandRecorder(tc.outputs)
+		restore := recorder.Install()
+		drifts, err := dp.detectHostRoutingDrift(pl)
+		restore()
+		if err != nil {
+			t.Fatal(fmt.Sprintf("detectHostRoutingDrift() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		var components []string
+		for _, drift := range drifts {
+			components = append(components, drift.Component)
+		}
+		if !reflect.DeepEqual(components, tc.expected) {
+			t.Fatal(fmt.Sprintf("detectHostRoutingDrift() - Test %d: Expected drift %v, got %v", k, tc.expected, drifts))
+		}
+	}
+}
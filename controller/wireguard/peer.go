@@ -3,16 +3,52 @@ package wireguard
 import (
 	"fmt"
 	"net"
+	"reflect"
+	"sort"
+)
+
+const (
+	// PeerSourceNode marks peers which were created from Kubernetes node objects.
+	PeerSourceNode = ""
+	// PeerSourceStatic marks peers which were created from the static peer configuration.
+	PeerSourceStatic = "static"
 )
 
 // Peer is a structure representing a wireguard peer (the node on the other side of the tunnel).
+// Static peers do not have a tunnel inner IP or a pod subnet. Instead, they route a list of arbitrary subnets.
+// Gateway peers act as hubs for the hub-and-spoke topology and as zone gateways for the zone topology.
+// PeerNodeIps are only set if the traffic between the nodes is encrypted, see HostRouting.
 type Peer struct {
-	PeerHostname  string
-	PeerInnerIp   net.IP
-	PeerOuterIp   net.IP
-	PeerOuterPort int
-	PeerPublicKey string
-	PeerPodSubnet string
+	PeerHostname      string   `json:"hostname"`
+	PeerInnerIp       net.IP   `json:"innerIp,omitempty"`
+	PeerOuterIp       net.IP   `json:"outerIp,omitempty"`
+	PeerOuterPort     int      `json:"outerPort,omitempty"`
+	PeerPublicKey     string   `json:"publicKey"`
+	PeerPodSubnet     string   `json:"podSubnet,omitempty"`
+	PeerRoutedSubnets []string `json:"routedSubnets,omitempty"`
+	PeerNodeIps       []string `json:"nodeIps,omitempty"`
+	PeerSource        string   `json:"source,omitempty"`
+	PeerGateway       bool     `json:"gateway,omitempty"`
+	PeerZone          string   `json:"zone,omitempty"`
+}
+
+// Subnets returns all subnets which are routed through the tunnel to this peer.
+func (p *Peer) Subnets() []string {
+	var subnets []string
+	if p.PeerPodSubnet != "" {
+		subnets = append(subnets, p.PeerPodSubnet)
+	}
+	return append(subnets, p.PeerRoutedSubnets...)
+}
+
+// AllowedIps returns the wireguard allowed-ips of this peer: its tunnel inner IP, all of its subnets and its node IPs.
+func (p *Peer) AllowedIps() []string {
+	var allowedIps []string
+	if p.PeerInnerIp != nil {
+		allowedIps = append(allowedIps, p.PeerInnerIp.String())
+	}
+	allowedIps = append(allowedIps, p.Subnets()...)
+	return append(allowedIps, p.PeerNodeIps...)
 }
 
 // PeerList is a list of peers.
@@ -46,3 +82,126 @@ func (pl *PeerList) UpdateOrAdd(p *Peer) error {
 
 	return nil
 }
+
+// ListBySource returns all peers which were created from the given source.
+func (pl *PeerList) ListBySource(source string) []*Peer {
+	var peers []*Peer
+	for _, p := range *pl {
+		if p.PeerSource == source {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// Copy returns a copy of the peer list. The peers are copied, too, so that later changes of the peers in pl do not
+// affect the copy.
+func (pl *PeerList) Copy() *PeerList {
+	c := NewPeerList()
+	for name, p := range *pl {
+		peer := *p
+		peer.PeerRoutedSubnets = append([]string(nil), p.PeerRoutedSubnets...)
+		peer.PeerNodeIps = append([]string(nil), p.PeerNodeIps...)
+		(*c)[name] = &peer
+	}
+	return c
+}
+
+// PeerChange is a peer which exists in both peer lists of a diff, but with different fields.
+type PeerChange struct {
+	Old *Peer
+	New *Peer
+	// Fields holds the names of the fields which differ, e.g. PeerOuterIp.
+	Fields []string
+}
+
+// AffectsDataPlane returns true if any of the changed fields is configured on the tunnel or in the routes. The
+// source, gateway role and zone of a peer only matter for the topology.
+func (c *PeerChange) AffectsDataPlane() bool {
+	for _, field := range c.Fields {
+		switch field {
+		case "PeerSource", "PeerGateway", "PeerZone":
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// PeerListDiff holds the changes which turn one peer list into another. All lists are sorted by peer hostname.
+type PeerListDiff struct {
+	Added   []*Peer
+	Removed []*Peer
+	Changed []*PeerChange
+}
+
+// Empty returns true if the diff holds no changes.
+func (d *PeerListDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d *PeerListDiff) String() string {
+	return fmt.Sprintf("%d added, %d removed, %d changed", len(d.Added), len(d.Removed), len(d.Changed))
+}
+
+// Diff returns the changes which turn the peer list applied into pl, e.g. the last peer list which was applied to
+// the tunnel.
+func (pl *PeerList) Diff(applied *PeerList) *PeerListDiff {
+	d := &PeerListDiff{}
+	for name, p := range *pl {
+		old, ok := (*applied)[name]
+		if !ok {
+			d.Added = append(d.Added, p)
+			continue
+		}
+		if fields := changedFields(old, p); len(fields) > 0 {
+			d.Changed = append(d.Changed, &PeerChange{Old: old, New: p, Fields: fields})
+		}
+	}
+	for name, p := range *applied {
+		if _, ok := (*pl)[name]; !ok {
+			d.Removed = append(d.Removed, p)
+		}
+	}
+	sort.Slice(d.Added, func(i, j int) bool { return d.Added[i].PeerHostname < d.Added[j].PeerHostname })
+	sort.Slice(d.Removed, func(i, j int) bool { return d.Removed[i].PeerHostname < d.Removed[j].PeerHostname })
+	sort.Slice(d.Changed, func(i, j int) bool { return d.Changed[i].New.PeerHostname < d.Changed[j].New.PeerHostname })
+	return d
+}
+
+// changedFields returns the names of the fields which differ between the two peers.
+func changedFields(old, new *Peer) []string {
+	var fields []string
+	if !old.PeerInnerIp.Equal(new.PeerInnerIp) {
+		fields = append(fields, "PeerInnerIp")
+	}
+	if !old.PeerOuterIp.Equal(new.PeerOuterIp) {
+		fields = append(fields, "PeerOuterIp")
+	}
+	if old.PeerOuterPort != new.PeerOuterPort {
+		fields = append(fields, "PeerOuterPort")
+	}
+	if old.PeerPublicKey != new.PeerPublicKey {
+		fields = append(fields, "PeerPublicKey")
+	}
+	if old.PeerPodSubnet != new.PeerPodSubnet {
+		fields = append(fields, "PeerPodSubnet")
+	}
+	if !reflect.DeepEqual(old.PeerRoutedSubnets, new.PeerRoutedSubnets) &&
+		(len(old.PeerRoutedSubnets) > 0 || len(new.PeerRoutedSubnets) > 0) {
+		fields = append(fields, "PeerRoutedSubnets")
+	}
+	if !reflect.DeepEqual(old.PeerNodeIps, new.PeerNodeIps) && (len(old.PeerNodeIps) > 0 || len(new.PeerNodeIps) > 0) {
+		fields = append(fields, "PeerNodeIps")
+	}
+	if old.PeerSource != new.PeerSource {
+		fields = append(fields, "PeerSource")
+	}
+	if old.PeerGateway != new.PeerGateway {
+		fields = append(fields, "PeerGateway")
+	}
+	if old.PeerZone != new.PeerZone {
+		fields = append(fields, "PeerZone")
+	}
+	return fields
+}
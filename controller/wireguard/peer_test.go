@@ -60,3 +60,108 @@ func TestPeerList(t *testing.T) {
 		t.Fatal(fmt.Sprintf("TestPeerList(): Expected peer.PeerInnerIp to be %s, got %s instead", "192.168.0.3", peer.PeerInnerIp.String()))
 	}
 }
+
+func TestPeerAllowedIps(t *testing.T) {
+	tcs := []struct {
+		peer     Peer
+		expected []string
+	}{
+		{
+			peer: Peer{
+				PeerInnerIp:   net.ParseIP("100.64.0.103"),
+				PeerPodSubnet: "10.245.3.0/24",
+			},
+			expected: []string{"100.64.0.103", "10.245.3.0/24"},
+		},
+		{
+			peer: Peer{
+				PeerRoutedSubnets: []string{"192.0.2.10/32", "192.168.10.0/24"},
+				PeerSource:        PeerSourceStatic,
+			},
+			expected: []string{"192.0.2.10/32", "192.168.10.0/24"},
+		},
+		{
+			peer: Peer{
+				PeerInnerIp:   net.ParseIP("100.64.0.103"),
+				PeerPodSubnet: "10.245.3.0/24",
+				PeerNodeIps:   []string{"172.18.0.3/32"},
+			},
+			expected: []string{"100.64.0.103", "10.245.3.0/24", "172.18.0.3/32"},
+		},
+	}
+	for k, tc := range tcs {
+		allowedIps := tc.peer.AllowedIps()
+		if fmt.Sprint(allowedIps) != fmt.Sprint(tc.expected) {
+			t.Fatal(fmt.Sprintf("TestPeerAllowedIps() - Test %d: Expected %v, got %v", k, tc.expected, allowedIps))
+		}
+	}
+}
+
+func TestPeerListDiff(t *testing.T) {
+	worker1 := &Peer{
+		PeerHostname:  "worker-1",
+		PeerInnerIp:   net.ParseIP("100.64.0.3"),
+		PeerOuterIp:   net.ParseIP("172.18.0.3"),
+		PeerOuterPort: 10000,
+		PeerPublicKey: "pub1",
+		PeerPodSubnet: "10.245.3.0/24",
+	}
+	worker2 := &Peer{
+		PeerHostname:  "worker-2",
+		PeerInnerIp:   net.ParseIP("100.64.0.4"),
+		PeerOuterIp:   net.ParseIP("172.18.0.4"),
+		PeerOuterPort: 10000,
+		PeerPublicKey: "pub2",
+		PeerPodSubnet: "10.245.4.0/24",
+	}
+	worker3 := &Peer{
+		PeerHostname:  "worker-3",
+		PeerInnerIp:   net.ParseIP("100.64.0.5"),
+		PeerOuterIp:   net.ParseIP("172.18.0.5"),
+		PeerOuterPort: 10000,
+		PeerPublicKey: "pub3",
+		PeerPodSubnet: "10.245.5.0/24",
+	}
+
+	applied := NewPeerList()
+	applied.UpdateOrAdd(worker1)
+	applied.UpdateOrAdd(worker2)
+	applied = applied.Copy()
+
+	pl := applied.Copy()
+	if d := pl.Diff(applied); !d.Empty() {
+		t.Fatal(fmt.Sprintf("Diff(): Expected no changes between copies, got %s", d))
+	}
+
+	// worker-1 moved and became a gateway, worker-2 was deleted and worker-3 was added
+	moved := *worker1
+	moved.PeerOuterIp = net.ParseIP("172.18.1.3")
+	moved.PeerGateway = true
+	pl.UpdateOrAdd(&moved)
+	pl.Delete("worker-2")
+	pl.UpdateOrAdd(worker3)
+
+	d := pl.Diff(applied)
+	if len(d.Added) != 1 || d.Added[0].PeerHostname != "worker-3" {
+		t.Fatal(fmt.Sprintf("Diff(): Expected worker-3 to be added, got %v", d.Added))
+	}
+	if len(d.Removed) != 1 || d.Removed[0].PeerHostname != "worker-2" {
+		t.Fatal(fmt.Sprintf("Diff(): Expected worker-2 to be removed, got %v", d.Removed))
+	}
+	if len(d.Changed) != 1 || fmt.Sprint(d.Changed[0].Fields) != "[PeerOuterIp PeerGateway]" || !d.Changed[0].AffectsDataPlane() {
+		t.Fatal(fmt.Sprintf("Diff(): Expected the endpoint and gateway role of worker-1 to change, got %v", d.Changed))
+	}
+	if !(*applied)["worker-1"].PeerOuterIp.Equal(worker1.PeerOuterIp) {
+		t.Fatal("Diff(): Expected the applied peer list to be unmodified")
+	}
+
+	// the gateway role alone does not change the data plane
+	gateway := *worker1
+	gateway.PeerGateway = true
+	pl = applied.Copy()
+	pl.UpdateOrAdd(&gateway)
+	d = pl.Diff(applied)
+	if len(d.Changed) != 1 || d.Changed[0].AffectsDataPlane() {
+		t.Fatal(fmt.Sprintf("Diff(): Expected a change which does not affect the data plane, got %v", d.Changed))
+	}
+}
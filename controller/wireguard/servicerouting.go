@@ -0,0 +1,132 @@
+package wireguard
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+// ServiceRouting keeps the pod's IP address as source address of the traffic of the local pods to the Service
+// ClusterIPs, which kube-proxy translates in the default namespace. The ClusterIpCidrs are routed through the link into
+// the default namespace, and the controller exempts them from masquerading. kube-proxy sends the translated traffic
+// back into the wireguard namespace, towards a remote or a local backend, whose replies would go straight to the pod
+// without the reverse translation. So the connections which enter the wireguard namespace from the default namespace
+// with a local pod's IP address are marked with FwMark, and the rule `fwmark FwMark lookup RouteTable` sends their
+// replies back into the default namespace. Bridged replies never reach the rule, so with a bridge, service traffic
+// between the pods of the node is masqueraded in the default namespace. It requires the wireguard namespace and
+// LocalPodCidr.
+type ServiceRouting struct {
+	ClusterIpCidrs []string
+	RouteTable     int
+	RulePriority   int
+	FwMark         int
+}
+
+// serviceRule returns the rule of the wireguard namespace, without the action, which sends the replies of the
+// service backends back into the default namespace.
+func (dp *DataPlane) serviceRule() string {
+	sr := dp.ServiceRouting
+	return utils.NetnsExec(dp.Namespace) + fmt.Sprintf("ip rule %%s fwmark 0x%x lookup %d priority %d", sr.FwMark, sr.RouteTable, sr.RulePriority)
+}
+
+// serviceIptablesRules returns the iptables rules, without the command, which mark the connections to the service
+// backends and masquerade the service traffic which cannot return through the default namespace otherwise. The first
+// two rules live inside the wireguard namespace, the others in the default namespace.
+func (dp *DataPlane) serviceIptablesRules() []string {
+	ns := utils.NetnsExec(dp.Namespace)
+	rules := []string{
+		ns + fmt.Sprintf("iptables -t mangle %%s PREROUTING -i %s --src %s -m conntrack --ctstate NEW -j CONNMARK --set-mark 0x%x",
+			dp.Link.ToDefaultNsInterface, dp.LocalPodCidr, dp.ServiceRouting.FwMark),
+		ns + "iptables -t mangle %s PREROUTING ! -i " + dp.Link.ToDefaultNsInterface + " -j CONNMARK --restore-mark",
+	}
+	// backends outside of the cluster's pod network reply to the node, not to the pod
+	if dp.Masquerade {
+		rules = append(rules, "iptables -t nat %s POSTROUTING -o "+dp.Uplink+" --src "+dp.LocalPodCidr+" -j MASQUERADE")
+	}
+	if dp.Bridge != "" {
+		rules = append(rules, "iptables -t nat %s POSTROUTING -o "+dp.Link.ToWireguardNsInterface+" --src "+dp.LocalPodCidr+
+			" --dst "+dp.LocalPodCidr+" -j MASQUERADE")
+	}
+	return rules
+}
+
+// serviceRouteCommands returns the commands which route the ClusterIpCidrs and, in table RouteTable, all traffic
+// through the link into the default namespace.
+func (dp *DataPlane) serviceRouteCommands() []string {
+	via := " via " + dp.Link.ToWireguardNsInterfaceIp + " dev " + dp.Link.ToDefaultNsInterface + " proto " + RouteProtocol
+	var cmds []string
+	for _, cidr := range dp.ServiceRouting.ClusterIpCidrs {
+		cmds = append(cmds, utils.NetnsExec(dp.Namespace)+"ip route replace "+cidr+via)
+	}
+	return append(cmds, utils.NetnsExec(dp.Namespace)+"ip route replace default"+via+" table "+
+		strconv.Itoa(dp.ServiceRouting.RouteTable))
+}
+
+// ensureServiceRouting sets the routes and adds the rules which are missing.
+func (dp *DataPlane) ensureServiceRouting() error {
+	cmds := dp.serviceRouteCommands()
+	for _, rule := range dp.serviceIptablesRules() {
+		cmds = append(cmds, fmt.Sprintf(rule, "-C")+" 2>/dev/null || "+fmt.Sprintf(rule, "-I"))
+	}
+	exists, err := hasIpRule(dp.serviceRule())
+	if err != nil {
+		return err
+	}
+	if !exists {
+		cmds = append(cmds, fmt.Sprintf(dp.serviceRule(), "add"))
+	}
+	for _, cmd := range cmds {
+		if err := utils.RunCommand(cmd, "ensureServiceRouting"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detectServiceRoutingDrift checks the routes and the rules of the service traffic.
+func (dp *DataPlane) detectServiceRoutingDrift() ([]Drift, error) {
+	var drifts []Drift
+	out, err := utils.RunCommandWithOutput(utils.NetnsExec(dp.Namespace)+"ip route ls dev "+dp.Link.ToDefaultNsInterface+
+		" proto "+RouteProtocol, "detectServiceRoutingDrift")
+	if err != nil {
+		return nil, err
+	}
+	for _, cidr := range dp.ServiceRouting.ClusterIpCidrs {
+		if !containsField(out, 0, utils.NormalizeCidr(cidr)) {
+			drifts = append(drifts, Drift{DriftService, "route to " + cidr + " is missing"})
+		}
+	}
+	out, err = utils.RunCommandWithOutput(utils.NetnsExec(dp.Namespace)+"ip route ls proto "+RouteProtocol+" table "+
+		strconv.Itoa(dp.ServiceRouting.RouteTable), "detectServiceRoutingDrift")
+	if err != nil {
+		return nil, err
+	}
+	if !containsField(out, 0, "default") {
+		drifts = append(drifts, Drift{DriftService, "default route of table " + strconv.Itoa(dp.ServiceRouting.RouteTable) + " is missing"})
+	}
+	exists, err := hasIpRule(dp.serviceRule())
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		drifts = append(drifts, Drift{DriftService, "rule is missing: " + fmt.Sprintf(dp.serviceRule(), "add")})
+	}
+	for _, rule := range dp.serviceIptablesRules() {
+		if err := utils.RunCommand(fmt.Sprintf(rule, "-C"), "detectServiceRoutingDrift"); err != nil {
+			drifts = append(drifts, Drift{DriftService, "rule is missing: " + fmt.Sprintf(rule, "-A")})
+		}
+	}
+	return drifts, nil
+}
+
+// teardownServiceRouting removes the rules of the default namespace. The routes and the rules of the wireguard
+// namespace are removed together with the namespace.
+func (dp *DataPlane) teardownServiceRouting() error {
+	for _, rule := range dp.serviceIptablesRules()[2:] {
+		if err := utils.RunCommand(fmt.Sprintf(rule, "-D")+" 2>/dev/null || true", "teardownServiceRouting"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package wireguard
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+func TestEnsureServiceRouting(t *testing.T) {
+	serviceRouting := &ServiceRouting{ClusterIpCidrs: []string{"10.96.0.0/16"}, RouteTable: 89, RulePriority: 95, FwMark: 0x580000}
+	ns := "ip netns exec wireguard-kubernetes "
+
+	tcs := []struct {
+		dataPlane *DataPlane
+		outputs   map[string]string
+		expected  []string
+	}{
+		{
+			// bridged replies between local pods cannot be sent back into the default namespace
+			dataPlane: &DataPlane{Namespace: "wireguard-kubernetes", Link: DefaultNamespaceLink, Uplink: "eth0", Masquerade: true,
+				Bridge: "wgb0", LocalPodCidr: "10.245.1.0/24", ServiceRouting: serviceRouting},
+			expected: []string{
+				ns + "ip rule show fwmark 0x580000 lookup 89 priority 95",
+				ns + "ip route replace 10.96.0.0/16 via 169.254.0.1 dev to-default-ns proto 87",
+				ns + "ip route replace default via 169.254.0.1 dev to-default-ns proto 87 table 89",
+				ns + "iptables -t mangle -C PREROUTING -i to-default-ns --src 10.245.1.0/24 -m conntrack --ctstate NEW -j CONNMARK --set-mark 0x580000 2>/dev/null || " +
+					ns + "iptables -t mangle -I PREROUTING -i to-default-ns --src 10.245.1.0/24 -m conntrack --ctstate NEW -j CONNMARK --set-mark 0x580000",
+				ns + "iptables -t mangle -C PREROUTING ! -i to-default-ns -j CONNMARK --restore-mark 2>/dev/null || " +
+					ns + "iptables -t mangle -I PREROUTING ! -i to-default-ns -j CONNMARK --restore-mark",
+				"iptables -t nat -C POSTROUTING -o eth0 --src 10.245.1.0/24 -j MASQUERADE 2>/dev/null || " +
+					"iptables -t nat -I POSTROUTING -o eth0 --src 10.245.1.0/24 -j MASQUERADE",
+				"iptables -t nat -C POSTROUTING -o to-wg-ns --src 10.245.1.0/24 --dst 10.245.1.0/24 -j MASQUERADE 2>/dev/null || " +
+					"iptables -t nat -I POSTROUTING -o to-wg-ns --src 10.245.1.0/24 --dst 10.245.1.0/24 -j MASQUERADE",
+				ns + "ip rule add fwmark 0x580000 lookup 89 priority 95",
+			},
+		},
+		{
+			// the rule exists already, routed replies between local pods reach the rule
+			dataPlane: &DataPlane{Namespace: "wireguard-kubernetes", Link: DefaultNamespaceLink, Uplink: "eth0", Routed: true,
+				LocalPodCidr: "10.245.1.0/24", ServiceRouting: serviceRouting},
+			outputs: map[string]string{
+				ns + "ip rule show fwmark 0x580000 lookup 89 priority 95": "95:	from all fwmark 0x580000 lookup 89\n",
+			},
+			expected: []string{
+				ns + "ip rule show fwmark 0x580000 lookup 89 priority 95",
+				ns + "ip route replace 10.96.0.0/16 via 169.254.0.1 dev to-default-ns proto 87",
+				ns + "ip route replace default via 169.254.0.1 dev to-default-ns proto 87 table 89",
+				ns + "iptables -t mangle -C PREROUTING -i to-default-ns --src 10.245.1.0/24 -m conntrack --ctstate NEW -j CONNMARK --set-mark 0x580000 2>/dev/null || " +
+					ns + "iptables -t mangle -I PREROUTING -i to-default-ns --src 10.245.1.0/24 -m conntrack --ctstate NEW -j CONNMARK --set-mark 0x580000",
+				ns + "iptables -t mangle -C PREROUTING ! -i to-default-ns -j CONNMARK --restore-mark 2>/dev/null || " +
+					ns + "iptables -t mangle -I PREROUTING ! -i to-default-ns -j CONNMARK --restore-mark",
+			},
+		},
+	}
+	for k, tc := range tcs {
+		recorder := utils.NewCommandRecorder(tc.outputs)
+		restore := recorder.Install()
+		err := tc.dataPlane.ensureServiceRouting()
+		restore()
+		if err != nil {
+			t.Fatal(fmt.Sprintf("ensureServiceRouting() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		if commands := recorder.Commands(); !reflect.DeepEqual(commands, tc.expected) {
+			t.Fatal(fmt.Sprintf("ensureServiceRouting() - Test %d: Expected commands %v, got %v", k, tc.expected, commands))
+		}
+	}
+}
+
+func TestDetectServiceRoutingDrift(t *testing.T) {
+	ns := "ip netns exec wireguard-kubernetes "
+	dp := &DataPlane{Namespace: "wireguard-kubernetes", Link: DefaultNamespaceLink, Uplink: "eth0", Routed: true,
+		LocalPodCidr:   "10.245.1.0/24",
+		ServiceRouting: &ServiceRouting{ClusterIpCidrs: []string{"10.96.0.0/16"}, RouteTable: 89, RulePriority: 95, FwMark: 0x580000}}
+
+	tcs := []struct {
+		outputs  map[string]string
+		expected []string
+	}{
+		{
+			outputs: map[string]string{
+				ns + "ip route ls dev to-default-ns proto 87":             "10.96.0.0/16 via 169.254.0.1\n",
+				ns + "ip route ls proto 87 table 89":                      "default via 169.254.0.1 dev to-default-ns\n",
+				ns + "ip rule show fwmark 0x580000 lookup 89 priority 95": "95:	from all fwmark 0x580000 lookup 89\n",
+			},
+		},
+		{
+			outputs: map[string]string{
+				ns + "ip route ls proto 87 table 89": "default via 169.254.0.1 dev to-default-ns\n",
+			},
+			expected: []string{DriftService, DriftService},
+		},
+	}
+	for k, tc := range tcs {
+		recorder := utils.NewCommandRecorder(tc.outputs)
+		restore := recorder.Install()
+		drifts, err := dp.detectServiceRoutingDrift()
+		restore()
+		if err != nil {
+			t.Fatal(fmt.Sprintf("detectServiceRoutingDrift() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		var components []string
+		for _, drift := range drifts {
+			components = append(components, drift.Component)
+		}
+		if !reflect.DeepEqual(components, tc.expected) {
+			t.Fatal(fmt.Sprintf("detectServiceRoutingDrift() - Test %d: Expected drift %v, got %v", k, tc.expected, drifts))
+		}
+	}
+}
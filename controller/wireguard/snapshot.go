@@ -0,0 +1,77 @@
+package wireguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sort"
+)
+
+// snapshotVersion is the version of the snapshot format. Snapshots of other versions are refused.
+const snapshotVersion = 1
+
+// snapshot is the file format of a peer state snapshot.
+type snapshot struct {
+	Version int     `json:"version"`
+	Peers   []*Peer `json:"peers"`
+}
+
+// SaveSnapshot atomically writes the peers in pl to file, so that they can be restored with LoadSnapshot when the
+// agent restarts. The peers are sorted by hostname.
+func SaveSnapshot(file string, pl *PeerList) error {
+	s := snapshot{Version: snapshotVersion, Peers: make([]*Peer, 0, len(*pl))}
+	for _, p := range *pl {
+		s.Peers = append(s.Peers, p)
+	}
+	sort.Slice(s.Peers, func(i, j int) bool { return s.Peers[i].PeerHostname < s.Peers[j].PeerHostname })
+	out, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Cannot encode peer snapshot: %v", err)
+	}
+
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		return fmt.Errorf("Cannot create directory for the peer snapshot: %v", err)
+	}
+	if err := os.WriteFile(file+".tmp", append(out, '\n'), 0600); err != nil {
+		return fmt.Errorf("Cannot write peer snapshot: %v", err)
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return fmt.Errorf("Cannot write peer snapshot: %v", err)
+	}
+	return nil
+}
+
+// LoadSnapshot reads the peers which were written with SaveSnapshot. It returns nil and no error if file does not
+// exist. Snapshots with an unknown version or invalid peers are refused as a whole.
+func LoadSnapshot(file string) (*PeerList, error) {
+	in, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read peer snapshot: %v", err)
+	}
+	var s snapshot
+	if err := json.Unmarshal(in, &s); err != nil {
+		return nil, fmt.Errorf("Cannot decode peer snapshot %s: %v", file, err)
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("Unsupported version %d of peer snapshot %s, expected %d", s.Version, file, snapshotVersion)
+	}
+
+	pl := NewPeerList()
+	for _, p := range s.Peers {
+		if p == nil || p.PeerHostname == "" || p.PeerPublicKey == "" {
+			return nil, fmt.Errorf("Invalid peer in snapshot %s: hostname and public key are required", file)
+		}
+		for _, subnet := range p.Subnets() {
+			if _, _, err := net.ParseCIDR(subnet); err != nil {
+				return nil, fmt.Errorf("Invalid subnet of peer %s in snapshot %s: %v", p.PeerHostname, file, err)
+			}
+		}
+		pl.UpdateOrAdd(p)
+	}
+	return pl, nil
+}
@@ -0,0 +1,70 @@
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	pl := NewPeerList()
+	pl.UpdateOrAdd(&Peer{
+		PeerHostname:  "worker-1",
+		PeerInnerIp:   net.ParseIP("100.64.0.3"),
+		PeerOuterIp:   net.ParseIP("172.18.0.3"),
+		PeerOuterPort: 10000,
+		PeerPublicKey: "qP+1Sstf6Y0MYBeUtJjWthBMfx8uG1hmK4mz9hOQjGI=",
+		PeerPodSubnet: "10.245.3.0/24",
+		PeerGateway:   true,
+		PeerZone:      "zone-a",
+	})
+	pl.UpdateOrAdd(&Peer{
+		PeerHostname:      "database",
+		PeerOuterIp:       net.ParseIP("192.0.2.10"),
+		PeerOuterPort:     51820,
+		PeerPublicKey:     "bDOPiAaYvtq1y+7+u75t1QYhogY4cuLo02jPhjNM+FA=",
+		PeerRoutedSubnets: []string{"192.0.2.10/32"},
+		PeerSource:        PeerSourceStatic,
+	})
+
+	file := path.Join(t.TempDir(), "state", "peers.json")
+	if err := SaveSnapshot(file, pl); err != nil {
+		t.Fatal(fmt.Sprintf("SaveSnapshot(): Expected to return nil error, instead got %s", err))
+	}
+	loaded, err := LoadSnapshot(file)
+	if err != nil {
+		t.Fatal(fmt.Sprintf("LoadSnapshot(): Expected to return nil error, instead got %s", err))
+	}
+	if !reflect.DeepEqual(loaded, pl) {
+		t.Fatal(fmt.Sprintf("LoadSnapshot(): Expected peers %v, got %v", *pl, *loaded))
+	}
+
+	tcs := []struct {
+		content string
+		isError bool
+	}{
+		{content: `{"version": 1, "peers": []}`, isError: false},
+		{content: `{"version": 2, "peers": []}`, isError: true},
+		{content: `{"version": 1, "peers": [{"hostname": "worker-1"}]}`, isError: true},
+		{content: `{"version": 1, "peers": [{"hostname": "worker-1", "publicKey": "key", "podSubnet": "10.245.3.0"}]}`, isError: true},
+		{content: `{"version": 1, "peers": [`, isError: true},
+	}
+	for k, tc := range tcs {
+		if err := os.WriteFile(file, []byte(tc.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadSnapshot(file)
+		if (err != nil) != tc.isError {
+			t.Fatal(fmt.Sprintf("LoadSnapshot() - Test %d: Expected error %t, instead got %v", k, tc.isError, err))
+		}
+	}
+
+	// a missing snapshot is not an error
+	loaded, err = LoadSnapshot(path.Join(t.TempDir(), "peers.json"))
+	if loaded != nil || err != nil {
+		t.Fatal(fmt.Sprintf("LoadSnapshot(): Expected no peers and no error for a missing snapshot, instead got %v and %v", loaded, err))
+	}
+}
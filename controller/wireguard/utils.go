@@ -61,7 +61,7 @@ func EnsureWireguardKeys(wireguardPrivateKey, wireguardPublicKey string) error {
 // EnsureBridge creates the bridge which joins the pod veth endpoints to the overlay.
 // If the bridge exists already, it does nothing.
 func EnsureBridge(wireguardNamespace, bridgeName, bridgeIp, bridgeIpNetmask string) error {
-	cmd := "ip netns exec " + wireguardNamespace + " ip link ls type bridge"
+	cmd := utils.NetnsExec(wireguardNamespace) + "ip link ls type bridge"
 	out, err := utils.RunCommandWithOutput(cmd, "EnsureBridge")
 	if err != nil {
 		return err
@@ -76,9 +76,9 @@ func EnsureBridge(wireguardNamespace, bridgeName, bridgeIp, bridgeIpNetmask stri
 	}
 
 	cmds := []string{
-		"ip netns exec " + wireguardNamespace + " ip link add " + bridgeName + " type bridge",
-		"ip netns exec " + wireguardNamespace + " ip address add dev " + bridgeName + " " + bridgeIp + "/" + bridgeIpNetmask,
-		"ip netns exec " + wireguardNamespace + " ip link set dev " + bridgeName + " up",
+		utils.NetnsExec(wireguardNamespace) + "ip link add " + bridgeName + " type bridge",
+		utils.NetnsExec(wireguardNamespace) + "ip address add dev " + bridgeName + " " + bridgeIp + "/" + bridgeIpNetmask,
+		utils.NetnsExec(wireguardNamespace) + "ip link set dev " + bridgeName + " up",
 	}
 	for _, cmd := range cmds {
 		err := utils.RunCommand(cmd, "EnsureBridge")
@@ -90,9 +90,56 @@ func EnsureBridge(wireguardNamespace, bridgeName, bridgeIp, bridgeIpNetmask stri
 	return nil
 }
 
+// EnsureUnreachableRoute makes the addresses of the local pod CIDR which are not routed to a pod unreachable inside
+// the wireguard namespace. Otherwise, traffic to them would follow the default route back into the default namespace,
+// which routes the pod CIDR into the wireguard namespace again. Without the wireguard namespace, it would leave the
+// node through the default route instead.
+func EnsureUnreachableRoute(wireguardNamespace, localPodCidr string) error {
+	cmd := utils.NetnsExec(wireguardNamespace) + "ip route replace unreachable " + localPodCidr + " proto " + RouteProtocol
+	return utils.RunCommand(cmd, "EnsureUnreachableRoute")
+}
+
+// NamespaceLink describes the veth pair which connects the default namespace with the wireguard namespace. The zero
+// NamespaceLink is used when the tunnel lives in the default namespace, there are no routes into a wireguard namespace
+// then.
+type NamespaceLink struct {
+	ToWireguardNsInterface   string
+	ToDefaultNsInterface     string
+	ToWireguardNsInterfaceIp string
+	ToDefaultNsInterfaceIp   string
+	PrefixLength             int
+	// RouteTable is the routing table of the default namespace which holds the routes into the wireguard namespace.
+	// 0 is the main table.
+	RouteTable int
+}
+
+// none returns true if there is no link, because the tunnel lives in the default namespace.
+func (l NamespaceLink) none() bool {
+	return l.ToWireguardNsInterface == ""
+}
+
+// routeTable returns the table argument of the ip route commands of the link, if it does not use the main table.
+func (l NamespaceLink) routeTable() string {
+	if l.RouteTable == 0 {
+		return ""
+	}
+	return " table " + strconv.Itoa(l.RouteTable)
+}
+
+// DefaultNamespaceLink is the default link between the default namespace and the wireguard namespace.
+var DefaultNamespaceLink = NamespaceLink{
+	ToWireguardNsInterface:   "to-wg-ns",
+	ToDefaultNsInterface:     "to-default-ns",
+	ToWireguardNsInterfaceIp: "169.254.0.1",
+	ToDefaultNsInterfaceIp:   "169.254.0.2",
+	PrefixLength:             30,
+}
+
 // EnsureNamespace creates a namespace with a given name only if the namespace does not exist yet.
 // Otherwise, it does nothing.
-func EnsureNamespace(wireguardNamespace, nodeDefaultInterface string) error {
+// If masquerade is true, traffic which leaves the wireguard namespace is masqueraded behind the link's IP
+// address, and again behind the node's IP address when it leaves the node through nodeDefaultInterface.
+func EnsureNamespace(wireguardNamespace, nodeDefaultInterface string, link NamespaceLink, masquerade bool) error {
 	err := createNamespace(wireguardNamespace)
 	if err != nil {
 		return err
@@ -100,12 +147,13 @@ func EnsureNamespace(wireguardNamespace, nodeDefaultInterface string) error {
 
 	err = connectNamespace(
 		wireguardNamespace,
-		"to-wg-ns",
-		"to-default-ns",
-		"169.254.0.1",
-		"169.254.0.2",
-		"30",
-		"eth0",
+		link.ToWireguardNsInterface,
+		link.ToDefaultNsInterface,
+		link.ToWireguardNsInterfaceIp,
+		link.ToDefaultNsInterfaceIp,
+		strconv.Itoa(link.PrefixLength),
+		nodeDefaultInterface,
+		masquerade,
 	)
 	if err != nil {
 		return err
@@ -116,7 +164,7 @@ func EnsureNamespace(wireguardNamespace, nodeDefaultInterface string) error {
 
 // EnsureNamespace creates a namespace with a given name only if the namespace does not exist yet.
 // Otherwise, it does nothing.
-func connectNamespace(wireguardNamespace, toWireguardNsInterface, toDefaultNsInterface, toWireguardNsInterfaceIp, toDefaultNsInterfaceIp, privateLinkNetmask, nodeDefaultInterface string) error {
+func connectNamespace(wireguardNamespace, toWireguardNsInterface, toDefaultNsInterface, toWireguardNsInterfaceIp, toDefaultNsInterfaceIp, privateLinkNetmask, nodeDefaultInterface string, masquerade bool) error {
 	cmd := "ip link ls"
 	out, err := utils.RunCommandWithOutput(cmd, "connectNamespace")
 	if err != nil {
@@ -139,12 +187,16 @@ func connectNamespace(wireguardNamespace, toWireguardNsInterface, toDefaultNsInt
 		"ip link set dev " + toDefaultNsInterface + " netns " + wireguardNamespace + "",
 		"ip address add dev " + toWireguardNsInterface + " " + toWireguardNsInterfaceIp + "/" + privateLinkNetmask,
 		"ip link set dev " + toWireguardNsInterface + " up",
-		"ip netns exec " + wireguardNamespace + " ip address add dev " + toDefaultNsInterface + " " + toDefaultNsInterfaceIp + "/" + privateLinkNetmask,
-		"ip netns exec " + wireguardNamespace + " ip link set dev " + toDefaultNsInterface + " up",
-		"ip netns exec " + wireguardNamespace + " ip route add default via " + toWireguardNsInterfaceIp + " dev " + toDefaultNsInterface + "",
-		"ip netns exec " + wireguardNamespace + " iptables -t nat -I POSTROUTING -o " + toDefaultNsInterface + " -j MASQUERADE",
-		"ip netns exec " + wireguardNamespace + " iptables -t nat -I POSTROUTING --src " + toWireguardNsInterfaceIp + " -j MASQUERADE",
-		"iptables -t nat -I POSTROUTING -o " + nodeDefaultInterface + " --src " + toDefaultNsInterfaceIp + " -j MASQUERADE",
+		utils.NetnsExec(wireguardNamespace) + "ip address add dev " + toDefaultNsInterface + " " + toDefaultNsInterfaceIp + "/" + privateLinkNetmask,
+		utils.NetnsExec(wireguardNamespace) + "ip link set dev " + toDefaultNsInterface + " up",
+		utils.NetnsExec(wireguardNamespace) + "ip route add default via " + toWireguardNsInterfaceIp + " dev " + toDefaultNsInterface + "",
+	}
+	if masquerade {
+		cmds = append(cmds,
+			utils.NetnsExec(wireguardNamespace)+"iptables -t nat -I POSTROUTING -o "+toDefaultNsInterface+" -j MASQUERADE",
+			utils.NetnsExec(wireguardNamespace)+"iptables -t nat -I POSTROUTING --src "+toWireguardNsInterfaceIp+" -j MASQUERADE",
+			"iptables -t nat -I POSTROUTING -o "+nodeDefaultInterface+" --src "+toDefaultNsInterfaceIp+" -j MASQUERADE",
+		)
 	}
 	for _, cmd := range cmds {
 		err = utils.RunCommand(cmd, "connectNamespace")
@@ -179,7 +231,7 @@ func createNamespace(wireguardNamespace string) error {
 		return err
 	}
 
-	cmd = "ip netns exec " + wireguardNamespace + " ip link set dev lo up"
+	cmd = utils.NetnsExec(wireguardNamespace) + "ip link set dev lo up"
 	err = utils.RunCommand(cmd, "createNamespace")
 	if err != nil {
 		return err
@@ -213,6 +265,41 @@ func DeleteNamespace(wireguardNamespace string) error {
 	return nil
 }
 
+// TeardownNamespace removes the data plane of the wireguard namespace: the peers and routes of the wireguard tunnel,
+// the routes and the masquerade rule of the default namespace and finally the namespace itself, together with the
+// tunnel and the veth pair. If the namespace does not exist, it does nothing.
+func TeardownNamespace(wireguardNamespace, wireguardInterface, nodeDefaultInterface string, link NamespaceLink, masquerade bool) error {
+	out, err := utils.RunCommandWithOutput("ip netns", "TeardownNamespace")
+	if err != nil {
+		return err
+	}
+	exists := false
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > 0 && fields[0] == wireguardNamespace {
+			exists = true
+		}
+	}
+	if !exists {
+		return nil
+	}
+
+	// an empty peer list prunes all peers and routes, including the route to the local pod subnet
+	err = UpdateWireguardTunnelPeers(wireguardNamespace, wireguardInterface, link, NewPeerList(), "")
+	if err != nil {
+		return err
+	}
+	if masquerade {
+		cmd := "iptables -t nat -D POSTROUTING -o " + nodeDefaultInterface + " --src " + link.ToDefaultNsInterfaceIp + " -j MASQUERADE"
+		err = utils.RunCommand(cmd, "TeardownNamespace")
+		if err != nil {
+			return err
+		}
+	}
+	return DeleteNamespace(wireguardNamespace)
+}
+
 // GetNodeTunnelInnerIp returns the IP address that's stored in annotation `wireguard.kubernetes.io/tunnel-ip`.
 /*func GetNodeTunnelInnerIp(clientset kubernetes.Interface, hostname string) (net.IP, error) {
 	node, err := clientset.CoreV1().Nodes().Get(context.TODO(), hostname, metav1.GetOptions{})
@@ -301,8 +388,8 @@ func AddPublicKeyLabel(c kubernetes.Interface, hostName, pubKey string) error {
 }
 
 // InitWireguardTunnel creates a new wireguard tunnel. It first deletes the existing tunnel, then it creates a new tunnel.
-// Todo: tunnel deletion is overly aggressive and whenever this process restarts, pod traffic would be interrupted.
-func InitWireguardTunnel(wireguardNamespace string, wireguardInterface string, localOuterPort int, localInnerIp net.IP, localPrivateKey string) error {
+// An mtu of 0 keeps the kernel's default MTU. Deleting the tunnel removes all of its peers, see EnsureWireguardTunnel.
+func InitWireguardTunnel(wireguardNamespace string, wireguardInterface string, localOuterPort int, localInnerIp net.IP, localPrivateKey string, mtu int) error {
 	tunnelExists, err := isWireguardTunnel(wireguardNamespace, wireguardInterface)
 	if err != nil {
 		return err
@@ -321,6 +408,7 @@ func InitWireguardTunnel(wireguardNamespace string, wireguardInterface string, l
 		localOuterPort,
 		localInnerIp,
 		localPrivateKey,
+		mtu,
 	)
 	if err != nil {
 		return err
@@ -328,25 +416,50 @@ func InitWireguardTunnel(wireguardNamespace string, wireguardInterface string, l
 	return nil
 }
 
-// UpdateWireguardTunnelPeers applied the contents of pl *PeerList to the wireguard tunnel. Dead routes and peers will be pruned.
-func UpdateWireguardTunnelPeers(wireguardNamespace string, wireguardInterface string, pl *PeerList, localPodCidr string) error {
-	klog.V(5).Info("Updating wireguard tunnels with peer list: ", *pl)
-	err := setWireguardTunnelPeers(wireguardNamespace, wireguardInterface, pl)
+// EnsureWireguardTunnel creates the wireguard tunnel if it does not exist. An existing tunnel is kept together with its
+// peers and routes, so that pod traffic is not interrupted when the agent restarts. Only its private key, listen port,
+// MTU and address are set.
+func EnsureWireguardTunnel(wireguardNamespace string, wireguardInterface string, localOuterPort int, localInnerIp net.IP, localPrivateKey string, mtu int) error {
+	tunnelExists, err := isWireguardTunnel(wireguardNamespace, wireguardInterface)
 	if err != nil {
 		return err
 	}
+	if !tunnelExists {
+		return createWireguardTunnel(wireguardNamespace, wireguardInterface, localOuterPort, localInnerIp, localPrivateKey, mtu)
+	}
 
-	err = setWireguardTunnelPeerRoutes(wireguardNamespace, wireguardInterface, pl)
+	ns := utils.NetnsExec(wireguardNamespace)
+	cmds := []string{ns + "wg set " + wireguardInterface + " private-key " + localPrivateKey + " listen-port " + strconv.Itoa(localOuterPort)}
+	if mtu > 0 {
+		cmds = append(cmds, ns+"ip link set dev "+wireguardInterface+" mtu "+strconv.Itoa(mtu))
+	}
+	cmds = append(cmds,
+		ns+"ip link set dev "+wireguardInterface+" up",
+		ns+"ip address replace dev "+wireguardInterface+" "+localInnerIp.String()+"/16",
+	)
+	for _, cmd := range cmds {
+		if err := utils.RunCommand(cmd, "EnsureWireguardTunnel"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateWireguardTunnelPeers applied the contents of pl *PeerList to the wireguard tunnel. Dead routes and peers will be pruned.
+// The peers are set and pruned atomically with `wg syncconf`.
+func UpdateWireguardTunnelPeers(wireguardNamespace string, wireguardInterface string, link NamespaceLink, pl *PeerList, localPodCidr string) error {
+	klog.V(5).Info("Updating wireguard tunnels with peer list: ", *pl)
+	err := SyncConfig(wireguardNamespace, wireguardInterface, InterfaceConfig{}, pl)
 	if err != nil {
 		return err
 	}
 
-	err = setWireguardNamespaceRoutes("to-wg-ns", "169.254.0.2", pl, localPodCidr)
+	err = setWireguardTunnelPeerRoutes(wireguardNamespace, wireguardInterface, pl)
 	if err != nil {
 		return err
 	}
 
-	err = pruneWireguardTunnelPeers(wireguardNamespace, wireguardInterface, pl)
+	err = setWireguardNamespaceRoutes(link, pl, localPodCidr)
 	if err != nil {
 		return err
 	}
@@ -356,7 +469,7 @@ func UpdateWireguardTunnelPeers(wireguardNamespace string, wireguardInterface st
 		return err
 	}
 
-	err = pruneWireguardNamespaceRoutes("to-wg-ns", "169.254.0.2", pl, localPodCidr)
+	err = pruneWireguardNamespaceRoutes(link, pl, localPodCidr)
 	if err != nil {
 		return err
 	}
@@ -364,40 +477,164 @@ func UpdateWireguardTunnelPeers(wireguardNamespace string, wireguardInterface st
 	return nil
 }
 
-func setWireguardTunnelPeers(wireguardNamespace string, wireguardInterface string, pl *PeerList) error {
-	var err error
-	for _, p := range *pl {
-		cmd := "ip netns exec " + wireguardNamespace + " wg set " + wireguardInterface + " peer " + p.PeerPublicKey + " allowed-ips " + p.PeerInnerIp.String() + "," + p.PeerPodSubnet + " endpoint " + p.PeerOuterIp.String() + ":" + strconv.Itoa(p.PeerOuterPort)
-		err = utils.RunCommand(cmd, "setWireguardTunnelPeers")
+// RouteProtocol is the route protocol number with which wgk8s installs all of its routes in the default namespace
+// and on the tunnel interface. Only routes with this protocol are pruned, routes of other components on the same
+// interfaces are left alone.
+const RouteProtocol = "87"
+
+// nonMasqueradeChain is the iptables chain inside the wireguard namespace which exempts destinations from masquerading.
+const nonMasqueradeChain = "WGK8S-NON-MASQUERADE"
+
+// SetNonMasqueradeCidrs makes sure that traffic from the wireguard namespace to the given destinations is not
+// masqueraded when it leaves through toDefaultNsInterface. The list of destinations replaces any previous list.
+func SetNonMasqueradeCidrs(wireguardNamespace, toDefaultNsInterface string, cidrs []string) error {
+	prefix := utils.NetnsExec(wireguardNamespace) + "iptables -t nat "
+	cmds := []string{
+		prefix + "-N " + nonMasqueradeChain + " 2>/dev/null || " + prefix + "-F " + nonMasqueradeChain,
+		prefix + "-C POSTROUTING -o " + toDefaultNsInterface + " -j " + nonMasqueradeChain + " 2>/dev/null || " +
+			prefix + "-I POSTROUTING -o " + toDefaultNsInterface + " -j " + nonMasqueradeChain,
+	}
+	for _, cidr := range cidrs {
+		cmds = append(cmds, prefix+"-A "+nonMasqueradeChain+" -d "+cidr+" -j ACCEPT")
+	}
+	for _, cmd := range cmds {
+		err := utils.RunCommand(cmd, "SetNonMasqueradeCidrs")
 		if err != nil {
-			klog.V(1).Info(err)
+			return err
 		}
 	}
 	return nil
 }
 
+// ApplyPeerListDiff applies only the changes in diff to the routes, instead of setting and pruning all routes like
+// UpdateWireguardTunnelPeers does. pl is the complete peer list which diff leads to, it is synced to the tunnel in a
+// single operation. All commands are run even if some of them fail, and the first error is returned. After an error,
+// the tunnel should be resynced with UpdateWireguardTunnelPeers.
+func ApplyPeerListDiff(wireguardNamespace string, wireguardInterface string, link NamespaceLink, pl *PeerList, diff *PeerListDiff) error {
+	klog.V(5).Info("Applying peer list diff: ", diff)
+	// old routes are removed before the peers are synced and new routes are added, so that subnets which move from
+	// one peer to another are not removed after they were added to the new peer
+	var removeCmds, addCmds []string
+	for _, p := range diff.Removed {
+		removeCmds = append(removeCmds, removeRouteCommands(wireguardNamespace, wireguardInterface, link, p, nil)...)
+	}
+	changed := len(diff.Removed) > 0 || len(diff.Added) > 0
+	for _, c := range diff.Changed {
+		if !c.AffectsDataPlane() {
+			continue
+		}
+		changed = true
+		removeCmds = append(removeCmds, removeRouteCommands(wireguardNamespace, wireguardInterface, link, c.Old, c.New)...)
+		addCmds = append(addCmds, addRouteCommands(wireguardNamespace, wireguardInterface, link, c.New)...)
+	}
+	for _, p := range diff.Added {
+		addCmds = append(addCmds, addRouteCommands(wireguardNamespace, wireguardInterface, link, p)...)
+	}
+	if !changed {
+		return nil
+	}
+
+	var firstErr error
+	runCommands := func(cmds []string) {
+		for _, cmd := range cmds {
+			if err := utils.RunCommand(cmd, "ApplyPeerListDiff"); err != nil {
+				klog.V(1).Info(err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	runCommands(removeCmds)
+	if err := SyncConfig(wireguardNamespace, wireguardInterface, InterfaceConfig{}, pl); err != nil {
+		return err
+	}
+	runCommands(addCmds)
+	return firstErr
+}
+
+// addRouteCommands returns the commands which add the routes of peer p.
+func addRouteCommands(wireguardNamespace, wireguardInterface string, link NamespaceLink, p *Peer) []string {
+	cmds := wireguardPeerRouteCommands(wireguardNamespace, wireguardInterface, p)
+	if !link.none() {
+		for _, subnet := range p.Subnets() {
+			cmds = append(cmds, namespaceRouteCommand(link, subnet))
+		}
+	}
+	return cmds
+}
+
+// removeRouteCommands returns the commands which remove the routes of peer old which are not routes of peer new. If
+// new is nil, all routes of old are removed.
+func removeRouteCommands(wireguardNamespace, wireguardInterface string, link NamespaceLink, old, new *Peer) []string {
+	var cmds []string
+	keep := map[string]bool{}
+	if new != nil {
+		for _, subnet := range new.Subnets() {
+			keep[utils.NormalizeCidr(subnet)] = true
+		}
+	}
+	var linkCmds []string
+	for _, subnet := range old.Subnets() {
+		if !keep[utils.NormalizeCidr(subnet)] {
+			cmds = append(cmds, utils.NetnsExec(wireguardNamespace)+"ip route delete "+subnet+" dev "+wireguardInterface+" proto "+RouteProtocol)
+			if !link.none() {
+				linkCmds = append(linkCmds, "ip route delete "+subnet+" dev "+link.ToWireguardNsInterface+" proto "+RouteProtocol+link.routeTable())
+			}
+		}
+	}
+	return append(cmds, linkCmds...)
+}
+
+// wireguardPeerRouteCommands returns the commands which route the subnets of peer p onto the tunnel interface.
+func wireguardPeerRouteCommands(wireguardNamespace, wireguardInterface string, p *Peer) []string {
+	// static peers do not have a tunnel inner IP, their subnets are routed directly onto the tunnel interface
+	via := ""
+	if p.PeerInnerIp != nil {
+		via = " via " + p.PeerInnerIp.String()
+	}
+	var cmds []string
+	for _, subnet := range p.Subnets() {
+		// replace adopts routes to the same subnet which were installed without the route protocol
+		cmds = append(cmds, utils.NetnsExec(wireguardNamespace)+"ip route replace "+subnet+via+" dev "+wireguardInterface+" proto "+RouteProtocol)
+	}
+	return cmds
+}
+
+// namespaceRouteCommand returns the command which routes subnet from the default namespace into the wireguard
+// namespace.
+func namespaceRouteCommand(link NamespaceLink, subnet string) string {
+	return "ip route replace " + subnet + " via " + link.ToDefaultNsInterfaceIp + " dev " + link.ToWireguardNsInterface +
+		" proto " + RouteProtocol + link.routeTable()
+}
+
 func setWireguardTunnelPeerRoutes(wireguardNamespace string, wireguardInterface string, pl *PeerList) error {
 	var err error
 	for _, p := range *pl {
-		cmd := "ip netns exec " + wireguardNamespace + " ip route add " + p.PeerPodSubnet + " via " + p.PeerInnerIp.String() + " dev " + wireguardInterface
-		err = utils.RunCommand(cmd, "setWireguardTunnelPeerRoutes")
-		if err != nil {
-			klog.V(1).Info(err)
+		for _, cmd := range wireguardPeerRouteCommands(wireguardNamespace, wireguardInterface, p) {
+			err = utils.RunCommand(cmd, "setWireguardTunnelPeerRoutes")
+			if err != nil {
+				klog.V(1).Info(err)
+			}
 		}
 	}
 	return nil
 }
 
-func setWireguardNamespaceRoutes(toWireguardNsInterface, toWireguardNsInterfaceIp string, pl *PeerList, localPodCidr string) error {
+func setWireguardNamespaceRoutes(link NamespaceLink, pl *PeerList, localPodCidr string) error {
+	if link.none() {
+		return nil
+	}
 	var err error
-	ips := []string{
-		localPodCidr,
+	var ips []string
+	if localPodCidr != "" {
+		ips = append(ips, localPodCidr)
 	}
 	for _, p := range *pl {
-		ips = append(ips, p.PeerPodSubnet)
+		ips = append(ips, p.Subnets()...)
 	}
 	for _, ip := range ips {
-		cmd := "ip route add " + ip + " via " + toWireguardNsInterfaceIp + " dev " + toWireguardNsInterface + ""
+		cmd := namespaceRouteCommand(link, ip)
 		err = utils.RunCommand(cmd, "setWireguardNamespaceRoutes")
 		if err != nil {
 			klog.V(1).Info(err)
@@ -406,44 +643,12 @@ func setWireguardNamespaceRoutes(toWireguardNsInterface, toWireguardNsInterfaceI
 	return nil
 }
 
-func pruneWireguardTunnelPeers(wireguardNamespace, wireguardInterface string, pl *PeerList) error {
-	var err error
-	var configuredPeerPublicKeys []string
-
-	cmd := "ip netns exec " + wireguardNamespace + " wg show " + wireguardInterface + " | awk '/^peer/ {print $2}'"
-	out, err := utils.RunCommandWithOutput(cmd, "pruneWireguardTunnelPeers")
-	if err != nil {
-		return err
-	}
-	s := bufio.NewScanner(bytes.NewReader(out))
-	for s.Scan() {
-		configuredPeerPublicKeys = append(configuredPeerPublicKeys, s.Text())
-	}
-	for _, configuredPeerPublicKey := range configuredPeerPublicKeys {
-		found := false
-		for _, p := range *pl {
-			if p.PeerPublicKey == configuredPeerPublicKey {
-				found = true
-				break
-			}
-		}
-		if !found {
-			cmd := "ip netns exec " + wireguardNamespace + " wg set " + wireguardInterface + " peer " + configuredPeerPublicKey + " remove"
-			err := utils.RunCommand(cmd, "pruneWireguardTunnelPeer")
-			if err != nil {
-				klog.V(1).Info("Could not prune peer ", configuredPeerPublicKey, ": ", err)
-				return err
-			}
-		}
-	}
-	return nil
-}
-
 func pruneWireguardTunnelPeerRoutes(wireguardNamespace, wireguardInterface string, pl *PeerList) error {
 	var err error
 	var currentRoutes []string
 
-	cmd := "ip netns exec " + wireguardNamespace + " ip route ls dev " + wireguardInterface
+	// only routes which were installed by wgk8s are listed
+	cmd := utils.NetnsExec(wireguardNamespace) + "ip route ls dev " + wireguardInterface + " proto " + RouteProtocol
 
 	out, err := utils.RunCommandWithOutput(cmd, "pruneWireguardTunnelPeerRoutes")
 	if err != nil {
@@ -459,15 +664,17 @@ func pruneWireguardTunnelPeerRoutes(wireguardNamespace, wireguardInterface strin
 
 	for _, currentRoute := range currentRoutes {
 		found := false
-		currentSubnet := strings.Fields(currentRoute)[0]
+		currentSubnet := utils.NormalizeCidr(strings.Fields(currentRoute)[0])
 		for _, p := range *pl {
-			if p.PeerPodSubnet == currentSubnet {
-				found = true
-				break
+			for _, subnet := range p.Subnets() {
+				if utils.NormalizeCidr(subnet) == currentSubnet {
+					found = true
+					break
+				}
 			}
 		}
 		if !found {
-			cmd := "ip netns exec " + wireguardNamespace + " ip route delete " + currentRoute
+			cmd := utils.NetnsExec(wireguardNamespace) + "ip route delete " + currentRoute + " proto " + RouteProtocol
 			err := utils.RunCommand(cmd, "pruneWireguardTunnelPeerRoutes")
 			if err != nil {
 				klog.V(1).Info("Could not prune route ", currentRoute, ": ", err)
@@ -479,17 +686,21 @@ func pruneWireguardTunnelPeerRoutes(wireguardNamespace, wireguardInterface strin
 	return nil
 }
 
-func pruneWireguardNamespaceRoutes(toWireguardInterface, toWireguardInterfaceIp string, pl *PeerList, localPodCidr string) error {
+func pruneWireguardNamespaceRoutes(link NamespaceLink, pl *PeerList, localPodCidr string) error {
+	if link.none() {
+		return nil
+	}
 	var err error
 	var currentRoutes []string
 	ips := []string{
 		localPodCidr,
 	}
 	for _, p := range *pl {
-		ips = append(ips, p.PeerPodSubnet)
+		ips = append(ips, p.Subnets()...)
 	}
 
-	cmd := "ip route ls dev " + toWireguardInterface
+	// only routes which were installed by wgk8s are listed
+	cmd := "ip route ls dev " + link.ToWireguardNsInterface + " proto " + RouteProtocol + link.routeTable()
 
 	out, err := utils.RunCommandWithOutput(cmd, "pruneWireguardNamespaceRoutes")
 	if err != nil {
@@ -505,15 +716,15 @@ func pruneWireguardNamespaceRoutes(toWireguardInterface, toWireguardInterfaceIp
 
 	for _, currentRoute := range currentRoutes {
 		found := false
-		currentSubnet := strings.Fields(currentRoute)[0]
+		currentSubnet := utils.NormalizeCidr(strings.Fields(currentRoute)[0])
 		for _, ip := range ips {
-			if ip == currentSubnet {
+			if utils.NormalizeCidr(ip) == currentSubnet {
 				found = true
 				break
 			}
 		}
 		if !found {
-			cmd := "ip route delete " + currentRoute
+			cmd := "ip route delete " + currentRoute + " proto " + RouteProtocol + link.routeTable()
 			err := utils.RunCommand(cmd, "pruneWireguardNamespaceRoutes")
 			if err != nil {
 				klog.V(1).Info("Could not prune route ", currentRoute, ": ", err)
@@ -525,15 +736,22 @@ func pruneWireguardNamespaceRoutes(toWireguardInterface, toWireguardInterfaceIp
 	return nil
 }
 
-func createWireguardTunnel(wireguardNamespace string, wireguardInterface string, localOuterPort int, localInnerIp net.IP, localPrivateKey string) error {
+func createWireguardTunnel(wireguardNamespace string, wireguardInterface string, localOuterPort int, localInnerIp net.IP, localPrivateKey string, mtu int) error {
 	var cmds []string = []string{
 		"ip link add " + wireguardInterface + " type wireguard",
 		"wg set " + wireguardInterface + " private-key " + localPrivateKey + " listen-port " + strconv.Itoa(localOuterPort),
-		"ip link set dev " + wireguardInterface + " netns " + wireguardNamespace,
-
-		"ip netns exec " + wireguardNamespace + " ip link set dev " + wireguardInterface + " up",
-		"ip netns exec " + wireguardNamespace + " ip address add dev " + wireguardInterface + " " + localInnerIp.String() + "/16",
 	}
+	// the tunnel is created in the default namespace, so that its UDP socket stays there
+	if wireguardNamespace != "" {
+		cmds = append(cmds, "ip link set dev "+wireguardInterface+" netns "+wireguardNamespace)
+	}
+	if mtu > 0 {
+		cmds = append(cmds, utils.NetnsExec(wireguardNamespace)+"ip link set dev "+wireguardInterface+" mtu "+strconv.Itoa(mtu))
+	}
+	cmds = append(cmds,
+		utils.NetnsExec(wireguardNamespace)+"ip link set dev "+wireguardInterface+" up",
+		utils.NetnsExec(wireguardNamespace)+"ip address add dev "+wireguardInterface+" "+localInnerIp.String()+"/16",
+	)
 
 	for _, cmd := range cmds {
 		err := utils.RunCommand(cmd, "createWireguardTunnel")
@@ -545,7 +763,7 @@ func createWireguardTunnel(wireguardNamespace string, wireguardInterface string,
 }
 
 func deleteWireguardTunnel(wireguardNamespace string, interfaceName string) error {
-	cmd := "ip netns exec " + wireguardNamespace + " ip link del " + interfaceName
+	cmd := utils.NetnsExec(wireguardNamespace) + "ip link del " + interfaceName
 	err := utils.RunCommand(cmd, "deleteWireguardTunnel")
 	if err != nil {
 		return err
@@ -554,7 +772,7 @@ func deleteWireguardTunnel(wireguardNamespace string, interfaceName string) erro
 }
 
 func isWireguardTunnel(wireguardNamespace, wireguardInterface string) (bool, error) {
-	cmd := "ip netns exec " + wireguardNamespace + " ip -o a"
+	cmd := utils.NetnsExec(wireguardNamespace) + "ip -o a"
 
 	out, err := utils.RunCommandWithOutput(cmd, "isWireguardTunnel")
 	if err != nil {
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"path"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
@@ -173,6 +175,7 @@ func TestEnsureNamespace(t *testing.T) {
 		commandInput         map[string]string
 		wireguardNamespace   string
 		nodeDefaultInterface string
+		masquerade           bool
 		errorExpected        bool
 		mustRunAllCommands   bool
 	}{
@@ -182,6 +185,7 @@ func TestEnsureNamespace(t *testing.T) {
 			},
 			wireguardNamespace:   "wireguard",
 			nodeDefaultInterface: "eth0",
+			masquerade:           true,
 			errorExpected:        true,
 		},
 		{
@@ -199,6 +203,7 @@ wireguard
 			},
 			wireguardNamespace:   "wireguard",
 			nodeDefaultInterface: "eth0",
+			masquerade:           true,
 			errorExpected:        false,
 		},
 		{
@@ -225,6 +230,30 @@ wireguard
 			},
 			wireguardNamespace:   "wireguard",
 			nodeDefaultInterface: "eth0",
+			masquerade:           true,
+			errorExpected:        false,
+			mustRunAllCommands:   true,
+		},
+		{
+			commandInput: map[string]string{
+				"ip netns": `test
+`,
+				"ip link ls": `1: lo: <LOOPBACK,UP,LOWER_UP> mtu 65536 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000
+    link/loopback 00:00:00:00:00:00 brd 00:00:00:00:00:00
+`,
+				"ip netns add wireguard":                                                         "",
+				"ip netns exec wireguard ip link set dev lo up":                                  "",
+				"ip link add name to-wg-ns type veth peer name to-default-ns":                    "",
+				"ip link set dev to-default-ns netns wireguard":                                  "",
+				"ip address add dev to-wg-ns 169.254.0.1/30":                                     "",
+				"ip link set dev to-wg-ns up":                                                    "",
+				"ip netns exec wireguard ip address add dev to-default-ns 169.254.0.2/30":        "",
+				"ip netns exec wireguard ip link set dev to-default-ns up":                       "",
+				"ip netns exec wireguard ip route add default via 169.254.0.1 dev to-default-ns": "",
+			},
+			wireguardNamespace:   "wireguard",
+			nodeDefaultInterface: "eth1",
+			masquerade:           false,
 			errorExpected:        false,
 			mustRunAllCommands:   true,
 		},
@@ -232,7 +261,7 @@ wireguard
 
 	for k, tc := range tcs {
 		commandInput = tc.commandInput
-		err := EnsureNamespace(tc.wireguardNamespace, tc.nodeDefaultInterface)
+		err := EnsureNamespace(tc.wireguardNamespace, tc.nodeDefaultInterface, DefaultNamespaceLink, tc.masquerade)
 		if tc.errorExpected != (err != nil) {
 			t.Fatal(
 				fmt.Sprintf(
@@ -411,6 +440,7 @@ func TestInitWireguardTunnel(t *testing.T) {
 		localOuterPort     int
 		localInnerIp       net.IP
 		localPrivateKey    string
+		mtu                int
 		errorExpected      bool
 		mustRunAllCommands bool
 	}{
@@ -439,6 +469,25 @@ func TestInitWireguardTunnel(t *testing.T) {
 			localPrivateKey:    "privateKey",
 			errorExpected:      false,
 			mustRunAllCommands: true,
+		}, {
+			commandInput: map[string]string{
+				"ip netns exec wireguard ip -o a": `1: lo    inet 127.0.0.1/8 scope host lo\       valid_lft forever preferred_lft forever
+`,
+				"ip link add wg0 type wireguard":                             "",
+				"wg set wg0 private-key privateKey listen-port 51820":        "",
+				"ip link set dev wg0 netns wireguard":                        "",
+				"ip netns exec wireguard ip link set dev wg0 mtu 1380":       "",
+				"ip netns exec wireguard ip link set dev wg0 up":             "",
+				"ip netns exec wireguard ip address add dev wg0 10.0.0.1/16": "",
+			},
+			wireguardNamespace: "wireguard",
+			wireguardInterface: "wg0",
+			localOuterPort:     51820,
+			localInnerIp:       net.ParseIP("10.0.0.1"),
+			localPrivateKey:    "privateKey",
+			mtu:                1380,
+			errorExpected:      false,
+			mustRunAllCommands: true,
 		},
 	}
 
@@ -450,6 +499,7 @@ func TestInitWireguardTunnel(t *testing.T) {
 			tc.localOuterPort,
 			tc.localInnerIp,
 			tc.localPrivateKey,
+			tc.mtu,
 		)
 		if tc.errorExpected != (err != nil) {
 			t.Fatal(
@@ -479,7 +529,51 @@ func TestInitWireguardTunnel(t *testing.T) {
 	}
 }
 
+func TestEnsureWireguardTunnel(t *testing.T) {
+	ns := "ip netns exec wireguard-kubernetes "
+	tcs := []struct {
+		ipOutput string
+		expected []string
+	}{
+		{
+			// the tunnel is missing and created
+			expected: []string{
+				ns + "ip -o a",
+				"ip link add wg0 type wireguard",
+				"wg set wg0 private-key /etc/wireguard/private listen-port 10000",
+				"ip link set dev wg0 netns wireguard-kubernetes",
+				ns + "ip link set dev wg0 up",
+				ns + "ip address add dev wg0 100.64.0.2/16",
+			},
+		},
+		{
+			// the existing tunnel keeps its peers
+			ipOutput: "5: wg0    inet 100.64.0.2/16 scope global wg0\\       valid_lft forever preferred_lft forever\n",
+			expected: []string{
+				ns + "ip -o a",
+				ns + "wg set wg0 private-key /etc/wireguard/private listen-port 10000",
+				ns + "ip link set dev wg0 up",
+				ns + "ip address replace dev wg0 100.64.0.2/16",
+			},
+		},
+	}
+	for k, tc := range tcs {
+		recorder := utils.NewCommandRecorder(map[string]string{ns + "ip -o a": tc.ipOutput})
+		restore := recorder.Install()
+		err := EnsureWireguardTunnel("wireguard-kubernetes", "wg0", 10000, net.ParseIP("100.64.0.2"), "/etc/wireguard/private", 0)
+		restore()
+		if err != nil {
+			t.Fatal(fmt.Sprintf("EnsureWireguardTunnel() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		if commands := recorder.Commands(); !reflect.DeepEqual(commands, tc.expected) {
+			t.Fatal(fmt.Sprintf("EnsureWireguardTunnel() - Test %d: Expected commands %v, got %v", k, tc.expected, commands))
+		}
+	}
+}
+
 func TestUpdateWireguardTunnelPeers(t *testing.T) {
+	RuntimeDir = t.TempDir()
+	syncconf := "ip netns exec wireguard wg syncconf wg0 " + path.Join(RuntimeDir, "wireguard-wg0.conf")
 	var commandInput map[string]string
 	// mock command
 	utils.RunCommandWithOutput = func(cmd string, methodName string) ([]byte, error) {
@@ -516,19 +610,47 @@ func TestUpdateWireguardTunnelPeers(t *testing.T) {
 	}{
 		{
 			commandInput: map[string]string{
-				"ip netns exec wireguard wg set wg0 peer peerPublicKey allowed-ips 10.0.0.2,10.244.0.0/24 endpoint 192.168.123.2:10000": "",
-				"ip netns exec wireguard ip route add 10.244.0.0/24 via 10.0.0.2 dev wg0":                                               "",
-				"ip netns exec wireguard wg show wg0 | awk '/^peer/ {print $2}'": `peerPublicKey
-toBePrunedKey`,
-				"ip netns exec wireguard wg set wg0 peer toBePrunedKey remove": "",
-				"ip netns exec wireguard ip route ls dev wg0": `100.64.122.0/24 proto kernel scope link src 100.64.122.79 
+				syncconf: "",
+				"ip netns exec wireguard ip route replace 10.244.0.0/24 via 10.0.0.2 dev wg0 proto 87": "",
+				"ip netns exec wireguard ip route ls dev wg0 proto 87": `100.64.122.0/24 proto kernel scope link src 100.64.122.79 
 				10.244.0.0/24 via 10.0.0.2 
 10.245.5.0/24 via 100.64.0.105`,
-				"ip netns exec wireguard ip route delete 10.245.5.0/24 via 100.64.0.105": "",
-				"ip route ls dev to-wg-ns": `100.64.122.0/24 proto kernel scope link src 100.64.122.79
+				"ip netns exec wireguard ip route delete 10.245.5.0/24 via 100.64.0.105 proto 87": "",
+				"ip route ls dev to-wg-ns proto 87": `100.64.122.0/24 proto kernel scope link src 100.64.122.79
 				10.244.0.0/24 via 169.254.0.2
 10.245.5.0/24 via 169.254.0.2`,
-				"ip route delete 10.245.5.0/24 via 169.254.0.2": "",
+				"ip route delete 10.245.5.0/24 via 169.254.0.2 proto 87": "",
+			},
+			wireguardNamespace: "wireguard",
+			wireguardInterface: "wg0",
+			localPodCidr:       "10.145.0.0/24",
+			pl: PeerList{
+				"peerHostname": &Peer{
+					PeerHostname:  "peerHostname",
+					PeerOuterIp:   net.ParseIP("192.168.123.2"),
+					PeerInnerIp:   net.ParseIP("10.0.0.2"),
+					PeerPublicKey: "peerPublicKey",
+					PeerOuterPort: 10000,
+					PeerPodSubnet: "10.244.0.0/24",
+				},
+			},
+			errorExpected:      false,
+			mustRunAllCommands: true,
+		},
+		{
+			commandInput: map[string]string{
+				syncconf: "",
+				"ip netns exec wireguard ip route replace 10.244.0.0/24 via 10.0.0.2 dev wg0 proto 87": "",
+				"ip netns exec wireguard ip route replace 192.0.2.10/32 dev wg0 proto 87":              "",
+				"ip netns exec wireguard ip route replace 192.168.10.0/24 dev wg0 proto 87":            "",
+				"ip route replace 10.145.0.0/24 via 169.254.0.2 dev to-wg-ns proto 87":                 "",
+				"ip route replace 10.244.0.0/24 via 169.254.0.2 dev to-wg-ns proto 87":                 "",
+				"ip netns exec wireguard ip route ls dev wg0 proto 87": `100.64.122.0/24 proto kernel scope link src 100.64.122.79
+10.244.0.0/24 via 10.0.0.2
+192.0.2.10 scope link
+192.168.10.0/24 scope link`,
+				"ip route ls dev to-wg-ns proto 87": `10.145.0.0/24 via 169.254.0.2
+10.244.0.0/24 via 169.254.0.2`,
 			},
 			wireguardNamespace: "wireguard",
 			wireguardInterface: "wg0",
@@ -542,6 +664,14 @@ toBePrunedKey`,
 					PeerOuterPort: 10000,
 					PeerPodSubnet: "10.244.0.0/24",
 				},
+				"static/database": &Peer{
+					PeerHostname:      "static/database",
+					PeerOuterIp:       net.ParseIP("192.0.2.10"),
+					PeerPublicKey:     "staticPublicKey",
+					PeerOuterPort:     51820,
+					PeerRoutedSubnets: []string{"192.0.2.10/32", "192.168.10.0/24"},
+					PeerSource:        PeerSourceStatic,
+				},
 			},
 			errorExpected:      false,
 			mustRunAllCommands: true,
@@ -553,6 +683,7 @@ toBePrunedKey`,
 		err := UpdateWireguardTunnelPeers(
 			tc.wireguardNamespace,
 			tc.wireguardInterface,
+			DefaultNamespaceLink,
 			&tc.pl,
 			tc.localPodCidr,
 		)
@@ -579,3 +710,257 @@ toBePrunedKey`,
 		}
 	}
 }
+
+func TestSetNonMasqueradeCidrs(t *testing.T) {
+	var commands []string
+	utils.RunCommand = func(cmd string, methodName string) error {
+		commands = append(commands, cmd)
+		return nil
+	}
+
+	err := SetNonMasqueradeCidrs("wireguard", "to-default-ns", []string{"10.0.0.0/8", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(fmt.Sprintf("SetNonMasqueradeCidrs(): Expected to return nil error, instead got %s", err))
+	}
+	expected := []string{
+		"ip netns exec wireguard iptables -t nat -N WGK8S-NON-MASQUERADE 2>/dev/null || ip netns exec wireguard iptables -t nat -F WGK8S-NON-MASQUERADE",
+		"ip netns exec wireguard iptables -t nat -C POSTROUTING -o to-default-ns -j WGK8S-NON-MASQUERADE 2>/dev/null || ip netns exec wireguard iptables -t nat -I POSTROUTING -o to-default-ns -j WGK8S-NON-MASQUERADE",
+		"ip netns exec wireguard iptables -t nat -A WGK8S-NON-MASQUERADE -d 10.0.0.0/8 -j ACCEPT",
+		"ip netns exec wireguard iptables -t nat -A WGK8S-NON-MASQUERADE -d 192.168.0.0/16 -j ACCEPT",
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatal(fmt.Sprintf("SetNonMasqueradeCidrs(): Expected commands %v, got %v", expected, commands))
+	}
+}
+
+func TestTeardownNamespace(t *testing.T) {
+	RuntimeDir = t.TempDir()
+	var commandOutputs map[string]string
+	var commands map[string]bool
+	// mock command
+	utils.RunCommandWithOutput = func(cmd string, methodName string) ([]byte, error) {
+		out, ok := commandOutputs[cmd]
+		if !ok {
+			return []byte{}, fmt.Errorf("Unknown command '%s' in method '%s'", cmd, methodName)
+		}
+		return []byte(out), nil
+	}
+	utils.RunCommand = func(cmd string, methodName string) error {
+		if _, ok := commands[cmd]; !ok {
+			return fmt.Errorf("Unknown command '%s' in method '%s'", cmd, methodName)
+		}
+		delete(commands, cmd)
+		return nil
+	}
+
+	tcs := []struct {
+		commandOutputs map[string]string
+		commands       map[string]bool
+		masquerade     bool
+	}{
+		{
+			// the namespace does not exist
+			commandOutputs: map[string]string{
+				"ip netns": "test\n",
+			},
+			commands:   map[string]bool{},
+			masquerade: true,
+		},
+		{
+			commandOutputs: map[string]string{
+				"ip netns": "test\nwireguard\n",
+				"ip netns exec wireguard ip route ls dev wg0 proto 87": `10.245.3.0/24 via 100.64.0.103
+100.64.0.0/16 proto kernel scope link src 100.64.0.106
+`,
+				"ip route ls dev to-wg-ns proto 87": `10.245.3.0/24 via 169.254.0.2
+10.245.6.0/24 via 169.254.0.2
+169.254.0.0/30 proto kernel scope link src 169.254.0.1
+`,
+			},
+			commands: map[string]bool{
+				"ip netns exec wireguard wg syncconf wg0 " + path.Join(RuntimeDir, "wireguard-wg0.conf"): true,
+				"ip netns exec wireguard ip route delete 10.245.3.0/24 via 100.64.0.103 proto 87":        true,
+				"ip route delete 10.245.3.0/24 via 169.254.0.2 proto 87":                                 true,
+				"ip route delete 10.245.6.0/24 via 169.254.0.2 proto 87":                                 true,
+				"iptables -t nat -D POSTROUTING -o eth0 --src 169.254.0.2 -j MASQUERADE":                 true,
+				"ip netns del wireguard": true,
+			},
+			masquerade: true,
+		},
+	}
+
+	for k, tc := range tcs {
+		commandOutputs = tc.commandOutputs
+		commands = tc.commands
+		err := TeardownNamespace("wireguard", "wg0", "eth0", DefaultNamespaceLink, tc.masquerade)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("TeardownNamespace() - Test %d: Expected to return nil error, instead got %s", k, err))
+		}
+		if len(commands) > 0 {
+			t.Fatal(fmt.Sprintf("TeardownNamespace() - Test %d: Did not run all commands, leftover commands are %v", k, commands))
+		}
+	}
+}
+
+func TestApplyPeerListDiff(t *testing.T) {
+	RuntimeDir = t.TempDir()
+	var commands []string
+	utils.RunCommand = func(cmd string, methodName string) error {
+		commands = append(commands, cmd)
+		return nil
+	}
+
+	applied := PeerList{
+		"worker-1": &Peer{
+			PeerHostname:  "worker-1",
+			PeerInnerIp:   net.ParseIP("100.64.0.3"),
+			PeerOuterIp:   net.ParseIP("172.18.0.3"),
+			PeerOuterPort: 10000,
+			PeerPublicKey: "pub1",
+			PeerPodSubnet: "10.245.3.0/24",
+		},
+		"worker-2": &Peer{
+			PeerHostname:  "worker-2",
+			PeerInnerIp:   net.ParseIP("100.64.0.4"),
+			PeerOuterIp:   net.ParseIP("172.18.0.4"),
+			PeerOuterPort: 10000,
+			PeerPublicKey: "pub2",
+			PeerPodSubnet: "10.245.4.0/24",
+		},
+	}
+	// worker-1 got a new key and pod subnet, worker-2 was deleted and a static peer was added
+	pl := PeerList{
+		"worker-1": &Peer{
+			PeerHostname:  "worker-1",
+			PeerInnerIp:   net.ParseIP("100.64.0.3"),
+			PeerOuterIp:   net.ParseIP("172.18.0.3"),
+			PeerOuterPort: 10000,
+			PeerPublicKey: "pub1b",
+			PeerPodSubnet: "10.245.13.0/24",
+		},
+		"static/database": &Peer{
+			PeerHostname:      "static/database",
+			PeerOuterIp:       net.ParseIP("192.0.2.10"),
+			PeerOuterPort:     51820,
+			PeerPublicKey:     "staticPublicKey",
+			PeerRoutedSubnets: []string{"192.0.2.10/32"},
+			PeerSource:        PeerSourceStatic,
+		},
+	}
+
+	err := ApplyPeerListDiff("wireguard", "wg0", DefaultNamespaceLink, &pl, pl.Diff(&applied))
+	if err != nil {
+		t.Fatal(fmt.Sprintf("ApplyPeerListDiff(): Expected to return nil error, instead got %s", err))
+	}
+	expected := []string{
+		"ip netns exec wireguard ip route delete 10.245.4.0/24 dev wg0 proto 87",
+		"ip route delete 10.245.4.0/24 dev to-wg-ns proto 87",
+		"ip netns exec wireguard ip route delete 10.245.3.0/24 dev wg0 proto 87",
+		"ip route delete 10.245.3.0/24 dev to-wg-ns proto 87",
+		"ip netns exec wireguard wg syncconf wg0 " + path.Join(RuntimeDir, "wireguard-wg0.conf"),
+		"ip netns exec wireguard ip route replace 10.245.13.0/24 via 100.64.0.3 dev wg0 proto 87",
+		"ip route replace 10.245.13.0/24 via 169.254.0.2 dev to-wg-ns proto 87",
+		"ip netns exec wireguard ip route replace 192.0.2.10/32 dev wg0 proto 87",
+		"ip route replace 192.0.2.10/32 via 169.254.0.2 dev to-wg-ns proto 87",
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatal(fmt.Sprintf("ApplyPeerListDiff(): Expected commands %v, got %v", expected, commands))
+	}
+	// with a route table, the routes of the default namespace are set in that table
+	commands = nil
+	link := DefaultNamespaceLink
+	link.RouteTable = 87
+	err = ApplyPeerListDiff("wireguard", "wg0", link, &applied, applied.Diff(&pl))
+	if err != nil {
+		t.Fatal(fmt.Sprintf("ApplyPeerListDiff(): Expected to return nil error, instead got %s", err))
+	}
+	for _, expected := range []string{
+		"ip route delete 10.245.13.0/24 dev to-wg-ns proto 87 table 87",
+		"ip route delete 192.0.2.10/32 dev to-wg-ns proto 87 table 87",
+		"ip route replace 10.245.4.0/24 via 169.254.0.2 dev to-wg-ns proto 87 table 87",
+	} {
+		found := false
+		for _, cmd := range commands {
+			found = found || cmd == expected
+		}
+		if !found {
+			t.Fatal(fmt.Sprintf("ApplyPeerListDiff(): Expected command %s, got %v", expected, commands))
+		}
+	}
+}
+
+func TestChainedPeerRoutes(t *testing.T) {
+	RuntimeDir = t.TempDir()
+	chainedLink := DefaultNamespaceLink
+	chainedLink.RouteTable = 87
+	// the hub relays the pod subnet of another spoke, the static peer routes an external subnet
+	pl := NewPeerList()
+	pl.UpdateOrAdd(&Peer{PeerHostname: "hub", PeerInnerIp: net.ParseIP("100.64.0.3"), PeerOuterIp: net.ParseIP("172.18.0.3"),
+		PeerOuterPort: 10000, PeerPublicKey: "hub", PeerPodSubnet: "10.245.3.0/24", PeerRoutedSubnets: []string{"10.245.5.0/24"}})
+	pl.UpdateOrAdd(&Peer{PeerHostname: "static/database", PeerOuterIp: net.ParseIP("192.0.2.10"), PeerOuterPort: 51820,
+		PeerPublicKey: "database", PeerRoutedSubnets: []string{"192.0.2.0/24"}, PeerSource: PeerSourceStatic})
+
+	recorder := utils.NewCommandRecorder(map[string]string{
+		"ip netns exec wireguard ip route ls dev wg0 proto 87": "10.245.3.0/24 via 100.64.0.3\n10.245.5.0/24 via 100.64.0.3\n192.0.2.0/24\n",
+		"ip route ls dev to-wg-ns proto 87 table 87": "10.245.3.0/24 via 169.254.0.2\n10.245.5.0/24 via 169.254.0.2\n" +
+			"192.0.2.0/24 via 169.254.0.2\n10.245.9.0/24 via 169.254.0.2\n",
+	})
+	restore := recorder.Install()
+	defer restore()
+	if err := UpdateWireguardTunnelPeers("wireguard", "wg0", chainedLink, pl, ""); err != nil {
+		t.Fatal(fmt.Sprintf("UpdateWireguardTunnelPeers(): Expected to return nil error, instead got %s", err))
+	}
+	commands := strings.Join(recorder.Commands(), "\n") + "\n"
+	for _, subnet := range []string{"10.245.3.0/24", "10.245.5.0/24", "192.0.2.0/24"} {
+		if cmd := "ip route replace " + subnet + " via 169.254.0.2 dev to-wg-ns proto 87 table 87"; !strings.Contains(commands, cmd+"\n") {
+			t.Fatal(fmt.Sprintf("UpdateWireguardTunnelPeers(): Expected command %s, got:\n%s", cmd, commands))
+		}
+		if strings.Contains(commands, "ip route delete "+subnet) {
+			t.Fatal(fmt.Sprintf("UpdateWireguardTunnelPeers(): Expected the route to %s to be kept, got:\n%s", subnet, commands))
+		}
+	}
+	if cmd := "ip route delete 10.245.9.0/24 via 169.254.0.2 proto 87 table 87"; !strings.Contains(commands, cmd+"\n") {
+		t.Fatal(fmt.Sprintf("UpdateWireguardTunnelPeers(): Expected command %s, got:\n%s", cmd, commands))
+	}
+
+	// only the stale route of the default namespace is reported as drift
+	dp := &DataPlane{Namespace: "wireguard", Interface: "wg0", Link: chainedLink, Uplink: "eth0", ListenPort: 10000}
+	recorder.SetOutput("ip netns", "wireguard (id: 0)\n")
+	recorder.SetOutput("ip link ls", "7: to-wg-ns@if6: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500\n")
+	drifts, err := dp.DetectDrift(pl)
+	if err != nil {
+		t.Fatal(fmt.Sprintf("DetectDrift(): Expected to return nil error, instead got %s", err))
+	}
+	var routeDrifts []string
+	for _, drift := range drifts {
+		if drift.Component == DriftRoute && strings.Contains(drift.Description, "to-wg-ns") {
+			routeDrifts = append(routeDrifts, drift.Description)
+		}
+	}
+	if len(routeDrifts) != 1 || !strings.Contains(routeDrifts[0], "unexpected route to 10.245.9.0/24") {
+		t.Fatal(fmt.Sprintf("DetectDrift(): Expected only the route to 10.245.9.0/24 to drift, got %v", routeDrifts))
+	}
+}
+
+func TestPruneWireguardNamespaceRoutes(t *testing.T) {
+	// the subnets of the peer are not written in their canonical form
+	pl := NewPeerList()
+	pl.UpdateOrAdd(&Peer{PeerHostname: "worker-1", PeerInnerIp: net.ParseIP("100.64.0.3"), PeerPodSubnet: "10.245.3.1/24",
+		PeerRoutedSubnets: []string{"FD00:0:0:3:0::/64"}})
+	recorder := utils.NewCommandRecorder(map[string]string{
+		"ip route ls dev to-wg-ns proto 87": "10.245.1.0/24 via 169.254.0.2\n10.245.3.0/24 via 169.254.0.2\n" +
+			"fd00:0:0:3::/64 via 169.254.0.2\n10.245.9.0/24 via 169.254.0.2\n",
+	})
+	restore := recorder.Install()
+	defer restore()
+	if err := pruneWireguardNamespaceRoutes(DefaultNamespaceLink, pl, "10.245.1.0/24"); err != nil {
+		t.Fatal(fmt.Sprintf("pruneWireguardNamespaceRoutes(): Expected to return nil error, instead got %s", err))
+	}
+	expected := []string{
+		"ip route ls dev to-wg-ns proto 87",
+		"ip route delete 10.245.9.0/24 via 169.254.0.2 proto 87",
+	}
+	if commands := recorder.Commands(); !reflect.DeepEqual(commands, expected) {
+		t.Fatal(fmt.Sprintf("pruneWireguardNamespaceRoutes(): Expected commands %v, got %v", expected, commands))
+	}
+}
@@ -0,0 +1,90 @@
+package wireguard
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+// RuntimeDir is the directory in which the generated wireguard configurations are written before they are synced to
+// the tunnel. The last configuration of each tunnel is kept there for debugging.
+var RuntimeDir = "/run/wireguard-kubernetes"
+
+// InterfaceConfig holds the local settings of a wireguard interface. Settings which are not set are not rendered and
+// keep their current value when the configuration is synced.
+type InterfaceConfig struct {
+	PrivateKey string
+	ListenPort int
+}
+
+// RenderConfig renders the local settings and the peers into a wireguard configuration, as understood by
+// `wg setconf` and `wg syncconf`. The output is deterministic: the peers are sorted by hostname, and the hostname is
+// written as a comment above each peer.
+func RenderConfig(intf InterfaceConfig, pl *PeerList) []byte {
+	var b bytes.Buffer
+	b.WriteString("# generated by wgk8s, do not edit\n")
+	b.WriteString("[Interface]\n")
+	if intf.PrivateKey != "" {
+		fmt.Fprintf(&b, "PrivateKey = %s\n", intf.PrivateKey)
+	}
+	if intf.ListenPort != 0 {
+		fmt.Fprintf(&b, "ListenPort = %d\n", intf.ListenPort)
+	}
+
+	peers := make([]*Peer, 0, len(*pl))
+	for _, p := range *pl {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PeerHostname < peers[j].PeerHostname })
+	for _, p := range peers {
+		fmt.Fprintf(&b, "\n# %s\n", p.PeerHostname)
+		b.WriteString("[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", p.PeerPublicKey)
+		if allowedIps := p.AllowedIps(); len(allowedIps) > 0 {
+			fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(allowedIps, ", "))
+		}
+		if p.PeerOuterIp != nil {
+			fmt.Fprintf(&b, "Endpoint = %s\n", net.JoinHostPort(p.PeerOuterIp.String(), strconv.Itoa(p.PeerOuterPort)))
+		}
+	}
+	return b.Bytes()
+}
+
+// SyncConfig configures the wireguard tunnel with the local settings and exactly the peers in pl in a single
+// `wg syncconf` operation. Peers which are not part of pl are removed, and peers which did not change are not
+// touched. Either all changes are applied or none.
+func SyncConfig(wireguardNamespace, wireguardInterface string, intf InterfaceConfig, pl *PeerList) error {
+	configFile, err := writeConfig(wireguardNamespace, wireguardInterface, RenderConfig(intf, pl))
+	if err != nil {
+		return err
+	}
+	cmd := utils.NetnsExec(wireguardNamespace) + "wg syncconf " + wireguardInterface + " " + configFile
+	return utils.RunCommand(cmd, "SyncConfig")
+}
+
+// writeConfig atomically writes the configuration of a tunnel to RuntimeDir and returns the path of the file. The
+// file is only readable by its owner, as it may hold the private key.
+func writeConfig(wireguardNamespace, wireguardInterface string, config []byte) (string, error) {
+	if err := os.MkdirAll(RuntimeDir, 0700); err != nil {
+		return "", fmt.Errorf("Cannot create directory for the wireguard configuration: %v", err)
+	}
+	name := wireguardInterface + ".conf"
+	if wireguardNamespace != "" {
+		name = wireguardNamespace + "-" + name
+	}
+	configFile := path.Join(RuntimeDir, name)
+	if err := os.WriteFile(configFile+".tmp", config, 0600); err != nil {
+		return "", fmt.Errorf("Cannot write wireguard configuration: %v", err)
+	}
+	if err := os.Rename(configFile+".tmp", configFile); err != nil {
+		return "", fmt.Errorf("Cannot write wireguard configuration: %v", err)
+	}
+	return configFile, nil
+}
@@ -0,0 +1,119 @@
+package wireguard
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/andreaskaris/wireguard-kubernetes/controller/utils"
+)
+
+var update = flag.Bool("update", false, "Update the golden files in testdata")
+
+func TestRenderConfig(t *testing.T) {
+	pl := PeerList{
+		"worker-2": &Peer{
+			PeerHostname:  "worker-2",
+			PeerInnerIp:   net.ParseIP("100.64.0.104"),
+			PeerOuterIp:   net.ParseIP("172.18.0.104"),
+			PeerOuterPort: 10000,
+			PeerPublicKey: "KmmEwqKHPxZIE2T1dRW51nj4V45W/0eIDibwEinlmQo=",
+			PeerPodSubnet: "10.245.4.0/24",
+		},
+		"worker-1": &Peer{
+			PeerHostname:  "worker-1",
+			PeerInnerIp:   net.ParseIP("100.64.0.103"),
+			PeerOuterIp:   net.ParseIP("fd00::103"),
+			PeerOuterPort: 10000,
+			PeerPublicKey: "qP+1Sstf6Y0MYBeUtJjWthBMfx8uG1hmK4mz9hOQjGI=",
+			PeerPodSubnet: "10.245.3.0/24",
+		},
+		"static/database": &Peer{
+			PeerHostname:      "static/database",
+			PeerOuterIp:       net.ParseIP("192.0.2.10"),
+			PeerOuterPort:     51820,
+			PeerPublicKey:     "bJpOINHuLj/VXDqhiwL1aiiNpSc3dfoKe5bMAV0mAX8=",
+			PeerRoutedSubnets: []string{"192.0.2.10/32", "192.168.10.0/24"},
+			PeerSource:        PeerSourceStatic,
+		},
+	}
+
+	tcs := []struct {
+		intf   InterfaceConfig
+		golden string
+	}{
+		{
+			intf:   InterfaceConfig{PrivateKey: "cJ0fXvzfq1IdcoXoAsYMRqnD6bNmRsS0HNbSmMfCoG0=", ListenPort: 10000},
+			golden: "wg0.conf",
+		},
+		{
+			// settings which are not set keep their current value
+			intf:   InterfaceConfig{},
+			golden: "wg0-peers-only.conf",
+		},
+	}
+	for k, tc := range tcs {
+		// the output must not depend on the iteration order of the peer list
+		config := RenderConfig(tc.intf, &pl)
+		for i := 0; i < 10; i++ {
+			if !bytes.Equal(RenderConfig(tc.intf, &pl), config) {
+				t.Fatal(fmt.Sprintf("RenderConfig() - Test %d: Expected the output to be deterministic", k))
+			}
+		}
+
+		golden := path.Join("testdata", tc.golden)
+		if *update {
+			if err := os.WriteFile(golden, config, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(config, expected) {
+			t.Fatal(fmt.Sprintf("RenderConfig() - Test %d: Expected:\n%s\ngot:\n%s", k, expected, config))
+		}
+	}
+}
+
+func TestSyncConfig(t *testing.T) {
+	RuntimeDir = path.Join(t.TempDir(), "run")
+	var commands []string
+	utils.RunCommand = func(cmd string, methodName string) error {
+		commands = append(commands, cmd)
+		return nil
+	}
+
+	pl := NewPeerList()
+	pl.UpdateOrAdd(&Peer{
+		PeerHostname:  "worker-1",
+		PeerInnerIp:   net.ParseIP("100.64.0.103"),
+		PeerOuterIp:   net.ParseIP("172.18.0.103"),
+		PeerOuterPort: 10000,
+		PeerPublicKey: "qP+1Sstf6Y0MYBeUtJjWthBMfx8uG1hmK4mz9hOQjGI=",
+		PeerPodSubnet: "10.245.3.0/24",
+	})
+	err := SyncConfig("wireguard", "wg0", InterfaceConfig{ListenPort: 10000}, pl)
+	if err != nil {
+		t.Fatal(fmt.Sprintf("SyncConfig(): Expected to return nil error, instead got %s", err))
+	}
+	configFile := path.Join(RuntimeDir, "wireguard-wg0.conf")
+	if len(commands) != 1 || commands[0] != "ip netns exec wireguard wg syncconf wg0 "+configFile {
+		t.Fatal(fmt.Sprintf("SyncConfig(): Expected a single syncconf command, got %v", commands))
+	}
+	config, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(config, RenderConfig(InterfaceConfig{ListenPort: 10000}, pl)) {
+		t.Fatal(fmt.Sprintf("SyncConfig(): Expected the rendered configuration to be synced, got:\n%s", config))
+	}
+	if info, err := os.Stat(configFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal(fmt.Sprintf("SyncConfig(): Expected the configuration to be readable by its owner only, got %v", info.Mode()))
+	}
+}
@@ -68,6 +68,7 @@ deploy_wireguard_kubernetes() {
 	echo "Deploying wireguard kubernetes"
 	kubectl apply -f custom-resources/kind/namespace.yaml
 	kubectl apply -f custom-resources/kind/rolebindings.yaml
+	kubectl apply -f custom-resources/kind/configmap.yaml
 	kubectl apply -f custom-resources/kind/daemonset.yaml
 }
 